@@ -4,12 +4,14 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"net/netip"
 	"strings"
 
 	dnsgo "github.com/miekg/dns"
 	corev1 "k8s.io/api/core/v1"
 	networking "k8s.io/api/networking/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
 )
 
 type IPVersion string
@@ -64,6 +66,11 @@ type PolicySpec struct {
 	// Clusters are isolated by default.
 	// +optional
 	Egress []EgressRule `json:"egress,omitempty"`
+
+	// TrafficClass assigns the traffic accepted by this policy to a class of the TrafficShaping
+	// of the network it is sent to or received from. Only used if the traffic of the firewall is shaped.
+	// +optional
+	TrafficClass string `json:"trafficClass,omitempty"`
 }
 
 type FQDNState map[string][]IPSet
@@ -106,8 +113,17 @@ type IngressRule struct {
 	// empty or missing, this rule matches all sources (traffic not restricted by
 	// source). If this field is present and contains at least one item, this rule
 	// allows traffic only if the traffic matches at least one item in the from list.
+	// From rules can't contain FromFQDNs rules.
 	// +optional
 	From []networking.IPBlock `json:"from,omitempty"`
+
+	// List of FQDNs (fully qualified domain names) of sources which should be able to access the cluster for this rule.
+	// Items in this list are combined using a logical OR operation. The names are resolved by the DNS cache
+	// of the firewall and the learned IPs expire according to their TTLs. Only MatchName is supported,
+	// as patterns can't be resolved without clients querying them.
+	// FromFQDNs rules can't contain From rules.
+	// +optional
+	FromFQDNs []FQDNSelector `json:"fromFQDNs,omitempty"`
 }
 
 // EgressRule describes a particular set of traffic that is allowed out of the cluster
@@ -166,6 +182,25 @@ type FQDNSelector struct {
 	// "*" matches 0 or more valid characters.
 	// +kubebuilder:validation:Pattern=`^([-a-zA-Z0-9_*]+[.]?)+$`
 	MatchPattern string `json:"matchPattern,omitempty"`
+
+	// MinTTL is the minimum time learned IPs are kept, even if the DNS server returned a lower TTL.
+	// +optional
+	MinTTL *metav1.Duration `json:"minTTL,omitempty"`
+
+	// MaxTTL is the maximum time learned IPs are kept, even if the DNS server returned a higher TTL.
+	// +optional
+	MaxTTL *metav1.Duration `json:"maxTTL,omitempty"`
+
+	// GracePeriod is the time learned IPs are kept after they expired.
+	// IPs to which established connections exist are kept beyond the grace period until these connections are closed.
+	// If several selectors match the same DNS name, the most permissive TTL settings are applied.
+	// +optional
+	GracePeriod *metav1.Duration `json:"gracePeriod,omitempty"`
+
+	// PinnedIPs are IPs or CIDRs which are always allowed for this selector in addition to the IPs learned by the DNS proxy,
+	// e.g. for names which resolve differently inside the cluster or through a split DNS the firewall can't see.
+	// +optional
+	PinnedIPs []string `json:"pinnedIPs,omitempty"`
 }
 
 // IPSet stores set name association to IP addresses
@@ -182,6 +217,8 @@ type IPSet struct {
 	IPExpirationTimes map[string]metav1.Time `json:"ipExpirationTimes,omitempty"`
 	// Whether this is a IPv4 or a IPv6 set.
 	Version IPVersion `json:"version,omitempty"`
+	// PinnedIPs are the IPs and CIDRs of the selector which are allowed in addition to the learned IPs, they never expire.
+	PinnedIPs []string `json:"pinnedIPs,omitempty"`
 }
 
 func (l *ClusterwideNetworkPolicyList) GetFQDNs() []FQDNSelector {
@@ -190,6 +227,9 @@ func (l *ClusterwideNetworkPolicyList) GetFQDNs() []FQDNSelector {
 		for _, e := range i.Spec.Egress {
 			s = append(s, e.ToFQDNs...)
 		}
+		for _, in := range i.Spec.Ingress {
+			s = append(s, in.FromFQDNs...)
+		}
 	}
 
 	return s
@@ -207,6 +247,33 @@ func (s *FQDNSelector) GetMatchName() string {
 	return dnsgo.Fqdn(s.MatchName)
 }
 
+// GetPinnedIPs returns the pinned IPs and CIDRs of the given IP version
+func (s *FQDNSelector) GetPinnedIPs(version IPVersion) []string {
+	var result []string
+	for _, pin := range s.PinnedIPs {
+		prefix, err := parsePin(pin)
+		if err != nil {
+			continue
+		}
+		if (version == IPv4) == prefix.Addr().Is4() {
+			result = append(result, pin)
+		}
+	}
+	return result
+}
+
+// parsePin parses a pinned IP or CIDR
+func parsePin(pin string) (netip.Prefix, error) {
+	if strings.Contains(pin, "/") {
+		return netip.ParsePrefix(pin)
+	}
+	addr, err := netip.ParseAddr(pin)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
 // GetRegex converts a MatchPattern into a regexp string
 func (s *FQDNSelector) GetRegex() string {
 	// Handle "*" as match-all case
@@ -231,10 +298,24 @@ func (s *FQDNSelector) GetRegex() string {
 func (p *PolicySpec) Validate() error {
 	var errs []error
 	for _, e := range p.Egress {
-		errs = append(errs, validatePorts(e.Ports), validateIPBlocks(e.To))
+		errs = append(errs, validatePorts(e.Ports), validateIPBlocks(e.To), validateFQDNSelectors(e.ToFQDNs))
 	}
 	for _, i := range p.Ingress {
-		errs = append(errs, validatePorts(i.Ports), validateIPBlocks(i.From))
+		errs = append(errs, validatePorts(i.Ports), validateIPBlocks(i.From), validateFQDNSelectors(i.FromFQDNs))
+		if len(i.From) > 0 && len(i.FromFQDNs) > 0 {
+			errs = append(errs, fmt.Errorf("from and fromFQDNs can't be combined in the same ingress rule"))
+		}
+		for _, f := range i.FromFQDNs {
+			if f.MatchName == "" {
+				errs = append(errs, fmt.Errorf("only matchName is supported in fromFQDNs, but pattern %q given", f.MatchPattern))
+			}
+		}
+	}
+
+	if p.TrafficClass != "" {
+		if msgs := validation.IsDNS1123Label(p.TrafficClass); len(msgs) > 0 {
+			errs = append(errs, fmt.Errorf("traffic class %q is invalid: %v", p.TrafficClass, msgs))
+		}
 	}
 
 	return errors.Join(errs...)
@@ -257,6 +338,28 @@ func validatePorts(ports []NetworkPolicyPort) error {
 	return errors.Join(errs...)
 }
 
+func validateFQDNSelectors(fqdns []FQDNSelector) error {
+	var errs []error
+	for _, f := range fqdns {
+		for _, d := range []*metav1.Duration{f.MinTTL, f.MaxTTL, f.GracePeriod} {
+			if d != nil && d.Duration < 0 {
+				errs = append(errs, fmt.Errorf("durations of fqdn selector %s must not be negative, but %v given", f.GetName(), d.Duration))
+			}
+		}
+
+		if f.MinTTL != nil && f.MaxTTL != nil && f.MinTTL.Duration > f.MaxTTL.Duration {
+			errs = append(errs, fmt.Errorf("minTTL of fqdn selector %s must not be greater than maxTTL", f.GetName()))
+		}
+
+		for _, pin := range f.PinnedIPs {
+			if _, err := parsePin(pin); err != nil {
+				errs = append(errs, fmt.Errorf("pinned ip %s of fqdn selector %s is not a valid IP or CIDR", pin, f.GetName()))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
 func validateIPBlocks(blocks []networking.IPBlock) error {
 	var errs []error
 	for _, b := range blocks {
@@ -2,9 +2,12 @@ package v1
 
 import (
 	"testing"
+	"time"
 
+	"github.com/google/go-cmp/cmp"
 	corev1 "k8s.io/api/core/v1"
 	networking "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 func TestPolicySpec_Validate(t *testing.T) {
@@ -17,10 +20,11 @@ func TestPolicySpec_Validate(t *testing.T) {
 	)
 
 	tests := []struct {
-		name    string
-		Ingress []IngressRule
-		Egress  []EgressRule
-		wantErr bool
+		name         string
+		Ingress      []IngressRule
+		Egress       []EgressRule
+		TrafficClass string
+		wantErr      bool
 	}{
 		{
 			name: "simple test",
@@ -72,12 +76,139 @@ func TestPolicySpec_Validate(t *testing.T) {
 			},
 			wantErr: true,
 		},
+		{
+			name: "valid fqdn ttl settings",
+			Egress: []EgressRule{
+				{
+					ToFQDNs: []FQDNSelector{
+						{
+							MatchName:   "example.com",
+							MinTTL:      &metav1.Duration{Duration: time.Minute},
+							MaxTTL:      &metav1.Duration{Duration: time.Hour},
+							GracePeriod: &metav1.Duration{Duration: 5 * time.Minute},
+						},
+					},
+				},
+			},
+		},
+		{
+			name: "fqdn minTTL greater than maxTTL",
+			Egress: []EgressRule{
+				{
+					ToFQDNs: []FQDNSelector{
+						{
+							MatchName: "example.com",
+							MinTTL:    &metav1.Duration{Duration: time.Hour},
+							MaxTTL:    &metav1.Duration{Duration: time.Minute},
+						},
+					},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "negative fqdn grace period",
+			Egress: []EgressRule{
+				{
+					ToFQDNs: []FQDNSelector{
+						{
+							MatchPattern: "*.example.com",
+							GracePeriod:  &metav1.Duration{Duration: -time.Minute},
+						},
+					},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "fqdn with pinned ips",
+			Egress: []EgressRule{
+				{
+					ToFQDNs: []FQDNSelector{
+						{
+							MatchName: "api.internal.example",
+							PinnedIPs: []string{"10.1.0.0/16", "10.2.0.5", "2001:db8::/64"},
+						},
+					},
+				},
+			},
+		},
+		{
+			name: "fqdn with invalid pinned ip",
+			Egress: []EgressRule{
+				{
+					ToFQDNs: []FQDNSelector{
+						{
+							MatchName: "api.internal.example",
+							PinnedIPs: []string{"10.2.0.300"},
+						},
+					},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "ingress from fqdns",
+			Ingress: []IngressRule{
+				{
+					FromFQDNs: []FQDNSelector{
+						{
+							MatchName: "partner.example.com",
+							MinTTL:    &metav1.Duration{Duration: time.Minute},
+						},
+					},
+				},
+			},
+		},
+		{
+			name: "ingress from fqdns with pattern",
+			Ingress: []IngressRule{
+				{
+					FromFQDNs: []FQDNSelector{
+						{
+							MatchPattern: "*.example.com",
+						},
+					},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "ingress from fqdns combined with from",
+			Ingress: []IngressRule{
+				{
+					From: []networking.IPBlock{
+						{
+							CIDR: "1.1.0.0/24",
+						},
+					},
+					FromFQDNs: []FQDNSelector{
+						{
+							MatchName: "partner.example.com",
+						},
+					},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name:         "traffic class",
+			Egress:       []EgressRule{{To: []networking.IPBlock{{CIDR: "0.0.0.0/0"}}}},
+			TrafficClass: "backup",
+		},
+		{
+			name:         "invalid traffic class",
+			Egress:       []EgressRule{{To: []networking.IPBlock{{CIDR: "0.0.0.0/0"}}}},
+			TrafficClass: "Backup_Jobs",
+			wantErr:      true,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			p := &PolicySpec{
-				Ingress: tt.Ingress,
-				Egress:  tt.Egress,
+				Ingress:      tt.Ingress,
+				Egress:       tt.Egress,
+				TrafficClass: tt.TrafficClass,
 			}
 			if err := p.Validate(); (err != nil) != tt.wantErr {
 				t.Errorf("PolicySpec.Validate() error = %v, wantErr %v", err, tt.wantErr)
@@ -129,3 +260,14 @@ func TestFQDNSelector_GetRegex(t *testing.T) {
 		})
 	}
 }
+
+func TestFQDNSelector_GetPinnedIPs(t *testing.T) {
+	s := FQDNSelector{PinnedIPs: []string{"10.1.0.0/16", "2001:db8::1", "10.2.0.5", "invalid"}}
+
+	if diff := cmp.Diff([]string{"10.1.0.0/16", "10.2.0.5"}, s.GetPinnedIPs(IPv4)); diff != "" {
+		t.Errorf("GetPinnedIPs(IPv4) diff = %s", diff)
+	}
+	if diff := cmp.Diff([]string{"2001:db8::1"}, s.GetPinnedIPs(IPv6)); diff != "" {
+		t.Errorf("GetPinnedIPs(IPv6) diff = %s", diff)
+	}
+}
@@ -0,0 +1,294 @@
+package v1
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+
+	dnsgo "github.com/miekg/dns"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	defaultDNSPort = "53"
+)
+
+// DNSProxyConfig configures how the DNS proxy of the firewall resolves names.
+// All resources in the firewall namespace are merged, resources are applied in the order of their names.
+// +kubebuilder:object:root=true
+// +kubebuilder:resource:shortName=dnsproxy
+// +kubebuilder:printcolumn:name="Age",type="date",JSONPath=".metadata.creationTimestamp"
+type DNSProxyConfig struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec DNSProxyConfigSpec `json:"spec,omitempty"`
+}
+
+// DNSProxyConfigList contains a list of DNSProxyConfig
+// +kubebuilder:object:root=true
+type DNSProxyConfigList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []DNSProxyConfig `json:"items"`
+}
+
+// DNSProxyConfigSpec defines the forwarding and local answers of the DNS proxy
+type DNSProxyConfigSpec struct {
+	// Forwarders send queries for names in the given zones to dedicated DNS servers instead of the upstream DNS server of the firewall.
+	// If zones overlap, the most specific zone is used.
+	// +optional
+	Forwarders []DNSForwarder `json:"forwarders,omitempty"`
+	// Hosts are answered by the DNS proxy itself, like entries of a hosts file.
+	// +optional
+	Hosts []DNSHost `json:"hosts,omitempty"`
+	// Interceptions configure the private networks whose DNS traffic is redirected to the DNS proxy.
+	// If none are given, the DNS traffic of the primary private network is redirected to the first IP of the network with the default route.
+	// +optional
+	Interceptions []DNSInterception `json:"interceptions,omitempty"`
+	// EDNS controls the EDNS options of requests which are forwarded to the DNS servers.
+	// +optional
+	EDNS *EDNSPolicy `json:"edns,omitempty"`
+	// RateLimit protects the DNS proxy and the DNS servers from clients which send too many queries.
+	// +optional
+	RateLimit *DNSRateLimit `json:"rateLimit,omitempty"`
+}
+
+// DNSForwarder forwards the queries of a zone
+type DNSForwarder struct {
+	// Zone is the DNS zone whose names are forwarded, including all subdomains, e.g. corp.example.
+	Zone string `json:"zone"`
+	// Servers are the addresses of the DNS servers in the form ip or ip:port.
+	// They are queried in the given order until one of them answers.
+	Servers []string `json:"servers"`
+}
+
+// DNSHost is a static DNS entry
+type DNSHost struct {
+	// Hostname is the name which is answered locally.
+	Hostname string `json:"hostname"`
+	// IPs are the IPv4 and IPv6 addresses returned for the hostname.
+	IPs []string `json:"ips"`
+	// TTL of the answers in seconds, defaults to 300.
+	// +optional
+	TTL *uint32 `json:"ttl,omitempty"`
+}
+
+// DNSInterception redirects the DNS traffic of a private network to the DNS proxy
+type DNSInterception struct {
+	// NetworkID is the ID of the private network whose DNS traffic is redirected.
+	NetworkID string `json:"networkID"`
+	// ListenAddress is the IPv4 address the DNS proxy listens on for this network.
+	// Defaults to the first IP of the network with the default route.
+	// +optional
+	ListenAddress string `json:"listenAddress,omitempty"`
+	// ExcludedPrefixes are source prefixes whose DNS traffic is not redirected to the DNS proxy.
+	// +optional
+	ExcludedPrefixes []string `json:"excludedPrefixes,omitempty"`
+}
+
+// EDNSOptionMode controls how an EDNS option of client requests is forwarded
+// +kubebuilder:validation:Enum=Pass;Strip;Set
+type EDNSOptionMode string
+
+const (
+	// EDNSOptionPass forwards the option as sent by the client
+	EDNSOptionPass EDNSOptionMode = "Pass"
+	// EDNSOptionStrip removes the option from forwarded requests
+	EDNSOptionStrip EDNSOptionMode = "Strip"
+	// EDNSOptionSet adds the option to all forwarded requests, replacing the option of the client
+	EDNSOptionSet EDNSOptionMode = "Set"
+)
+
+// EDNSPolicy controls the EDNS options of forwarded requests.
+// Options which were not sent by the client are removed from the responses.
+type EDNSPolicy struct {
+	// ClientSubnet controls the EDNS client subnet option (ECS), defaults to Pass.
+	// Set replaces it with the ClientSubnetPrefix, e.g. the egress address of the firewall,
+	// such that DNS servers return IPs suited for the egress address instead of the pod range.
+	// +optional
+	ClientSubnet EDNSOptionMode `json:"clientSubnet,omitempty"`
+	// ClientSubnetPrefix is the prefix which is sent as client subnet if ClientSubnet is Set.
+	// +optional
+	ClientSubnetPrefix string `json:"clientSubnetPrefix,omitempty"`
+	// UDPBufferSize is the UDP buffer size announced to the DNS servers, e.g. 1232 to avoid IP fragmentation.
+	// Defaults to the buffer size of the client.
+	// +kubebuilder:validation:Minimum=512
+	// +optional
+	UDPBufferSize *uint16 `json:"udpBufferSize,omitempty"`
+	// NSID controls the name server identifier option, defaults to Pass.
+	// Set requests the identifier from the DNS servers for all requests, such that it is logged by the DNS proxy.
+	// +optional
+	NSID EDNSOptionMode `json:"nsid,omitempty"`
+	// Padding controls the padding option, defaults to Pass.
+	// Set pads the requests to a multiple of 128 bytes.
+	// +optional
+	Padding EDNSOptionMode `json:"padding,omitempty"`
+}
+
+// DNSRateLimit limits the queries and responses per client
+type DNSRateLimit struct {
+	// QueriesPerSecond is the number of queries a single client IP may send per second.
+	// Queries exceeding the limit are refused. Queries are not limited if not set.
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	QueriesPerSecond *uint32 `json:"queriesPerSecond,omitempty"`
+	// Burst is the number of queries a single client IP may send at once, defaults to twice QueriesPerSecond.
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	Burst *uint32 `json:"burst,omitempty"`
+	// ResponsesPerSecond is the number of identical responses, i.e. with the same name, type and rcode, which are sent
+	// to a client subnet (/24 for IPv4, /56 for IPv6) per second via UDP. Exceeding responses are dropped,
+	// every second one is answered truncated, such that legitimate clients retry via TCP. Responses are not limited if not set.
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	ResponsesPerSecond *uint32 `json:"responsesPerSecond,omitempty"`
+}
+
+// GetZone returns the fully qualified, lower cased zone of the forwarder
+func (f *DNSForwarder) GetZone() string {
+	return strings.ToLower(dnsgo.Fqdn(f.Zone))
+}
+
+// GetServers returns the server addresses of the forwarder with the port defaulted to 53
+func (f *DNSForwarder) GetServers() []string {
+	servers := make([]string, 0, len(f.Servers))
+	for _, s := range f.Servers {
+		if _, _, err := net.SplitHostPort(s); err != nil {
+			s = net.JoinHostPort(s, defaultDNSPort)
+		}
+		servers = append(servers, s)
+	}
+	return servers
+}
+
+// GetHostname returns the fully qualified, lower cased hostname
+func (h *DNSHost) GetHostname() string {
+	return strings.ToLower(dnsgo.Fqdn(h.Hostname))
+}
+
+// Merge returns the combined spec of all configs, ordered by their names.
+// Forwarders, hosts and interceptions of configs with greater names take precedence,
+// the EDNS policy and rate limit of the config with the greatest name are used.
+func (l *DNSProxyConfigList) Merge() DNSProxyConfigSpec {
+	items := slices.Clone(l.Items)
+	slices.SortFunc(items, func(a, b DNSProxyConfig) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+
+	var merged DNSProxyConfigSpec
+	for _, i := range items {
+		merged.Forwarders = append(merged.Forwarders, i.Spec.Forwarders...)
+		merged.Hosts = append(merged.Hosts, i.Spec.Hosts...)
+		for _, in := range i.Spec.Interceptions {
+			idx := slices.IndexFunc(merged.Interceptions, func(m DNSInterception) bool {
+				return m.NetworkID == in.NetworkID
+			})
+			if idx >= 0 {
+				merged.Interceptions[idx] = in
+				continue
+			}
+			merged.Interceptions = append(merged.Interceptions, in)
+		}
+		if i.Spec.EDNS != nil {
+			merged.EDNS = i.Spec.EDNS
+		}
+		if i.Spec.RateLimit != nil {
+			merged.RateLimit = i.Spec.RateLimit
+		}
+	}
+	return merged
+}
+
+// Validate validates the spec of a DNSProxyConfig
+func (s *DNSProxyConfigSpec) Validate() error {
+	var errs []error
+	for _, f := range s.Forwarders {
+		if _, ok := dnsgo.IsDomainName(f.Zone); !ok || f.Zone == "" {
+			errs = append(errs, fmt.Errorf("zone %q of forwarder is not a valid domain name", f.Zone))
+		}
+		if len(f.Servers) == 0 {
+			errs = append(errs, fmt.Errorf("forwarder for zone %s does not have any servers", f.Zone))
+		}
+		for _, server := range f.GetServers() {
+			host, _, _ := net.SplitHostPort(server)
+			if net.ParseIP(host) == nil {
+				errs = append(errs, fmt.Errorf("server %s of forwarder for zone %s is not a valid ip address", server, f.Zone))
+			}
+		}
+	}
+	for _, h := range s.Hosts {
+		if _, ok := dnsgo.IsDomainName(h.Hostname); !ok || h.Hostname == "" {
+			errs = append(errs, fmt.Errorf("hostname %q is not a valid domain name", h.Hostname))
+		}
+		if len(h.IPs) == 0 {
+			errs = append(errs, fmt.Errorf("host %s does not have any ips", h.Hostname))
+		}
+		for _, ip := range h.IPs {
+			if net.ParseIP(ip) == nil {
+				errs = append(errs, fmt.Errorf("ip %s of host %s is not a valid ip address", ip, h.Hostname))
+			}
+		}
+	}
+	for _, in := range s.Interceptions {
+		if in.NetworkID == "" {
+			errs = append(errs, fmt.Errorf("interception does not have a network id"))
+		}
+		if in.ListenAddress != "" {
+			if ip := net.ParseIP(in.ListenAddress); ip == nil || ip.To4() == nil {
+				errs = append(errs, fmt.Errorf("listen address %s of interception for network %s is not a valid ipv4 address", in.ListenAddress, in.NetworkID))
+			}
+		}
+		for _, prefix := range in.ExcludedPrefixes {
+			if _, _, err := net.ParseCIDR(prefix); err != nil {
+				errs = append(errs, fmt.Errorf("excluded prefix %s of interception for network %s is not a valid IP CIDR", prefix, in.NetworkID))
+			}
+		}
+	}
+	if s.EDNS != nil {
+		errs = append(errs, s.EDNS.validate())
+	}
+	if s.RateLimit != nil {
+		errs = append(errs, s.RateLimit.validate())
+	}
+	return errors.Join(errs...)
+}
+
+func (p *EDNSPolicy) validate() error {
+	var errs []error
+	for name, mode := range map[string]EDNSOptionMode{"clientSubnet": p.ClientSubnet, "nsid": p.NSID, "padding": p.Padding} {
+		switch mode {
+		case "", EDNSOptionPass, EDNSOptionStrip, EDNSOptionSet:
+		default:
+			errs = append(errs, fmt.Errorf("%s must be one of Pass, Strip or Set, but %q given", name, mode))
+		}
+	}
+	if p.ClientSubnet == EDNSOptionSet {
+		if _, _, err := net.ParseCIDR(p.ClientSubnetPrefix); err != nil {
+			errs = append(errs, fmt.Errorf("client subnet prefix %q is not a valid IP CIDR", p.ClientSubnetPrefix))
+		}
+	}
+	if p.UDPBufferSize != nil && *p.UDPBufferSize < dnsgo.MinMsgSize {
+		errs = append(errs, fmt.Errorf("udp buffer size must be at least %d, but %d given", dnsgo.MinMsgSize, *p.UDPBufferSize))
+	}
+	return errors.Join(errs...)
+}
+
+func (l *DNSRateLimit) validate() error {
+	var errs []error
+	for name, value := range map[string]*uint32{"queriesPerSecond": l.QueriesPerSecond, "burst": l.Burst, "responsesPerSecond": l.ResponsesPerSecond} {
+		if value != nil && *value == 0 {
+			errs = append(errs, fmt.Errorf("%s must be at least 1", name))
+		}
+	}
+	if l.Burst != nil && l.QueriesPerSecond == nil {
+		errs = append(errs, fmt.Errorf("burst requires queriesPerSecond to be set"))
+	}
+	return errors.Join(errs...)
+}
+
+func init() {
+	SchemeBuilder.Register(&DNSProxyConfig{}, &DNSProxyConfigList{})
+}
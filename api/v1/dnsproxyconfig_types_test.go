@@ -0,0 +1,173 @@
+package v1
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestDNSProxyConfigSpec_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		spec    DNSProxyConfigSpec
+		wantErr bool
+	}{
+		{
+			name: "valid config",
+			spec: DNSProxyConfigSpec{
+				Forwarders: []DNSForwarder{{Zone: "corp.example", Servers: []string{"10.0.0.53", "10.0.1.53:5353", "2001:db8::53"}}},
+				Hosts:      []DNSHost{{Hostname: "db.corp.example", IPs: []string{"10.0.0.10", "2001:db8::10"}}},
+			},
+		},
+		{
+			name: "forwarder without servers",
+			spec: DNSProxyConfigSpec{
+				Forwarders: []DNSForwarder{{Zone: "corp.example"}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "forwarder with hostname as server",
+			spec: DNSProxyConfigSpec{
+				Forwarders: []DNSForwarder{{Zone: "corp.example", Servers: []string{"dns.corp.example"}}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "host with invalid ip",
+			spec: DNSProxyConfigSpec{
+				Hosts: []DNSHost{{Hostname: "db.corp.example", IPs: []string{"10.0.0.300"}}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "host without name",
+			spec: DNSProxyConfigSpec{
+				Hosts: []DNSHost{{IPs: []string{"10.0.0.1"}}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "valid interception",
+			spec: DNSProxyConfigSpec{
+				Interceptions: []DNSInterception{{NetworkID: "private", ListenAddress: "10.0.1.1", ExcludedPrefixes: []string{"10.0.1.128/25"}}},
+			},
+		},
+		{
+			name: "interception without network",
+			spec: DNSProxyConfigSpec{
+				Interceptions: []DNSInterception{{ListenAddress: "10.0.1.1"}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "interception with ipv6 listen address",
+			spec: DNSProxyConfigSpec{
+				Interceptions: []DNSInterception{{NetworkID: "private", ListenAddress: "2001:db8::1"}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "interception with invalid excluded prefix",
+			spec: DNSProxyConfigSpec{
+				Interceptions: []DNSInterception{{NetworkID: "private", ExcludedPrefixes: []string{"10.0.1.300/25"}}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "valid edns policy",
+			spec: DNSProxyConfigSpec{
+				EDNS: &EDNSPolicy{ClientSubnet: EDNSOptionSet, ClientSubnetPrefix: "185.0.0.0/24", UDPBufferSize: new(uint16(1232)), NSID: EDNSOptionStrip},
+			},
+		},
+		{
+			name: "edns policy sets client subnet without prefix",
+			spec: DNSProxyConfigSpec{
+				EDNS: &EDNSPolicy{ClientSubnet: EDNSOptionSet},
+			},
+			wantErr: true,
+		},
+		{
+			name: "edns policy with unknown mode",
+			spec: DNSProxyConfigSpec{
+				EDNS: &EDNSPolicy{Padding: "Add"},
+			},
+			wantErr: true,
+		},
+		{
+			name: "edns policy with too small buffer size",
+			spec: DNSProxyConfigSpec{
+				EDNS: &EDNSPolicy{UDPBufferSize: new(uint16(256))},
+			},
+			wantErr: true,
+		},
+		{
+			name: "valid rate limit",
+			spec: DNSProxyConfigSpec{
+				RateLimit: &DNSRateLimit{QueriesPerSecond: new(uint32(100)), Burst: new(uint32(500)), ResponsesPerSecond: new(uint32(5))},
+			},
+		},
+		{
+			name: "rate limit with zero queries",
+			spec: DNSProxyConfigSpec{
+				RateLimit: &DNSRateLimit{QueriesPerSecond: new(uint32(0))},
+			},
+			wantErr: true,
+		},
+		{
+			name: "rate limit with burst but without queries",
+			spec: DNSProxyConfigSpec{
+				RateLimit: &DNSRateLimit{Burst: new(uint32(10)), ResponsesPerSecond: new(uint32(5))},
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.spec.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("DNSProxyConfigSpec.Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDNSProxyConfigList_Merge(t *testing.T) {
+	l := DNSProxyConfigList{
+		Items: []DNSProxyConfig{
+			{
+				ObjectMeta: metav1.ObjectMeta{Name: "b"},
+				Spec: DNSProxyConfigSpec{
+					Forwarders:    []DNSForwarder{{Zone: "b.example", Servers: []string{"10.0.0.2"}}},
+					Interceptions: []DNSInterception{{NetworkID: "private", ListenAddress: "10.0.1.2"}},
+				},
+			},
+			{
+				ObjectMeta: metav1.ObjectMeta{Name: "a"},
+				Spec: DNSProxyConfigSpec{
+					Forwarders: []DNSForwarder{{Zone: "a.example", Servers: []string{"10.0.0.1"}}},
+					Hosts:      []DNSHost{{Hostname: "host.a.example", IPs: []string{"10.0.1.1"}}},
+					Interceptions: []DNSInterception{
+						{NetworkID: "private", ListenAddress: "10.0.1.1"},
+						{NetworkID: "secondary"},
+					},
+				},
+			},
+		},
+	}
+
+	want := DNSProxyConfigSpec{
+		Forwarders: []DNSForwarder{
+			{Zone: "a.example", Servers: []string{"10.0.0.1"}},
+			{Zone: "b.example", Servers: []string{"10.0.0.2"}},
+		},
+		Hosts: []DNSHost{{Hostname: "host.a.example", IPs: []string{"10.0.1.1"}}},
+		Interceptions: []DNSInterception{
+			{NetworkID: "private", ListenAddress: "10.0.1.2"},
+			{NetworkID: "secondary"},
+		},
+	}
+	if diff := cmp.Diff(want, l.Merge()); diff != "" {
+		t.Errorf("DNSProxyConfigList.Merge() diff = %s", diff)
+	}
+}
@@ -0,0 +1,62 @@
+package v1
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// FQDNCacheEntry persists the IP addresses the DNS proxy learned for a single FQDN.
+// Entries are written by the firewall-controller and are used to restore the DNS cache
+// after a restart of the controller or a reboot of the firewall.
+// +kubebuilder:object:root=true
+// +kubebuilder:resource:shortName=fqdncache
+// +kubebuilder:printcolumn:name="FQDN",type="string",JSONPath=".spec.fqdn"
+// +kubebuilder:printcolumn:name="Age",type="date",JSONPath=".metadata.creationTimestamp"
+type FQDNCacheEntry struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec FQDNCacheEntrySpec `json:"spec,omitempty"`
+}
+
+// FQDNCacheEntryList contains a list of FQDNCacheEntry
+// +kubebuilder:object:root=true
+type FQDNCacheEntryList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []FQDNCacheEntry `json:"items"`
+}
+
+// FQDNCacheEntrySpec holds the cached addresses of a FQDN
+type FQDNCacheEntrySpec struct {
+	// FQDN is the fully qualified domain name, including the trailing dot.
+	FQDN string `json:"fqdn"`
+	// IPv4 contains the cached IPv4 addresses of the FQDN.
+	// +optional
+	IPv4 *CachedIPs `json:"ipv4,omitempty"`
+	// IPv6 contains the cached IPv6 addresses of the FQDN.
+	// +optional
+	IPv6 *CachedIPs `json:"ipv6,omitempty"`
+}
+
+// CachedIPs stores the addresses of one IP family together with the nftables set they are rendered to
+type CachedIPs struct {
+	// SetName is the name of the nftables set which contains the addresses.
+	SetName string `json:"setName"`
+	// Maps IP addresses to their expiration times.
+	// +optional
+	IPExpirationTimes map[string]metav1.Time `json:"ipExpirationTimes,omitempty"`
+}
+
+// FQDNCacheEntryName returns the object name of the cache entry for the given FQDN.
+// FQDNs are hashed because they may contain characters which are not allowed in object names.
+func FQDNCacheEntryName(fqdn string) string {
+	h := sha256.Sum256([]byte(fqdn))
+	return "fqdn-" + hex.EncodeToString(h[:])[:32]
+}
+
+func init() {
+	SchemeBuilder.Register(&FQDNCacheEntry{}, &FQDNCacheEntryList{})
+}
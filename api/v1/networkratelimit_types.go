@@ -0,0 +1,131 @@
+package v1
+
+import (
+	"errors"
+	"fmt"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// RateLimitDirection is the direction of the traffic which is limited
+type RateLimitDirection string
+
+// RateLimitUnit is the unit of a rate limit
+type RateLimitUnit string
+
+const (
+	// RateLimitDirectionIngress limits the traffic received from a network
+	RateLimitDirectionIngress RateLimitDirection = "Ingress"
+	// RateLimitDirectionEgress limits the traffic sent to a network
+	RateLimitDirectionEgress RateLimitDirection = "Egress"
+
+	// RateLimitUnitMBytes limits the traffic in mbytes/second, bursts are given in kbytes
+	RateLimitUnitMBytes RateLimitUnit = "mbytes/second"
+	// RateLimitUnitKBytes limits the traffic in kbytes/second, bursts are given in kbytes
+	RateLimitUnitKBytes RateLimitUnit = "kbytes/second"
+	// RateLimitUnitPackets limits the traffic in packets/second, bursts are given in packets
+	RateLimitUnitPackets RateLimitUnit = "packets/second"
+)
+
+// NetworkRateLimit drops the traffic of a network over a rate, in addition to the rate limits of the firewall spec.
+// +kubebuilder:object:root=true
+// +kubebuilder:resource:shortName=nrl
+// +kubebuilder:subresource:status
+// +kubebuilder:printcolumn:name="Network",type="string",JSONPath=".spec.networkID"
+// +kubebuilder:printcolumn:name="Direction",type="string",JSONPath=".spec.direction"
+// +kubebuilder:printcolumn:name="Rate",type="integer",JSONPath=".spec.rate"
+// +kubebuilder:printcolumn:name="Unit",type="string",JSONPath=".spec.unit"
+// +kubebuilder:printcolumn:name="Status",type="string",JSONPath=".status.state"
+// +kubebuilder:printcolumn:name="Message",type="string",JSONPath=".status.message"
+type NetworkRateLimit struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   NetworkRateLimitSpec   `json:"spec,omitempty"`
+	Status NetworkRateLimitStatus `json:"status,omitempty"`
+}
+
+// NetworkRateLimitList contains a list of NetworkRateLimit
+// +kubebuilder:object:root=true
+type NetworkRateLimitList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []NetworkRateLimit `json:"items"`
+}
+
+// NetworkRateLimitSpec defines which traffic of a network is limited to which rate
+type NetworkRateLimitSpec struct {
+	// NetworkID is the id of the network whose traffic is limited.
+	NetworkID string `json:"networkID"`
+	// Direction of the limited traffic, either Ingress for the traffic received from the network or Egress for the traffic sent to it.
+	// Defaults to Ingress.
+	// +optional
+	// +kubebuilder:validation:Enum=Ingress;Egress
+	Direction RateLimitDirection `json:"direction,omitempty"`
+	// Rate is the rate over which the traffic is dropped.
+	Rate uint32 `json:"rate"`
+	// Unit of the rate, one of mbytes/second, kbytes/second or packets/second. Defaults to mbytes/second.
+	// +optional
+	// +kubebuilder:validation:Enum=mbytes/second;kbytes/second;packets/second
+	Unit RateLimitUnit `json:"unit,omitempty"`
+	// Burst is the amount of traffic which may exceed the rate at once, in kbytes or in packets for the unit packets/second.
+	// +optional
+	Burst *uint32 `json:"burst,omitempty"`
+	// Destinations restrict the limit to the traffic to these IPv4 CIDRs. If empty, all traffic of the network in the direction is limited.
+	// +optional
+	Destinations []string `json:"destinations,omitempty"`
+}
+
+// NetworkRateLimitStatus defines the observed state of a NetworkRateLimit
+type NetworkRateLimitStatus struct {
+	// State of the NetworkRateLimit, can be either deployed or ignored
+	State PolicyDeploymentState `json:"state,omitempty"`
+	// Message describes why the rate limit is ignored
+	Message string `json:"message,omitempty"`
+}
+
+// GetDirection returns the direction of the limited traffic
+func (s *NetworkRateLimitSpec) GetDirection() RateLimitDirection {
+	if s.Direction == "" {
+		return RateLimitDirectionIngress
+	}
+	return s.Direction
+}
+
+// GetUnit returns the unit of the rate
+func (s *NetworkRateLimitSpec) GetUnit() RateLimitUnit {
+	if s.Unit == "" {
+		return RateLimitUnitMBytes
+	}
+	return s.Unit
+}
+
+// Validate validates the spec of a NetworkRateLimit
+func (s *NetworkRateLimitSpec) Validate() error {
+	var errs []error
+	if s.NetworkID == "" {
+		errs = append(errs, fmt.Errorf("network id must be given"))
+	}
+	switch s.GetDirection() {
+	case RateLimitDirectionIngress, RateLimitDirectionEgress:
+	default:
+		errs = append(errs, fmt.Errorf("direction %s is not supported, must be either %s or %s", s.Direction, RateLimitDirectionIngress, RateLimitDirectionEgress))
+	}
+	switch s.GetUnit() {
+	case RateLimitUnitMBytes, RateLimitUnitKBytes, RateLimitUnitPackets:
+	default:
+		errs = append(errs, fmt.Errorf("unit %s is not supported, must be one of %s, %s or %s", s.Unit, RateLimitUnitMBytes, RateLimitUnitKBytes, RateLimitUnitPackets))
+	}
+	if s.Rate == 0 {
+		errs = append(errs, fmt.Errorf("rate must be greater than 0"))
+	}
+	if s.Burst != nil && *s.Burst == 0 {
+		errs = append(errs, fmt.Errorf("burst must be greater than 0"))
+	}
+	errs = append(errs, validateIPv4CIDRs("destination", s.Destinations))
+	return errors.Join(errs...)
+}
+
+func init() {
+	SchemeBuilder.Register(&NetworkRateLimit{}, &NetworkRateLimitList{})
+}
@@ -0,0 +1,71 @@
+package v1
+
+import (
+	"testing"
+)
+
+func TestNetworkRateLimitSpec_Validate(t *testing.T) {
+	var (
+		zero    = uint32(0)
+		hundred = uint32(100)
+	)
+
+	tests := []struct {
+		name    string
+		spec    NetworkRateLimitSpec
+		wantErr bool
+	}{
+		{
+			name: "valid rate limit with defaults",
+			spec: NetworkRateLimitSpec{NetworkID: "internet", Rate: 10},
+		},
+		{
+			name: "valid packet rate limit",
+			spec: NetworkRateLimitSpec{
+				NetworkID:    "internet",
+				Direction:    RateLimitDirectionEgress,
+				Rate:         1000,
+				Unit:         RateLimitUnitPackets,
+				Burst:        &hundred,
+				Destinations: []string{"185.0.0.0/24"},
+			},
+		},
+		{
+			name:    "missing network",
+			spec:    NetworkRateLimitSpec{Rate: 10},
+			wantErr: true,
+		},
+		{
+			name:    "zero rate",
+			spec:    NetworkRateLimitSpec{NetworkID: "internet"},
+			wantErr: true,
+		},
+		{
+			name:    "zero burst",
+			spec:    NetworkRateLimitSpec{NetworkID: "internet", Rate: 10, Burst: &zero},
+			wantErr: true,
+		},
+		{
+			name:    "unknown direction",
+			spec:    NetworkRateLimitSpec{NetworkID: "internet", Rate: 10, Direction: "Both"},
+			wantErr: true,
+		},
+		{
+			name:    "unknown unit",
+			spec:    NetworkRateLimitSpec{NetworkID: "internet", Rate: 10, Unit: "bytes/minute"},
+			wantErr: true,
+		},
+		{
+			name:    "invalid destination",
+			spec:    NetworkRateLimitSpec{NetworkID: "internet", Rate: 10, Destinations: []string{"2001:db8::/32"}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.spec.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("NetworkRateLimitSpec.Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,97 @@
+package v1
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// PortForward forwards traffic to a port of an external IP of the firewall to a port of an internal IP, e.g. for a bastion host.
+// +kubebuilder:object:root=true
+// +kubebuilder:resource:shortName=pf
+// +kubebuilder:subresource:status
+// +kubebuilder:printcolumn:name="External IP",type="string",JSONPath=".spec.externalIP"
+// +kubebuilder:printcolumn:name="Port",type="integer",JSONPath=".spec.port"
+// +kubebuilder:printcolumn:name="Target IP",type="string",JSONPath=".spec.targetIP"
+// +kubebuilder:printcolumn:name="Target Port",type="integer",JSONPath=".spec.targetPort"
+// +kubebuilder:printcolumn:name="Status",type="string",JSONPath=".status.state"
+// +kubebuilder:printcolumn:name="Message",type="string",JSONPath=".status.message"
+type PortForward struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   PortForwardSpec   `json:"spec,omitempty"`
+	Status PortForwardStatus `json:"status,omitempty"`
+}
+
+// PortForwardList contains a list of PortForward
+// +kubebuilder:object:root=true
+type PortForwardList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []PortForward `json:"items"`
+}
+
+// PortForwardSpec defines which traffic is forwarded to which internal address
+type PortForwardSpec struct {
+	// ExternalIP is the IPv4 address the traffic is sent to, it must be routed to the firewall.
+	ExternalIP string `json:"externalIP"`
+	// Protocol is the protocol of the forwarded traffic, either TCP or UDP. Defaults to TCP.
+	// +optional
+	Protocol *corev1.Protocol `json:"protocol,omitempty"`
+	// Port is the port the traffic is sent to.
+	Port int32 `json:"port"`
+	// TargetIP is the internal IPv4 address the traffic is forwarded to.
+	TargetIP string `json:"targetIP"`
+	// TargetPort is the port the traffic is forwarded to. Defaults to Port.
+	// +optional
+	TargetPort int32 `json:"targetPort,omitempty"`
+	// From are the IPv4 CIDRs which are allowed to use the port forward. If empty, all sources are allowed.
+	// +optional
+	From []string `json:"from,omitempty"`
+}
+
+// PortForwardStatus defines the observed state of a PortForward
+type PortForwardStatus struct {
+	// State of the PortForward, can be either deployed or ignored
+	State PolicyDeploymentState `json:"state,omitempty"`
+	// Message describes why the port forward is ignored
+	Message string `json:"message,omitempty"`
+}
+
+// GetTargetPort returns the port the traffic is forwarded to
+func (s *PortForwardSpec) GetTargetPort() int32 {
+	if s.TargetPort == 0 {
+		return s.Port
+	}
+	return s.TargetPort
+}
+
+// Validate validates the spec of a PortForward
+func (s *PortForwardSpec) Validate() error {
+	var errs []error
+	if ip := net.ParseIP(s.ExternalIP); ip == nil || ip.To4() == nil {
+		errs = append(errs, fmt.Errorf("external ip %q is not a valid ipv4 address", s.ExternalIP))
+	}
+	if ip := net.ParseIP(s.TargetIP); ip == nil || ip.To4() == nil {
+		errs = append(errs, fmt.Errorf("target ip %q is not a valid ipv4 address", s.TargetIP))
+	}
+	if s.Protocol != nil && *s.Protocol != corev1.ProtocolTCP && *s.Protocol != corev1.ProtocolUDP {
+		errs = append(errs, fmt.Errorf("protocol %s is not supported, must be either TCP or UDP", *s.Protocol))
+	}
+	if s.Port < 1 || s.Port > 65535 {
+		errs = append(errs, fmt.Errorf("port %d is out of range", s.Port))
+	}
+	if s.TargetPort < 0 || s.TargetPort > 65535 {
+		errs = append(errs, fmt.Errorf("target port %d is out of range", s.TargetPort))
+	}
+	errs = append(errs, validateIPv4CIDRs("source", s.From))
+	return errors.Join(errs...)
+}
+
+func init() {
+	SchemeBuilder.Register(&PortForward{}, &PortForwardList{})
+}
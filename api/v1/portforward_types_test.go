@@ -0,0 +1,64 @@
+package v1
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestPortForwardSpec_Validate(t *testing.T) {
+	udp := corev1.ProtocolUDP
+	sctp := corev1.ProtocolSCTP
+
+	tests := []struct {
+		name    string
+		spec    PortForwardSpec
+		wantErr bool
+	}{
+		{
+			name: "valid port forward",
+			spec: PortForwardSpec{ExternalIP: "185.0.0.10", Port: 2222, TargetIP: "10.0.1.5", TargetPort: 22, From: []string{"203.0.113.0/24"}},
+		},
+		{
+			name: "valid udp port forward without target port",
+			spec: PortForwardSpec{ExternalIP: "185.0.0.10", Protocol: &udp, Port: 51820, TargetIP: "10.0.1.5"},
+		},
+		{
+			name:    "unsupported protocol",
+			spec:    PortForwardSpec{ExternalIP: "185.0.0.10", Protocol: &sctp, Port: 2222, TargetIP: "10.0.1.5"},
+			wantErr: true,
+		},
+		{
+			name:    "ipv6 external ip",
+			spec:    PortForwardSpec{ExternalIP: "2001:db8::10", Port: 2222, TargetIP: "10.0.1.5"},
+			wantErr: true,
+		},
+		{
+			name:    "missing target ip",
+			spec:    PortForwardSpec{ExternalIP: "185.0.0.10", Port: 2222},
+			wantErr: true,
+		},
+		{
+			name:    "missing port",
+			spec:    PortForwardSpec{ExternalIP: "185.0.0.10", TargetIP: "10.0.1.5"},
+			wantErr: true,
+		},
+		{
+			name:    "target port out of range",
+			spec:    PortForwardSpec{ExternalIP: "185.0.0.10", Port: 2222, TargetIP: "10.0.1.5", TargetPort: 65536},
+			wantErr: true,
+		},
+		{
+			name:    "invalid source",
+			spec:    PortForwardSpec{ExternalIP: "185.0.0.10", Port: 2222, TargetIP: "10.0.1.5", From: []string{"203.0.113.1"}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.spec.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("PortForwardSpec.Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,117 @@
+package v1
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// SNATPolicy selects the egress IP which is used for traffic of specific sources or to specific destinations.
+// Policies are applied in the order of their names, the first policy matching a connection determines its egress IP.
+// Connections which do not match any policy are masqueraded to the egress IPs of the firewall as before.
+// +kubebuilder:object:root=true
+// +kubebuilder:resource:shortName=snat
+// +kubebuilder:subresource:status
+// +kubebuilder:printcolumn:name="Network",type="string",JSONPath=".spec.networkID"
+// +kubebuilder:printcolumn:name="Egress IP",type="string",JSONPath=".spec.egressIP"
+// +kubebuilder:printcolumn:name="Status",type="string",JSONPath=".status.state"
+// +kubebuilder:printcolumn:name="Message",type="string",JSONPath=".status.message"
+type SNATPolicy struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   SNATPolicySpec   `json:"spec,omitempty"`
+	Status SNATPolicyStatus `json:"status,omitempty"`
+}
+
+// SNATPolicyList contains a list of SNATPolicy
+// +kubebuilder:object:root=true
+type SNATPolicyList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []SNATPolicy `json:"items"`
+}
+
+// SNATPolicySpec defines which traffic is masqueraded to which egress IP
+type SNATPolicySpec struct {
+	// Sources select the traffic by its source. If empty, the traffic of the primary private network matches.
+	// +optional
+	Sources []SNATSource `json:"sources,omitempty"`
+	// Destinations are the IPv4 CIDRs the traffic is sent to. If empty, traffic to all destinations matches.
+	// +optional
+	Destinations []string `json:"destinations,omitempty"`
+	// NetworkID is the external network the traffic leaves the firewall through.
+	NetworkID string `json:"networkID"`
+	// EgressIP is the IPv4 address the matching traffic is masqueraded to.
+	// It must be one of the egress IPs configured for the network in the firewall.
+	EgressIP string `json:"egressIP"`
+}
+
+// SNATSource selects traffic either by source CIDRs or by the pods it originates from
+type SNATSource struct {
+	// CIDRs are the IPv4 CIDRs of the sources.
+	// +optional
+	CIDRs []string `json:"cidrs,omitempty"`
+	// NamespaceSelector selects the namespaces of the pods, all namespaces are selected if not set.
+	// +optional
+	NamespaceSelector *metav1.LabelSelector `json:"namespaceSelector,omitempty"`
+	// PodSelector selects the pods within the selected namespaces, all pods are selected if not set.
+	// +optional
+	PodSelector *metav1.LabelSelector `json:"podSelector,omitempty"`
+}
+
+// SNATPolicyStatus defines the observed state of a SNATPolicy
+type SNATPolicyStatus struct {
+	// State of the SNATPolicy, can be either deployed or ignored
+	State PolicyDeploymentState `json:"state,omitempty"`
+	// Message describes why the policy is ignored
+	Message string `json:"message,omitempty"`
+}
+
+// SelectsPods returns whether the source selects pods instead of CIDRs
+func (s *SNATSource) SelectsPods() bool {
+	return s.NamespaceSelector != nil || s.PodSelector != nil
+}
+
+// Validate validates the spec of a SNATPolicy
+func (s *SNATPolicySpec) Validate() error {
+	var errs []error
+	if s.NetworkID == "" {
+		errs = append(errs, fmt.Errorf("network id must be set"))
+	}
+	if ip := net.ParseIP(s.EgressIP); ip == nil || ip.To4() == nil {
+		errs = append(errs, fmt.Errorf("egress ip %q is not a valid ipv4 address", s.EgressIP))
+	}
+	errs = append(errs, validateIPv4CIDRs("destination", s.Destinations))
+	for _, src := range s.Sources {
+		if len(src.CIDRs) > 0 && src.SelectsPods() {
+			errs = append(errs, fmt.Errorf("cidrs can't be combined with namespace or pod selectors in the same source"))
+		}
+		if len(src.CIDRs) == 0 && !src.SelectsPods() {
+			errs = append(errs, fmt.Errorf("source must either contain cidrs or select pods"))
+		}
+		errs = append(errs, validateIPv4CIDRs("source", src.CIDRs))
+		for _, selector := range []*metav1.LabelSelector{src.NamespaceSelector, src.PodSelector} {
+			if _, err := metav1.LabelSelectorAsSelector(selector); err != nil {
+				errs = append(errs, fmt.Errorf("invalid label selector: %w", err))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func validateIPv4CIDRs(kind string, cidrs []string) error {
+	var errs []error
+	for _, c := range cidrs {
+		if ip, _, err := net.ParseCIDR(c); err != nil || ip.To4() == nil {
+			errs = append(errs, fmt.Errorf("%s %s is not a valid ipv4 CIDR", kind, c))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func init() {
+	SchemeBuilder.Register(&SNATPolicy{}, &SNATPolicyList{})
+}
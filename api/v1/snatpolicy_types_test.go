@@ -0,0 +1,90 @@
+package v1
+
+import (
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestSNATPolicySpec_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		spec    SNATPolicySpec
+		wantErr bool
+	}{
+		{
+			name: "valid policy",
+			spec: SNATPolicySpec{
+				Sources: []SNATSource{
+					{CIDRs: []string{"10.0.1.0/24"}},
+					{NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"team": "billing"}}},
+				},
+				Destinations: []string{"203.0.113.0/24"},
+				NetworkID:    "internet",
+				EgressIP:     "185.1.2.3",
+			},
+		},
+		{
+			name: "policy without sources and destinations",
+			spec: SNATPolicySpec{NetworkID: "internet", EgressIP: "185.1.2.3"},
+		},
+		{
+			name:    "missing network",
+			spec:    SNATPolicySpec{EgressIP: "185.1.2.3"},
+			wantErr: true,
+		},
+		{
+			name:    "ipv6 egress ip",
+			spec:    SNATPolicySpec{NetworkID: "internet", EgressIP: "2001:db8::1"},
+			wantErr: true,
+		},
+		{
+			name: "invalid destination",
+			spec: SNATPolicySpec{
+				Destinations: []string{"203.0.113.0"},
+				NetworkID:    "internet",
+				EgressIP:     "185.1.2.3",
+			},
+			wantErr: true,
+		},
+		{
+			name: "source with cidrs and selector",
+			spec: SNATPolicySpec{
+				Sources: []SNATSource{{
+					CIDRs:       []string{"10.0.1.0/24"},
+					PodSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "billing"}},
+				}},
+				NetworkID: "internet",
+				EgressIP:  "185.1.2.3",
+			},
+			wantErr: true,
+		},
+		{
+			name: "empty source",
+			spec: SNATPolicySpec{
+				Sources:   []SNATSource{{}},
+				NetworkID: "internet",
+				EgressIP:  "185.1.2.3",
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid selector",
+			spec: SNATPolicySpec{
+				Sources: []SNATSource{{
+					PodSelector: &metav1.LabelSelector{MatchExpressions: []metav1.LabelSelectorRequirement{{Key: "app", Operator: "Unknown"}}},
+				}},
+				NetworkID: "internet",
+				EgressIP:  "185.1.2.3",
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.spec.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("SNATPolicySpec.Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,125 @@
+package v1
+
+import (
+	"errors"
+	"fmt"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+const maxTrafficClassPriority = 7
+
+// TrafficShaping shapes the bandwidth of a network of the firewall instead of dropping the traffic over its rate limit.
+// It is only applied if the firewall-controller runs with the rate limit mode shape.
+// +kubebuilder:object:root=true
+// +kubebuilder:resource:shortName=shaping
+// +kubebuilder:subresource:status
+// +kubebuilder:printcolumn:name="Network",type="string",JSONPath=".spec.networkID"
+// +kubebuilder:printcolumn:name="Rate",type="integer",JSONPath=".spec.rate"
+// +kubebuilder:printcolumn:name="Status",type="string",JSONPath=".status.state"
+// +kubebuilder:printcolumn:name="Message",type="string",JSONPath=".status.message"
+type TrafficShaping struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   TrafficShapingSpec   `json:"spec,omitempty"`
+	Status TrafficShapingStatus `json:"status,omitempty"`
+}
+
+// TrafficShapingList contains a list of TrafficShaping
+// +kubebuilder:object:root=true
+type TrafficShapingList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []TrafficShaping `json:"items"`
+}
+
+// TrafficShapingSpec defines the bandwidth of a network and how it is divided
+type TrafficShapingSpec struct {
+	// NetworkID is the id of the network whose traffic is shaped.
+	NetworkID string `json:"networkID"`
+	// Rate is the bandwidth of the network in mbytes/second, it applies to the traffic received from and sent to the network.
+	// It must not exceed the rate limit of the network in the firewall spec and defaults to it.
+	// +optional
+	Rate *uint32 `json:"rate,omitempty"`
+	// Burst is the amount of kbytes which may be sent at once at a higher speed than the rate.
+	// Defaults to the minimum burst the kernel requires for the rate.
+	// +optional
+	Burst *uint32 `json:"burst,omitempty"`
+	// Classes divide the bandwidth of the network, the traffic accepted by a ClusterwideNetworkPolicy is assigned to a class by its trafficClass.
+	// Traffic without a class shares the bandwidth which is not guaranteed to the classes.
+	// +optional
+	Classes []TrafficClass `json:"classes,omitempty"`
+}
+
+// TrafficClass guarantees a part of the bandwidth of a network to the traffic of ClusterwideNetworkPolicies
+type TrafficClass struct {
+	// Name of the class, it is referenced by the trafficClass of ClusterwideNetworkPolicies.
+	Name string `json:"name"`
+	// Rate is the bandwidth guaranteed to the class in mbytes/second.
+	Rate uint32 `json:"rate"`
+	// Ceil is the bandwidth the class may use in mbytes/second if other classes do not use their share.
+	// Defaults to the rate of the network.
+	// +optional
+	Ceil *uint32 `json:"ceil,omitempty"`
+	// Priority of the class when spare bandwidth is distributed, from 0 (highest) to 7 (lowest). Defaults to 0.
+	// +optional
+	Priority *uint32 `json:"priority,omitempty"`
+}
+
+// TrafficShapingStatus defines the observed state of a TrafficShaping
+type TrafficShapingStatus struct {
+	// State of the TrafficShaping, can be either deployed or ignored
+	State PolicyDeploymentState `json:"state,omitempty"`
+	// Message describes why the traffic shaping is ignored
+	Message string `json:"message,omitempty"`
+}
+
+// Validate validates the spec of a TrafficShaping
+func (s *TrafficShapingSpec) Validate() error {
+	var errs []error
+	if s.NetworkID == "" {
+		errs = append(errs, fmt.Errorf("network id must be given"))
+	}
+	if s.Rate != nil && *s.Rate == 0 {
+		errs = append(errs, fmt.Errorf("rate must be greater than 0"))
+	}
+
+	var (
+		names = map[string]bool{}
+		sum   uint64
+	)
+	for _, c := range s.Classes {
+		if msgs := validation.IsDNS1123Label(c.Name); len(msgs) > 0 {
+			errs = append(errs, fmt.Errorf("class name %q is invalid: %v", c.Name, msgs))
+		}
+		if names[c.Name] {
+			errs = append(errs, fmt.Errorf("class %q is defined more than once", c.Name))
+		}
+		names[c.Name] = true
+
+		if c.Rate == 0 {
+			errs = append(errs, fmt.Errorf("rate of class %q must be greater than 0", c.Name))
+		}
+		if c.Ceil != nil && *c.Ceil < c.Rate {
+			errs = append(errs, fmt.Errorf("ceil of class %q must not be lower than its rate", c.Name))
+		}
+		if c.Ceil != nil && s.Rate != nil && *c.Ceil > *s.Rate {
+			errs = append(errs, fmt.Errorf("ceil of class %q must not exceed the rate of the network", c.Name))
+		}
+		if c.Priority != nil && *c.Priority > maxTrafficClassPriority {
+			errs = append(errs, fmt.Errorf("priority of class %q must be between 0 and %d", c.Name, maxTrafficClassPriority))
+		}
+		sum += uint64(c.Rate)
+	}
+	if s.Rate != nil && sum > uint64(*s.Rate) {
+		errs = append(errs, fmt.Errorf("the rates of the classes exceed the rate of the network"))
+	}
+
+	return errors.Join(errs...)
+}
+
+func init() {
+	SchemeBuilder.Register(&TrafficShaping{}, &TrafficShapingList{})
+}
@@ -0,0 +1,89 @@
+package v1
+
+import (
+	"testing"
+)
+
+func TestTrafficShapingSpec_Validate(t *testing.T) {
+	var (
+		zero    = uint32(0)
+		one     = uint32(1)
+		five    = uint32(5)
+		seven   = uint32(7)
+		eight   = uint32(8)
+		fifty   = uint32(50)
+		hundred = uint32(100)
+		burst   = uint32(512)
+		tooHigh = uint32(200)
+	)
+
+	tests := []struct {
+		name    string
+		spec    TrafficShapingSpec
+		wantErr bool
+	}{
+		{
+			name: "valid traffic shaping",
+			spec: TrafficShapingSpec{
+				NetworkID: "internet",
+				Rate:      &hundred,
+				Burst:     &burst,
+				Classes: []TrafficClass{
+					{Name: "web", Rate: 60, Priority: &one},
+					{Name: "backup", Rate: 20, Ceil: &fifty, Priority: &seven},
+				},
+			},
+		},
+		{
+			name: "rate of the rate limit",
+			spec: TrafficShapingSpec{NetworkID: "internet", Classes: []TrafficClass{{Name: "web", Rate: 60}}},
+		},
+		{
+			name:    "missing network",
+			spec:    TrafficShapingSpec{Rate: &hundred},
+			wantErr: true,
+		},
+		{
+			name:    "zero rate",
+			spec:    TrafficShapingSpec{NetworkID: "internet", Rate: &zero},
+			wantErr: true,
+		},
+		{
+			name:    "invalid class name",
+			spec:    TrafficShapingSpec{NetworkID: "internet", Classes: []TrafficClass{{Name: "Web", Rate: 10}}},
+			wantErr: true,
+		},
+		{
+			name:    "duplicate class",
+			spec:    TrafficShapingSpec{NetworkID: "internet", Classes: []TrafficClass{{Name: "web", Rate: 10}, {Name: "web", Rate: 20}}},
+			wantErr: true,
+		},
+		{
+			name:    "ceil lower than rate",
+			spec:    TrafficShapingSpec{NetworkID: "internet", Classes: []TrafficClass{{Name: "web", Rate: 10, Ceil: &five}}},
+			wantErr: true,
+		},
+		{
+			name:    "ceil exceeds the rate of the network",
+			spec:    TrafficShapingSpec{NetworkID: "internet", Rate: &hundred, Classes: []TrafficClass{{Name: "web", Rate: 10, Ceil: &tooHigh}}},
+			wantErr: true,
+		},
+		{
+			name:    "priority out of range",
+			spec:    TrafficShapingSpec{NetworkID: "internet", Classes: []TrafficClass{{Name: "web", Rate: 10, Priority: &eight}}},
+			wantErr: true,
+		},
+		{
+			name:    "classes exceed the rate",
+			spec:    TrafficShapingSpec{NetworkID: "internet", Rate: &hundred, Classes: []TrafficClass{{Name: "web", Rate: 60}, {Name: "backup", Rate: 50}}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.spec.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("TrafficShapingSpec.Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -3,6 +3,10 @@ package controllers
 import (
 	"context"
 	"fmt"
+	"maps"
+	"net/netip"
+	"slices"
+	"strings"
 	"time"
 
 	"go4.org/netipx"
@@ -10,12 +14,19 @@ import (
 	"github.com/metal-stack/firewall-controller/v2/pkg/dns"
 	"github.com/metal-stack/firewall-controller/v2/pkg/helper"
 	"github.com/metal-stack/firewall-controller/v2/pkg/nftables"
+	"github.com/metal-stack/firewall-controller/v2/pkg/trafficcontrol"
+	"github.com/metal-stack/firewall-controller/v2/pkg/updater"
 
 	"github.com/go-logr/logr"
 
 	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/retry"
 
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/builder"
@@ -24,12 +35,16 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/manager"
 	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 	"sigs.k8s.io/controller-runtime/pkg/source"
 
 	firewallv2 "github.com/metal-stack/firewall-controller-manager/api/v2"
 	firewallv1 "github.com/metal-stack/firewall-controller/v2/api/v1"
 )
 
+// egressIPsConfigured is the condition of the firewall monitor which reports whether the egress ips of all networks are configured
+const egressIPsConfigured firewallv2.ConditionType = "EgressIPsConfigured"
+
 // ClusterwideNetworkPolicyReconciler reconciles a ClusterwideNetworkPolicy object
 // +kubebuilder:rbac:groups=metal-stack.io,resources=events,verbs=create;patch
 type ClusterwideNetworkPolicyReconciler struct {
@@ -43,9 +58,16 @@ type ClusterwideNetworkPolicyReconciler struct {
 	Ctx      context.Context
 	Recorder record.EventRecorder
 
-	Interval time.Duration
-	DnsProxy *dns.DNSProxy
-	SkipDNS  bool
+	Interval     time.Duration
+	DnsProxy     *dns.DNSProxy
+	SkipDNS      bool
+	SNATHashMode nftables.SNATHashMode
+
+	RateLimitMode nftables.RateLimitMode
+	// EgressPrefixLengths are the prefix lengths the egress IPs are added with to the interfaces
+	EgressPrefixLengths nftables.EgressPrefixLengths
+	// Shaper shapes the traffic of the networks if the rate limit mode is shape
+	Shaper *trafficcontrol.Shaper
 }
 
 // SetupWithManager configures this controller to run in schedule
@@ -62,6 +84,15 @@ func (r *ClusterwideNetworkPolicyReconciler) SetupWithManager(mgr ctrl.Manager)
 	return ctrl.NewControllerManagedBy(mgr).
 		For(&firewallv1.ClusterwideNetworkPolicy{}, builder.WithPredicates(predicate.GenerationChangedPredicate{})).
 		Watches(&corev1.Service{}, &handler.EnqueueRequestForObject{}).
+		Watches(&corev1.Node{}, &handler.EnqueueRequestForObject{}, builder.WithPredicates(nodeAddressChangedPredicate())).
+		Watches(&discoveryv1.EndpointSlice{}, handler.EnqueueRequestsFromMapFunc(r.exposedServiceRequests), builder.WithPredicates(endpointSliceChangedPredicate())).
+		Watches(&firewallv1.DNSProxyConfig{}, &handler.EnqueueRequestForObject{}).
+		Watches(&firewallv1.SNATPolicy{}, &handler.EnqueueRequestForObject{}, builder.WithPredicates(predicate.GenerationChangedPredicate{})).
+		Watches(&firewallv1.PortForward{}, &handler.EnqueueRequestForObject{}, builder.WithPredicates(predicate.GenerationChangedPredicate{})).
+		Watches(&firewallv1.NetworkRateLimit{}, &handler.EnqueueRequestForObject{}, builder.WithPredicates(predicate.GenerationChangedPredicate{})).
+		Watches(&firewallv1.TrafficShaping{}, &handler.EnqueueRequestForObject{}, builder.WithPredicates(predicate.GenerationChangedPredicate{})).
+		Watches(&corev1.Pod{}, handler.EnqueueRequestsFromMapFunc(r.podSelectingRequests), builder.WithPredicates(podAddressChangedPredicate())).
+		Watches(&corev1.Namespace{}, handler.EnqueueRequestsFromMapFunc(r.podSelectingRequests), builder.WithPredicates(predicate.LabelChangedPredicate{})).
 		WatchesRawSource(source.Channel(scheduleChan, &handler.TypedEnqueueRequestForObject[*firewallv1.ClusterwideNetworkPolicy]{})).
 		Complete(r)
 }
@@ -71,6 +102,18 @@ func (r *ClusterwideNetworkPolicyReconciler) SetupWithManager(mgr ctrl.Manager)
 //
 // +kubebuilder:rbac:groups=metal-stack.io,resources=clusterwidenetworkpolicies,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=metal-stack.io,resources=clusterwidenetworkpolicies/status,verbs=get;update;patch
+// +kubebuilder:rbac:groups=metal-stack.io,resources=fqdncacheentries,verbs=get;list;watch;create;update;delete
+// +kubebuilder:rbac:groups=metal-stack.io,resources=dnsproxyconfigs,verbs=get;list;watch
+// +kubebuilder:rbac:groups=metal-stack.io,resources=snatpolicies,verbs=get;list;watch
+// +kubebuilder:rbac:groups=metal-stack.io,resources=snatpolicies/status,verbs=get;update;patch
+// +kubebuilder:rbac:groups=metal-stack.io,resources=portforwards,verbs=get;list;watch
+// +kubebuilder:rbac:groups=metal-stack.io,resources=portforwards/status,verbs=get;update;patch
+// +kubebuilder:rbac:groups=metal-stack.io,resources=networkratelimits,verbs=get;list;watch
+// +kubebuilder:rbac:groups=metal-stack.io,resources=networkratelimits/status,verbs=get;update;patch
+// +kubebuilder:rbac:groups=metal-stack.io,resources=trafficshapings,verbs=get;list;watch
+// +kubebuilder:rbac:groups=metal-stack.io,resources=trafficshapings/status,verbs=get;update;patch
+// +kubebuilder:rbac:groups="",resources=pods;namespaces;nodes,verbs=get;list;watch
+// +kubebuilder:rbac:groups=discovery.k8s.io,resources=endpointslices,verbs=get;list;watch
 
 func (r *ClusterwideNetworkPolicyReconciler) Reconcile(ctx context.Context, _ ctrl.Request) (ctrl.Result, error) {
 	var cwnps firewallv1.ClusterwideNetworkPolicyList
@@ -99,6 +142,14 @@ func (r *ClusterwideNetworkPolicyReconciler) Reconcile(ctx context.Context, _ ct
 	if err := r.ShootClient.List(ctx, &services); err != nil {
 		return ctrl.Result{}, err
 	}
+	var nodes corev1.NodeList
+	if err := r.ShootClient.List(ctx, &nodes); err != nil {
+		return ctrl.Result{}, err
+	}
+	var endpointSlices discoveryv1.EndpointSliceList
+	if err := r.ShootClient.List(ctx, &endpointSlices); err != nil {
+		return ctrl.Result{}, err
+	}
 
 	validCwnps, err := r.allowedCWNPs(ctx, cwnps.Items, f.Spec.AllowedNetworks)
 	if err != nil {
@@ -106,14 +157,88 @@ func (r *ClusterwideNetworkPolicyReconciler) Reconcile(ctx context.Context, _ ct
 	}
 	cwnps.Items = validCwnps
 
-	nftablesFirewall := nftables.NewFirewall(f, &cwnps, &services, r.DnsProxy, r.Log, r.Recorder)
-	if err := r.manageDNSProxy(f, cwnps, nftablesFirewall); err != nil {
+	dnsConfig, err := r.dnsProxyConfig(ctx)
+	if err != nil {
+		return ctrl.Result{}, fmt.Errorf("failed to get DNS proxy configuration: %w", err)
+	}
+
+	snatPolicies, err := r.snatPolicies(ctx)
+	if err != nil {
+		return ctrl.Result{}, fmt.Errorf("failed to get SNAT policies: %w", err)
+	}
+	var portForwards firewallv1.PortForwardList
+	if err := r.ShootClient.List(ctx, &portForwards, client.InNamespace(firewallv1.ClusterwideNetworkPolicyNamespace)); err != nil {
+		return ctrl.Result{}, fmt.Errorf("failed to get port forwards: %w", err)
+	}
+	var networkRateLimits firewallv1.NetworkRateLimitList
+	if err := r.ShootClient.List(ctx, &networkRateLimits, client.InNamespace(firewallv1.ClusterwideNetworkPolicyNamespace)); err != nil {
+		return ctrl.Result{}, fmt.Errorf("failed to get network rate limits: %w", err)
+	}
+	slices.SortFunc(networkRateLimits.Items, func(a, b firewallv1.NetworkRateLimit) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	var trafficShapings firewallv1.TrafficShapingList
+	if err := r.ShootClient.List(ctx, &trafficShapings, client.InNamespace(firewallv1.ClusterwideNetworkPolicyNamespace)); err != nil {
+		return ctrl.Result{}, fmt.Errorf("failed to get traffic shapings: %w", err)
+	}
+	slices.SortFunc(trafficShapings.Items, func(a, b firewallv1.TrafficShaping) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+
+	// the status of the policies, port forwards, rate limits and traffic shapings is set while rendering the rules and shaping the traffic
+	observed := make([]firewallv1.SNATPolicyStatus, 0, len(snatPolicies))
+	for _, p := range snatPolicies {
+		observed = append(observed, p.Status)
+	}
+	observedPortForwards := make([]firewallv1.PortForwardStatus, 0, len(portForwards.Items))
+	for _, pf := range portForwards.Items {
+		observedPortForwards = append(observedPortForwards, pf.Status)
+	}
+	observedNetworkRateLimits := make([]firewallv1.NetworkRateLimitStatus, 0, len(networkRateLimits.Items))
+	for _, rl := range networkRateLimits.Items {
+		observedNetworkRateLimits = append(observedNetworkRateLimits, rl.Status)
+	}
+	observedTrafficShapings := make([]firewallv1.TrafficShapingStatus, 0, len(trafficShapings.Items))
+	for _, ts := range trafficShapings.Items {
+		observedTrafficShapings = append(observedTrafficShapings, ts.Status)
+	}
+
+	if err := r.manageDNSProxy(f, cwnps, services, dnsConfig); err != nil {
 		return ctrl.Result{}, err
 	}
+	nftablesFirewall := nftables.NewFirewall(f, &cwnps, &services, r.DnsProxy, r.Log, r.Recorder, nftables.FirewallOptions{
+		Nodes:               nodes.Items,
+		EndpointSlices:      endpointSlices.Items,
+		SNATPolicies:        snatPolicies,
+		PortForwards:        portForwards.Items,
+		NetworkRateLimits:   networkRateLimits.Items,
+		DNSInterceptions:    dnsConfig.Interceptions,
+		SNATHashMode:        r.SNATHashMode,
+		RateLimitMode:       r.RateLimitMode,
+		EgressPrefixLengths: r.EgressPrefixLengths,
+	})
+	if !r.SkipDNS {
+		if err := nftablesFirewall.ReconcileNetconfTables(); err != nil {
+			return ctrl.Result{}, fmt.Errorf("failed to reconcile nftables for DNS proxy: %w", err)
+		}
+	}
 	updated, err := nftablesFirewall.Reconcile()
 	if err != nil {
 		return ctrl.Result{}, err
 	}
+	// errors of reconciling the egress IPs are reported after the status of the resources was updated
+	addressErr := r.reportAddressErrors(ctx, f, nftablesFirewall.AddressErrors())
+
+	// errors of the traffic shaping are returned after the status of the resources was updated
+	var shapingErr error
+	if r.Shaper != nil {
+		shapings := trafficcontrol.Shapings(f, trafficShapings.Items, r.Recorder)
+		if !f.Spec.DryRun {
+			shapingErr = r.Shaper.Reconcile(f, shapings)
+		}
+	} else {
+		trafficcontrol.Ignore(trafficShapings.Items)
+	}
 
 	if updated {
 		for _, i := range cwnps.Items {
@@ -124,49 +249,85 @@ func (r *ClusterwideNetworkPolicyReconciler) Reconcile(ctx context.Context, _ ct
 		}
 	}
 
+	for i, p := range snatPolicies {
+		if p.Status == observed[i] {
+			continue
+		}
+		if err := r.ShootClient.Status().Update(ctx, &p.SNATPolicy); err != nil {
+			return ctrl.Result{}, fmt.Errorf("failed to update status of SNAT policy %q: %w", p.Name, err)
+		}
+	}
+
+	for i, pf := range portForwards.Items {
+		if pf.Status == observedPortForwards[i] {
+			continue
+		}
+		if err := r.ShootClient.Status().Update(ctx, &pf); err != nil {
+			return ctrl.Result{}, fmt.Errorf("failed to update status of port forward %q: %w", pf.Name, err)
+		}
+	}
+
+	for i, rl := range networkRateLimits.Items {
+		if rl.Status == observedNetworkRateLimits[i] {
+			continue
+		}
+		if err := r.ShootClient.Status().Update(ctx, &rl); err != nil {
+			return ctrl.Result{}, fmt.Errorf("failed to update status of network rate limit %q: %w", rl.Name, err)
+		}
+	}
+
+	for i, ts := range trafficShapings.Items {
+		if ts.Status == observedTrafficShapings[i] {
+			continue
+		}
+		if err := r.ShootClient.Status().Update(ctx, &ts); err != nil {
+			return ctrl.Result{}, fmt.Errorf("failed to update status of traffic shaping %q: %w", ts.Name, err)
+		}
+	}
+
+	if shapingErr != nil {
+		return ctrl.Result{}, fmt.Errorf("failed to shape traffic: %w", shapingErr)
+	}
+	if addressErr != nil {
+		return ctrl.Result{}, fmt.Errorf("failed to report egress ip errors: %w", addressErr)
+	}
+
 	return ctrl.Result{}, nil
 }
 
-// manageDNSProxy start DNS proxy if toFQDN rules are present
-// if rules were deleted it will stop running DNS proxy
+// manageDNSProxy enables the DNS proxy if toFQDN rules or services with load balancer hostnames are present
+// if rules were deleted the DNS proxy stops serving, but keeps its cache
+// changes of the DNS server, port and listen addresses are applied without restarting the proxy
 func (r *ClusterwideNetworkPolicyReconciler) manageDNSProxy(
-	f *firewallv2.Firewall, cwnps firewallv1.ClusterwideNetworkPolicyList, nftablesFirewall *nftables.Firewall,
-) (err error) {
+	f *firewallv2.Firewall, cwnps firewallv1.ClusterwideNetworkPolicyList, services corev1.ServiceList, config firewallv1.DNSProxyConfigSpec,
+) error {
 	// Skipping is needed for testing
-	if r.SkipDNS {
+	if r.SkipDNS || r.DnsProxy == nil {
 		return nil
 	}
 
-	enableDNS := len(cwnps.GetFQDNs()) > 0
-
-	if err := nftablesFirewall.ReconcileNetconfTables(); err != nil {
-		return fmt.Errorf("failed to reconcile nftables for DNS proxy: %w", err)
+	// the hostnames of load balancers are resolved by the DNS cache to open the service ports on their addresses
+	fqdns := append(cwnps.GetFQDNs(), nftables.ServiceHostnameSelectors(services.Items)...)
+	c := dns.Config{
+		Enabled:       len(fqdns) > 0,
+		Port:          f.Spec.DNSPort,
+		Interceptions: config.Interceptions,
 	}
-
-	if enableDNS && r.DnsProxy == nil {
-		r.Log.Info("DNS Proxy is initialized")
-		if r.DnsProxy, err = dns.NewDNSProxy(r.Ctx, f.Spec.DNSServerAddress, f.Spec.DNSPort, r.ShootClient, ctrl.Log.WithName("DNS proxy")); err != nil {
-			return fmt.Errorf("failed to init DNS proxy: %w", err)
-		}
-		go r.DnsProxy.Run()
-	} else if !enableDNS && r.DnsProxy != nil {
-		r.Log.Info("DNS Proxy is stopped")
-		r.DnsProxy.Stop()
-		r.DnsProxy = nil
-	}
-
-	// If proxy is ON, update DNS address(if it's set in spec)
-	if r.DnsProxy != nil && f.Spec.DNSServerAddress != "" {
+	if f.Spec.DNSServerAddress != "" {
 		port := uint(53)
 		if f.Spec.DNSPort != nil {
 			port = *f.Spec.DNSPort
 		}
-		addr := fmt.Sprintf("%s:%d", f.Spec.DNSServerAddress, port)
-		if err = r.DnsProxy.UpdateDNSServerAddr(addr); err != nil {
-			return fmt.Errorf("failed to update DNS server address: %w", err)
-		}
+		c.DNSServerAddr = fmt.Sprintf("%s:%d", f.Spec.DNSServerAddress, port)
+	}
+
+	if err := r.DnsProxy.Configure(c); err != nil {
+		return fmt.Errorf("failed to configure DNS proxy: %w", err)
 	}
 
+	r.DnsProxy.UpdateFQDNSelectors(fqdns)
+	r.DnsProxy.UpdateConfig(config)
+
 	return nil
 }
 
@@ -202,6 +363,271 @@ func (r *ClusterwideNetworkPolicyReconciler) getReconciliationTicker(scheduleCha
 	}
 }
 
+// reportAddressErrors records an event for every network whose egress IPs could not be reconciled
+// and reflects the result in the EgressIPsConfigured condition of the firewall monitor
+func (r *ClusterwideNetworkPolicyReconciler) reportAddressErrors(ctx context.Context, f *firewallv2.Firewall, errs map[string]error) error {
+	condition := firewallv2.NewCondition(egressIPsConfigured, firewallv2.ConditionTrue, "Configured", "the egress ips of all networks are configured")
+	if len(errs) > 0 {
+		recordFirewallEvent := updater.ShootRecorderNamespaceRewriter(r.Recorder)
+		var messages []string
+		for _, networkID := range slices.Sorted(maps.Keys(errs)) {
+			message := fmt.Sprintf("network %s: %v", networkID, errs[networkID])
+			recordFirewallEvent(f, corev1.EventTypeWarning, "EgressIPsFailed", fmt.Sprintf("reconciliation of the egress ips failed for %s", message))
+			messages = append(messages, message)
+		}
+		condition = firewallv2.NewCondition(egressIPsConfigured, firewallv2.ConditionFalse, "Failed", strings.Join(messages, "; "))
+	}
+
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		mon := &firewallv2.FirewallMonitor{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      r.FirewallName,
+				Namespace: firewallv1.ClusterwideNetworkPolicyNamespace,
+			},
+		}
+		if err := r.ShootClient.Get(ctx, client.ObjectKeyFromObject(mon), mon); err != nil {
+			return client.IgnoreNotFound(err)
+		}
+		if current := mon.Conditions.Get(egressIPsConfigured); current != nil && current.Status == condition.Status && current.Reason == condition.Reason && current.Message == condition.Message {
+			return nil
+		}
+		mon.Conditions.Set(condition)
+		return r.ShootClient.Update(ctx, mon)
+	})
+}
+
+// dnsProxyConfig merges all valid DNS proxy configurations, invalid ones are skipped
+func (r *ClusterwideNetworkPolicyReconciler) dnsProxyConfig(ctx context.Context) (firewallv1.DNSProxyConfigSpec, error) {
+	var configs firewallv1.DNSProxyConfigList
+	if err := r.ShootClient.List(ctx, &configs, client.InNamespace(firewallv1.ClusterwideNetworkPolicyNamespace)); err != nil {
+		return firewallv1.DNSProxyConfigSpec{}, err
+	}
+
+	valid := firewallv1.DNSProxyConfigList{}
+	for _, c := range configs.Items {
+		if err := c.Spec.Validate(); err != nil {
+			r.Recorder.Event(
+				&c,
+				corev1.EventTypeWarning,
+				"Inapplicable",
+				fmt.Sprintf("dns proxy configuration is not valid and is skipped: %v", err),
+			)
+			continue
+		}
+		valid.Items = append(valid.Items, c)
+	}
+
+	return valid.Merge(), nil
+}
+
+// snatPolicies returns the SNAT policies ordered by their names, with the IPs of the pods selected by their sources
+func (r *ClusterwideNetworkPolicyReconciler) snatPolicies(ctx context.Context) ([]nftables.SNATPolicy, error) {
+	var policies firewallv1.SNATPolicyList
+	if err := r.ShootClient.List(ctx, &policies, client.InNamespace(firewallv1.ClusterwideNetworkPolicyNamespace)); err != nil {
+		return nil, err
+	}
+	slices.SortFunc(policies.Items, func(a, b firewallv1.SNATPolicy) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+
+	var (
+		result     []nftables.SNATPolicy
+		pods       *corev1.PodList
+		namespaces *corev1.NamespaceList
+	)
+	for _, p := range policies.Items {
+		policy := nftables.SNATPolicy{SNATPolicy: p}
+		result = append(result, policy)
+
+		// invalid policies are reported when the rules are rendered
+		if p.Spec.Validate() != nil {
+			continue
+		}
+		for _, src := range p.Spec.Sources {
+			if !src.SelectsPods() {
+				continue
+			}
+			if pods == nil {
+				pods, namespaces = &corev1.PodList{}, &corev1.NamespaceList{}
+				if err := r.ShootClient.List(ctx, pods); err != nil {
+					return nil, err
+				}
+				if err := r.ShootClient.List(ctx, namespaces); err != nil {
+					return nil, err
+				}
+			}
+			ips, err := selectedPodIPs(src, pods.Items, namespaces.Items)
+			if err != nil {
+				return nil, err
+			}
+			result[len(result)-1].PodIPs = append(result[len(result)-1].PodIPs, ips...)
+		}
+		slices.Sort(result[len(result)-1].PodIPs)
+		result[len(result)-1].PodIPs = slices.Compact(result[len(result)-1].PodIPs)
+	}
+	return result, nil
+}
+
+// selectedPodIPs returns the IPv4 addresses of the running pods selected by the source.
+// Pods in the host network are not selected, as their traffic can't be told apart from the traffic of their node.
+func selectedPodIPs(src firewallv1.SNATSource, pods []corev1.Pod, namespaces []corev1.Namespace) ([]string, error) {
+	namespaceSelector, err := metav1.LabelSelectorAsSelector(src.NamespaceSelector)
+	if err != nil {
+		return nil, err
+	}
+	if src.NamespaceSelector == nil {
+		namespaceSelector = labels.Everything()
+	}
+	podSelector, err := metav1.LabelSelectorAsSelector(src.PodSelector)
+	if err != nil {
+		return nil, err
+	}
+	if src.PodSelector == nil {
+		podSelector = labels.Everything()
+	}
+
+	selected := map[string]bool{}
+	for _, ns := range namespaces {
+		selected[ns.Name] = namespaceSelector.Matches(labels.Set(ns.Labels))
+	}
+
+	var ips []string
+	for _, pod := range pods {
+		if !selected[pod.Namespace] || !podSelector.Matches(labels.Set(pod.Labels)) {
+			continue
+		}
+		if pod.Spec.HostNetwork || pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+			continue
+		}
+		for _, podIP := range pod.Status.PodIPs {
+			if ip, err := netip.ParseAddr(podIP.IP); err == nil && ip.Is4() {
+				ips = append(ips, ip.String())
+			}
+		}
+	}
+	return ips, nil
+}
+
+// podSelectingRequest is the request events of pods and namespaces are mapped to.
+// As every reconciliation renders all rules, the changes of many pods are queued as a single reconciliation.
+var podSelectingRequest = reconcile.Request{NamespacedName: types.NamespacedName{Namespace: firewallv1.ClusterwideNetworkPolicyNamespace, Name: "pod-selecting-snat-policies"}}
+
+// podSelectingRequests maps events of pods and namespaces to a reconciliation, if a valid SNAT policy selects pods.
+// Otherwise the pods are not rendered and their events are ignored.
+func (r *ClusterwideNetworkPolicyReconciler) podSelectingRequests(ctx context.Context, _ client.Object) []reconcile.Request {
+	var policies firewallv1.SNATPolicyList
+	if err := r.ShootClient.List(ctx, &policies, client.InNamespace(firewallv1.ClusterwideNetworkPolicyNamespace)); err != nil {
+		r.Log.Error(err, "unable to list snat policies")
+		return nil
+	}
+	for _, p := range policies.Items {
+		if p.Spec.Validate() != nil {
+			continue
+		}
+		for _, src := range p.Spec.Sources {
+			if src.SelectsPods() {
+				return []reconcile.Request{podSelectingRequest}
+			}
+		}
+	}
+	return nil
+}
+
+// podAddressChangedPredicate only passes events of pods whose addresses or labels changed,
+// as only these are relevant for the sources of SNAT policies
+func podAddressChangedPredicate() predicate.Predicate {
+	return predicate.Funcs{
+		UpdateFunc: func(e event.UpdateEvent) bool {
+			oldPod, ok := e.ObjectOld.(*corev1.Pod)
+			if !ok {
+				return false
+			}
+			newPod, ok := e.ObjectNew.(*corev1.Pod)
+			if !ok {
+				return false
+			}
+			return !maps.Equal(oldPod.Labels, newPod.Labels) ||
+				!slices.Equal(oldPod.Status.PodIPs, newPod.Status.PodIPs) ||
+				oldPod.Status.Phase != newPod.Status.Phase
+		},
+	}
+}
+
+// exposedServiceRequests maps events of endpoint slices to a reconciliation of their service,
+// if the service is exposed by the firewall. Deleted services are reconciled by their own events.
+func (r *ClusterwideNetworkPolicyReconciler) exposedServiceRequests(ctx context.Context, obj client.Object) []reconcile.Request {
+	name, ok := obj.GetLabels()[discoveryv1.LabelServiceName]
+	if !ok {
+		return nil
+	}
+	var svc corev1.Service
+	if err := r.ShootClient.Get(ctx, types.NamespacedName{Namespace: obj.GetNamespace(), Name: name}, &svc); err != nil {
+		if !apierrors.IsNotFound(err) {
+			r.Log.Error(err, "unable to get service of endpoint slice", "namespace", obj.GetNamespace(), "name", name)
+		}
+		return nil
+	}
+	if !nftables.IsExposedService(svc) {
+		return nil
+	}
+	return []reconcile.Request{{NamespacedName: client.ObjectKeyFromObject(&svc)}}
+}
+
+// endpointSliceChangedPredicate only passes updates of endpoint slices which change whether there is a ready endpoint
+// or the nodes of the ready endpoints, as only these are relevant for the rules of services
+func endpointSliceChangedPredicate() predicate.Predicate {
+	return predicate.Funcs{
+		UpdateFunc: func(e event.UpdateEvent) bool {
+			oldSlice, ok := e.ObjectOld.(*discoveryv1.EndpointSlice)
+			if !ok {
+				return false
+			}
+			newSlice, ok := e.ObjectNew.(*discoveryv1.EndpointSlice)
+			if !ok {
+				return false
+			}
+			oldReady, oldNodes := readyEndpointNodes(oldSlice)
+			newReady, newNodes := readyEndpointNodes(newSlice)
+			return oldReady != newReady || !maps.Equal(oldNodes, newNodes) ||
+				oldSlice.Labels[discoveryv1.LabelServiceName] != newSlice.Labels[discoveryv1.LabelServiceName]
+		},
+	}
+}
+
+// readyEndpointNodes returns whether the endpoint slice has a ready endpoint and the nodes of the ready endpoints
+func readyEndpointNodes(slice *discoveryv1.EndpointSlice) (bool, map[string]bool) {
+	ready, nodes := false, map[string]bool{}
+	for _, e := range slice.Endpoints {
+		// an unknown readiness is interpreted as ready, as in the rendering of the rules
+		if e.Conditions.Ready != nil && !*e.Conditions.Ready {
+			continue
+		}
+		ready = true
+		if e.NodeName != nil {
+			nodes[*e.NodeName] = true
+		}
+	}
+	return ready, nodes
+}
+
+// nodeAddressChangedPredicate only passes events of nodes whose addresses changed,
+// as only these are relevant for the rules of services of type node port
+func nodeAddressChangedPredicate() predicate.Predicate {
+	return predicate.Funcs{
+		UpdateFunc: func(e event.UpdateEvent) bool {
+			oldNode, ok := e.ObjectOld.(*corev1.Node)
+			if !ok {
+				return false
+			}
+			newNode, ok := e.ObjectNew.(*corev1.Node)
+			if !ok {
+				return false
+			}
+			return !slices.Equal(oldNode.Status.Addresses, newNode.Status.Addresses)
+		},
+	}
+}
+
 func (r *ClusterwideNetworkPolicyReconciler) allowedCWNPs(ctx context.Context, cwnps []firewallv1.ClusterwideNetworkPolicy, allowedNetworks firewallv2.AllowedNetworks) ([]firewallv1.ClusterwideNetworkPolicy, error) {
 	if len(allowedNetworks.Egress) == 0 && len(allowedNetworks.Ingress) == 0 {
 		return cwnps, nil
@@ -0,0 +1,199 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/google/go-cmp/cmp"
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	firewallv1 "github.com/metal-stack/firewall-controller/v2/api/v1"
+)
+
+func TestPodSelectingRequests(t *testing.T) {
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	_ = firewallv1.AddToScheme(scheme)
+
+	policy := func(name string, src firewallv1.SNATSource) *firewallv1.SNATPolicy {
+		return &firewallv1.SNATPolicy{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: firewallv1.ClusterwideNetworkPolicyNamespace},
+			Spec: firewallv1.SNATPolicySpec{
+				NetworkID: "internet",
+				EgressIP:  "185.0.0.2",
+				Sources:   []firewallv1.SNATSource{src},
+			},
+		}
+	}
+	selector := &metav1.LabelSelector{MatchLabels: map[string]string{"app": "egress"}}
+
+	tests := []struct {
+		name     string
+		policies []client.Object
+		want     []reconcile.Request
+	}{
+		{
+			name: "no snat policies",
+		},
+		{
+			name:     "snat policy with cidrs",
+			policies: []client.Object{policy("cidrs", firewallv1.SNATSource{CIDRs: []string{"10.0.1.0/24"}})},
+		},
+		{
+			name: "invalid snat policy selecting pods",
+			policies: []client.Object{
+				policy("invalid", firewallv1.SNATSource{CIDRs: []string{"10.0.1.0/24"}, PodSelector: selector}),
+			},
+		},
+		{
+			name: "snat policies selecting pods",
+			policies: []client.Object{
+				policy("cidrs", firewallv1.SNATSource{CIDRs: []string{"10.0.1.0/24"}}),
+				policy("pods", firewallv1.SNATSource{PodSelector: selector}),
+				policy("namespaces", firewallv1.SNATSource{NamespaceSelector: selector}),
+			},
+			want: []reconcile.Request{podSelectingRequest},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &ClusterwideNetworkPolicyReconciler{
+				ShootClient: fake.NewClientBuilder().WithScheme(scheme).WithObjects(tt.policies...).Build(),
+				Log:         logr.Discard(),
+			}
+
+			got := r.podSelectingRequests(context.Background(), &corev1.Pod{})
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("podSelectingRequests() diff = %s", diff)
+			}
+		})
+	}
+}
+
+func TestExposedServiceRequests(t *testing.T) {
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+
+	service := func(name string, svcType corev1.ServiceType, externalIPs ...string) client.Object {
+		return &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+			Spec:       corev1.ServiceSpec{Type: svcType, ExternalIPs: externalIPs},
+		}
+	}
+	r := &ClusterwideNetworkPolicyReconciler{
+		ShootClient: fake.NewClientBuilder().WithScheme(scheme).WithObjects(
+			service("lb", corev1.ServiceTypeLoadBalancer),
+			service("nodeport", corev1.ServiceTypeNodePort),
+			service("external", corev1.ServiceTypeClusterIP, "185.0.0.1"),
+			service("internal", corev1.ServiceTypeClusterIP),
+		).Build(),
+		Log: logr.Discard(),
+	}
+
+	tests := []struct {
+		name    string
+		service string
+		want    []reconcile.Request
+	}{
+		{
+			name:    "load balancer",
+			service: "lb",
+			want:    []reconcile.Request{{NamespacedName: types.NamespacedName{Namespace: "default", Name: "lb"}}},
+		},
+		{
+			name:    "node port",
+			service: "nodeport",
+			want:    []reconcile.Request{{NamespacedName: types.NamespacedName{Namespace: "default", Name: "nodeport"}}},
+		},
+		{
+			name:    "external ips",
+			service: "external",
+			want:    []reconcile.Request{{NamespacedName: types.NamespacedName{Namespace: "default", Name: "external"}}},
+		},
+		{
+			name:    "cluster ip",
+			service: "internal",
+		},
+		{
+			name:    "deleted service",
+			service: "deleted",
+		},
+		{
+			name: "slice without service",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			slice := &discoveryv1.EndpointSlice{ObjectMeta: metav1.ObjectMeta{Name: "slice", Namespace: "default"}}
+			if tt.service != "" {
+				slice.Labels = map[string]string{discoveryv1.LabelServiceName: tt.service}
+			}
+
+			got := r.exposedServiceRequests(context.Background(), slice)
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("exposedServiceRequests() diff = %s", diff)
+			}
+		})
+	}
+}
+
+func TestEndpointSliceChangedPredicate(t *testing.T) {
+	endpoint := func(node string, ready *bool) discoveryv1.Endpoint {
+		return discoveryv1.Endpoint{NodeName: &node, Conditions: discoveryv1.EndpointConditions{Ready: ready}}
+	}
+	slice := func(endpoints ...discoveryv1.Endpoint) *discoveryv1.EndpointSlice {
+		return &discoveryv1.EndpointSlice{
+			ObjectMeta: metav1.ObjectMeta{Name: "slice", Namespace: "default", Labels: map[string]string{discoveryv1.LabelServiceName: "lb"}},
+			Endpoints:  endpoints,
+		}
+	}
+	ready, notReady := new(true), new(false)
+
+	tests := []struct {
+		name     string
+		old, new *discoveryv1.EndpointSlice
+		want     bool
+	}{
+		{
+			name: "unchanged ready endpoints",
+			old:  slice(endpoint("node-1", ready)),
+			new:  slice(endpoint("node-1", nil), endpoint("node-1", ready), endpoint("node-2", notReady)),
+		},
+		{
+			name: "first endpoint becomes ready",
+			old:  slice(endpoint("node-1", notReady)),
+			new:  slice(endpoint("node-1", ready)),
+			want: true,
+		},
+		{
+			name: "last endpoint becomes unready",
+			old:  slice(endpoint("node-1", ready)),
+			new:  slice(endpoint("node-1", notReady)),
+			want: true,
+		},
+		{
+			name: "ready endpoint moves to another node",
+			old:  slice(endpoint("node-1", ready)),
+			new:  slice(endpoint("node-2", ready)),
+			want: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := endpointSliceChangedPredicate().Update(event.UpdateEvent{ObjectOld: tt.old, ObjectNew: tt.new})
+			if got != tt.want {
+				t.Errorf("Update() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -53,17 +53,24 @@ type FirewallReconciler struct {
 	SeedUpdatedFunc func()
 
 	FrrVersion *semver.Version
+
+	// NftablesExporter exposes the nftables-exporter in the shoot cluster, it is optional as the nftables metrics are also served on the metrics endpoint
+	NftablesExporter bool
+	// MetricsPort is the port of the metrics endpoint of the firewall-controller which is exposed in the shoot cluster, it is not exposed if zero
+	MetricsPort int32
 }
 
 const (
 	reconciliationInterval = 10 * time.Second
 
-	nftablesExporterService   = "node-exporter"
-	nftablesExporterNamedPort = "nodeexporter"
-	nftablesExporterPort      = 9100
-	nodeExporterService       = "nftables-exporter"
-	nodeExporterNamedPort     = "nftexporter"
-	nodeExporterPort          = 9630
+	nodeExporterService       = "node-exporter"
+	nodeExporterNamedPort     = "nodeexporter"
+	nodeExporterPort          = 9100
+	nftablesExporterService   = "nftables-exporter"
+	nftablesExporterNamedPort = "nftexporter"
+	nftablesExporterPort      = 9630
+	metricsService            = "firewall-controller"
+	metricsNamedPort          = "metrics"
 	exporterLabelKey          = "app"
 )
 
@@ -81,7 +88,7 @@ func (r *FirewallReconciler) SetupWithManager(mgr ctrl.Manager) error {
 
 // Reconcile reconciles a firewall by:
 // - rendering nftables rules (changes in firewall networks)
-// - exposing local services (nftables exporter and node exporter) in the shoot cluster as services
+// - exposing local services (node exporter, nftables exporter and metrics endpoint) in the shoot cluster as services
 func (r *FirewallReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
 	r.Log.Info("reconciling firewall resource")
 
@@ -90,7 +97,7 @@ func (r *FirewallReconciler) Reconcile(ctx context.Context, req ctrl.Request) (c
 		if apierrors.IsNotFound(err) {
 			r.Log.Info("flushing k8s firewall rules")
 
-			defaultFw := nftables.NewFirewall(&firewallv2.Firewall{}, &firewallv1.ClusterwideNetworkPolicyList{}, &corev1.ServiceList{}, nil, logr.Discard(), r.Recorder)
+			defaultFw := nftables.NewFirewall(&firewallv2.Firewall{}, &firewallv1.ClusterwideNetworkPolicyList{}, &corev1.ServiceList{}, nil, logr.Discard(), r.Recorder, nftables.FirewallOptions{})
 
 			flushErr := defaultFw.Flush()
 			if flushErr != nil {
@@ -169,11 +176,28 @@ func (r *FirewallReconciler) reconcileFirewallServices(ctx context.Context, f *f
 			port:      nodeExporterPort,
 			namedPort: nodeExporterNamedPort,
 		},
-		{
-			name:      nftablesExporterService,
-			port:      nftablesExporterPort,
-			namedPort: nftablesExporterNamedPort,
-		},
+	}
+	var obsolete []string
+
+	nftablesExporter := firewallService{
+		name:      nftablesExporterService,
+		port:      nftablesExporterPort,
+		namedPort: nftablesExporterNamedPort,
+	}
+	if r.NftablesExporter {
+		services = append(services, nftablesExporter)
+	} else {
+		obsolete = append(obsolete, nftablesExporter.name)
+	}
+
+	if r.MetricsPort > 0 {
+		services = append(services, firewallService{
+			name:      metricsService,
+			port:      r.MetricsPort,
+			namedPort: metricsNamedPort,
+		})
+	} else {
+		obsolete = append(obsolete, metricsService)
 	}
 
 	var errs []error
@@ -183,10 +207,34 @@ func (r *FirewallReconciler) reconcileFirewallServices(ctx context.Context, f *f
 			errs = append(errs, err)
 		}
 	}
+	for _, name := range obsolete {
+		err := r.deleteFirewallService(ctx, name)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
 
 	return errors.Join(errs...)
 }
 
+// deleteFirewallService deletes a service and its endpoints which are not to be exposed at the firewall anymore.
+func (r *FirewallReconciler) deleteFirewallService(ctx context.Context, name string) error {
+	meta := metav1.ObjectMeta{Name: name, Namespace: firewallv1.ClusterwideNetworkPolicyNamespace}
+
+	err := r.ShootClient.Delete(ctx, &corev1.Service{ObjectMeta: meta})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("unable to delete service %s: %w", name, err)
+	}
+
+	//nolint:staticcheck // SA1019
+	err = r.ShootClient.Delete(ctx, &corev1.Endpoints{ObjectMeta: meta})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("unable to delete endpoints %s: %w", name, err)
+	}
+
+	return nil
+}
+
 // reconcileFirewallService reconciles a single service that is to be exposed at the firewall.
 func (r *FirewallReconciler) reconcileFirewallService(ctx context.Context, s firewallService, f *firewallv2.Firewall) error {
 	nn := types.NamespacedName{Name: s.name, Namespace: firewallv1.ClusterwideNetworkPolicyNamespace}
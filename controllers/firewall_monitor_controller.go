@@ -21,6 +21,13 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/predicate"
 )
 
+const (
+	// conntrackTableAvailable is the condition of the firewall monitor which reports the usage of the conntrack table
+	conntrackTableAvailable firewallv2.ConditionType = "ConntrackTableAvailable"
+	// conntrackUsageThreshold is the usage of the conntrack table from which on it is reported as exhausted
+	conntrackUsageThreshold = 0.9
+)
+
 // FirewallMonitorReconciler reconciles a firewall monitor object
 type FirewallMonitorReconciler struct {
 	ShootClient client.Client
@@ -34,6 +41,9 @@ type FirewallMonitorReconciler struct {
 	IDSEnabled bool
 	Interval   time.Duration
 
+	// Conntrack collects the conntrack statistics, they are not reported if nil
+	Conntrack *collector.ConntrackCollector
+
 	seedUpdated metav1.Time
 }
 
@@ -86,6 +96,16 @@ func (r *FirewallMonitorReconciler) Reconcile(ctx context.Context, req ctrl.Requ
 		}
 	}
 
+	var conntrackCondition *firewallv2.Condition
+	if r.Conntrack != nil {
+		stats, err := r.Conntrack.CollectConntrackStats()
+		if err != nil {
+			r.Log.Error(err, "unable to collect conntrack statistics")
+		}
+		condition := conntrackTableCondition(stats, err)
+		conntrackCondition = &condition
+	}
+
 	err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
 		mon := &firewallv2.FirewallMonitor{
 			ObjectMeta: metav1.ObjectMeta{
@@ -127,6 +147,10 @@ func (r *FirewallMonitorReconciler) Reconcile(ctx context.Context, req ctrl.Requ
 			mon.ControllerStatus.SeedUpdated = r.seedUpdated
 		}
 
+		if conntrackCondition != nil {
+			mon.Conditions.Set(*conntrackCondition)
+		}
+
 		err := r.ShootClient.Update(ctx, mon)
 		if err != nil {
 			return err
@@ -146,3 +170,15 @@ func (r *FirewallMonitorReconciler) Reconcile(ctx context.Context, req ctrl.Requ
 		RequeueAfter: r.Interval,
 	}, nil
 }
+
+// conntrackTableCondition reports whether the conntrack table has entries left for new connections
+func conntrackTableCondition(stats *collector.ConntrackStats, err error) firewallv2.Condition {
+	switch {
+	case err != nil:
+		return firewallv2.NewCondition(conntrackTableAvailable, firewallv2.ConditionUnknown, "Unknown", err.Error())
+	case stats.Usage() >= conntrackUsageThreshold:
+		return firewallv2.NewCondition(conntrackTableAvailable, firewallv2.ConditionFalse, "Exhausted", stats.String())
+	default:
+		return firewallv2.NewCondition(conntrackTableAvailable, firewallv2.ConditionTrue, "Available", stats.String())
+	}
+}
@@ -5,15 +5,19 @@ import (
 	"flag"
 	"fmt"
 	"log/slog"
+	"net"
 	"os"
+	"strconv"
 	"time"
 
 	"github.com/metal-stack/v"
 
 	"github.com/go-logr/logr"
+	dnsgo "github.com/miekg/dns"
 
 	corev1 "k8s.io/api/core/v1"
 	apiextensions "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/util/yaml"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
@@ -21,6 +25,7 @@ import (
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/cache"
 	controllerclient "sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
 	"sigs.k8s.io/controller-runtime/pkg/metrics/server"
 	"sigs.k8s.io/controller-runtime/pkg/webhook"
 
@@ -29,14 +34,21 @@ import (
 
 	firewallv1 "github.com/metal-stack/firewall-controller/v2/api/v1"
 	"github.com/metal-stack/firewall-controller/v2/controllers"
+	"github.com/metal-stack/firewall-controller/v2/pkg/collector"
+	"github.com/metal-stack/firewall-controller/v2/pkg/conntrack"
+	"github.com/metal-stack/firewall-controller/v2/pkg/dns"
 	"github.com/metal-stack/firewall-controller/v2/pkg/frr"
+	"github.com/metal-stack/firewall-controller/v2/pkg/nftables"
 	"github.com/metal-stack/firewall-controller/v2/pkg/sysctl"
+	"github.com/metal-stack/firewall-controller/v2/pkg/trafficcontrol"
 	"github.com/metal-stack/firewall-controller/v2/pkg/updater"
 	// +kubebuilder:scaffold:imports
 )
 
 const (
 	seedKubeconfigPath = "/etc/firewall-controller/.seed-kubeconfig"
+	// conntrackRefreshInterval is the interval the conntrack table is dumped at while its flows are needed
+	conntrackRefreshInterval = 30 * time.Second
 )
 
 var (
@@ -59,20 +71,35 @@ func main() {
 		logLevel             string
 		isVersion            bool
 		metricsAddr          string
+		healthProbeAddr      string
 		enableIDS            bool
 		enableSignatureCheck bool
 		hostsFile            string
 		firewallName         string
+		dnssecTrustAnchors   string
+		snatHashMode         string
+		rateLimitMode        string
+		egressPrefixLengths  nftables.EgressPrefixLengths
+		nftablesExporter     bool
+		conntrackTopTalkers  int
 		kubeconfigPath       = os.Getenv("KUBECONFIG")
 	)
 
 	flag.StringVar(&logLevel, "log-level", "info", "the log level of the controller")
 	flag.BoolVar(&isVersion, "v", false, "Show firewall-controller version")
 	flag.StringVar(&metricsAddr, "metrics-addr", ":8080", "The address the metric endpoint binds to.")
+	flag.StringVar(&healthProbeAddr, "health-probe-addr", ":8081", "The address the health and readiness endpoints bind to.")
 	flag.BoolVar(&enableIDS, "enable-IDS", true, "Set this to false to exclude IDS.")
 	flag.StringVar(&hostsFile, "hosts-file", "/etc/hosts", "The hosts file to manipulate for the droptailer.")
 	flag.BoolVar(&enableSignatureCheck, "enable-signature-check", true, "Set this to false to ignore signature checking.")
 	flag.StringVar(&firewallName, "firewall-name", "", "the name of the firewall resource in the seed cluster to reconcile (defaults to hostname)")
+	flag.StringVar(&dnssecTrustAnchors, "dnssec-trust-anchors", "", "path to a file with DS or DNSKEY records in zone file format, enables DNSSEC validation of the answers learned by the DNS proxy if set")
+	flag.StringVar(&snatHashMode, "snat-hash-mode", string(nftables.SNATHashModeProtocol), "how connections are distributed among multiple egress IPs of a network, one of protocol, source, destination or round-robin")
+	flag.StringVar(&rateLimitMode, "rate-limit-mode", string(nftables.RateLimitModeDrop), "how the traffic of a network over its rate limit is treated, either drop or shape to shape the traffic with tc and TrafficShaping resources")
+	flag.IntVar(&egressPrefixLengths.IPv4, "egress-ipv4-prefix-length", 0, "the prefix length the ipv4 egress ips are added with to the interfaces of the external networks, defaults to 32")
+	flag.IntVar(&egressPrefixLengths.IPv6, "egress-ipv6-prefix-length", 0, "the prefix length the ipv6 egress ips are added with to the interfaces of the external networks, defaults to 128")
+	flag.IntVar(&conntrackTopTalkers, "conntrack-top-talkers", 0, "the number of source and destination pairs with the most conntrack flows reported in the firewall monitor and as metrics, disabled with 0. Enabling it keeps the conntrack table dumped every 30s, the flows are counted for at most 10 times as many pairs to bound the memory")
+	flag.BoolVar(&nftablesExporter, "nftables-exporter", true, "Set this to false if the nftables metrics are only scraped from the metrics endpoint, the nftables-exporter is neither updated nor exposed then.")
 
 	if _, err := os.Stat(seedKubeconfigPath); err == nil || os.IsExist(err) {
 		// controller-runtime registered this flag already, so we can use it
@@ -124,6 +151,29 @@ func main() {
 		panic(err)
 	}
 
+	if err := nftables.SNATHashMode(snatHashMode).Validate(); err != nil {
+		l.Error("invalid snat hash mode", "error", err)
+		panic(err)
+	}
+	if err := nftables.RateLimitMode(rateLimitMode).Validate(); err != nil {
+		l.Error("invalid rate limit mode", "error", err)
+		panic(err)
+	}
+	if err := egressPrefixLengths.Validate(); err != nil {
+		l.Error("invalid egress prefix lengths", "error", err)
+		panic(err)
+	}
+
+	var trustAnchors []*dnsgo.DS
+	if dnssecTrustAnchors != "" {
+		trustAnchors, err = dns.LoadTrustAnchors(dnssecTrustAnchors)
+		if err != nil {
+			l.Error("unable to load dnssec trust anchors", "path", dnssecTrustAnchors, "error", err)
+			panic(err)
+		}
+		l.Info("dnssec validation of the dns proxy enabled", "trust-anchors", len(trustAnchors))
+	}
+
 	seedClient, err := controllerclient.New(seedConfig, controllerclient.Options{
 		Scheme: scheme,
 	})
@@ -204,7 +254,8 @@ func main() {
 		Metrics: server.Options{
 			BindAddress: "0",
 		},
-		LeaderElection: false,
+		HealthProbeBindAddress: healthProbeAddr,
+		LeaderElection:         false,
 	})
 	if err != nil {
 		l.Error("unable to create shoot manager", "error", err)
@@ -217,6 +268,39 @@ func main() {
 		panic(err)
 	}
 
+	// the conntrack table is dumped in the background, e.g. to keep expired IPs of FQDNs with established connections
+	flows := conntrack.NewTracker(ctrl.Log.WithName("conntrack-tracker"), conntrackRefreshInterval, conntrackTopTalkers)
+	if err = shootMgr.Add(flows); err != nil {
+		l.Error("unable to add conntrack tracker to shoot manager", "error", err)
+		panic(err)
+	}
+
+	// the DNS proxy runs as long as the shoot manager and is configured by the clusterwide network policy controller
+	dnsProxy := dns.NewDNSProxy(
+		shootMgr.GetClient(),
+		shootMgr.GetEventRecorderFor("DNSProxy"), // nolint:staticcheck
+		&firewallv2.FirewallMonitor{ObjectMeta: metav1.ObjectMeta{Name: firewallName, Namespace: firewallv2.FirewallShootNamespace}},
+		ctrl.Log.WithName("DNS proxy"),
+		trustAnchors,
+		flows,
+	)
+	if err = shootMgr.Add(dnsProxy); err != nil {
+		l.Error("unable to add dns proxy to shoot manager", "error", err)
+		panic(err)
+	}
+	if err = shootMgr.AddHealthzCheck("dns-proxy", dnsProxy.Healthz); err != nil {
+		l.Error("unable to add dns proxy health check", "error", err)
+		panic(err)
+	}
+	if err = shootMgr.AddReadyzCheck("dns-proxy", dnsProxy.Readyz); err != nil {
+		l.Error("unable to add dns proxy readiness check", "error", err)
+		panic(err)
+	}
+
+	// the top talkers are taken from the snapshots of the conntrack tracker, the table is not dumped for them separately
+	conntrackCollector := collector.NewConntrackCollector(ctrl.Log.WithName("conntrack"), flows, conntrackTopTalkers > 0)
+	metrics.Registry.MustRegister(conntrackCollector)
+
 	fwmReconciler := &controllers.FirewallMonitorReconciler{
 		ShootClient:  shootMgr.GetClient(),
 		Log:          ctrl.Log.WithName("controllers").WithName("FirewallMonitorReconciler"),
@@ -224,6 +308,7 @@ func main() {
 		IDSEnabled:   enableIDS,
 		FirewallName: firewallName,
 		Namespace:    firewallv2.FirewallShootNamespace,
+		Conntrack:    conntrackCollector,
 	}
 
 	frrVersion, err := frr.DetectVersion()
@@ -233,21 +318,26 @@ func main() {
 	}
 	l.Info("detected frr", "version", frrVersion.String())
 
-	updater := updater.New(ctrl.Log.WithName("updater"), shootMgr.GetEventRecorderFor("FirewallController")) // nolint:staticcheck
+	updater := updater.New(ctrl.Log.WithName("updater"), shootMgr.GetEventRecorderFor("FirewallController"), nftablesExporter) // nolint:staticcheck
+
+	// the nftables metrics are served on the metrics endpoint, the nftables-exporter is optional
+	metrics.Registry.MustRegister(collector.NewMetricsCollector(ctrl.Log.WithName("collector")))
 
 	// Firewall Reconciler
 	if err = (&controllers.FirewallReconciler{
-		SeedClient:      seedMgr.GetClient(),
-		ShootClient:     shootClient,
-		Log:             ctrl.Log.WithName("controllers").WithName("Firewall"),
-		Scheme:          scheme,
-		Namespace:       seedNamespace,
-		FirewallName:    firewallName,
-		Recorder:        shootMgr.GetEventRecorderFor("FirewallController"), // nolint:staticcheck
-		Updater:         updater,
-		SeedUpdatedFunc: fwmReconciler.SeedUpdated,
-		TokenUpdater:    accessTokenUpdater,
-		FrrVersion:      frrVersion,
+		SeedClient:       seedMgr.GetClient(),
+		ShootClient:      shootClient,
+		Log:              ctrl.Log.WithName("controllers").WithName("Firewall"),
+		Scheme:           scheme,
+		Namespace:        seedNamespace,
+		FirewallName:     firewallName,
+		Recorder:         shootMgr.GetEventRecorderFor("FirewallController"), // nolint:staticcheck
+		Updater:          updater,
+		SeedUpdatedFunc:  fwmReconciler.SeedUpdated,
+		TokenUpdater:     accessTokenUpdater,
+		FrrVersion:       frrVersion,
+		NftablesExporter: nftablesExporter,
+		MetricsPort:      metricsPort(metricsAddr),
 	}).SetupWithManager(seedMgr); err != nil {
 		l.Error("unable to create firewall controller", "error", err)
 		panic(err)
@@ -263,15 +353,25 @@ func main() {
 		panic(err)
 	}
 
+	var shaper *trafficcontrol.Shaper
+	if nftables.RateLimitMode(rateLimitMode) == nftables.RateLimitModeShape {
+		shaper = trafficcontrol.NewShaper(ctrl.Log.WithName("trafficcontrol"))
+	}
+
 	// ClusterwideNetworkPolicy Reconciler
 	if err = (&controllers.ClusterwideNetworkPolicyReconciler{
-		SeedClient:    seedMgr.GetClient(),
-		ShootClient:   shootMgr.GetClient(),
-		Log:           ctrl.Log.WithName("controllers").WithName("ClusterwideNetworkPolicy"),
-		Ctx:           ctx,
-		Recorder:      shootMgr.GetEventRecorderFor("FirewallController"), // nolint:staticcheck
-		FirewallName:  firewallName,
-		SeedNamespace: seedNamespace,
+		SeedClient:          seedMgr.GetClient(),
+		ShootClient:         shootMgr.GetClient(),
+		Log:                 ctrl.Log.WithName("controllers").WithName("ClusterwideNetworkPolicy"),
+		Ctx:                 ctx,
+		Recorder:            shootMgr.GetEventRecorderFor("FirewallController"), // nolint:staticcheck
+		FirewallName:        firewallName,
+		SeedNamespace:       seedNamespace,
+		DnsProxy:            dnsProxy,
+		SNATHashMode:        nftables.SNATHashMode(snatHashMode),
+		RateLimitMode:       nftables.RateLimitMode(rateLimitMode),
+		Shaper:              shaper,
+		EgressPrefixLengths: egressPrefixLengths,
 	}).SetupWithManager(shootMgr); err != nil {
 		l.Error("unable to create clusterwidenetworkpolicy controller", "error", err)
 		panic(err)
@@ -378,3 +478,16 @@ func getSeedNamespace(rawKubeconfig []byte) (string, error) {
 
 	return "", fmt.Errorf("unable to figure out seed namespace from kubeconfig")
 }
+
+// metricsPort returns the port of the metrics bind address, zero if the metrics endpoint is disabled
+func metricsPort(metricsAddr string) int32 {
+	_, port, err := net.SplitHostPort(metricsAddr)
+	if err != nil {
+		return 0
+	}
+	p, err := strconv.ParseInt(port, 10, 32)
+	if err != nil {
+		return 0
+	}
+	return int32(p)
+}
@@ -50,3 +50,22 @@ users:
 		})
 	}
 }
+
+func Test_metricsPort(t *testing.T) {
+	tests := []struct {
+		metricsAddr string
+		want        int32
+	}{
+		{metricsAddr: ":8080", want: 8080},
+		{metricsAddr: "127.0.0.1:2112", want: 2112},
+		{metricsAddr: "0", want: 0},
+		{metricsAddr: ":metrics", want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.metricsAddr, func(t *testing.T) {
+			if got := metricsPort(tt.metricsAddr); got != tt.want {
+				t.Errorf("metricsPort() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
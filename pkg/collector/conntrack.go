@@ -0,0 +1,275 @@
+package collector
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/go-logr/logr"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+
+	"github.com/metal-stack/firewall-controller/v2/pkg/conntrack"
+)
+
+// messages and attributes of the conntrack statistics, see include/uapi/linux/netfilter/nfnetlink_conntrack.h
+const (
+	ipctnlMsgCtGetStatsCPU = 4
+	ipctnlMsgCtGetStats    = 5
+
+	ctaStatsInsert       = 8
+	ctaStatsInsertFailed = 9
+	ctaStatsDrop         = 10
+	ctaStatsEarlyDrop    = 11
+
+	ctaStatsGlobalEntries    = 1
+	ctaStatsGlobalMaxEntries = 2
+)
+
+const conntrackSubsystem = "conntrack"
+
+var (
+	conntrackEntriesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, conntrackSubsystem, "entries"),
+		"Number of entries in the conntrack table.",
+		nil, nil,
+	)
+	conntrackMaxEntriesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, conntrackSubsystem, "max_entries"),
+		"Maximum number of entries in the conntrack table, i.e. nf_conntrack_max.",
+		nil, nil,
+	)
+	conntrackInsertsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, conntrackSubsystem, "inserts_total"),
+		"Number of entries inserted into the conntrack table.",
+		nil, nil,
+	)
+	conntrackInsertFailedDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, conntrackSubsystem, "insert_failed_total"),
+		"Number of entries which could not be inserted into the conntrack table.",
+		nil, nil,
+	)
+	conntrackDropsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, conntrackSubsystem, "drops_total"),
+		"Number of packets dropped because no entry could be inserted into the conntrack table.",
+		nil, nil,
+	)
+	conntrackEarlyDropsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, conntrackSubsystem, "early_drops_total"),
+		"Number of entries dropped from the full conntrack table to make room for new ones.",
+		nil, nil,
+	)
+	conntrackTopTalkerFlowsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, conntrackSubsystem, "top_talker_flows"),
+		"Number of flows in the conntrack table of the source and destination pairs with the most flows.",
+		[]string{"source", "destination"}, nil,
+	)
+)
+
+// ConntrackTalker is a pair of source and destination address with the number of its flows in the conntrack table
+type ConntrackTalker struct {
+	Source      string
+	Destination string
+	Flows       int
+}
+
+// ConntrackStats contains the usage of the conntrack table and its counters summed up over all cpus
+type ConntrackStats struct {
+	Entries      uint32
+	MaxEntries   uint32
+	Inserts      uint64
+	InsertFailed uint64
+	Drops        uint64
+	EarlyDrops   uint64
+	// TopTalkers are the source and destination pairs with the most flows in descending order
+	TopTalkers []ConntrackTalker
+}
+
+// Usage returns the ratio of the entries to the maximum number of entries of the conntrack table
+func (s *ConntrackStats) Usage() float64 {
+	if s.MaxEntries == 0 {
+		return 0
+	}
+	return float64(s.Entries) / float64(s.MaxEntries)
+}
+
+func (s *ConntrackStats) String() string {
+	result := fmt.Sprintf("%d of %d entries used (%.1f%%), %d inserts, %d failed inserts, %d drops, %d early drops",
+		s.Entries, s.MaxEntries, 100*s.Usage(), s.Inserts, s.InsertFailed, s.Drops, s.EarlyDrops)
+	if len(s.TopTalkers) == 0 {
+		return result
+	}
+	var talkers []string
+	for _, t := range s.TopTalkers {
+		talkers = append(talkers, fmt.Sprintf("%s -> %s: %d flows", t.Source, t.Destination, t.Flows))
+	}
+	return result + ", top talkers: " + strings.Join(talkers, ", ")
+}
+
+// conntrackConn are the netlink operations needed to collect the conntrack statistics, it is implemented by conntrackNetlink
+type conntrackConn interface {
+	// Stats returns the global statistics by attribute type
+	Stats() (map[uint16]uint32, error)
+	// CPUStats returns the statistics of every cpu by attribute type
+	CPUStats() ([]map[uint16]uint32, error)
+}
+
+// conntrackFlows returns the latest snapshot of the conntrack table, it is implemented by conntrack.Tracker
+type conntrackFlows interface {
+	Flows() *conntrack.Flows
+}
+
+// ConntrackCollector collects the statistics of the conntrack table via netlink.
+// The statistics of the last collection are exposed as prometheus metrics, as dumping the conntrack table is too expensive for every scrape.
+type ConntrackCollector struct {
+	log  logr.Logger
+	conn conntrackConn
+	// flows provides the top talkers of the snapshot shared with the DNS cache, they are not reported if nil
+	flows conntrackFlows
+
+	lock  sync.RWMutex
+	stats *ConntrackStats
+}
+
+// NewConntrackCollector creates a new collector for the conntrack statistics.
+// If reportTopTalkers is set, the top talkers of the snapshots of the tracker are reported, which keeps the tracker dumping the conntrack table.
+func NewConntrackCollector(log logr.Logger, tracker *conntrack.Tracker, reportTopTalkers bool) *ConntrackCollector {
+	c := &ConntrackCollector{
+		log:  log,
+		conn: conntrackNetlink{},
+	}
+	if reportTopTalkers {
+		c.flows = tracker
+	}
+	return c
+}
+
+// CollectConntrackStats reads the conntrack statistics and keeps them for the metrics
+func (c *ConntrackCollector) CollectConntrackStats() (*ConntrackStats, error) {
+	global, err := c.conn.Stats()
+	if err != nil {
+		return nil, fmt.Errorf("unable to read conntrack statistics: %w", err)
+	}
+	cpus, err := c.conn.CPUStats()
+	if err != nil {
+		return nil, fmt.Errorf("unable to read conntrack cpu statistics: %w", err)
+	}
+
+	stats := &ConntrackStats{
+		Entries:    global[ctaStatsGlobalEntries],
+		MaxEntries: global[ctaStatsGlobalMaxEntries],
+	}
+	for _, cpu := range cpus {
+		stats.Inserts += uint64(cpu[ctaStatsInsert])
+		stats.InsertFailed += uint64(cpu[ctaStatsInsertFailed])
+		stats.Drops += uint64(cpu[ctaStatsDrop])
+		stats.EarlyDrops += uint64(cpu[ctaStatsEarlyDrop])
+	}
+
+	// the top talkers are taken from the latest snapshot, they are missing until the table was dumped once
+	if c.flows != nil {
+		if flows := c.flows.Flows(); flows != nil {
+			for _, t := range flows.TopTalkers {
+				stats.TopTalkers = append(stats.TopTalkers, ConntrackTalker{Source: t.Source.String(), Destination: t.Destination.String(), Flows: t.Flows})
+			}
+		}
+	}
+
+	c.lock.Lock()
+	c.stats = stats
+	c.lock.Unlock()
+
+	return stats, nil
+}
+
+// Describe implements prometheus.Collector
+func (c *ConntrackCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- conntrackEntriesDesc
+	ch <- conntrackMaxEntriesDesc
+	ch <- conntrackInsertsDesc
+	ch <- conntrackInsertFailedDesc
+	ch <- conntrackDropsDesc
+	ch <- conntrackEarlyDropsDesc
+	ch <- conntrackTopTalkerFlowsDesc
+}
+
+// Collect implements prometheus.Collector, nothing is reported until the statistics were collected once
+func (c *ConntrackCollector) Collect(ch chan<- prometheus.Metric) {
+	c.lock.RLock()
+	s := c.stats
+	c.lock.RUnlock()
+	if s == nil {
+		return
+	}
+
+	ch <- prometheus.MustNewConstMetric(conntrackEntriesDesc, prometheus.GaugeValue, float64(s.Entries))
+	ch <- prometheus.MustNewConstMetric(conntrackMaxEntriesDesc, prometheus.GaugeValue, float64(s.MaxEntries))
+	ch <- prometheus.MustNewConstMetric(conntrackInsertsDesc, prometheus.CounterValue, float64(s.Inserts))
+	ch <- prometheus.MustNewConstMetric(conntrackInsertFailedDesc, prometheus.CounterValue, float64(s.InsertFailed))
+	ch <- prometheus.MustNewConstMetric(conntrackDropsDesc, prometheus.CounterValue, float64(s.Drops))
+	ch <- prometheus.MustNewConstMetric(conntrackEarlyDropsDesc, prometheus.CounterValue, float64(s.EarlyDrops))
+	for _, t := range s.TopTalkers {
+		ch <- prometheus.MustNewConstMetric(conntrackTopTalkerFlowsDesc, prometheus.GaugeValue, float64(t.Flows), t.Source, t.Destination)
+	}
+}
+
+// conntrackNetlink reads the conntrack statistics with ctnetlink, which is not covered by the netlink library
+type conntrackNetlink struct{}
+
+func (conntrackNetlink) Stats() (map[uint16]uint32, error) {
+	msgs, err := conntrackRequest(ipctnlMsgCtGetStats, 0)
+	if err != nil {
+		return nil, err
+	}
+	if len(msgs) == 0 {
+		return nil, fmt.Errorf("no conntrack statistics received")
+	}
+	return parseConntrackStats(msgs[0])
+}
+
+func (conntrackNetlink) CPUStats() ([]map[uint16]uint32, error) {
+	msgs, err := conntrackRequest(ipctnlMsgCtGetStatsCPU, syscall.NLM_F_DUMP)
+	if err != nil {
+		return nil, err
+	}
+	var result []map[uint16]uint32
+	for _, msg := range msgs {
+		stats, err := parseConntrackStats(msg)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, stats)
+	}
+	return result, nil
+}
+
+func conntrackRequest(msgType, flags int) ([][]byte, error) {
+	req := nl.NewNetlinkRequest(netlink.ConntrackTable<<8|msgType, flags)
+	req.AddData(&nl.Nfgenmsg{
+		NfgenFamily: syscall.AF_UNSPEC,
+		Version:     nl.NFNETLINK_V0,
+	})
+	return req.Execute(syscall.NETLINK_NETFILTER, 0)
+}
+
+// parseConntrackStats parses the attributes of a statistics message, all of them are 32 bit counters in network byte order
+func parseConntrackStats(msg []byte) (map[uint16]uint32, error) {
+	if len(msg) < nl.SizeofNfgenmsg {
+		return nil, fmt.Errorf("conntrack statistics message too short: %d bytes", len(msg))
+	}
+	attrs, err := nl.ParseRouteAttr(msg[nl.SizeofNfgenmsg:])
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse conntrack statistics: %w", err)
+	}
+	stats := map[uint16]uint32{}
+	for _, a := range attrs {
+		if len(a.Value) < 4 {
+			continue
+		}
+		stats[a.Attr.Type&nl.NLA_TYPE_MASK] = binary.BigEndian.Uint32(a.Value)
+	}
+	return stats, nil
+}
@@ -0,0 +1,143 @@
+package collector
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/google/go-cmp/cmp"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/metal-stack/firewall-controller/v2/pkg/conntrack"
+)
+
+type fakeConntrackConn struct {
+	stats    map[uint16]uint32
+	cpuStats []map[uint16]uint32
+}
+
+func (f *fakeConntrackConn) Stats() (map[uint16]uint32, error)      { return f.stats, nil }
+func (f *fakeConntrackConn) CPUStats() ([]map[uint16]uint32, error) { return f.cpuStats, nil }
+
+type fakeConntrackFlows struct {
+	flows *conntrack.Flows
+}
+
+func (f *fakeConntrackFlows) Flows() *conntrack.Flows { return f.flows }
+
+func talker(src, dst string, flows int) conntrack.Talker {
+	return conntrack.Talker{Source: netip.MustParseAddr(src), Destination: netip.MustParseAddr(dst), Flows: flows}
+}
+
+func TestConntrackCollector(t *testing.T) {
+	conn := &fakeConntrackConn{
+		stats: map[uint16]uint32{ctaStatsGlobalEntries: 1000, ctaStatsGlobalMaxEntries: 4000},
+		cpuStats: []map[uint16]uint32{
+			{ctaStatsInsert: 10, ctaStatsInsertFailed: 1, ctaStatsDrop: 2, ctaStatsEarlyDrop: 3},
+			{ctaStatsInsert: 20, ctaStatsDrop: 1},
+		},
+	}
+	flows := &fakeConntrackFlows{}
+	c := &ConntrackCollector{log: logr.Discard(), conn: conn, flows: flows}
+
+	if err := testutil.CollectAndCompare(c, strings.NewReader("")); err != nil {
+		t.Errorf("expected no metrics before the first collection: %v", err)
+	}
+
+	stats, err := c.CollectConntrackStats()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if stats.TopTalkers != nil {
+		t.Errorf("expected no top talkers before the conntrack table was dumped, got %v", stats.TopTalkers)
+	}
+
+	flows.flows = &conntrack.Flows{TopTalkers: []conntrack.Talker{
+		talker("2001:db8::1", "2001:db8::2", 3),
+		talker("10.0.0.1", "1.1.1.1", 2),
+		talker("10.0.0.2", "8.8.8.8", 2),
+	}}
+	stats, err = c.CollectConntrackStats()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := &ConntrackStats{
+		Entries:      1000,
+		MaxEntries:   4000,
+		Inserts:      30,
+		InsertFailed: 1,
+		Drops:        3,
+		EarlyDrops:   3,
+		TopTalkers: []ConntrackTalker{
+			{Source: "2001:db8::1", Destination: "2001:db8::2", Flows: 3},
+			{Source: "10.0.0.1", Destination: "1.1.1.1", Flows: 2},
+			{Source: "10.0.0.2", Destination: "8.8.8.8", Flows: 2},
+		},
+	}
+	if diff := cmp.Diff(want, stats); diff != "" {
+		t.Errorf("CollectConntrackStats() diff: %v", diff)
+	}
+
+	wantString := "1000 of 4000 entries used (25.0%), 30 inserts, 1 failed inserts, 3 drops, 3 early drops, " +
+		"top talkers: 2001:db8::1 -> 2001:db8::2: 3 flows, 10.0.0.1 -> 1.1.1.1: 2 flows, 10.0.0.2 -> 8.8.8.8: 2 flows"
+	if got := stats.String(); got != wantString {
+		t.Errorf("String() = %q, want %q", got, wantString)
+	}
+
+	wantMetrics := `
+# HELP firewall_controller_conntrack_drops_total Number of packets dropped because no entry could be inserted into the conntrack table.
+# TYPE firewall_controller_conntrack_drops_total counter
+firewall_controller_conntrack_drops_total 3
+# HELP firewall_controller_conntrack_early_drops_total Number of entries dropped from the full conntrack table to make room for new ones.
+# TYPE firewall_controller_conntrack_early_drops_total counter
+firewall_controller_conntrack_early_drops_total 3
+# HELP firewall_controller_conntrack_entries Number of entries in the conntrack table.
+# TYPE firewall_controller_conntrack_entries gauge
+firewall_controller_conntrack_entries 1000
+# HELP firewall_controller_conntrack_insert_failed_total Number of entries which could not be inserted into the conntrack table.
+# TYPE firewall_controller_conntrack_insert_failed_total counter
+firewall_controller_conntrack_insert_failed_total 1
+# HELP firewall_controller_conntrack_inserts_total Number of entries inserted into the conntrack table.
+# TYPE firewall_controller_conntrack_inserts_total counter
+firewall_controller_conntrack_inserts_total 30
+# HELP firewall_controller_conntrack_max_entries Maximum number of entries in the conntrack table, i.e. nf_conntrack_max.
+# TYPE firewall_controller_conntrack_max_entries gauge
+firewall_controller_conntrack_max_entries 4000
+# HELP firewall_controller_conntrack_top_talker_flows Number of flows in the conntrack table of the source and destination pairs with the most flows.
+# TYPE firewall_controller_conntrack_top_talker_flows gauge
+firewall_controller_conntrack_top_talker_flows{destination="1.1.1.1",source="10.0.0.1"} 2
+firewall_controller_conntrack_top_talker_flows{destination="2001:db8::2",source="2001:db8::1"} 3
+firewall_controller_conntrack_top_talker_flows{destination="8.8.8.8",source="10.0.0.2"} 2
+`
+	if err := testutil.CollectAndCompare(c, strings.NewReader(wantMetrics)); err != nil {
+		t.Errorf("unexpected metrics: %v", err)
+	}
+}
+
+func TestParseConntrackStats(t *testing.T) {
+	attr := func(typ uint16, value uint32) []byte {
+		b := make([]byte, 8)
+		binary.NativeEndian.PutUint16(b[0:], 8)
+		binary.NativeEndian.PutUint16(b[2:], typ)
+		binary.BigEndian.PutUint32(b[4:], value)
+		return b
+	}
+	msg := []byte{0, 0, 0, 1} // nfgenmsg of cpu 1
+	msg = append(msg, attr(ctaStatsInsert, 42)...)
+	msg = append(msg, attr(ctaStatsEarlyDrop, 7)...)
+
+	got, err := parseConntrackStats(msg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if diff := cmp.Diff(map[uint16]uint32{ctaStatsInsert: 42, ctaStatsEarlyDrop: 7}, got); diff != "" {
+		t.Errorf("parseConntrackStats() diff: %v", diff)
+	}
+
+	if _, err := parseConntrackStats([]byte{0}); err == nil {
+		t.Errorf("expected an error for a truncated message")
+	}
+}
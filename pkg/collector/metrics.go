@@ -0,0 +1,191 @@
+package collector
+
+import (
+	"strings"
+
+	"github.com/go-logr/logr"
+	"github.com/google/nftables"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	metricsNamespace = "firewall_controller"
+	metricsSubsystem = "nftables"
+)
+
+var (
+	counterBytesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, metricsSubsystem, "counter_bytes_total"),
+		"Bytes counted by a named nftables counter, e.g. internal_in, external_out, drop_total or drop_ratelimit.",
+		[]string{"name"}, nil,
+	)
+	counterPacketsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, metricsSubsystem, "counter_packets_total"),
+		"Packets counted by a named nftables counter, e.g. internal_in, external_out, drop_total or drop_ratelimit.",
+		[]string{"name"}, nil,
+	)
+	ruleBytesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, metricsSubsystem, "rule_bytes_total"),
+		"Bytes counted by the nftables rules with a counter, summed up by chain, comment and action.",
+		[]string{"chain", "comment", "policy", "action"}, nil,
+	)
+	rulePacketsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, metricsSubsystem, "rule_packets_total"),
+		"Packets counted by the nftables rules with a counter, summed up by chain, comment and action.",
+		[]string{"chain", "comment", "policy", "action"}, nil,
+	)
+	setElementsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, metricsSubsystem, "set_elements"),
+		"Number of elements of a nftables set.",
+		[]string{"set"}, nil,
+	)
+
+	// policyCommentPrefixes are the prefixes of the comments of the rules rendered for a ClusterwideNetworkPolicy, followed by its name
+	policyCommentPrefixes = []string{
+		"accept traffic for k8s network policy ",
+		"accept traffic for np ",
+	}
+)
+
+// nftablesConn are the nftables operations needed to collect the metrics, it is implemented by nftables.Conn
+type nftablesConn interface {
+	ListChains() ([]*nftables.Chain, error)
+	GetRules(t *nftables.Table, c *nftables.Chain) ([]*nftables.Rule, error)
+	GetObjects(t *nftables.Table) ([]nftables.Obj, error)
+	GetSets(t *nftables.Table) ([]*nftables.Set, error)
+	GetSetElements(s *nftables.Set) ([]nftables.SetElement, error)
+}
+
+// MetricsCollector exposes the counters and sets of the nftables firewall table as prometheus metrics,
+// such that no separate nftables-exporter is needed.
+type MetricsCollector struct {
+	log  logr.Logger
+	conn nftablesConn
+}
+
+// NewMetricsCollector creates a new prometheus collector for the nftables firewall table
+func NewMetricsCollector(log logr.Logger) *MetricsCollector {
+	return &MetricsCollector{
+		log:  log,
+		conn: &nftables.Conn{},
+	}
+}
+
+// Describe implements prometheus.Collector
+func (m *MetricsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- counterBytesDesc
+	ch <- counterPacketsDesc
+	ch <- ruleBytesDesc
+	ch <- rulePacketsDesc
+	ch <- setElementsDesc
+}
+
+// Collect implements prometheus.Collector, the metrics of the parts of the table which can't be read are skipped
+func (m *MetricsCollector) Collect(ch chan<- prometheus.Metric) {
+	table := &nftables.Table{Family: nftables.TableFamilyINet, Name: tableName}
+
+	m.collectCounters(ch, table)
+	m.collectRules(ch, table)
+	m.collectSets(ch, table)
+}
+
+func (m *MetricsCollector) collectCounters(ch chan<- prometheus.Metric, table *nftables.Table) {
+	objs, err := m.conn.GetObjects(table)
+	if err != nil {
+		m.log.Error(err, "unable to collect nftables counters")
+		return
+	}
+	for _, o := range objs {
+		c, ok := o.(*nftables.CounterObj)
+		if !ok {
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(counterBytesDesc, prometheus.CounterValue, float64(c.Bytes), c.Name)
+		ch <- prometheus.MustNewConstMetric(counterPacketsDesc, prometheus.CounterValue, float64(c.Packets), c.Name)
+	}
+}
+
+func (m *MetricsCollector) collectRules(ch chan<- prometheus.Metric, table *nftables.Table) {
+	chains, err := m.conn.ListChains()
+	if err != nil {
+		m.log.Error(err, "unable to collect nftables chains")
+		return
+	}
+
+	type ruleLabels struct {
+		chain, comment, policy, action string
+	}
+	// rules rendered from the same resource share their comment, their counters are summed up as the labels must be unique
+	var (
+		labels   []ruleLabels
+		counters = map[ruleLabels]*ruleInfo{}
+	)
+	for _, chain := range chains {
+		if chain.Table == nil || chain.Table.Name != table.Name || chain.Table.Family != table.Family {
+			continue
+		}
+		rules, err := m.conn.GetRules(chain.Table, chain)
+		if err != nil {
+			m.log.Error(err, "unable to collect nftables rules", "chain", chain.Name)
+			continue
+		}
+		for _, r := range rules {
+			ri := extractRuleInfo(r)
+			if ri == nil {
+				continue
+			}
+			l := ruleLabels{chain: chain.Name, comment: ri.comment, policy: policyOfComment(ri.comment), action: ri.action}
+			sum, ok := counters[l]
+			if !ok {
+				labels = append(labels, l)
+				counters[l] = ri
+				continue
+			}
+			sum.counter.Bytes += ri.counter.Bytes
+			sum.counter.Packets += ri.counter.Packets
+		}
+	}
+
+	for _, l := range labels {
+		c := counters[l].counter
+		ch <- prometheus.MustNewConstMetric(ruleBytesDesc, prometheus.CounterValue, float64(c.Bytes), l.chain, l.comment, l.policy, l.action)
+		ch <- prometheus.MustNewConstMetric(rulePacketsDesc, prometheus.CounterValue, float64(c.Packets), l.chain, l.comment, l.policy, l.action)
+	}
+}
+
+func (m *MetricsCollector) collectSets(ch chan<- prometheus.Metric, table *nftables.Table) {
+	sets, err := m.conn.GetSets(table)
+	if err != nil {
+		m.log.Error(err, "unable to collect nftables sets")
+		return
+	}
+	for _, s := range sets {
+		elements, err := m.conn.GetSetElements(s)
+		if err != nil {
+			m.log.Error(err, "unable to collect nftables set elements", "set", s.Name)
+			continue
+		}
+		count := 0
+		for _, e := range elements {
+			// the end of an interval is a separate element
+			if e.IntervalEnd {
+				continue
+			}
+			count++
+		}
+		ch <- prometheus.MustNewConstMetric(setElementsDesc, prometheus.GaugeValue, float64(count), s.Name)
+	}
+}
+
+// policyOfComment returns the name of the ClusterwideNetworkPolicy a rule was rendered for, if any
+func policyOfComment(comment string) string {
+	for _, prefix := range policyCommentPrefixes {
+		name, ok := strings.CutPrefix(comment, prefix)
+		if !ok {
+			continue
+		}
+		name, _, _ = strings.Cut(name, " ")
+		return name
+	}
+	return ""
+}
@@ -0,0 +1,114 @@
+package collector
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// fakeConn returns the objects of a single firewall table
+type fakeConn struct {
+	chains   []*nftables.Chain
+	rules    map[string][]*nftables.Rule
+	objs     []nftables.Obj
+	sets     []*nftables.Set
+	elements map[string][]nftables.SetElement
+}
+
+func (f *fakeConn) ListChains() ([]*nftables.Chain, error) { return f.chains, nil }
+func (f *fakeConn) GetRules(_ *nftables.Table, c *nftables.Chain) ([]*nftables.Rule, error) {
+	return f.rules[c.Name], nil
+}
+func (f *fakeConn) GetObjects(_ *nftables.Table) ([]nftables.Obj, error) { return f.objs, nil }
+func (f *fakeConn) GetSets(_ *nftables.Table) ([]*nftables.Set, error)   { return f.sets, nil }
+func (f *fakeConn) GetSetElements(s *nftables.Set) ([]nftables.SetElement, error) {
+	return f.elements[s.Name], nil
+}
+
+func rule(comment string, bytes, packets uint64, verdict expr.VerdictKind) *nftables.Rule {
+	return &nftables.Rule{
+		UserData: append([]byte{0, byte(len(comment) + 1)}, append([]byte(comment), 0)...),
+		Exprs: []expr.Any{
+			&expr.Counter{Bytes: bytes, Packets: packets},
+			&expr.Verdict{Kind: verdict},
+		},
+	}
+}
+
+func TestMetricsCollector(t *testing.T) {
+	var (
+		firewall = &nftables.Table{Family: nftables.TableFamilyINet, Name: "firewall"}
+		other    = &nftables.Table{Family: nftables.TableFamilyINet, Name: "nat"}
+	)
+	conn := &fakeConn{
+		chains: []*nftables.Chain{
+			{Name: "forward", Table: firewall},
+			{Name: "postrouting", Table: other},
+		},
+		rules: map[string][]*nftables.Rule{
+			"forward": {
+				rule("accept traffic for k8s network policy backup tcp", 100, 1, expr.VerdictAccept),
+				rule("accept traffic for k8s network policy backup tcp", 50, 2, expr.VerdictAccept),
+				rule("drop ping floods", 10, 3, expr.VerdictDrop),
+				{UserData: []byte{0, 1, 0}, Exprs: []expr.Any{&expr.Verdict{Kind: expr.VerdictAccept}}},
+			},
+			"postrouting": {
+				rule("snat for internet", 1000, 10, expr.VerdictAccept),
+			},
+		},
+		objs: []nftables.Obj{
+			&nftables.CounterObj{Table: firewall, Name: "drop_total", Bytes: 300, Packets: 3},
+			&nftables.CounterObj{Table: firewall, Name: "drop_ratelimit", Bytes: 200, Packets: 2},
+		},
+		sets: []*nftables.Set{{Table: firewall, Name: "internal_prefixes"}, {Table: firewall, Name: "fqdn_test"}},
+		elements: map[string][]nftables.SetElement{
+			"internal_prefixes": {{Key: []byte{10, 0, 0, 0}}, {Key: []byte{11, 0, 0, 0}, IntervalEnd: true}},
+			"fqdn_test":         {{Key: []byte{1, 2, 3, 4}}, {Key: []byte{1, 2, 3, 5}}},
+		},
+	}
+	m := &MetricsCollector{log: logr.Discard(), conn: conn}
+
+	want := `
+# HELP firewall_controller_nftables_counter_bytes_total Bytes counted by a named nftables counter, e.g. internal_in, external_out, drop_total or drop_ratelimit.
+# TYPE firewall_controller_nftables_counter_bytes_total counter
+firewall_controller_nftables_counter_bytes_total{name="drop_ratelimit"} 200
+firewall_controller_nftables_counter_bytes_total{name="drop_total"} 300
+# HELP firewall_controller_nftables_counter_packets_total Packets counted by a named nftables counter, e.g. internal_in, external_out, drop_total or drop_ratelimit.
+# TYPE firewall_controller_nftables_counter_packets_total counter
+firewall_controller_nftables_counter_packets_total{name="drop_ratelimit"} 2
+firewall_controller_nftables_counter_packets_total{name="drop_total"} 3
+# HELP firewall_controller_nftables_rule_bytes_total Bytes counted by the nftables rules with a counter, summed up by chain, comment and action.
+# TYPE firewall_controller_nftables_rule_bytes_total counter
+firewall_controller_nftables_rule_bytes_total{action="accept",chain="forward",comment="accept traffic for k8s network policy backup tcp",policy="backup"} 150
+firewall_controller_nftables_rule_bytes_total{action="drop",chain="forward",comment="drop ping floods",policy=""} 10
+# HELP firewall_controller_nftables_rule_packets_total Packets counted by the nftables rules with a counter, summed up by chain, comment and action.
+# TYPE firewall_controller_nftables_rule_packets_total counter
+firewall_controller_nftables_rule_packets_total{action="accept",chain="forward",comment="accept traffic for k8s network policy backup tcp",policy="backup"} 3
+firewall_controller_nftables_rule_packets_total{action="drop",chain="forward",comment="drop ping floods",policy=""} 3
+# HELP firewall_controller_nftables_set_elements Number of elements of a nftables set.
+# TYPE firewall_controller_nftables_set_elements gauge
+firewall_controller_nftables_set_elements{set="fqdn_test"} 2
+firewall_controller_nftables_set_elements{set="internal_prefixes"} 1
+`
+	if err := testutil.CollectAndCompare(m, strings.NewReader(want)); err != nil {
+		t.Errorf("unexpected metrics: %v", err)
+	}
+}
+
+func TestPolicyOfComment(t *testing.T) {
+	tests := map[string]string{
+		"accept traffic for k8s network policy backup tcp": "backup",
+		"accept traffic for np web udp, fqdn: test.com":    "web",
+		"accept traffic for k8s service test/svc":          "",
+		"drop ping floods": "",
+	}
+	for comment, want := range tests {
+		if got := policyOfComment(comment); got != want {
+			t.Errorf("policyOfComment(%q) = %q, want %q", comment, got, want)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package conntrack
+
+import (
+	"fmt"
+	"net/netip"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+)
+
+// attributes of the conntrack entries, see include/uapi/linux/netfilter/nfnetlink_conntrack.h
+const (
+	ctaTupleOrig = 1
+	ctaProtoinfo = 4
+
+	ctaTupleIP = 1
+
+	ctaIPv4Src = 1
+	ctaIPv4Dst = 2
+	ctaIPv6Src = 3
+	ctaIPv6Dst = 4
+
+	ctaProtoinfoTCP      = 1
+	ctaProtoinfoTCPState = 1
+)
+
+// flow contains the parts of a conntrack entry needed for the snapshots
+type flow struct {
+	source      netip.Addr
+	destination netip.Addr
+	// tcp is set for tcp flows, which have a connection state
+	tcp      bool
+	tcpState uint8
+}
+
+func (f flow) established() bool {
+	return !f.tcp || f.tcpState == nl.TCP_CONNTRACK_ESTABLISHED
+}
+
+// dumpTable streams the conntrack table of all families and calls fn for every flow.
+// Unlike netlink.ConntrackTableList the flows are not collected, such that the memory does not grow with the size of the table.
+func dumpTable(fn func(flow)) error {
+	req := nl.NewNetlinkRequest(netlink.ConntrackTable<<8|nl.IPCTNL_MSG_CT_GET, syscall.NLM_F_DUMP)
+	req.AddData(&nl.Nfgenmsg{
+		NfgenFamily: syscall.AF_UNSPEC,
+		Version:     nl.NFNETLINK_V0,
+	})
+
+	return req.ExecuteIter(syscall.NETLINK_NETFILTER, 0, func(msg []byte) bool {
+		f, err := parseFlow(msg)
+		if err != nil {
+			// entries which can't be parsed are skipped, they do not affect the others
+			return true
+		}
+		fn(f)
+		return true
+	})
+}
+
+// parseFlow parses the addresses of the original direction and the tcp state of a conntrack entry
+func parseFlow(msg []byte) (flow, error) {
+	var f flow
+
+	if len(msg) < nl.SizeofNfgenmsg {
+		return f, fmt.Errorf("conntrack message too short: %d bytes", len(msg))
+	}
+	attrs, err := nl.ParseRouteAttr(msg[nl.SizeofNfgenmsg:])
+	if err != nil {
+		return f, err
+	}
+
+	for _, a := range attrs {
+		switch a.Attr.Type & nl.NLA_TYPE_MASK {
+		case ctaTupleOrig:
+			ips, err := nestedAttr(a.Value, ctaTupleIP)
+			if err != nil {
+				return f, err
+			}
+			ipAttrs, err := nl.ParseRouteAttr(ips)
+			if err != nil {
+				return f, err
+			}
+			for _, ip := range ipAttrs {
+				addr, ok := netip.AddrFromSlice(ip.Value)
+				if !ok {
+					continue
+				}
+				switch ip.Attr.Type & nl.NLA_TYPE_MASK {
+				case ctaIPv4Src, ctaIPv6Src:
+					f.source = addr
+				case ctaIPv4Dst, ctaIPv6Dst:
+					f.destination = addr
+				}
+			}
+		case ctaProtoinfo:
+			tcp, err := nestedAttr(a.Value, ctaProtoinfoTCP)
+			if err != nil || tcp == nil {
+				continue
+			}
+			state, err := nestedAttr(tcp, ctaProtoinfoTCPState)
+			if err != nil || len(state) != 1 {
+				continue
+			}
+			f.tcp = true
+			f.tcpState = state[0]
+		}
+	}
+
+	if !f.source.IsValid() || !f.destination.IsValid() {
+		return f, fmt.Errorf("conntrack entry without addresses")
+	}
+	return f, nil
+}
+
+// nestedAttr returns the value of the attribute of the given type within a nested attribute, nil if it is missing
+func nestedAttr(b []byte, attrType uint16) ([]byte, error) {
+	attrs, err := nl.ParseRouteAttr(b)
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range attrs {
+		if a.Attr.Type&nl.NLA_TYPE_MASK == attrType {
+			return a.Value, nil
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,105 @@
+package conntrack
+
+import (
+	"cmp"
+	"container/heap"
+	"net/netip"
+	"slices"
+)
+
+// talkerCounterFactor is the number of pairs counted per top talker, more pairs make the counts of the top talkers more accurate
+const talkerCounterFactor = 10
+
+type pair [2]netip.Addr
+
+type pairCount struct {
+	pair  pair
+	count int
+	index int
+}
+
+// talkerCounter counts the flows of the source and destination pairs with the Space-Saving algorithm, such that its memory is bounded.
+// If all pairs are counted, a new pair replaces the pair with the least flows and takes over its count.
+// So the counts may be overestimated by the count of the replaced pair, but every pair with more flows than that is counted.
+type talkerCounter struct {
+	capacity int
+	pairs    map[pair]*pairCount
+	// least is a min heap of the counts
+	least pairCountHeap
+}
+
+func newTalkerCounter(topTalkers int) *talkerCounter {
+	capacity := topTalkers * talkerCounterFactor
+	return &talkerCounter{
+		capacity: capacity,
+		pairs:    make(map[pair]*pairCount, capacity),
+	}
+}
+
+func (c *talkerCounter) add(source, destination netip.Addr) {
+	p := pair{source, destination}
+
+	if pc, ok := c.pairs[p]; ok {
+		pc.count++
+		heap.Fix(&c.least, pc.index)
+		return
+	}
+
+	if len(c.least) < c.capacity {
+		pc := &pairCount{pair: p, count: 1}
+		heap.Push(&c.least, pc)
+		c.pairs[p] = pc
+		return
+	}
+
+	pc := c.least[0]
+	delete(c.pairs, pc.pair)
+	pc.pair = p
+	pc.count++
+	c.pairs[p] = pc
+	heap.Fix(&c.least, 0)
+}
+
+// top returns the n pairs with the most flows
+func (c *talkerCounter) top(n int) []Talker {
+	var talkers []Talker
+	for _, pc := range c.least {
+		talkers = append(talkers, Talker{Source: pc.pair[0], Destination: pc.pair[1], Flows: pc.count})
+	}
+	slices.SortFunc(talkers, func(a, b Talker) int {
+		return cmp.Or(
+			cmp.Compare(b.Flows, a.Flows),
+			a.Source.Compare(b.Source),
+			a.Destination.Compare(b.Destination),
+		)
+	})
+
+	if len(talkers) > n {
+		talkers = talkers[:n]
+	}
+	return talkers
+}
+
+// pairCountHeap implements heap.Interface ordered by the count
+type pairCountHeap []*pairCount
+
+func (h pairCountHeap) Len() int           { return len(h) }
+func (h pairCountHeap) Less(i, j int) bool { return h[i].count < h[j].count }
+func (h pairCountHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *pairCountHeap) Push(x any) {
+	pc := x.(*pairCount)
+	pc.index = len(*h)
+	*h = append(*h, pc)
+}
+
+func (h *pairCountHeap) Pop() any {
+	old := *h
+	pc := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return pc
+}
@@ -0,0 +1,42 @@
+package conntrack
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestTalkerCounter(t *testing.T) {
+	var (
+		c       = newTalkerCounter(3)
+		source  = netip.MustParseAddr("10.0.0.1")
+		heavy   = []netip.Addr{netip.MustParseAddr("1.1.1.1"), netip.MustParseAddr("2.2.2.2"), netip.MustParseAddr("3.3.3.3")}
+		another = netip.MustParseAddr("203.0.113.0")
+	)
+
+	// the pairs with the most flows are interleaved with many pairs with a single flow
+	for i := range 10000 {
+		c.add(source, heavy[i%len(heavy)])
+		another = another.Next()
+		c.add(source, another)
+	}
+
+	if len(c.pairs) > 3*talkerCounterFactor || len(c.least) > 3*talkerCounterFactor {
+		t.Errorf("expected at most %d counted pairs, got %d", 3*talkerCounterFactor, len(c.pairs))
+	}
+
+	var got []netip.Addr
+	for _, talker := range c.top(3) {
+		if talker.Source != source {
+			t.Errorf("unexpected source %s", talker.Source)
+		}
+		if talker.Flows < 10000/len(heavy) {
+			t.Errorf("expected at least %d flows for %s, got %d", 10000/len(heavy), talker.Destination, talker.Flows)
+		}
+		got = append(got, talker.Destination)
+	}
+	if diff := cmp.Diff(heavy, got, cmp.Comparer(func(a, b netip.Addr) bool { return a == b })); diff != "" {
+		t.Errorf("top() diff: %v", diff)
+	}
+}
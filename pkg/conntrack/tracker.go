@@ -0,0 +1,148 @@
+package conntrack
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/vishvananda/netlink"
+)
+
+// Flows is a snapshot of the flows in the conntrack table
+type Flows struct {
+	// Time is the time of the dump of the table
+	Time time.Time
+	// TopTalkers are the source and destination pairs with the most flows in descending order, only counted if enabled for the tracker.
+	// The flows are counted with a bounded number of pairs, so they can be overestimated if there are many pairs with few flows.
+	TopTalkers []Talker
+	// established are the destinations of the original direction with an established flow
+	established map[netip.Addr]struct{}
+}
+
+// Talker is a source and destination pair of the original direction with the number of its flows
+type Talker struct {
+	Source      netip.Addr
+	Destination netip.Addr
+	Flows       int
+}
+
+// HasEstablishedFlows reports whether there is an established flow to the ip.
+// Flows of protocols without connection state, e.g. UDP, count as established as long as they are in the table, i.e. until their conntrack timeout expired.
+func (f *Flows) HasEstablishedFlows(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	_, ok := f.established[addr]
+	return ok
+}
+
+// Tracker keeps a snapshot of the conntrack table, which is refreshed in the background.
+// The table can contain millions of flows, so it is aggregated while it is streamed from the kernel and it is only dumped while the snapshot is used.
+type Tracker struct {
+	log      logr.Logger
+	interval time.Duration
+	dump     func(fn func(flow)) error
+	// topTalkers is the number of source and destination pairs with the most flows to keep, the pairs are not counted if zero
+	topTalkers int
+
+	lock  sync.RWMutex
+	flows *Flows
+
+	// used is set when the snapshot is read, trigger requests a refresh of a missing or outdated snapshot
+	used    atomic.Bool
+	trigger chan struct{}
+}
+
+// NewTracker creates a new conntrack tracker which refreshes its snapshot at the given interval and keeps the given number of top talkers, it has to be added to a manager
+func NewTracker(log logr.Logger, interval time.Duration, topTalkers int) *Tracker {
+	return &Tracker{
+		log:        log,
+		interval:   interval,
+		dump:       dumpTable,
+		topTalkers: topTalkers,
+		trigger:    make(chan struct{}, 1),
+	}
+}
+
+// Start refreshes the snapshot until the context is done
+func (t *Tracker) Start(ctx context.Context) error {
+	ticker := time.NewTicker(t.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-t.trigger:
+		case <-ticker.C:
+			// the table is only dumped as long as the snapshot is used
+			if !t.used.Swap(false) {
+				continue
+			}
+		}
+		t.refresh()
+	}
+}
+
+// Flows returns the latest snapshot of the conntrack table, nil if the table was not dumped yet
+func (t *Tracker) Flows() *Flows {
+	t.used.Store(true)
+
+	t.lock.RLock()
+	flows := t.flows
+	t.lock.RUnlock()
+
+	if flows == nil || time.Since(flows.Time) > t.interval {
+		select {
+		case t.trigger <- struct{}{}:
+		default:
+		}
+	}
+	return flows
+}
+
+// HasEstablishedFlows reports whether there is an established flow to the ip in the latest snapshot.
+// As long as the table was not dumped yet, this is unknown and true is returned, such that no IPs are removed too early.
+func (t *Tracker) HasEstablishedFlows(ip string) bool {
+	flows := t.Flows()
+	if flows == nil {
+		return true
+	}
+	return flows.HasEstablishedFlows(ip)
+}
+
+func (t *Tracker) refresh() {
+	flows := &Flows{
+		established: map[netip.Addr]struct{}{},
+	}
+	talkers := newTalkerCounter(t.topTalkers)
+	err := t.dump(func(f flow) {
+		if f.established() {
+			flows.established[f.destination] = struct{}{}
+		}
+		if t.topTalkers > 0 {
+			talkers.add(f.source, f.destination)
+		}
+	})
+	switch {
+	case errors.Is(err, netlink.ErrDumpInterrupted):
+		// an interrupted dump still gives a good picture of the flows
+		t.log.Info("conntrack table changed during the dump, the flows may be incomplete")
+	case err != nil:
+		// the last snapshot keeps its time, such that the next use triggers another dump, without snapshot the flows stay unknown
+		t.log.Error(err, "unable to dump conntrack table, keeping the last snapshot")
+		return
+	}
+
+	flows.TopTalkers = talkers.top(t.topTalkers)
+	flows.Time = time.Now()
+
+	t.lock.Lock()
+	t.flows = flows
+	t.lock.Unlock()
+}
@@ -0,0 +1,170 @@
+package conntrack
+
+import (
+	"errors"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/google/go-cmp/cmp"
+	"github.com/vishvananda/netlink/nl"
+)
+
+func tcpFlow(src, dst string, state uint8) flow {
+	return flow{source: netip.MustParseAddr(src), destination: netip.MustParseAddr(dst), tcp: true, tcpState: state}
+}
+
+func udpFlow(src, dst string) flow {
+	return flow{source: netip.MustParseAddr(src), destination: netip.MustParseAddr(dst)}
+}
+
+func TestTracker(t *testing.T) {
+	var (
+		flows = []flow{
+			tcpFlow("10.0.0.1", "1.1.1.1", nl.TCP_CONNTRACK_ESTABLISHED),
+			tcpFlow("10.0.0.1", "2.2.2.2", nl.TCP_CONNTRACK_TIME_WAIT),
+			tcpFlow("10.0.0.1", "1.1.1.1", nl.TCP_CONNTRACK_TIME_WAIT),
+			udpFlow("10.0.0.1", "3.3.3.3"),
+			tcpFlow("2001:db8::1", "2001:db8::2", nl.TCP_CONNTRACK_ESTABLISHED),
+		}
+		dumpErr error
+	)
+	tracker := NewTracker(logr.Discard(), time.Minute, 2)
+	tracker.dump = func(fn func(flow)) error {
+		for _, f := range flows {
+			fn(f)
+		}
+		return dumpErr
+	}
+
+	if !tracker.HasEstablishedFlows("2.2.2.2") {
+		t.Errorf("expected flows to be reported as established before the first dump")
+	}
+	select {
+	case <-tracker.trigger:
+	default:
+		t.Errorf("expected a refresh to be triggered without snapshot")
+	}
+
+	// a failed first dump leaves the flows unknown
+	dumpErr = errors.New("permission denied")
+	tracker.refresh()
+	if !tracker.HasEstablishedFlows("2.2.2.2") {
+		t.Errorf("expected flows to be reported as established after a failed first dump")
+	}
+	dumpErr = nil
+
+	tracker.refresh()
+	dumped := tracker.Flows().Time
+
+	want := map[string]bool{
+		"1.1.1.1":     true,
+		"2.2.2.2":     false,
+		"3.3.3.3":     true,
+		"2001:db8::2": true,
+		"10.0.0.1":    false,
+		"invalid":     false,
+	}
+	got := map[string]bool{}
+	for ip := range want {
+		got[ip] = tracker.HasEstablishedFlows(ip)
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("HasEstablishedFlows() diff: %v", diff)
+	}
+
+	wantTalkers := []Talker{
+		{Source: netip.MustParseAddr("10.0.0.1"), Destination: netip.MustParseAddr("1.1.1.1"), Flows: 2},
+		{Source: netip.MustParseAddr("10.0.0.1"), Destination: netip.MustParseAddr("2.2.2.2"), Flows: 1},
+	}
+	if diff := cmp.Diff(wantTalkers, tracker.Flows().TopTalkers, cmp.Comparer(func(a, b netip.Addr) bool { return a == b })); diff != "" {
+		t.Errorf("TopTalkers diff: %v", diff)
+	}
+
+	// a failed dump keeps the last snapshot
+	flows = nil
+	dumpErr = errors.New("permission denied")
+	tracker.refresh()
+	if !tracker.HasEstablishedFlows("1.1.1.1") {
+		t.Errorf("expected the last snapshot to be kept after a failed dump")
+	}
+	if got := tracker.Flows().Time; !got.Equal(dumped) {
+		t.Errorf("expected the last snapshot to keep its time %v after a failed dump, got %v", dumped, got)
+	}
+	if diff := cmp.Diff(wantTalkers, tracker.Flows().TopTalkers, cmp.Comparer(func(a, b netip.Addr) bool { return a == b })); diff != "" {
+		t.Errorf("expected the last top talkers to be kept after a failed dump: %v", diff)
+	}
+}
+
+func TestParseFlow(t *testing.T) {
+	nested := func(attrType int, children ...*nl.RtAttr) *nl.RtAttr {
+		a := nl.NewRtAttr(int(nl.NLA_F_NESTED)|attrType, nil)
+		for _, c := range children {
+			a.AddChild(c)
+		}
+		return a
+	}
+	message := func(attrs ...*nl.RtAttr) []byte {
+		msg := []byte{2, 0, 0, 0} // nfgenmsg of an ipv4 entry
+		for _, a := range attrs {
+			msg = append(msg, a.Serialize()...)
+		}
+		return msg
+	}
+
+	tests := []struct {
+		name    string
+		msg     []byte
+		want    flow
+		wantErr bool
+	}{
+		{
+			name: "tcp flow",
+			msg: message(
+				nested(ctaTupleOrig, nested(ctaTupleIP,
+					nl.NewRtAttr(ctaIPv4Src, []byte{10, 0, 0, 1}),
+					nl.NewRtAttr(ctaIPv4Dst, []byte{1, 1, 1, 1}),
+				)),
+				nested(ctaProtoinfo, nested(ctaProtoinfoTCP,
+					nl.NewRtAttr(ctaProtoinfoTCPState, []byte{nl.TCP_CONNTRACK_ESTABLISHED}),
+				)),
+			),
+			want: tcpFlow("10.0.0.1", "1.1.1.1", nl.TCP_CONNTRACK_ESTABLISHED),
+		},
+		{
+			name: "udp flow",
+			msg: message(
+				nested(ctaTupleOrig, nested(ctaTupleIP,
+					nl.NewRtAttr(ctaIPv6Src, netip.MustParseAddr("2001:db8::1").AsSlice()),
+					nl.NewRtAttr(ctaIPv6Dst, netip.MustParseAddr("2001:db8::2").AsSlice()),
+				)),
+			),
+			want: udpFlow("2001:db8::1", "2001:db8::2"),
+		},
+		{
+			name:    "entry without addresses",
+			msg:     message(nested(ctaProtoinfo)),
+			wantErr: true,
+		},
+		{
+			name:    "truncated message",
+			msg:     []byte{2},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseFlow(tt.msg)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseFlow() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if diff := cmp.Diff(tt.want, got, cmp.AllowUnexported(flow{}), cmp.Comparer(func(a, b netip.Addr) bool { return a == b })); diff != "" {
+				t.Errorf("parseFlow() diff: %v", diff)
+			}
+		})
+	}
+}
@@ -1,14 +1,19 @@
 package dns
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net"
+	"net/netip"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/go-logr/logr"
 	dnsgo "github.com/miekg/dns"
+
+	firewallv1 "github.com/metal-stack/firewall-controller/v2/api/v1"
 )
 
 const (
@@ -20,8 +25,18 @@ const (
 	dnsTimeout           = 10 * time.Second
 	defaultDNSServerAddr = "8.8.8.8:53"
 	testDNSRecord        = "*."
+
+	// cacheUpdateWorkers is the number of workers which apply DNS answers to the cache
+	cacheUpdateWorkers = 4
+	// cacheUpdateQueueSize is the number of DNS answers which wait for a worker, further answers are not cached
+	cacheUpdateQueueSize = 1024
 )
 
+type cacheUpdate struct {
+	lookupTime time.Time
+	response   *dnsgo.Msg
+}
+
 type DNSProxyHandler struct {
 	sync.RWMutex
 	log           logr.Logger
@@ -29,6 +44,14 @@ type DNSProxyHandler struct {
 	tcpClient     *dnsgo.Client
 	dnsServerAddr string
 	updateCache   func(lookupTime time.Time, response *dnsgo.Msg)
+	cacheUpdates  chan cacheUpdate
+	// dnssec sets the DO bit on forwarded requests, such that the cache receives the signatures to validate
+	dnssec  bool
+	routes  *dnsRoutes
+	edns    ednsPolicy
+	limiter *rateLimiter
+	// reportRateLimit is called when a rate limit of a client trips
+	reportRateLimit rateLimitReporter
 }
 
 func NewDNSProxyHandler(log logr.Logger, cache *DNSCache) *DNSProxyHandler {
@@ -36,13 +59,25 @@ func NewDNSProxyHandler(log logr.Logger, cache *DNSCache) *DNSProxyHandler {
 	udpClient := &dnsgo.Client{Net: "udp", Timeout: dnsTimeout, SingleInflight: false}
 	tcpClient := &dnsgo.Client{Net: "tcp", Timeout: dnsTimeout, SingleInflight: false}
 
-	return &DNSProxyHandler{
+	h := &DNSProxyHandler{
 		log:           log.WithName("DNS handler"),
 		udpClient:     udpClient,
 		tcpClient:     tcpClient,
 		dnsServerAddr: cache.dnsServerAddr,
 		updateCache:   getUpdateCacheFunc(log, cache),
+		cacheUpdates:  make(chan cacheUpdate, cacheUpdateQueueSize),
+		dnssec:        cache.validator != nil,
+		routes:        cache.routes,
+	}
+	h.reportRateLimit = func(limit string, client netip.Prefix, message string) {
+		h.log.Info("rate limit exceeded", "limit", limit, "client", client, "message", message)
+	}
+
+	for range cacheUpdateWorkers {
+		go h.runCacheUpdates(cache.ctx)
 	}
+
+	return h
 }
 
 func (h *DNSProxyHandler) ServeDNS(w dnsgo.ResponseWriter, request *dnsgo.Msg) {
@@ -63,14 +98,51 @@ func (h *DNSProxyHandler) ServeDNS(w dnsgo.ResponseWriter, request *dnsgo.Msg) {
 	bufsize := getBufSize(serverAddress.Network(), request)
 	scopedLog.Info("started processing request", "server", serverAddress, "bufsize", bufsize, "request", request)
 
-	response, err := h.getDataFromDNS(serverAddress, request)
+	h.RLock()
+	edns := h.edns
+	limiter := h.limiter
+	h.RUnlock()
+
+	client := clientAddr(w.RemoteAddr())
+	if !limiter.allowQuery(client, time.Now()) {
+		scopedLog.V(4).Info("refusing request because of rate limit")
+		refused := refusedMsg(request)
+		countRequest(serverAddress.Network(), request, refused)
+		err = w.WriteMsg(refused)
+		return
+	}
+
+	if response := h.routes.staticAnswer(request); response != nil {
+		scopedLog.Info("answering static host", "response", response)
+		h.enqueueCacheUpdate(time.Now(), response.Copy())
+		err = h.writeResponse(w, limiter, client, request, response)
+		return
+	}
+
+	upstreamRequest, clientDNSSEC := request, true
+	if h.dnssec {
+		upstreamRequest, clientDNSSEC = setDNSSECOK(request)
+	}
+	// the EDNS policy is applied after the DO bit was set, such that the padding is computed for the final request
+	upstreamRequest = edns.prepareRequest(upstreamRequest)
+
+	response, err := h.getDataFromDNS(serverAddress, upstreamRequest)
 	if err != nil {
 		scopedLog.Error(err, "failed to get DNS response")
-		err = w.WriteMsg(refusedMsg(request))
+		refused := refusedMsg(request)
+		countRequest(serverAddress.Network(), request, refused)
+		err = w.WriteMsg(refused)
 		return
 	}
 
 	originalResponse := response.Copy()
+	if nsid := responseNSID(response); nsid != "" {
+		scopedLog = scopedLog.WithValues("nsid", nsid)
+	}
+	if !clientDNSSEC {
+		stripDNSSECRecords(response, request.IsEdns0() != nil)
+	}
+	edns.restoreClientEDNS(request, response)
 	/*
 		Why are we truncating the answer?
 		DNS has a feature where a DNS server can "compress" the names in a message, and will usually do this if the reply will not fit in the maximum payload length for a DNS packet; for more explanation see here: https://datatracker.ietf.org/doc/html/rfc1035#autoid-44
@@ -78,11 +150,76 @@ func (h *DNSProxyHandler) ServeDNS(w dnsgo.ResponseWriter, request *dnsgo.Msg) {
 		Therefore we find out the buffer size of the client from the request (with UDP it's 512 bytes by default) and limit the reply to this buffer size before we send it out. The Truncate method will try compression first to fit the message into the buffer size and will truncate the message if necessary.
 	*/
 	response.Truncate(bufsize)
+	if response.Truncated {
+		truncatedResponsesTotal.WithLabelValues(serverAddress.Network()).Inc()
+	}
 	scopedLog.Info("processing response", "buffer size", bufsize, "original response", originalResponse, "truncated response", response)
 
-	go h.updateCache(time.Now(), response)
+	h.enqueueCacheUpdate(time.Now(), originalResponse)
+
+	err = h.writeResponse(w, limiter, client, request, response)
+}
+
+// writeResponse sends the response to the client, unless identical responses to its subnet exceed the rate limit.
+// Responses via TCP are not limited, as the address of the client can not be spoofed.
+func (h *DNSProxyHandler) writeResponse(w dnsgo.ResponseWriter, limiter *rateLimiter, client netip.Addr, request, response *dnsgo.Msg) error {
+	transport := w.LocalAddr().Network()
+	if transport == "udp" {
+		if allow, slip := limiter.allowResponse(client, request, response, time.Now()); !allow {
+			if !slip {
+				return nil
+			}
+			response = truncatedMsg(request)
+		}
+	}
+
+	countRequest(transport, request, response)
+	return w.WriteMsg(response)
+}
+
+// enqueueCacheUpdate passes the response to the workers updating the cache.
+// If all workers are busy and the queue is full, the response is not cached.
+func (h *DNSProxyHandler) enqueueCacheUpdate(lookupTime time.Time, response *dnsgo.Msg) {
+	select {
+	case h.cacheUpdates <- cacheUpdate{lookupTime: lookupTime, response: response}:
+	default:
+		cacheUpdatesTotal.WithLabelValues("dropped").Inc()
+		h.log.V(4).Info("dropping cache update because the queue is full", reqIdLogField, response.Id)
+	}
+}
+
+// runCacheUpdates applies the queued responses to the cache until the context is done
+func (h *DNSProxyHandler) runCacheUpdates(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case u := <-h.cacheUpdates:
+			h.updateCache(u.lookupTime, u.response)
+		}
+	}
+}
 
-	err = w.WriteMsg(response)
+// clientAddr returns the IP of the client, or the zero address if it is unknown
+func clientAddr(addr net.Addr) netip.Addr {
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		ip = a.IP
+	case *net.TCPAddr:
+		ip = a.IP
+	}
+	client, _ := netip.AddrFromSlice(ip)
+	return client.Unmap()
+}
+
+// countRequest counts the answered request by the rcode of the response
+func countRequest(transport string, request, response *dnsgo.Msg) {
+	qtype := ""
+	if len(request.Question) > 0 {
+		qtype = dnsgo.TypeToString[request.Question[0].Qtype]
+	}
+	requestsTotal.WithLabelValues(dnsgo.RcodeToString[response.Rcode], qtype, transport).Inc()
 }
 
 func getBufSize(protocol string, request *dnsgo.Msg) int {
@@ -119,6 +256,24 @@ func (h *DNSProxyHandler) UpdateDNSServerAddr(addr string) error {
 	return nil
 }
 
+// UpdateRateLimit sets the rate limits of the clients.
+// The state of the clients is kept if the limits did not change.
+func (h *DNSProxyHandler) UpdateRateLimit(limit *firewallv1.DNSRateLimit) {
+	h.Lock()
+	defer h.Unlock()
+	if h.limiter.equals(limit) {
+		return
+	}
+	h.limiter = newRateLimiter(limit, h.reportRateLimit)
+}
+
+// UpdateEDNSPolicy sets how the EDNS options of forwarded requests are rewritten
+func (h *DNSProxyHandler) UpdateEDNSPolicy(policy *firewallv1.EDNSPolicy) {
+	h.Lock()
+	h.edns = newEDNSPolicy(policy)
+	h.Unlock()
+}
+
 func (h *DNSProxyHandler) getDataFromDNS(addr net.Addr, request *dnsgo.Msg) (*dnsgo.Msg, error) {
 	// Keep the same transport protocol
 	var client *dnsgo.Client
@@ -136,12 +291,26 @@ func (h *DNSProxyHandler) getDataFromDNS(addr net.Addr, request *dnsgo.Msg) (*dn
 	dnsAddr := h.dnsServerAddr
 	h.RUnlock()
 
-	response, _, err := client.Exchange(request, dnsAddr)
-	if err != nil {
-		return nil, fmt.Errorf("failed to call target DNS: %w", err)
+	// Forwarders of zones take precedence over the default DNS server
+	servers := []string{dnsAddr}
+	if len(request.Question) > 0 {
+		servers = h.routes.serversFor(request.Question[0].Name, dnsAddr)
+	}
+
+	var errs []error
+	for _, server := range servers {
+		start := time.Now()
+		response, _, err := client.Exchange(request, server)
+		upstreamRequestDuration.WithLabelValues(server, protocol).Observe(time.Since(start).Seconds())
+		if err != nil {
+			upstreamErrorsTotal.WithLabelValues(server, protocol).Inc()
+			errs = append(errs, fmt.Errorf("failed to call target DNS %s: %w", server, err))
+			continue
+		}
+		return response, nil
 	}
 
-	return response, nil
+	return nil, errors.Join(errs...)
 }
 
 func getUpdateCacheFunc(log logr.Logger, cache *DNSCache) func(lookupTime time.Time, response *dnsgo.Msg) {
@@ -4,11 +4,12 @@ import (
 	"context"
 	"crypto/md5" //nolint:gosec
 	"encoding/hex"
+	"errors"
 	"fmt"
-	"reflect"
-	"regexp"
+	"maps"
 	"slices"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -17,12 +18,8 @@ import (
 	"github.com/go-logr/logr"
 	"github.com/google/nftables"
 	dnsgo "github.com/miekg/dns"
-	v1 "k8s.io/api/core/v1"
-	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/types"
 	"sigs.k8s.io/controller-runtime/pkg/client"
-	"sigs.k8s.io/yaml"
 
 	firewallv1 "github.com/metal-stack/firewall-controller/v2/api/v1"
 )
@@ -39,7 +36,7 @@ const (
 	// How many DNS redirections (CNAME/DNAME) are followed, to break up redirection loops.
 	maxDNSRedirects = 10
 
-	// Configmap that holds the FQDN state
+	// Configmap that held the FQDN state before it was moved to FQDNCacheEntry resources
 	fqdnStateConfigmapName = "fqdnstate"
 	fqdnStateNamespace     = firewallv1.ClusterwideNetworkPolicyNamespace
 	fqdnStateConfigmapKey  = "state"
@@ -65,9 +62,10 @@ func newIPEntry(setName string) *iPEntry {
 	}
 }
 
-func (e *iPEntry) update(log logr.Logger, setName string, rrs []dnsgo.RR, lookupTime time.Time, dtype nftables.SetDatatype) error {
-	deletedIPs := e.expireIPs()
-	newIPs := e.addAndUpdateIPs(log, rrs, lookupTime)
+func (e *iPEntry) update(log logr.Logger, setName string, rrs []dnsgo.RR, lookupTime time.Time, dtype nftables.SetDatatype, policy ttlPolicy, flows flowTracker) error {
+	deletedIPs := e.expireIPs(time.Now(), policy.gracePeriod, flows)
+	newIPs := e.addAndUpdateIPs(log, rrs, lookupTime, policy)
+	expiredIPsTotal.Add(float64(len(deletedIPs)))
 
 	if newIPs != nil || deletedIPs != nil {
 		if err := updateNftSet(newIPs, deletedIPs, setName, dtype); err != nil {
@@ -78,17 +76,23 @@ func (e *iPEntry) update(log logr.Logger, setName string, rrs []dnsgo.RR, lookup
 	return nil
 }
 
-func (e *iPEntry) expireIPs() (deletedIPs []nftables.SetElement) {
+// expireIPs removes all IPs whose expiration time plus grace period has passed.
+// IPs to which established connections exist are kept.
+func (e *iPEntry) expireIPs(now time.Time, gracePeriod time.Duration, flows flowTracker) (deletedIPs []nftables.SetElement) {
 	for ip, expirationTime := range e.IPs {
-		if expirationTime.Before(time.Now()) {
-			deletedIPs = append(deletedIPs, nftables.SetElement{Key: []byte(ip)})
-			delete(e.IPs, ip)
+		if !expirationTime.Add(gracePeriod).Before(now) {
+			continue
+		}
+		if flows != nil && flows.HasEstablishedFlows(ip) {
+			continue
 		}
+		deletedIPs = append(deletedIPs, nftables.SetElement{Key: []byte(ip)})
+		delete(e.IPs, ip)
 	}
 	return
 }
 
-func (e *iPEntry) addAndUpdateIPs(log logr.Logger, rrs []dnsgo.RR, lookupTime time.Time) (newIPs []nftables.SetElement) {
+func (e *iPEntry) addAndUpdateIPs(log logr.Logger, rrs []dnsgo.RR, lookupTime time.Time, policy ttlPolicy) (newIPs []nftables.SetElement) {
 	for _, rr := range rrs {
 		var s string
 		switch r := rr.(type) {
@@ -100,8 +104,9 @@ func (e *iPEntry) addAndUpdateIPs(log logr.Logger, rrs []dnsgo.RR, lookupTime ti
 		if _, ok := e.IPs[s]; !ok {
 			newIPs = append(newIPs, nftables.SetElement{Key: []byte(s)})
 		}
-		log.WithValues("ip", s, "rr header ttl", rr.Header().Ttl, "expiration time", lookupTime.Add(time.Duration(rr.Header().Ttl)*time.Second))
-		e.IPs[s] = lookupTime.Add(time.Duration(rr.Header().Ttl) * time.Second)
+		expirationTime := lookupTime.Add(policy.ttl(rr.Header().Ttl))
+		log.WithValues("ip", s, "rr header ttl", rr.Header().Ttl, "expiration time", expirationTime)
+		e.IPs[s] = expirationTime
 
 	}
 	return
@@ -118,6 +123,13 @@ type DNSCache struct {
 	log           logr.Logger
 	fqdnToEntry   map[string]cacheEntry
 	setNames      map[string]struct{}
+	dirty         map[string]struct{}
+	selectors     []firewallv1.FQDNSelector
+	matcher       *fqdnMatcher
+	matches       map[string]map[string]struct{} // names of the cache entries matching the selectors of the matcher by selector key
+	flows         flowTracker
+	validator     *dnssecValidator
+	routes        *dnsRoutes
 	dnsServerAddr string
 	shootClient   client.Client
 	ctx           context.Context
@@ -125,11 +137,16 @@ type DNSCache struct {
 	ipv6Enabled   bool
 }
 
-func newDNSCache(ctx context.Context, dns string, ipv4Enabled, ipv6Enabled bool, shootClient client.Client, log logr.Logger) (*DNSCache, error) {
+func newDNSCache(ctx context.Context, dns string, ipv4Enabled, ipv6Enabled bool, shootClient client.Client, log logr.Logger, trustAnchors []*dnsgo.DS, flows flowTracker) (*DNSCache, error) {
 	c := DNSCache{
 		log:           log,
 		fqdnToEntry:   map[string]cacheEntry{},
 		setNames:      map[string]struct{}{},
+		dirty:         map[string]struct{}{},
+		matcher:       newFQDNMatcher(nil),
+		matches:       map[string]map[string]struct{}{},
+		flows:         flows,
+		routes:        newDNSRoutes(),
 		dnsServerAddr: dns,
 		shootClient:   shootClient,
 		ctx:           ctx,
@@ -137,105 +154,28 @@ func newDNSCache(ctx context.Context, dns string, ipv4Enabled, ipv6Enabled bool,
 		ipv6Enabled:   ipv6Enabled,
 	}
 
-	nn := types.NamespacedName{Name: fqdnStateConfigmapName, Namespace: fqdnStateNamespace}
-	scm := &v1.ConfigMap{}
-
-	ctxWithTimeout, cancel := context.WithTimeout(c.ctx, 5*time.Second)
-	defer func() {
-		cancel()
-	}()
+	if len(trustAnchors) > 0 {
+		c.validator = newDNSSECValidator(trustAnchors, func(name string, qtype uint16) (*dnsgo.Msg, error) {
+			var errs []error
+			for _, server := range c.serversFor(name) {
+				resp, err := queryDNSSEC(server, name, qtype)
+				if err == nil {
+					return resp, nil
+				}
+				errs = append(errs, err)
+			}
+			return nil, errors.Join(errs...)
+		})
+	}
 
-	err := shootClient.Get(ctxWithTimeout, nn, scm)
-	if err != nil && !apierrors.IsNotFound(err) {
-		c.log.Error(err, "error reading fqndstate configmap")
+	if err := c.loadState(); err != nil {
+		c.log.Error(err, "error restoring dns cache state")
 		return nil, err
 	}
-	if scm.Data == nil {
-		c.log.V(4).Info("DEBUG fqdnstate cm not found or contains no data", "cm", scm)
-		return &c, nil
 
-	}
-	if scm.Data[fqdnStateConfigmapKey] == "" {
-		c.log.Error(fmt.Errorf("error reading fqdnstate configmap, ignoring content"), "fqdnstate configmap does not contain the right key", "configmap", scm, "key", fqdnStateConfigmapKey)
-		return &c, nil
-	}
-	c.log.V(4).Info("DEBUG state stored in fqdnstate cm, trying to unmarshal", fqdnStateConfigmapKey, scm.Data[fqdnStateConfigmapKey])
-	err = yaml.UnmarshalStrict([]byte(scm.Data[fqdnStateConfigmapKey]), &c.fqdnToEntry)
-	if err != nil {
-		c.log.Info("could not unmarshal state from fqdnstate configmap, ignoring content.", "error", err)
-	}
 	return &c, nil
 }
 
-// writeStateToConfigmap writes the whole DNS cache to the state configmap
-func (c *DNSCache) writeStateToConfigmap() error {
-	c.RLock()
-	s, err := yaml.Marshal(c.fqdnToEntry)
-	c.RUnlock()
-	if err != nil {
-		return err
-	}
-
-	var (
-		cm = &v1.ConfigMap{
-			ObjectMeta: metav1.ObjectMeta{
-				Name:      fqdnStateConfigmapName,
-				Namespace: fqdnStateNamespace,
-			},
-		}
-
-		data = map[string]string{
-			fqdnStateConfigmapKey: string(s),
-		}
-
-		debugLog = c.log.V(4).WithValues("namespace", cm.Namespace, "name", cm.Name)
-	)
-
-	debugLog.Info("DEBUG writing cache to configmap", "fqdnToEntry", string(s))
-
-	debugLog.Info("DEBUG looking for configmap")
-
-	ctxWithTimeout, cancel := context.WithTimeout(c.ctx, 5*time.Second)
-	defer func() {
-		cancel()
-	}()
-
-	err = c.shootClient.Get(ctxWithTimeout, client.ObjectKeyFromObject(cm), cm)
-	if err != nil && !apierrors.IsNotFound(err) {
-		return err
-	}
-
-	if apierrors.IsNotFound(err) {
-		debugLog.Info("DEBUG configmap not found, trying to create configmap")
-
-		cm.Data = data
-
-		err = c.shootClient.Create(ctxWithTimeout, cm)
-		if err != nil {
-			return err
-		}
-
-		return nil
-	}
-
-	if !reflect.DeepEqual(cm.Data, data) {
-		cm.Data = data
-
-		err = c.shootClient.Update(ctxWithTimeout, cm)
-		if err != nil {
-			return err
-		}
-
-		debugLog.Info("DEBUG updated cm", "old data", cm.Data, "new data", data)
-
-		return nil
-	}
-
-	debugLog.Info("DEBUG no need to update cm, already up to date")
-
-	return nil
-}
-
 // getSetsForFQDN returns sets for FQDN selector
 func (c *DNSCache) getSetsForFQDN(fqdn firewallv1.FQDNSelector) (result []firewallv1.IPSet) {
 	sets := map[string]firewallv1.IPSet{}
@@ -245,7 +185,7 @@ func (c *DNSCache) getSetsForFQDN(fqdn firewallv1.FQDNSelector) (result []firewa
 		}
 
 	} else if fqdn.MatchPattern != "" {
-		for _, s := range c.getSetNameForRegex(fqdn.GetRegex()) {
+		for _, s := range c.getSetNameForPattern(fqdn) {
 			sets[s.SetName] = s
 		}
 	}
@@ -265,28 +205,13 @@ func (c *DNSCache) getSetsForFQDN(fqdn firewallv1.FQDNSelector) (result []firewa
 func (c *DNSCache) getSetsForRendering(fqdns []firewallv1.FQDNSelector) (result []RenderIPSet) {
 	c.RLock()
 	defer c.RUnlock()
-	for n, e := range c.fqdnToEntry {
-		var matched bool
-		for _, fqdn := range fqdns {
-			if fqdn.MatchName != "" {
-				if fqdn.GetMatchName() == n {
-					matched = true
-					break
-				}
-			} else if fqdn.MatchPattern != "" {
-				if m, _ := regexp.MatchString(fqdn.GetRegex(), n); m {
-					matched = true
-					break
-				}
-			}
+	for _, n := range c.matchingEntries(fqdns...) {
+		e := c.fqdnToEntry[n]
+		if e.IPv4 != nil {
+			result = append(result, createRenderIPSetFromIPEntry(IPv4, e.IPv4))
 		}
-		if matched {
-			if e.IPv4 != nil {
-				result = append(result, createRenderIPSetFromIPEntry(IPv4, e.IPv4))
-			}
-			if e.IPv6 != nil {
-				result = append(result, createRenderIPSetFromIPEntry(IPv6, e.IPv6))
-			}
+		if e.IPv6 != nil {
+			result = append(result, createRenderIPSetFromIPEntry(IPv6, e.IPv6))
 		}
 	}
 	slices.SortStableFunc(result, func(a, b RenderIPSet) int {
@@ -296,6 +221,96 @@ func (c *DNSCache) getSetsForRendering(fqdns []firewallv1.FQDNSelector) (result
 	return
 }
 
+// matchingEntries returns the names of the cache entries matching any of the selectors.
+// Selectors of the matcher are looked up in the matches, others are matched against all entries.
+// The caller must hold the lock.
+func (c *DNSCache) matchingEntries(fqdns ...firewallv1.FQDNSelector) []string {
+	names := map[string]struct{}{}
+	var unknown []firewallv1.FQDNSelector
+	for _, s := range fqdns {
+		key := selectorKey(s)
+		if _, ok := c.matcher.selectors[key]; !ok {
+			unknown = append(unknown, s)
+			continue
+		}
+		for n := range c.matches[key] {
+			names[n] = struct{}{}
+		}
+	}
+
+	if len(unknown) > 0 {
+		matcher := newFQDNMatcher(unknown)
+		for n := range c.fqdnToEntry {
+			if matcher.matches(n) {
+				names[n] = struct{}{}
+			}
+		}
+	}
+
+	return slices.Collect(maps.Keys(names))
+}
+
+// updateSelectors sets the FQDN selectors of all policies, which define the TTL settings of the cache entries
+func (c *DNSCache) updateSelectors(fqdns []firewallv1.FQDNSelector) {
+	c.Lock()
+	defer c.Unlock()
+	c.selectors = fqdns
+	if !c.matcher.update(fqdns) {
+		return
+	}
+
+	c.matches = map[string]map[string]struct{}{}
+	for n := range c.fqdnToEntry {
+		c.addMatches(n)
+	}
+}
+
+// addMatches adds the name of a cache entry to the matches of all selectors matching it.
+// The caller must hold the lock.
+func (c *DNSCache) addMatches(name string) {
+	c.matcher.visit(name, func(key string, _ firewallv1.FQDNSelector) bool {
+		names, ok := c.matches[key]
+		if !ok {
+			names = map[string]struct{}{}
+			c.matches[key] = names
+		}
+		names[name] = struct{}{}
+		return true
+	})
+}
+
+// removeMatches removes the name of a cache entry from the matches of all selectors.
+// The caller must hold the lock.
+func (c *DNSCache) removeMatches(name string) {
+	c.matcher.visit(name, func(key string, _ firewallv1.FQDNSelector) bool {
+		if names, ok := c.matches[key]; ok {
+			delete(names, name)
+			if len(names) == 0 {
+				delete(c.matches, key)
+			}
+		}
+		return true
+	})
+}
+
+// ttlPolicyFor merges the TTL settings of all selectors matching the given name.
+// The caller must hold the lock.
+func (c *DNSCache) ttlPolicyFor(name string) (policy ttlPolicy) {
+	c.matcher.visit(name, func(_ string, s firewallv1.FQDNSelector) bool {
+		policy = policy.merge(s)
+		return true
+	})
+	return
+}
+
+// serversFor returns the DNS servers which are asked for the given name
+func (c *DNSCache) serversFor(qname string) []string {
+	c.RLock()
+	dnsAddr := c.dnsServerAddr
+	c.RUnlock()
+	return c.routes.serversFor(qname, dnsAddr)
+}
+
 func (c *DNSCache) updateDNSServerAddr(addr string) {
 	c.Lock()
 	c.dnsServerAddr = addr
@@ -341,21 +356,34 @@ func (c *DNSCache) loadDataFromDNSServer(fqdns []string) error {
 		return fmt.Errorf("too many hops, fqdn chain: %s", strings.Join(fqdns, ","))
 	}
 	qname := fqdns[len(fqdns)-1]
-	c.RLock()
-	dnsAddr := c.dnsServerAddr
-	c.RUnlock()
+	servers := c.serversFor(qname)
 	cl := new(dnsgo.Client)
 	for _, t := range []uint16{dnsgo.TypeA, dnsgo.TypeAAAA} {
 		m := new(dnsgo.Msg)
 		m.Id = dnsgo.Id()
 		m.SetQuestion(qname, t)
+		if c.validator != nil {
+			m.SetEdns0(dnssecBufSize, true)
+		}
 		c.log.V(4).Info("DEBUG dnscache loadDataFromDNSServer function querying DNS", "message", m)
-		in, _, err := cl.Exchange(m, dnsAddr)
-		if err != nil {
-			return fmt.Errorf("failed to get DNS data about fqdn %s: %w", fqdns[0], err)
+		in := c.routes.staticAnswer(m)
+		if in == nil {
+			var errs []error
+			for _, server := range servers {
+				resp, _, err := cl.Exchange(m, server)
+				if err != nil {
+					errs = append(errs, err)
+					continue
+				}
+				in = resp
+				break
+			}
+			if in == nil {
+				return fmt.Errorf("failed to get DNS data about fqdn %s: %w", fqdns[0], errors.Join(errs...))
+			}
 		}
 		c.log.V(4).Info("DEBUG dnscache loadDataFromDNSServer function calling Update function", "answer", in, "fqdns", fqdns)
-		if _, err = c.Update(time.Now().UTC(), qname, in, fqdns); err != nil {
+		if _, err := c.Update(time.Now().UTC(), qname, in, fqdns); err != nil {
 			return fmt.Errorf("failed to update DNS data for fqdn %s: %w", fqdns[0], err)
 		}
 	}
@@ -363,16 +391,13 @@ func (c *DNSCache) loadDataFromDNSServer(fqdns []string) error {
 	return nil
 }
 
-// getSetNameForRegex returns list of FQDN set data that match provided regex
-func (c *DNSCache) getSetNameForRegex(regex string) (sets []firewallv1.IPSet) {
+// getSetNameForPattern returns list of FQDN set data that match the pattern of the provided selector
+func (c *DNSCache) getSetNameForPattern(fqdn firewallv1.FQDNSelector) (sets []firewallv1.IPSet) {
 	c.RLock()
 	defer c.RUnlock()
 
-	for n, e := range c.fqdnToEntry {
-		if matched, _ := regexp.MatchString(regex, n); !matched {
-			continue
-		}
-
+	for _, n := range c.matchingEntries(fqdn) {
+		e := c.fqdnToEntry[n]
 		if e.IPv4 != nil {
 			sets = append(sets, createIPSetFromIPEntry(n, firewallv1.IPv4, e.IPv4))
 		}
@@ -387,7 +412,28 @@ func (c *DNSCache) getSetNameForRegex(regex string) (sets []firewallv1.IPSet) {
 // Update DNS cache.
 // It expects that there was only one question to DNS(majority of cases).
 // So it picks first qname and skips all others(if there is).
+// If DNSSEC validation is enabled, only records with a valid chain of signatures are added.
 func (c *DNSCache) Update(lookupTime time.Time, qname string, msg *dnsgo.Msg, fqdnsfield ...[]string) (bool, error) {
+	// static hosts are configured by the operator and are not signed
+	if c.validator != nil && !c.routes.isStatic(qname) {
+		validated, err := c.validator.validate(time.Now(), msg)
+		if err != nil {
+			dnssecValidationFailuresTotal.Inc()
+			c.log.Error(err, "dnssec validation failed, ignoring unvalidated records", "qname", qname)
+		}
+		msg = validated
+	}
+
+	found, err := c.update(lookupTime, qname, msg, fqdnsfield...)
+	if err != nil {
+		cacheUpdatesTotal.WithLabelValues("error").Inc()
+	} else {
+		cacheUpdatesTotal.WithLabelValues("success").Inc()
+	}
+	return found, err
+}
+
+func (c *DNSCache) update(lookupTime time.Time, qname string, msg *dnsgo.Msg, fqdnsfield ...[]string) (bool, error) {
 	c.log.V(4).Info("DEBUG dnscache Update function called", "Message", msg, "fqdnsfield", fqdnsfield)
 
 	fqdns := []string{}
@@ -424,7 +470,7 @@ func (c *DNSCache) Update(lookupTime time.Time, qname string, msg *dnsgo.Msg, fq
 			c.log.V(4).Info("DEBUG dnscache Update function AAAA record found", "IPs", ipv6)
 		case *dnsgo.CNAME:
 			c.log.V(4).Info("DEBUG dnscache Update function CNAME record found. Looking for resolution in same DNS reply", "CNAME", rr.Target, "fqdns slice", append(fqdns, rr.Target))
-			stop, err := c.Update(lookupTime, rr.Target, msg, append(fqdns, rr.Target))
+			stop, err := c.update(lookupTime, rr.Target, msg, append(fqdns, rr.Target))
 			if err != nil {
 				return found, fmt.Errorf("error while trying to resolve CNAME %s within the same DNS reply: %w", rr.Target, err)
 			}
@@ -442,27 +488,17 @@ func (c *DNSCache) Update(lookupTime time.Time, qname string, msg *dnsgo.Msg, fq
 		}
 	}
 
-	ipEntriesUpdated := false
-
 	for _, fqdn := range fqdns {
 		c.log.V(4).Info("DEBUG dnscache Update function Updating DNS cache for", "fqdn", fqdn, "ipv4", ipv4, "ipv6", ipv6)
 		if c.ipv4Enabled && len(ipv4) > 0 {
 			if err := c.updateIPEntry(fqdn, ipv4, lookupTime, nftables.TypeIPAddr); err != nil {
 				return false, fmt.Errorf("failed to update IPv4 addresses: %w", err)
 			}
-			ipEntriesUpdated = true
 		}
 		if c.ipv6Enabled && len(ipv6) > 0 {
 			if err := c.updateIPEntry(fqdn, ipv6, lookupTime, nftables.TypeIP6Addr); err != nil {
 				return false, fmt.Errorf("failed to update IPv6 addresses: %w", err)
 			}
-			ipEntriesUpdated = true
-		}
-	}
-
-	if ipEntriesUpdated {
-		if err := c.writeStateToConfigmap(); err != nil {
-			c.log.V(4).Info("DEBUG could not write updated DNS cache to state configmap", "configmap", fqdnStateConfigmapName, "namespace", fqdnStateNamespace, "error", err)
 		}
 	}
 
@@ -504,28 +540,41 @@ func (c *DNSCache) updateIPEntry(qname string, rrs []dnsgo.RR, lookupTime time.T
 
 	setName := ipe.SetName
 	scopedLog.WithValues("set", setName, "lookupTime", lookupTime, "rrs", rrs).Info("updating ip entry")
-	if err := ipe.update(scopedLog, setName, rrs, lookupTime, dtype); err != nil {
+	if err := ipe.update(scopedLog, setName, rrs, lookupTime, dtype, c.ttlPolicyFor(qname), c.flows); err != nil {
 		return fmt.Errorf("failed to update IPEntry: %w", err)
 	}
+	if !exists {
+		c.addMatches(qname)
+	}
 	c.fqdnToEntry[qname] = entry
+	c.dirty[qname] = struct{}{}
+	trackedFQDNs.Set(float64(len(c.fqdnToEntry)))
+	setIPs.WithLabelValues(setName).Set(float64(len(ipe.IPs)))
 
 	scopedLog.WithValues("set", setName).Info("added new IP entry")
 	return nil
 }
 
 func (c *DNSCache) createSetName(qname, dataType string, suffix int) (setName string) {
-	md5Hash := md5.Sum([]byte(qname + dataType)) //nolint:gosec
+	input := qname + dataType
+	if suffix > 0 {
+		input += strconv.Itoa(suffix)
+	}
+	md5Hash := md5.Sum([]byte(input)) //nolint:gosec
 	hex := hex.EncodeToString(md5Hash[:])
 
+	// Set names must not start with a digit
 	for i, ch := range hex {
 		if !unicode.IsDigit(ch) {
-			setName = hex[i : i+16]
+			if i+16 <= len(hex) {
+				setName = hex[i : i+16]
+			}
 			break
 		}
 	}
 
-	// Check that set name isn't taken already
-	if _, ok := c.setNames[setName]; ok {
+	// Check that set name is valid and isn't taken already
+	if _, ok := c.setNames[setName]; ok || setName == "" {
 		setName = c.createSetName(qname, dataType, suffix+1)
 		return
 	}
@@ -539,7 +588,13 @@ func updateNftSet(
 	newIPs, deletedIPs []nftables.SetElement,
 	setName string,
 	dataType nftables.SetDatatype,
-) error {
+) (err error) {
+	defer func() {
+		if err != nil {
+			nftSetUpdateErrorsTotal.Inc()
+		}
+	}()
+
 	conn := nftables.Conn{}
 
 	table := &nftables.Table{
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"net"
+	"slices"
 	"sync"
 	"testing"
 	"time"
@@ -170,6 +171,7 @@ func Test_GetSetsForFQDN(t *testing.T) {
 				log:         logr.Discard(),
 				fqdnToEntry: tt.fqdnToEntry,
 				setNames:    make(map[string]struct{}),
+				matcher:     newFQDNMatcher(nil),
 				ipv4Enabled: true,
 				ipv6Enabled: true,
 			}
@@ -234,6 +236,66 @@ func Test_createIPSetFromIPEntry(t *testing.T) {
 	}
 }
 
+func Test_getSetsForRenderingMatches(t *testing.T) {
+	var (
+		now       = time.Now()
+		selectors = []firewallv1.FQDNSelector{
+			{MatchName: "www.example.com"},
+			{MatchPattern: "*.test.org"},
+		}
+		setNames = func(sets []RenderIPSet) (result []string) {
+			for _, s := range sets {
+				result = append(result, s.SetName)
+			}
+			return
+		}
+	)
+	cache := newTestDNSCache(map[string]cacheEntry{})
+	add := func(fqdn string) {
+		if err := cache.updateIPEntry(fqdn, makeTestRRs(fqdn, "10.0.0.1"), now, nftables.TypeIPAddr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	setName := func(fqdn string) string {
+		return cache.fqdnToEntry[fqdn].IPv4.SetName
+	}
+
+	add("www.example.com.")
+	add("a.test.org.")
+	add("other.com.")
+	cache.updateSelectors(selectors)
+	// entries added after the selectors are matched as well
+	add("b.test.org.")
+
+	want := []string{setName("www.example.com."), setName("a.test.org."), setName("b.test.org.")}
+	slices.Sort(want)
+	if diff := cmp.Diff(want, setNames(cache.getSetsForRendering(selectors))); diff != "" {
+		t.Errorf("getSetsForRendering() diff = %s", diff)
+	}
+
+	// selectors which are not known to the cache are matched against all entries
+	unknown := []firewallv1.FQDNSelector{{MatchPattern: "*.com"}}
+	want = []string{setName("www.example.com."), setName("other.com.")}
+	slices.Sort(want)
+	if diff := cmp.Diff(want, setNames(cache.getSetsForRendering(unknown))); diff != "" {
+		t.Errorf("getSetsForRendering() with unknown selectors diff = %s", diff)
+	}
+
+	cache.updateSelectors(append(selectors, firewallv1.FQDNSelector{MatchName: "other.com"}))
+	if diff := cmp.Diff([]string{setName("other.com.")}, setNames(cache.getSetsForRendering([]firewallv1.FQDNSelector{{MatchName: "other.com"}}))); diff != "" {
+		t.Errorf("getSetsForRendering() after selector update diff = %s", diff)
+	}
+
+	// expired entries are not rendered anymore
+	cache.removeExpiredEntries(now.Add(time.Hour))
+	if got := cache.getSetsForRendering(selectors); len(got) != 0 {
+		t.Errorf("expected no sets after all entries expired, got %v", setNames(got))
+	}
+	if len(cache.matches) != 0 {
+		t.Errorf("expected no matches after all entries expired, got %v", cache.matches)
+	}
+}
+
 const (
 	raceNumGoroutines = 10
 	raceNumIterations = 100
@@ -244,9 +306,13 @@ func newTestDNSCache(entries map[string]cacheEntry) *DNSCache {
 		log:           logr.Discard(),
 		fqdnToEntry:   entries,
 		setNames:      make(map[string]struct{}),
+		dirty:         make(map[string]struct{}),
+		matcher:       newFQDNMatcher(nil),
+		matches:       map[string]map[string]struct{}{},
+		routes:        newDNSRoutes(),
 		dnsServerAddr: "127.0.0.1:53",
 		ctx:           context.Background(),
-		shootClient:   fake.NewClientBuilder().Build(),
+		shootClient:   fake.NewClientBuilder().WithScheme(testScheme()).Build(),
 		ipv4Enabled:   true,
 		ipv6Enabled:   true,
 	}
@@ -307,7 +373,7 @@ func TestRace_UpdateAndGetSetsForRendering(t *testing.T) {
 	wg.Wait()
 }
 
-func TestRace_UpdateAndGetSetNameForRegex(t *testing.T) {
+func TestRace_UpdateAndGetSetNameForPattern(t *testing.T) {
 	cache := newTestDNSCache(seedEntries(5))
 
 	var wg sync.WaitGroup
@@ -329,7 +395,7 @@ func TestRace_UpdateAndGetSetNameForRegex(t *testing.T) {
 		wg.Go(func() {
 			<-start
 			for range raceNumIterations {
-				cache.getSetNameForRegex(`.*\.example\.com\.`)
+				cache.getSetNameForPattern(firewallv1.FQDNSelector{MatchPattern: "*.example.com"})
 			}
 		})
 	}
@@ -372,7 +438,7 @@ func TestRace_UpdateAndGetSetNameForFQDN(t *testing.T) {
 	wg.Wait()
 }
 
-func TestRace_UpdateAndWriteStateToConfigmap(t *testing.T) {
+func TestRace_UpdateAndFlushState(t *testing.T) {
 	cache := newTestDNSCache(seedEntries(5))
 
 	var wg sync.WaitGroup
@@ -394,7 +460,7 @@ func TestRace_UpdateAndWriteStateToConfigmap(t *testing.T) {
 		wg.Go(func() {
 			<-start
 			for range raceNumIterations {
-				_ = cache.writeStateToConfigmap()
+				_ = cache.flushState(context.Background())
 			}
 		})
 	}
@@ -455,7 +521,7 @@ func TestRace_ConcurrentMultipleReaders(t *testing.T) {
 		wg.Go(func() {
 			<-start
 			for range raceNumIterations {
-				cache.getSetNameForRegex(`.*\.example\.com\.`)
+				cache.getSetNameForPattern(firewallv1.FQDNSelector{MatchPattern: "*.example.com"})
 			}
 		})
 	}
@@ -475,3 +541,14 @@ func TestRace_ConcurrentMultipleReaders(t *testing.T) {
 	close(start)
 	wg.Wait()
 }
+
+func Test_createSetNameCollision(t *testing.T) {
+	cache := newTestDNSCache(map[string]cacheEntry{})
+
+	first := cache.createSetName("example.com.", nftables.TypeIPAddr.Name, 0)
+
+	second := cache.createSetName("example.com.", nftables.TypeIPAddr.Name, 0)
+	if second == "" || second == first {
+		t.Errorf("expected a different set name on collision, got %q and %q", first, second)
+	}
+}
@@ -2,12 +2,21 @@ package dns
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
+	"net/http"
+	"net/netip"
+	"slices"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/metal-stack/metal-networker/pkg/netconf"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 
 	firewallv1 "github.com/metal-stack/firewall-controller/v2/api/v1"
@@ -15,131 +24,372 @@ import (
 	"github.com/go-logr/logr"
 	dnsgo "github.com/miekg/dns"
 
+	"github.com/metal-stack/firewall-controller/v2/pkg/conntrack"
 	"github.com/metal-stack/firewall-controller/v2/pkg/network"
 )
 
 const (
 	defaultDNSPort uint = 53
+	// shutdownTimeout is the time the servers get to finish running requests when they are stopped
+	shutdownTimeout = 5 * time.Second
 )
 
 type DNSHandler interface {
 	ServeDNS(w dnsgo.ResponseWriter, r *dnsgo.Msg)
 	UpdateDNSServerAddr(addr string) error
+	UpdateEDNSPolicy(policy *firewallv1.EDNSPolicy)
+	UpdateRateLimit(limit *firewallv1.DNSRateLimit)
 }
 
+// Config is the desired state of the DNS proxy
+type Config struct {
+	// Enabled serves DNS on the listen addresses, otherwise the servers are stopped but the cache is kept
+	Enabled bool
+	// DNSServerAddr is the address of the upstream DNS server in the form ip:port, defaults to 8.8.8.8:53
+	DNSServerAddr string
+	// Port is the port the DNS proxy listens on, defaults to 53
+	Port *uint
+	// Interceptions define the addresses the DNS proxy listens on, see ListenAddresses
+	Interceptions []firewallv1.DNSInterception
+}
+
+// DNSProxy forwards DNS requests and learns the IPs of the answers.
+// It runs for the whole lifetime of the manager and is reconfigured at runtime,
+// the cache is created when the proxy is enabled for the first time and kept from then on.
 type DNSProxy struct {
-	log        logr.Logger
-	ctx        context.Context
-	cancelFunc context.CancelFunc
-	cache      *DNSCache
+	sync.RWMutex
+
+	log          logr.Logger
+	shootClient  client.Client
+	trustAnchors []*dnsgo.DS
+	flows        flowTracker
+	recorder     record.EventRecorder
+	// eventObject is the object events about the DNS proxy are recorded for
+	eventObject runtime.Object
+
+	// ctx is the context of the manager, it is set when the proxy is started
+	ctx     context.Context
+	cache   *DNSCache
+	handler DNSHandler
 
+	enabled       bool
+	dnsServerAddr string
+	listeners     map[string]*listener
+}
+
+// listener serves DNS on a single address with UDP and TCP
+type listener struct {
 	udpServer *dnsgo.Server
 	tcpServer *dnsgo.Server
+	started   atomic.Int32
+	err       atomic.Pointer[error]
+}
 
-	handler DNSHandler
+// NewDNSProxy creates a DNS proxy which has to be added to a manager and is enabled with Configure.
+// If trust anchors are given, only IPs of answers which pass DNSSEC validation are learned.
+// Events, e.g. about clients exceeding the rate limits, are recorded for the given object if the recorder is set.
+// If the conntrack tracker is set, expired IPs are kept as long as established connections to them exist.
+func NewDNSProxy(shootClient client.Client, recorder record.EventRecorder, eventObject runtime.Object, log logr.Logger, trustAnchors []*dnsgo.DS, flows *conntrack.Tracker) *DNSProxy {
+	p := &DNSProxy{
+		log:          log,
+		shootClient:  shootClient,
+		trustAnchors: trustAnchors,
+		recorder:     recorder,
+		eventObject:  eventObject,
+		listeners:    map[string]*listener{},
+	}
+	if flows != nil {
+		p.flows = flows
+	}
+	return p
+}
+
+// Start waits until the manager stops and shuts down the servers
+func (p *DNSProxy) Start(ctx context.Context) error {
+	p.Lock()
+	p.ctx = ctx
+	p.Unlock()
+
+	<-ctx.Done()
+
+	p.Lock()
+	defer p.Unlock()
+	p.enabled = false
+	return p.updateListeners(nil)
+}
+
+// NeedLeaderElection returns false, the DNS proxy has to run on every firewall
+func (p *DNSProxy) NeedLeaderElection() bool {
+	return false
 }
 
-func NewDNSProxy(ctx context.Context, dns string, port *uint, shootClient client.Client, log logr.Logger) (*DNSProxy, error) {
-	if dns == "" {
-		dns = defaultDNSServerAddr
+// Configure applies the desired state to the proxy.
+// Servers on addresses which did not change keep running, so the proxy can be reconfigured without interruption.
+func (p *DNSProxy) Configure(c Config) error {
+	p.Lock()
+	defer p.Unlock()
+
+	if p.ctx == nil {
+		return fmt.Errorf("dns proxy is not started yet")
+	}
+	if p.ctx.Err() != nil {
+		return fmt.Errorf("dns proxy is stopped")
 	}
 
-	host, err := getHost()
-	if err != nil {
-		return nil, err
+	if !c.Enabled {
+		if p.enabled {
+			p.log.Info("stopping DNS proxy")
+		}
+		p.enabled = false
+		return p.updateListeners(nil)
+	}
+
+	if p.cache == nil {
+		cache, err := newDNSCache(p.ctx, defaultDNSServerAddr, true, false, p.shootClient, p.log.WithName("DNS cache"), p.trustAnchors, p.flows)
+		if err != nil {
+			return err
+		}
+		handler := NewDNSProxyHandler(p.log, cache)
+		handler.reportRateLimit = p.reportRateLimit
+		p.cache = cache
+		p.handler = handler
+		p.dnsServerAddr = defaultDNSServerAddr
+
+		go cache.runStateWriter()
+		go cache.runRefresher()
 	}
 
-	p := defaultDNSPort
-	if port != nil {
-		p = *port
+	dnsServerAddr := c.DNSServerAddr
+	if dnsServerAddr == "" {
+		dnsServerAddr = defaultDNSServerAddr
 	}
-	udpConn, tcpListener, err := bindToPort(host, int(p), log) // nolint:gosec
-	if err != nil {
-		return nil, fmt.Errorf("failed to bind to port: %w", err)
+	if dnsServerAddr != p.dnsServerAddr {
+		if err := p.handler.UpdateDNSServerAddr(dnsServerAddr); err != nil {
+			return fmt.Errorf("failed to update DNS server address: %w", err)
+		}
+		p.cache.updateDNSServerAddr(dnsServerAddr)
+		p.dnsServerAddr = dnsServerAddr
 	}
 
-	backgroundCtx, cancel := context.WithCancel(ctx)
-	cache, err := newDNSCache(backgroundCtx, dns, true, false, shootClient, log.WithName("DNS cache"))
+	hosts, err := ListenAddresses(c.Interceptions)
 	if err != nil {
-		cancel()
-		return nil, err
+		return err
+	}
+	port := defaultDNSPort
+	if c.Port != nil {
+		port = *c.Port
+	}
+	var addrs []string
+	for _, host := range hosts {
+		addrs = append(addrs, net.JoinHostPort(host, strconv.FormatUint(uint64(port), 10)))
 	}
-	handler := NewDNSProxyHandler(log, cache)
 
-	udpServer := &dnsgo.Server{PacketConn: udpConn, Addr: udpConn.LocalAddr().String(), Net: "udp", Handler: handler}
-	tcpServer := &dnsgo.Server{Listener: tcpListener, Addr: udpConn.LocalAddr().String(), Net: "tcp", Handler: handler}
+	if !p.enabled {
+		p.log.Info("starting DNS proxy", "addresses", addrs)
+	}
+	p.enabled = true
+	return p.updateListeners(addrs)
+}
 
-	return &DNSProxy{
-		log:        log,
-		ctx:        backgroundCtx,
-		cancelFunc: cancel,
-		cache:      cache,
+// updateListeners stops the servers of addresses which are not wanted anymore or failed and starts the missing ones.
+// The caller must hold the lock.
+func (p *DNSProxy) updateListeners(addrs []string) error {
+	for addr, l := range p.listeners {
+		if slices.Contains(addrs, addr) && l.err.Load() == nil {
+			continue
+		}
+		p.log.Info("stopping DNS servers", "address", addr)
+		l.shutdown(p.log)
+		delete(p.listeners, addr)
+	}
 
-		udpServer: udpServer,
-		tcpServer: tcpServer,
+	var errs []error
+	for _, addr := range addrs {
+		if _, ok := p.listeners[addr]; ok {
+			continue
+		}
+		l, err := p.listen(addr)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to bind to %s: %w", addr, err))
+			continue
+		}
+		p.listeners[addr] = l
+	}
+	return errors.Join(errs...)
+}
 
-		handler: handler,
-	}, nil
+// listen binds to the address and starts the UDP and TCP servers
+func (p *DNSProxy) listen(addr string) (*listener, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	portNumber, err := strconv.Atoi(port)
+	if err != nil {
+		return nil, err
+	}
+	udpConn, tcpListener, err := bindToPort(host, portNumber, p.log)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &listener{}
+	started := func() { l.started.Add(1) }
+	l.udpServer = &dnsgo.Server{PacketConn: udpConn, Addr: addr, Net: "udp", Handler: p.handler, NotifyStartedFunc: started}
+	l.tcpServer = &dnsgo.Server{Listener: tcpListener, Addr: addr, Net: "tcp", Handler: p.handler, NotifyStartedFunc: started}
+
+	for _, server := range []*dnsgo.Server{l.udpServer, l.tcpServer} {
+		go func() {
+			p.log.Info("starting server", "net", server.Net, "address", server.Addr)
+			if err := server.ActivateAndServe(); err != nil {
+				p.log.Error(err, "failed to start server", "net", server.Net, "address", server.Addr)
+				err = fmt.Errorf("%s server on %s failed: %w", server.Net, server.Addr, err)
+				l.err.Store(&err)
+			}
+		}()
+	}
+	return l, nil
 }
 
-// Run starts TCP/UDP servers
-func (p *DNSProxy) Run() {
-	go func() {
-		p.log.Info("starting UDP server")
-		if err := p.udpServer.ActivateAndServe(); err != nil {
-			p.log.Error(err, "failed to start UDP server")
+// shutdown stops the servers and releases the address
+func (l *listener) shutdown(log logr.Logger) {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	for _, server := range []*dnsgo.Server{l.udpServer, l.tcpServer} {
+		if err := server.ShutdownContext(ctx); err != nil {
+			log.Error(err, "failed to shut down server", "net", server.Net, "address", server.Addr)
 		}
-	}()
+	}
+	// the sockets are not closed by the shutdown if the server did not start yet
+	_ = l.udpServer.PacketConn.Close()
+	_ = l.tcpServer.Listener.Close()
+}
 
-	go func() {
-		p.log.Info("starting TCP server")
-		if err := p.tcpServer.ActivateAndServe(); err != nil {
-			p.log.Error(err, "failed to start TCP server")
+// Healthz fails if one of the servers stopped unexpectedly
+func (p *DNSProxy) Healthz(_ *http.Request) error {
+	p.RLock()
+	defer p.RUnlock()
+
+	var errs []error
+	for _, l := range p.listeners {
+		if err := l.err.Load(); err != nil {
+			errs = append(errs, *err)
 		}
-	}()
+	}
+	return errors.Join(errs...)
+}
 
-	<-p.ctx.Done()
-	ctx, cancel := context.WithTimeout(p.ctx, time.Second*5)
-	defer cancel()
+// Readyz fails if the proxy is enabled but does not serve on all of its addresses
+func (p *DNSProxy) Readyz(req *http.Request) error {
+	if err := p.Healthz(req); err != nil {
+		return err
+	}
 
-	if err := p.udpServer.ShutdownContext(ctx); err != nil {
-		p.log.Error(err, "failed to shut down UDP server")
+	p.RLock()
+	defer p.RUnlock()
+	if !p.enabled {
+		return nil
 	}
-	if err := p.tcpServer.ShutdownContext(ctx); err != nil {
-		p.log.Error(err, "failed to shut down TCP server")
+	if len(p.listeners) == 0 {
+		return fmt.Errorf("dns proxy is enabled but does not listen on any address")
 	}
+	for addr, l := range p.listeners {
+		if l.started.Load() < 2 {
+			return fmt.Errorf("dns proxy is not serving on %s yet", addr)
+		}
+	}
+	return nil
 }
 
-// Stop starts TCP/UDP servers
-func (p *DNSProxy) Stop() {
-	p.cancelFunc()
+// getCache returns the cache, which is nil until the proxy was enabled for the first time
+func (p *DNSProxy) getCache() *DNSCache {
+	p.RLock()
+	defer p.RUnlock()
+	return p.cache
 }
 
-func (p *DNSProxy) UpdateDNSServerAddr(addr string) error {
-	if err := p.handler.UpdateDNSServerAddr(addr); err != nil {
-		return fmt.Errorf("failed to update DNS server address: %w", err)
+func (p *DNSProxy) GetSetsForRendering(fqdns []firewallv1.FQDNSelector) (result []RenderIPSet) {
+	if c := p.getCache(); c != nil {
+		return c.getSetsForRendering(fqdns)
 	}
-	p.cache.updateDNSServerAddr(addr)
-
 	return nil
 }
 
-func (p *DNSProxy) GetSetsForRendering(fqdns []firewallv1.FQDNSelector) (result []RenderIPSet) {
-	return p.cache.getSetsForRendering(fqdns)
+// UpdateConfig applies the forwarders, static hosts and EDNS policy of the DNS proxy configuration
+func (p *DNSProxy) UpdateConfig(spec firewallv1.DNSProxyConfigSpec) {
+	p.RLock()
+	defer p.RUnlock()
+	if p.cache == nil {
+		return
+	}
+	p.cache.routes.update(spec)
+	p.handler.UpdateEDNSPolicy(spec.EDNS)
+	p.handler.UpdateRateLimit(spec.RateLimit)
+}
+
+// reportRateLimit logs and records an event when a client exceeds a rate limit
+func (p *DNSProxy) reportRateLimit(limit string, client netip.Prefix, message string) {
+	p.log.Info("rate limit exceeded", "limit", limit, "client", client)
+	if p.recorder != nil && p.eventObject != nil {
+		p.recorder.Event(p.eventObject, corev1.EventTypeWarning, "DNSRateLimited", message)
+	}
+}
+
+// UpdateFQDNSelectors passes the FQDN selectors of all policies to the cache
+func (p *DNSProxy) UpdateFQDNSelectors(fqdns []firewallv1.FQDNSelector) {
+	if c := p.getCache(); c != nil {
+		c.updateSelectors(fqdns)
+	}
 }
 
 func (p *DNSProxy) GetSetsForFQDN(fqdn firewallv1.FQDNSelector) (result []firewallv1.IPSet) {
-	return p.cache.getSetsForFQDN(fqdn)
+	if c := p.getCache(); c != nil {
+		return c.getSetsForFQDN(fqdn)
+	}
+	return nil
 }
 
+// IsInitialized returns whether the proxy is enabled
 func (p *DNSProxy) IsInitialized() bool {
-	return p != nil
+	if p == nil {
+		return false
+	}
+	p.RLock()
+	defer p.RUnlock()
+	return p.enabled
 }
 
 func (p *DNSProxy) CacheAddr() (string, error) {
 	return getHost()
 }
 
+// ListenAddresses returns the sorted addresses the DNS proxy has to listen on for the given interceptions.
+// Interceptions without a listen address, or no interceptions at all, use the first IP of the network with the default route.
+func ListenAddresses(interceptions []firewallv1.DNSInterception) ([]string, error) {
+	var (
+		addrs       []string
+		defaultAddr = len(interceptions) == 0
+	)
+	for _, i := range interceptions {
+		if i.ListenAddress == "" {
+			defaultAddr = true
+			continue
+		}
+		addrs = append(addrs, i.ListenAddress)
+	}
+	if defaultAddr {
+		host, err := getHost()
+		if err != nil {
+			return nil, err
+		}
+		addrs = append(addrs, host)
+	}
+
+	slices.Sort(addrs)
+	return slices.Compact(addrs), nil
+}
+
 func getHost() (string, error) {
 	c, err := netconf.New(network.GetLogger(), network.MetalNetworkerConfig)
 	if err != nil || c == nil {
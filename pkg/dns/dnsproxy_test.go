@@ -0,0 +1,139 @@
+package dns
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	dnsgo "github.com/miekg/dns"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	firewallv1 "github.com/metal-stack/firewall-controller/v2/api/v1"
+)
+
+func freePort(t *testing.T) uint {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %v", err)
+	}
+	defer func() {
+		_ = l.Close()
+	}()
+	return uint(l.Addr().(*net.TCPAddr).Port) // nolint:gosec
+}
+
+func waitFor(t *testing.T, msg string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", msg)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func Test_DNSProxyReconfiguration(t *testing.T) {
+	upstream := newTestEDNSUpstream(t)
+	// the requests are not inspected, including the one validating the upstream
+	go func() {
+		for range upstream.requests {
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	p := NewDNSProxy(fake.NewClientBuilder().WithScheme(testScheme()).Build(), nil, nil, logr.Discard(), nil, nil)
+
+	stopped := make(chan error)
+	go func() {
+		stopped <- p.Start(ctx)
+	}()
+
+	if err := p.Readyz(nil); err != nil {
+		t.Errorf("expected disabled proxy to be ready, got %v", err)
+	}
+
+	query := func(addr string) error {
+		request := new(dnsgo.Msg)
+		request.SetQuestion("www.example.com.", dnsgo.TypeA)
+		_, _, err := (&dnsgo.Client{Timeout: time.Second}).Exchange(request, addr)
+		return err
+	}
+
+	config := func(port uint) Config {
+		return Config{
+			Enabled:       true,
+			DNSServerAddr: upstream.addr,
+			Port:          &port,
+			Interceptions: []firewallv1.DNSInterception{{NetworkID: "internal", ListenAddress: "127.0.0.1"}},
+		}
+	}
+
+	var err error
+	waitFor(t, "proxy to start", func() bool {
+		err = p.Configure(config(freePort(t)))
+		return err == nil
+	})
+
+	firstAddr := ""
+	for addr := range p.listeners {
+		firstAddr = addr
+	}
+	waitFor(t, "proxy to be ready", func() bool { return p.Readyz(nil) == nil })
+	if err := query(firstAddr); err != nil {
+		t.Fatalf("expected query to be answered: %v", err)
+	}
+	cache := p.getCache()
+
+	err = p.Configure(config(freePort(t)))
+	if err != nil {
+		t.Fatalf("unable to reconfigure proxy: %v", err)
+	}
+	if len(p.listeners) != 1 {
+		t.Fatalf("expected proxy to listen on one address, got %d", len(p.listeners))
+	}
+	if _, ok := p.listeners[firstAddr]; ok {
+		t.Errorf("expected proxy to stop listening on %s", firstAddr)
+	}
+	if p.getCache() != cache {
+		t.Errorf("expected cache to be kept on reconfiguration")
+	}
+	secondAddr := ""
+	for addr := range p.listeners {
+		secondAddr = addr
+	}
+	waitFor(t, "proxy to be ready", func() bool { return p.Readyz(nil) == nil })
+	if err := query(secondAddr); err != nil {
+		t.Fatalf("expected query to be answered on the new port: %v", err)
+	}
+	if _, err := net.DialTimeout("tcp", firstAddr, time.Second); err == nil {
+		t.Errorf("expected old address %s to be released", firstAddr)
+	}
+
+	err = p.Configure(Config{})
+	if err != nil {
+		t.Fatalf("unable to disable proxy: %v", err)
+	}
+	if p.IsInitialized() {
+		t.Errorf("expected disabled proxy not to be initialized")
+	}
+	if p.getCache() != cache {
+		t.Errorf("expected cache to be kept when disabled")
+	}
+	if err := p.Readyz(nil); err != nil {
+		t.Errorf("expected disabled proxy to be ready, got %v", err)
+	}
+	if _, err := net.DialTimeout("tcp", secondAddr, time.Second); err == nil {
+		t.Errorf("expected address %s to be released", secondAddr)
+	}
+
+	cancel()
+	if err := <-stopped; err != nil {
+		t.Errorf("expected proxy to stop without error, got %v", err)
+	}
+	if err := p.Configure(config(freePort(t))); err == nil {
+		t.Errorf("expected stopped proxy not to be configurable")
+	}
+}
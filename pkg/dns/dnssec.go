@@ -0,0 +1,346 @@
+package dns
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	dnsgo "github.com/miekg/dns"
+)
+
+const (
+	// dnssecBufSize is the EDNS buffer size announced in queries with the DO bit set, signatures do not fit into 512 bytes
+	dnssecBufSize = 4096
+	// maxKeyCacheTTL is the maximum time validated zone keys are cached
+	maxKeyCacheTTL = time.Hour
+)
+
+// LoadTrustAnchors reads DS or DNSKEY records in zone file format which are used as trust anchors for DNSSEC validation.
+// DNSKEY records are converted to DS records.
+func LoadTrustAnchors(path string) ([]*dnsgo.DS, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open trust anchor file: %w", err)
+	}
+	defer f.Close()
+
+	var anchors []*dnsgo.DS
+	zp := dnsgo.NewZoneParser(f, ".", path)
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		switch r := rr.(type) {
+		case *dnsgo.DS:
+			anchors = append(anchors, r)
+		case *dnsgo.DNSKEY:
+			anchors = append(anchors, r.ToDS(dnsgo.SHA256))
+		}
+	}
+	if err := zp.Err(); err != nil {
+		return nil, fmt.Errorf("unable to parse trust anchor file: %w", err)
+	}
+	if len(anchors) == 0 {
+		return nil, fmt.Errorf("trust anchor file %s does not contain any DS or DNSKEY records", path)
+	}
+
+	return anchors, nil
+}
+
+// dnssecValidator validates answers by following the chain of signatures from the zone of the answer to a trust anchor.
+// Keys of zones which were validated once are cached.
+type dnssecValidator struct {
+	sync.Mutex
+
+	anchors map[string][]*dnsgo.DS
+	keys    map[string]zoneKeys
+	// query sends a query with the DO bit set to the upstream DNS server
+	query func(name string, qtype uint16) (*dnsgo.Msg, error)
+}
+
+type zoneKeys struct {
+	keys       []*dnsgo.DNSKEY
+	expiration time.Time
+}
+
+func newDNSSECValidator(anchors []*dnsgo.DS, query func(name string, qtype uint16) (*dnsgo.Msg, error)) *dnssecValidator {
+	v := &dnssecValidator{
+		anchors: map[string][]*dnsgo.DS{},
+		keys:    map[string]zoneKeys{},
+		query:   query,
+	}
+	for _, ds := range anchors {
+		zone := dnsgo.CanonicalName(ds.Hdr.Name)
+		v.anchors[zone] = append(v.anchors[zone], ds)
+	}
+	return v
+}
+
+// validate returns a copy of the message whose answer section only contains the RRsets with a valid chain of signatures.
+// The returned error lists all RRsets which were removed.
+func (v *dnssecValidator) validate(now time.Time, msg *dnsgo.Msg) (*dnsgo.Msg, error) {
+	type rrsetKey struct {
+		name  string
+		rtype uint16
+	}
+
+	var (
+		order []rrsetKey
+		sets  = map[rrsetKey][]dnsgo.RR{}
+		sigs  = map[rrsetKey][]*dnsgo.RRSIG{}
+	)
+	for _, rr := range msg.Answer {
+		name := dnsgo.CanonicalName(rr.Header().Name)
+		if sig, ok := rr.(*dnsgo.RRSIG); ok {
+			k := rrsetKey{name: name, rtype: sig.TypeCovered}
+			sigs[k] = append(sigs[k], sig)
+			continue
+		}
+		k := rrsetKey{name: name, rtype: rr.Header().Rrtype}
+		if _, ok := sets[k]; !ok {
+			order = append(order, k)
+		}
+		sets[k] = append(sets[k], rr)
+	}
+
+	validated := msg.Copy()
+	validated.Answer = nil
+
+	var errs []error
+	for _, k := range order {
+		sig, err := v.verifyRRset(now, sets[k], sigs[k])
+		if err != nil {
+			errs = append(errs, fmt.Errorf("unable to validate %s %s: %w", k.name, dnsgo.TypeToString[k.rtype], err))
+			continue
+		}
+		validated.Answer = append(validated.Answer, sets[k]...)
+		validated.Answer = append(validated.Answer, sig)
+	}
+
+	return validated, errors.Join(errs...)
+}
+
+// verifyRRset returns the first signature of the RRset which can be verified with validated keys.
+// The signer must be the zone of the RRset or one of its parents. RRSIG.Verify only checks that the name ends with the signer name,
+// which would allow e.g. the zone le.com. to sign records of example.com.
+func (v *dnssecValidator) verifyRRset(now time.Time, rrset []dnsgo.RR, sigs []*dnsgo.RRSIG) (*dnsgo.RRSIG, error) {
+	if len(sigs) == 0 {
+		return nil, fmt.Errorf("rrset is not signed")
+	}
+
+	var errs []error
+	for _, sig := range sigs {
+		if !dnsgo.IsSubDomain(sig.SignerName, rrset[0].Header().Name) {
+			errs = append(errs, fmt.Errorf("signer %s is not authoritative for %s", sig.SignerName, rrset[0].Header().Name))
+			continue
+		}
+		if !sig.ValidityPeriod(now) {
+			errs = append(errs, fmt.Errorf("signature of %s with key %d is expired or not yet valid", sig.SignerName, sig.KeyTag))
+			continue
+		}
+
+		keys, err := v.zoneKeys(now, dnsgo.CanonicalName(sig.SignerName))
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		for _, key := range keys {
+			if key.KeyTag() != sig.KeyTag || key.Algorithm != sig.Algorithm {
+				continue
+			}
+			if err := sig.Verify(key, rrset); err != nil {
+				errs = append(errs, fmt.Errorf("signature of %s with key %d is invalid: %w", sig.SignerName, sig.KeyTag, err))
+				continue
+			}
+			return sig, nil
+		}
+	}
+
+	return nil, errors.Join(append([]error{fmt.Errorf("no valid signature found")}, errs...)...)
+}
+
+// zoneKeys returns the validated keys of a zone.
+// The DNSKEY RRset of the zone must be signed by a key matching a trust anchor or a validated DS record of the parent zone.
+func (v *dnssecValidator) zoneKeys(now time.Time, zone string) ([]*dnsgo.DNSKEY, error) {
+	v.Lock()
+	cached, ok := v.keys[zone]
+	v.Unlock()
+	if ok && now.Before(cached.expiration) {
+		return cached.keys, nil
+	}
+
+	dsSet, err := v.delegationSigners(now, zone)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := v.query(zone, dnsgo.TypeDNSKEY)
+	if err != nil {
+		return nil, fmt.Errorf("unable to query keys of zone %s: %w", zone, err)
+	}
+
+	var (
+		keys []*dnsgo.DNSKEY
+		sigs []*dnsgo.RRSIG
+	)
+	for _, rr := range resp.Answer {
+		if dnsgo.CanonicalName(rr.Header().Name) != zone {
+			continue
+		}
+		switch r := rr.(type) {
+		case *dnsgo.DNSKEY:
+			keys = append(keys, r)
+		case *dnsgo.RRSIG:
+			if r.TypeCovered == dnsgo.TypeDNSKEY {
+				sigs = append(sigs, r)
+			}
+		}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("zone %s does not have any keys", zone)
+	}
+
+	rrset := make([]dnsgo.RR, 0, len(keys))
+	for _, k := range keys {
+		rrset = append(rrset, k)
+	}
+
+	// the key set must be signed by a key which is referenced by a DS record
+	for _, sig := range sigs {
+		if !sig.ValidityPeriod(now) {
+			continue
+		}
+		for _, key := range keys {
+			if key.KeyTag() != sig.KeyTag || !matchesDS(key, dsSet) {
+				continue
+			}
+			if err := sig.Verify(key, rrset); err != nil {
+				continue
+			}
+
+			ttl := min(time.Duration(keys[0].Hdr.Ttl)*time.Second, maxKeyCacheTTL)
+			v.Lock()
+			v.keys[zone] = zoneKeys{keys: keys, expiration: now.Add(ttl)}
+			v.Unlock()
+
+			return keys, nil
+		}
+	}
+
+	return nil, fmt.Errorf("keys of zone %s are not signed by a trusted key", zone)
+}
+
+// delegationSigners returns the DS records of a zone, either from the trust anchors or validated with the keys of the parent zone
+func (v *dnssecValidator) delegationSigners(now time.Time, zone string) ([]*dnsgo.DS, error) {
+	if anchors, ok := v.anchors[zone]; ok {
+		return anchors, nil
+	}
+	if zone == "." {
+		return nil, fmt.Errorf("no trust anchor found in the chain of trust")
+	}
+
+	resp, err := v.query(zone, dnsgo.TypeDS)
+	if err != nil {
+		return nil, fmt.Errorf("unable to query delegation signers of zone %s: %w", zone, err)
+	}
+
+	var (
+		rrset []dnsgo.RR
+		dsSet []*dnsgo.DS
+		sigs  []*dnsgo.RRSIG
+	)
+	for _, rr := range resp.Answer {
+		if dnsgo.CanonicalName(rr.Header().Name) != zone {
+			continue
+		}
+		switch r := rr.(type) {
+		case *dnsgo.DS:
+			rrset = append(rrset, r)
+			dsSet = append(dsSet, r)
+		case *dnsgo.RRSIG:
+			// DS records are signed by the parent zone, anything else would allow a loop
+			if r.TypeCovered == dnsgo.TypeDS && dnsgo.CanonicalName(r.SignerName) != zone && dnsgo.IsSubDomain(r.SignerName, zone) {
+				sigs = append(sigs, r)
+			}
+		}
+	}
+	if len(dsSet) == 0 {
+		return nil, fmt.Errorf("zone %s is not signed", zone)
+	}
+
+	if _, err := v.verifyRRset(now, rrset, sigs); err != nil {
+		return nil, fmt.Errorf("unable to validate delegation signers of zone %s: %w", zone, err)
+	}
+
+	return dsSet, nil
+}
+
+func matchesDS(key *dnsgo.DNSKEY, dsSet []*dnsgo.DS) bool {
+	for _, ds := range dsSet {
+		if ds.KeyTag != key.KeyTag() || ds.Algorithm != key.Algorithm {
+			continue
+		}
+		if d := key.ToDS(ds.DigestType); d != nil && strings.EqualFold(d.Digest, ds.Digest) {
+			return true
+		}
+	}
+	return false
+}
+
+// queryDNSSEC queries the given DNS server with the DO bit set and retries over TCP if the answer was truncated
+func queryDNSSEC(addr, name string, qtype uint16) (*dnsgo.Msg, error) {
+	m := new(dnsgo.Msg)
+	m.Id = dnsgo.Id()
+	m.SetQuestion(name, qtype)
+	m.SetEdns0(dnssecBufSize, true)
+
+	resp, _, err := (&dnsgo.Client{Net: "udp", Timeout: dnsTimeout}).Exchange(m, addr)
+	if err == nil && resp.Truncated {
+		resp, _, err = (&dnsgo.Client{Net: "tcp", Timeout: dnsTimeout}).Exchange(m, addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// setDNSSECOK returns a copy of the request with the DO bit set and whether the client requested DNSSEC records itself
+func setDNSSECOK(request *dnsgo.Msg) (*dnsgo.Msg, bool) {
+	if opt := request.IsEdns0(); opt != nil && opt.Do() {
+		return request, true
+	}
+
+	r := request.Copy()
+	if opt := r.IsEdns0(); opt != nil {
+		opt.SetDo()
+	} else {
+		r.SetEdns0(dnssecBufSize, true)
+	}
+	return r, false
+}
+
+// stripDNSSECRecords removes the DNSSEC records which were only added to a response because the proxy set the DO bit.
+// If the client did not use EDNS, the OPT record is removed as well.
+func stripDNSSECRecords(response *dnsgo.Msg, clientEDNS bool) {
+	filter := func(rrs []dnsgo.RR) []dnsgo.RR {
+		var result []dnsgo.RR
+		for _, rr := range rrs {
+			switch r := rr.(type) {
+			case *dnsgo.RRSIG, *dnsgo.NSEC, *dnsgo.NSEC3:
+				continue
+			case *dnsgo.OPT:
+				if !clientEDNS {
+					continue
+				}
+				r.SetDo(false)
+			}
+			result = append(result, rr)
+		}
+		return result
+	}
+
+	response.Answer = filter(response.Answer)
+	response.Ns = filter(response.Ns)
+	response.Extra = filter(response.Extra)
+}
@@ -0,0 +1,254 @@
+package dns
+
+import (
+	"crypto"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	dnsgo "github.com/miekg/dns"
+)
+
+type testZoneKey struct {
+	key    *dnsgo.DNSKEY
+	signer crypto.Signer
+}
+
+func newTestZoneKey(t *testing.T, zone string) testZoneKey {
+	key := &dnsgo.DNSKEY{
+		Hdr:       dnsgo.RR_Header{Name: zone, Rrtype: dnsgo.TypeDNSKEY, Class: dnsgo.ClassINET, Ttl: 3600},
+		Flags:     dnsgo.ZONE | dnsgo.SEP,
+		Protocol:  3,
+		Algorithm: dnsgo.ECDSAP256SHA256,
+	}
+	priv, err := key.Generate(256)
+	if err != nil {
+		t.Fatalf("unable to generate key: %v", err)
+	}
+	return testZoneKey{key: key, signer: priv.(crypto.Signer)}
+}
+
+func (k testZoneKey) sign(t *testing.T, validFrom, validUntil time.Time, rrset ...dnsgo.RR) *dnsgo.RRSIG {
+	sig := &dnsgo.RRSIG{
+		Hdr:        dnsgo.RR_Header{Ttl: rrset[0].Header().Ttl},
+		KeyTag:     k.key.KeyTag(),
+		SignerName: k.key.Hdr.Name,
+		Algorithm:  k.key.Algorithm,
+		Inception:  uint32(validFrom.Unix()),  // nolint:gosec
+		Expiration: uint32(validUntil.Unix()), // nolint:gosec
+	}
+	if err := sig.Sign(k.signer, rrset); err != nil {
+		t.Fatalf("unable to sign rrset: %v", err)
+	}
+	return sig
+}
+
+func newTestA(name, ip string) *dnsgo.A {
+	return &dnsgo.A{
+		Hdr: dnsgo.RR_Header{Name: name, Rrtype: dnsgo.TypeA, Class: dnsgo.ClassINET, Ttl: 300},
+		A:   net.ParseIP(ip),
+	}
+}
+
+// testSignedZones serves the zone example. which is used as trust anchor and its delegated zones child.example. and ild.example.
+type testSignedZones struct {
+	addr    string
+	anchor  *dnsgo.DS
+	answers map[string][]dnsgo.RR
+}
+
+func newTestSignedZones(t *testing.T) *testSignedZones {
+	now := time.Now()
+	from, until := now.Add(-time.Hour), now.Add(time.Hour)
+
+	parent := newTestZoneKey(t, "example.")
+	child := newTestZoneKey(t, "child.example.")
+	rogue := newTestZoneKey(t, "child.example.")
+	other := newTestZoneKey(t, "ild.example.")
+
+	ds := child.key.ToDS(dnsgo.SHA256)
+	ds.Hdr.Ttl = 3600
+	otherDS := other.key.ToDS(dnsgo.SHA256)
+	otherDS.Hdr.Ttl = 3600
+
+	www := newTestA("www.child.example.", "1.2.3.4")
+	evil := newTestA("evil.child.example.", "6.6.6.6")
+	unsigned := newTestA("unsigned.child.example.", "7.7.7.7")
+	expired := newTestA("expired.child.example.", "8.8.8.8")
+	forged := newTestA("forged.child.example.", "9.9.9.9")
+
+	z := &testSignedZones{
+		anchor: parent.key.ToDS(dnsgo.SHA256),
+		answers: map[string][]dnsgo.RR{
+			"example./DNSKEY":           {parent.key, parent.sign(t, from, until, parent.key)},
+			"child.example./DS":         {ds, parent.sign(t, from, until, ds)},
+			"child.example./DNSKEY":     {child.key, child.sign(t, from, until, child.key)},
+			"www.child.example./A":      {www, child.sign(t, from, until, www)},
+			"evil.child.example./A":     {evil, rogue.sign(t, from, until, evil)},
+			"unsigned.child.example./A": {unsigned},
+			"expired.child.example./A":  {expired, child.sign(t, now.Add(-2*time.Hour), from, expired)},
+			"ild.example./DS":           {otherDS, parent.sign(t, from, until, otherDS)},
+			"ild.example./DNSKEY":       {other.key, other.sign(t, from, until, other.key)},
+			// signed with a valid chain of trust by a zone whose name is a suffix, but not a parent of the name
+			"forged.child.example./A": {forged, other.sign(t, from, until, forged)},
+		},
+	}
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %v", err)
+	}
+	z.addr = pc.LocalAddr().String()
+
+	started := make(chan struct{})
+	server := &dnsgo.Server{PacketConn: pc, Handler: z, NotifyStartedFunc: func() { close(started) }}
+	go func() {
+		_ = server.ActivateAndServe()
+	}()
+	t.Cleanup(func() {
+		_ = server.Shutdown()
+	})
+	<-started
+
+	return z
+}
+
+func (z *testSignedZones) ServeDNS(w dnsgo.ResponseWriter, r *dnsgo.Msg) {
+	m := new(dnsgo.Msg)
+	m.SetReply(r)
+	q := r.Question[0]
+	m.Answer = z.answers[strings.ToLower(q.Name)+"/"+dnsgo.TypeToString[q.Qtype]]
+	_ = w.WriteMsg(m)
+}
+
+func (z *testSignedZones) query(t *testing.T, name string) *dnsgo.Msg {
+	resp, err := queryDNSSEC(z.addr, name, dnsgo.TypeA)
+	if err != nil {
+		t.Fatalf("unable to query %s: %v", name, err)
+	}
+	return resp
+}
+
+func Test_dnssecValidator(t *testing.T) {
+	zones := newTestSignedZones(t)
+
+	tests := []struct {
+		name    string
+		qname   string
+		wantErr bool
+	}{
+		{
+			name:  "answer with valid chain of trust",
+			qname: "www.child.example.",
+		},
+		{
+			name:    "answer signed by a key not in the zone",
+			qname:   "evil.child.example.",
+			wantErr: true,
+		},
+		{
+			name:    "unsigned answer",
+			qname:   "unsigned.child.example.",
+			wantErr: true,
+		},
+		{
+			name:    "expired signature",
+			qname:   "expired.child.example.",
+			wantErr: true,
+		},
+		{
+			name:    "answer signed by a zone which is not a parent",
+			qname:   "forged.child.example.",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := newDNSSECValidator([]*dnsgo.DS{zones.anchor}, func(name string, qtype uint16) (*dnsgo.Msg, error) {
+				return queryDNSSEC(zones.addr, name, qtype)
+			})
+
+			validated, err := v.validate(time.Now(), zones.query(t, tt.qname))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			hasA := false
+			for _, rr := range validated.Answer {
+				if _, ok := rr.(*dnsgo.A); ok {
+					hasA = true
+				}
+			}
+			if hasA == tt.wantErr {
+				t.Errorf("validate() returned A records = %v, but wantErr %v", hasA, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_dnssecValidatorWithoutTrustAnchor(t *testing.T) {
+	zones := newTestSignedZones(t)
+	other := newTestZoneKey(t, "example.")
+
+	v := newDNSSECValidator([]*dnsgo.DS{other.key.ToDS(dnsgo.SHA256)}, func(name string, qtype uint16) (*dnsgo.Msg, error) {
+		return queryDNSSEC(zones.addr, name, qtype)
+	})
+
+	if _, err := v.validate(time.Now(), zones.query(t, "www.child.example.")); err == nil {
+		t.Errorf("expected validation to fail if the zone is not signed by the trust anchor")
+	}
+}
+
+func Test_UpdateOnlyAddsValidatedRecords(t *testing.T) {
+	zones := newTestSignedZones(t)
+
+	cache := newTestDNSCache(map[string]cacheEntry{})
+	cache.dnsServerAddr = zones.addr
+	cache.validator = newDNSSECValidator([]*dnsgo.DS{zones.anchor}, func(name string, qtype uint16) (*dnsgo.Msg, error) {
+		return queryDNSSEC(zones.addr, name, qtype)
+	})
+
+	for _, name := range []string{"www.child.example.", "evil.child.example."} {
+		if _, err := cache.Update(time.Now(), name, zones.query(t, name)); err != nil {
+			t.Fatalf("Update() error = %v", err)
+		}
+	}
+
+	if _, ok := cache.fqdnToEntry["www.child.example."]; !ok {
+		t.Errorf("expected validated answer to be added to the cache")
+	}
+	if _, ok := cache.fqdnToEntry["evil.child.example."]; ok {
+		t.Errorf("expected answer which failed validation not to be added to the cache")
+	}
+	if len(cache.setNames) != 1 {
+		t.Errorf("expected only one set to be created, got %v", cache.setNames)
+	}
+}
+
+func Test_stripDNSSECRecords(t *testing.T) {
+	request := new(dnsgo.Msg)
+	request.SetQuestion("www.child.example.", dnsgo.TypeA)
+
+	upstream, clientDNSSEC := setDNSSECOK(request)
+	if clientDNSSEC {
+		t.Errorf("expected client not to request dnssec records")
+	}
+	if opt := upstream.IsEdns0(); opt == nil || !opt.Do() {
+		t.Errorf("expected DO bit to be set on the upstream request")
+	}
+	if request.IsEdns0() != nil {
+		t.Errorf("expected the client request not to be modified")
+	}
+
+	response := new(dnsgo.Msg)
+	response.SetReply(upstream)
+	response.Answer = []dnsgo.RR{newTestA("www.child.example.", "1.2.3.4"), &dnsgo.RRSIG{Hdr: dnsgo.RR_Header{Name: "www.child.example.", Rrtype: dnsgo.TypeRRSIG}}}
+	response.SetEdns0(dnssecBufSize, true)
+
+	stripDNSSECRecords(response, false)
+
+	if len(response.Answer) != 1 || response.IsEdns0() != nil {
+		t.Errorf("expected signatures and OPT record to be removed, got %v", response)
+	}
+}
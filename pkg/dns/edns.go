@@ -0,0 +1,160 @@
+package dns
+
+import (
+	"net/netip"
+	"slices"
+
+	dnsgo "github.com/miekg/dns"
+
+	firewallv1 "github.com/metal-stack/firewall-controller/v2/api/v1"
+)
+
+const (
+	// defaultEDNSBufSize is the UDP buffer size of OPT records which are added by the proxy, as recommended by the DNS flag day 2020
+	defaultEDNSBufSize = 1232
+	// paddingBlockSize is the block length requests are padded to, as recommended by RFC 8467
+	paddingBlockSize = 128
+)
+
+// ednsPolicy rewrites the EDNS options of requests which are forwarded to the DNS servers
+type ednsPolicy struct {
+	clientSubnet  firewallv1.EDNSOptionMode
+	subnet        *dnsgo.EDNS0_SUBNET
+	udpBufferSize uint16
+	nsid          firewallv1.EDNSOptionMode
+	padding       firewallv1.EDNSOptionMode
+}
+
+// newEDNSPolicy creates the policy of the given configuration, without configuration all options are passed through
+func newEDNSPolicy(p *firewallv1.EDNSPolicy) ednsPolicy {
+	if p == nil {
+		return ednsPolicy{}
+	}
+
+	policy := ednsPolicy{
+		clientSubnet: p.ClientSubnet,
+		nsid:         p.NSID,
+		padding:      p.Padding,
+	}
+	if p.UDPBufferSize != nil {
+		policy.udpBufferSize = *p.UDPBufferSize
+	}
+	if prefix, err := netip.ParsePrefix(p.ClientSubnetPrefix); err == nil && p.ClientSubnet == firewallv1.EDNSOptionSet {
+		prefix = prefix.Masked()
+		policy.subnet = &dnsgo.EDNS0_SUBNET{
+			Code:          dnsgo.EDNS0SUBNET,
+			Family:        1,
+			SourceNetmask: uint8(prefix.Bits()), // nolint:gosec
+			Address:       prefix.Addr().AsSlice(),
+		}
+		if prefix.Addr().Is6() {
+			policy.subnet.Family = 2
+		}
+	}
+	return policy
+}
+
+// needsEDNS returns whether the policy adds options or a buffer size, such that requests without EDNS get an OPT record
+func (p ednsPolicy) needsEDNS() bool {
+	return p.subnet != nil || p.nsid == firewallv1.EDNSOptionSet || p.padding == firewallv1.EDNSOptionSet
+}
+
+// prepareRequest returns the request which is forwarded to the DNS servers.
+// The request of the client is copied if it needs to be changed.
+func (p ednsPolicy) prepareRequest(request *dnsgo.Msg) *dnsgo.Msg {
+	if (p == ednsPolicy{}) || (request.IsEdns0() == nil && !p.needsEDNS()) {
+		return request
+	}
+
+	r := request.Copy()
+	opt := r.IsEdns0()
+	if opt == nil {
+		r.SetEdns0(defaultEDNSBufSize, false)
+		opt = r.IsEdns0()
+	}
+	if p.udpBufferSize > 0 {
+		opt.SetUDPSize(p.udpBufferSize)
+	}
+
+	opt.Option = slices.DeleteFunc(opt.Option, func(o dnsgo.EDNS0) bool {
+		switch o.Option() {
+		case dnsgo.EDNS0SUBNET:
+			return p.clientSubnet == firewallv1.EDNSOptionStrip || p.clientSubnet == firewallv1.EDNSOptionSet
+		case dnsgo.EDNS0NSID:
+			return p.nsid == firewallv1.EDNSOptionStrip || p.nsid == firewallv1.EDNSOptionSet
+		case dnsgo.EDNS0PADDING:
+			// padding is added again as last option, after the size of the request is known
+			return p.padding == firewallv1.EDNSOptionStrip || p.padding == firewallv1.EDNSOptionSet
+		}
+		return false
+	})
+	if p.subnet != nil {
+		subnet := *p.subnet
+		opt.Option = append(opt.Option, &subnet)
+	}
+	if p.nsid == firewallv1.EDNSOptionSet {
+		opt.Option = append(opt.Option, &dnsgo.EDNS0_NSID{Code: dnsgo.EDNS0NSID})
+	}
+	if p.padding == firewallv1.EDNSOptionSet {
+		padding := &dnsgo.EDNS0_PADDING{}
+		opt.Option = append(opt.Option, padding)
+		padding.Padding = make([]byte, paddingLength(r.Len()))
+	}
+	return r
+}
+
+// paddingLength returns the length of the padding which fills a message with an empty padding option up to the next block
+func paddingLength(msgLen int) int {
+	return (paddingBlockSize - msgLen%paddingBlockSize) % paddingBlockSize
+}
+
+// restoreClientEDNS removes the EDNS options from the response which were not sent by the client.
+// If the client did not use EDNS, the OPT record is removed. If the client subnet option of the client
+// was not forwarded as is, it is returned with a scope of zero, as the answer was not scoped to it.
+func (p ednsPolicy) restoreClientEDNS(request, response *dnsgo.Msg) {
+	clientOpt := request.IsEdns0()
+	if clientOpt == nil {
+		response.Extra = slices.DeleteFunc(response.Extra, func(rr dnsgo.RR) bool {
+			_, ok := rr.(*dnsgo.OPT)
+			return ok
+		})
+		return
+	}
+
+	opt := response.IsEdns0()
+	if opt == nil {
+		return
+	}
+
+	sent := map[uint16]dnsgo.EDNS0{}
+	for _, o := range clientOpt.Option {
+		sent[o.Option()] = o
+	}
+	subnetForwarded := p.clientSubnet == "" || p.clientSubnet == firewallv1.EDNSOptionPass
+	opt.Option = slices.DeleteFunc(opt.Option, func(o dnsgo.EDNS0) bool {
+		if _, ok := sent[o.Option()]; !ok {
+			return true
+		}
+		return o.Option() == dnsgo.EDNS0SUBNET && !subnetForwarded
+	})
+
+	if clientSubnet, ok := sent[dnsgo.EDNS0SUBNET].(*dnsgo.EDNS0_SUBNET); ok && !subnetForwarded {
+		subnet := *clientSubnet
+		subnet.SourceScope = 0
+		opt.Option = append(opt.Option, &subnet)
+	}
+}
+
+// responseNSID returns the name server identifier of the response, if there is any
+func responseNSID(response *dnsgo.Msg) string {
+	opt := response.IsEdns0()
+	if opt == nil {
+		return ""
+	}
+	for _, o := range opt.Option {
+		if nsid, ok := o.(*dnsgo.EDNS0_NSID); ok {
+			return nsid.Nsid
+		}
+	}
+	return ""
+}
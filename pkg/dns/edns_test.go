@@ -0,0 +1,282 @@
+package dns
+
+import (
+	"net"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/google/go-cmp/cmp"
+	dnsgo "github.com/miekg/dns"
+
+	firewallv1 "github.com/metal-stack/firewall-controller/v2/api/v1"
+)
+
+// testEDNSUpstream is a DNS server which records the requests it received and answers with an A record.
+// It returns a name server identifier and a client subnet scope if requested.
+type testEDNSUpstream struct {
+	addr     string
+	requests chan recordedRequest
+}
+
+type recordedRequest struct {
+	msg    *dnsgo.Msg
+	length int
+}
+
+func newTestEDNSUpstream(t *testing.T) *testEDNSUpstream {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+
+	u := &testEDNSUpstream{addr: conn.LocalAddr().String(), requests: make(chan recordedRequest, 1)}
+	go func() {
+		buf := make([]byte, dnsgo.MaxMsgSize)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			request := new(dnsgo.Msg)
+			if err := request.Unpack(buf[:n]); err != nil {
+				continue
+			}
+			u.requests <- recordedRequest{msg: request, length: n}
+
+			response := new(dnsgo.Msg)
+			response.SetReply(request)
+			response.Answer = makeTestRRs(request.Question[0].Name, "10.0.0.1")
+			if opt := request.IsEdns0(); opt != nil {
+				reply := &dnsgo.OPT{Hdr: dnsgo.RR_Header{Name: ".", Rrtype: dnsgo.TypeOPT}}
+				reply.SetUDPSize(dnsgo.DefaultMsgSize)
+				for _, o := range opt.Option {
+					switch o := o.(type) {
+					case *dnsgo.EDNS0_NSID:
+						reply.Option = append(reply.Option, &dnsgo.EDNS0_NSID{Code: dnsgo.EDNS0NSID, Nsid: "6e7331"})
+					case *dnsgo.EDNS0_SUBNET:
+						scoped := *o
+						scoped.SourceScope = 24
+						reply.Option = append(reply.Option, &scoped)
+					}
+				}
+				response.Extra = append(response.Extra, reply)
+			}
+
+			packed, err := response.Pack()
+			if err != nil {
+				continue
+			}
+			_, _ = conn.WriteTo(packed, addr)
+		}
+	}()
+	return u
+}
+
+func testSubnet(addr string, bits, scope uint8) *dnsgo.EDNS0_SUBNET {
+	return &dnsgo.EDNS0_SUBNET{
+		Code:          dnsgo.EDNS0SUBNET,
+		Family:        1,
+		SourceNetmask: bits,
+		SourceScope:   scope,
+		Address:       net.ParseIP(addr).To4(),
+	}
+}
+
+func Test_ServeDNSEDNSPolicy(t *testing.T) {
+	upstream := newTestEDNSUpstream(t)
+
+	tests := []struct {
+		name          string
+		policy        *firewallv1.EDNSPolicy
+		dnssec        bool
+		clientEDNS    bool
+		clientOptions []dnsgo.EDNS0
+		// wantUpstreamOptions are the options received by the upstream, nil if it did not receive an OPT record
+		wantUpstreamOptions []dnsgo.EDNS0
+		wantUpstreamBufSize uint16
+		wantUpstreamDO      bool
+		// wantClientOptions are the options of the response to the client, nil if it does not contain an OPT record
+		wantClientOptions []dnsgo.EDNS0
+		wantPadded        bool
+	}{
+		{
+			name:                "client subnet is passed by default",
+			clientEDNS:          true,
+			clientOptions:       []dnsgo.EDNS0{testSubnet("10.0.1.0", 24, 0)},
+			wantUpstreamOptions: []dnsgo.EDNS0{testSubnet("10.0.1.0", 24, 0)},
+			wantUpstreamBufSize: 4096,
+			wantClientOptions:   []dnsgo.EDNS0{testSubnet("10.0.1.0", 24, 24)},
+		},
+		{
+			name:                "client subnet is stripped",
+			policy:              &firewallv1.EDNSPolicy{ClientSubnet: firewallv1.EDNSOptionStrip},
+			clientEDNS:          true,
+			clientOptions:       []dnsgo.EDNS0{testSubnet("10.0.1.0", 24, 0)},
+			wantUpstreamOptions: []dnsgo.EDNS0{},
+			wantUpstreamBufSize: 4096,
+			wantClientOptions:   []dnsgo.EDNS0{testSubnet("10.0.1.0", 24, 0)},
+		},
+		{
+			name:                "client subnet of the firewall is added to requests without edns",
+			policy:              &firewallv1.EDNSPolicy{ClientSubnet: firewallv1.EDNSOptionSet, ClientSubnetPrefix: "185.0.0.7/24"},
+			wantUpstreamOptions: []dnsgo.EDNS0{testSubnet("185.0.0.0", 24, 0)},
+			wantUpstreamBufSize: defaultEDNSBufSize,
+		},
+		{
+			name:                "client subnet of the client is replaced",
+			policy:              &firewallv1.EDNSPolicy{ClientSubnet: firewallv1.EDNSOptionSet, ClientSubnetPrefix: "185.0.0.0/24"},
+			clientEDNS:          true,
+			clientOptions:       []dnsgo.EDNS0{testSubnet("10.0.1.0", 24, 0)},
+			wantUpstreamOptions: []dnsgo.EDNS0{testSubnet("185.0.0.0", 24, 0)},
+			wantUpstreamBufSize: 4096,
+			wantClientOptions:   []dnsgo.EDNS0{testSubnet("10.0.1.0", 24, 0)},
+		},
+		{
+			name:                "buffer size is normalized",
+			policy:              &firewallv1.EDNSPolicy{UDPBufferSize: new(uint16(1400))},
+			clientEDNS:          true,
+			wantUpstreamOptions: []dnsgo.EDNS0{},
+			wantUpstreamBufSize: 1400,
+			wantClientOptions:   []dnsgo.EDNS0{},
+		},
+		{
+			name:                "nsid is requested but not returned to clients which did not ask for it",
+			policy:              &firewallv1.EDNSPolicy{NSID: firewallv1.EDNSOptionSet},
+			clientEDNS:          true,
+			wantUpstreamOptions: []dnsgo.EDNS0{&dnsgo.EDNS0_NSID{Code: dnsgo.EDNS0NSID}},
+			wantUpstreamBufSize: 4096,
+			wantClientOptions:   []dnsgo.EDNS0{},
+		},
+		{
+			name:                "nsid is passed to clients which asked for it",
+			clientEDNS:          true,
+			clientOptions:       []dnsgo.EDNS0{&dnsgo.EDNS0_NSID{Code: dnsgo.EDNS0NSID}},
+			wantUpstreamOptions: []dnsgo.EDNS0{&dnsgo.EDNS0_NSID{Code: dnsgo.EDNS0NSID}},
+			wantUpstreamBufSize: 4096,
+			wantClientOptions:   []dnsgo.EDNS0{&dnsgo.EDNS0_NSID{Code: dnsgo.EDNS0NSID, Nsid: "6e7331"}},
+		},
+		{
+			name:                "nsid is stripped",
+			policy:              &firewallv1.EDNSPolicy{NSID: firewallv1.EDNSOptionStrip},
+			clientEDNS:          true,
+			clientOptions:       []dnsgo.EDNS0{&dnsgo.EDNS0_NSID{Code: dnsgo.EDNS0NSID}},
+			wantUpstreamOptions: []dnsgo.EDNS0{},
+			wantUpstreamBufSize: 4096,
+			wantClientOptions:   []dnsgo.EDNS0{},
+		},
+		{
+			name:                "requests are padded",
+			policy:              &firewallv1.EDNSPolicy{Padding: firewallv1.EDNSOptionSet},
+			clientEDNS:          true,
+			wantUpstreamBufSize: 4096,
+			wantClientOptions:   []dnsgo.EDNS0{},
+			wantPadded:          true,
+		},
+		{
+			name:                "policy is applied to requests with dnssec",
+			policy:              &firewallv1.EDNSPolicy{ClientSubnet: firewallv1.EDNSOptionSet, ClientSubnetPrefix: "185.0.0.0/24", NSID: firewallv1.EDNSOptionSet},
+			dnssec:              true,
+			clientEDNS:          true,
+			clientOptions:       []dnsgo.EDNS0{testSubnet("10.0.1.0", 24, 0)},
+			wantUpstreamOptions: []dnsgo.EDNS0{testSubnet("185.0.0.0", 24, 0), &dnsgo.EDNS0_NSID{Code: dnsgo.EDNS0NSID}},
+			wantUpstreamBufSize: 4096,
+			wantUpstreamDO:      true,
+			wantClientOptions:   []dnsgo.EDNS0{testSubnet("10.0.1.0", 24, 0)},
+		},
+		{
+			name:                "requests with dnssec of clients without edns are padded",
+			policy:              &firewallv1.EDNSPolicy{Padding: firewallv1.EDNSOptionSet},
+			dnssec:              true,
+			wantUpstreamBufSize: dnssecBufSize,
+			wantUpstreamDO:      true,
+			wantPadded:          true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cache := newTestDNSCache(map[string]cacheEntry{})
+			cache.dnsServerAddr = upstream.addr
+			handler := NewDNSProxyHandler(logr.Discard(), cache)
+			handler.dnssec = tt.dnssec
+			handler.UpdateEDNSPolicy(tt.policy)
+
+			request := new(dnsgo.Msg)
+			request.SetQuestion("www.edns.example.", dnsgo.TypeA)
+			if tt.clientEDNS {
+				request.SetEdns0(dnsgo.DefaultMsgSize, false)
+				request.IsEdns0().Option = tt.clientOptions
+			}
+			clientRequest := request.Copy()
+
+			w := &fakeResponseWriter{}
+			handler.ServeDNS(w, request)
+			if w.msg == nil || len(w.msg.Answer) != 1 {
+				t.Fatalf("expected a response with an answer, got %v", w.msg)
+			}
+			if diff := cmp.Diff(clientRequest.String(), request.String()); diff != "" {
+				t.Errorf("request of the client was modified, diff = %s", diff)
+			}
+
+			received := <-upstream.requests
+			upstreamOpt := received.msg.IsEdns0()
+			if upstreamOpt == nil {
+				t.Fatalf("expected upstream request to contain an OPT record")
+			}
+			if upstreamOpt.UDPSize() != tt.wantUpstreamBufSize {
+				t.Errorf("expected upstream buffer size %d, got %d", tt.wantUpstreamBufSize, upstreamOpt.UDPSize())
+			}
+			if upstreamOpt.Do() != tt.wantUpstreamDO {
+				t.Errorf("expected upstream DO bit %v, got %v", tt.wantUpstreamDO, upstreamOpt.Do())
+			}
+			if tt.wantPadded {
+				if received.length%paddingBlockSize != 0 {
+					t.Errorf("expected upstream request to be padded to a multiple of %d, got length %d", paddingBlockSize, received.length)
+				}
+			} else if diff := cmp.Diff(optionStrings(tt.wantUpstreamOptions), optionStrings(upstreamOpt.Option)); diff != "" {
+				t.Errorf("upstream options diff = %s", diff)
+			}
+
+			clientOpt := w.msg.IsEdns0()
+			if tt.wantClientOptions == nil {
+				if clientOpt != nil {
+					t.Errorf("expected response without OPT record, got %v", clientOpt)
+				}
+				return
+			}
+			if clientOpt == nil {
+				t.Fatalf("expected response with OPT record")
+			}
+			if diff := cmp.Diff(optionStrings(tt.wantClientOptions), optionStrings(clientOpt.Option)); diff != "" {
+				t.Errorf("client options diff = %s", diff)
+			}
+		})
+	}
+}
+
+func optionStrings(options []dnsgo.EDNS0) []string {
+	result := []string{}
+	for _, o := range options {
+		result = append(result, o.String())
+	}
+	return result
+}
+
+func Test_paddingLength(t *testing.T) {
+	tests := []struct {
+		msgLen int
+		want   int
+	}{
+		{msgLen: 0, want: 0},
+		{msgLen: 1, want: 127},
+		{msgLen: 128, want: 0},
+		{msgLen: 200, want: 56},
+	}
+	for _, tt := range tests {
+		if got := paddingLength(tt.msgLen); got != tt.want {
+			t.Errorf("paddingLength(%d) = %d, want %d", tt.msgLen, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,250 @@
+package dns
+
+import (
+	"encoding/json"
+	"strings"
+
+	dnsgo "github.com/miekg/dns"
+
+	firewallv1 "github.com/metal-stack/firewall-controller/v2/api/v1"
+)
+
+// fqdnMatcher matches DNS names against FQDN selectors without evaluating regular expressions.
+// Selectors are stored in a trie of reversed labels, e.g. "*.example.com." is stored below "com" -> "example".
+// Labels up to the first label containing a wildcard are matched exactly by walking the trie,
+// the remaining prefix of a pattern is matched by a precompiled glob.
+type fqdnMatcher struct {
+	root *matcherNode
+	// selectors holds all selectors in the trie by their key, such that the trie can be updated incrementally
+	selectors map[string]firewallv1.FQDNSelector
+}
+
+type matcherNode struct {
+	children map[string]*matcherNode
+	// names are the selectors which match exactly the name ending at this node
+	names map[string]firewallv1.FQDNSelector
+	// globs are the patterns whose exact labels end at this node
+	globs map[string]globSelector
+}
+
+type globSelector struct {
+	glob     glob
+	selector firewallv1.FQDNSelector
+}
+
+func newMatcherNode() *matcherNode {
+	return &matcherNode{
+		children: map[string]*matcherNode{},
+		names:    map[string]firewallv1.FQDNSelector{},
+		globs:    map[string]globSelector{},
+	}
+}
+
+func newFQDNMatcher(fqdns []firewallv1.FQDNSelector) *fqdnMatcher {
+	m := &fqdnMatcher{
+		root:      newMatcherNode(),
+		selectors: map[string]firewallv1.FQDNSelector{},
+	}
+	m.update(fqdns)
+	return m
+}
+
+// update replaces the selectors of the matcher and returns whether they changed.
+// Only selectors which were added or removed are touched.
+func (m *fqdnMatcher) update(fqdns []firewallv1.FQDNSelector) (changed bool) {
+	selectors := make(map[string]firewallv1.FQDNSelector, len(fqdns))
+	for _, s := range fqdns {
+		selectors[selectorKey(s)] = s
+	}
+
+	for key, s := range m.selectors {
+		if _, ok := selectors[key]; !ok {
+			m.remove(key, s)
+			changed = true
+		}
+	}
+	for key, s := range selectors {
+		if _, ok := m.selectors[key]; !ok {
+			m.add(key, s)
+			changed = true
+		}
+	}
+	return changed
+}
+
+func (m *fqdnMatcher) add(key string, s firewallv1.FQDNSelector) {
+	labels, wildcard, ok := selectorLabels(s)
+	if !ok {
+		return
+	}
+
+	node := m.root
+	for i := len(labels) - 1; i > wildcard; i-- {
+		child, ok := node.children[labels[i]]
+		if !ok {
+			child = newMatcherNode()
+			node.children[labels[i]] = child
+		}
+		node = child
+	}
+
+	if wildcard < 0 {
+		node.names[key] = s
+	} else {
+		node.globs[key] = globSelector{
+			glob:     compileGlob(strings.Join(labels[:wildcard+1], ".") + "."),
+			selector: s,
+		}
+	}
+	m.selectors[key] = s
+}
+
+func (m *fqdnMatcher) remove(key string, s firewallv1.FQDNSelector) {
+	delete(m.selectors, key)
+
+	labels, wildcard, ok := selectorLabels(s)
+	if !ok {
+		return
+	}
+	removeFromNode(m.root, labels[wildcard+1:], key)
+}
+
+// removeFromNode removes the selector from the node reached by the remaining reversed labels.
+// It returns whether the node is empty afterwards and can be pruned.
+func removeFromNode(node *matcherNode, labels []string, key string) bool {
+	if len(labels) == 0 {
+		delete(node.names, key)
+		delete(node.globs, key)
+	} else {
+		label := labels[len(labels)-1]
+		if child, ok := node.children[label]; ok && removeFromNode(child, labels[:len(labels)-1], key) {
+			delete(node.children, label)
+		}
+	}
+	return len(node.children) == 0 && len(node.names) == 0 && len(node.globs) == 0
+}
+
+// matches returns whether any selector matches the given DNS name
+func (m *fqdnMatcher) matches(name string) bool {
+	matched := false
+	m.visit(name, func(string, firewallv1.FQDNSelector) bool {
+		matched = true
+		return false
+	})
+	return matched
+}
+
+// visit calls fn with the key of every selector matching the given DNS name until fn returns false
+func (m *fqdnMatcher) visit(name string, fn func(key string, s firewallv1.FQDNSelector) bool) {
+	name = strings.ToLower(dnsgo.Fqdn(name))
+
+	node := m.root
+	rest := name
+	for {
+		for key, g := range node.globs {
+			if g.glob.match(rest) && !fn(key, g.selector) {
+				return
+			}
+		}
+		if rest == "" || rest == "." {
+			break
+		}
+
+		trimmed := rest[:len(rest)-1]
+		i := strings.LastIndexByte(trimmed, '.')
+		child, ok := node.children[trimmed[i+1:]]
+		if !ok {
+			return
+		}
+		node = child
+		rest = trimmed[:i+1]
+	}
+
+	for key, s := range node.names {
+		if !fn(key, s) {
+			return
+		}
+	}
+}
+
+// selectorLabels returns the lower cased labels of a selector
+// and the index of the label closest to the root containing a wildcard, or -1 if there is none.
+func selectorLabels(s firewallv1.FQDNSelector) (labels []string, wildcard int, ok bool) {
+	var name string
+	switch {
+	case s.MatchName != "":
+		name = s.GetMatchName()
+	case s.MatchPattern != "":
+		name = dnsgo.Fqdn(strings.TrimSpace(s.MatchPattern))
+	default:
+		return nil, -1, false
+	}
+	name = strings.ToLower(name)
+
+	if name != "." {
+		labels = strings.Split(strings.TrimSuffix(name, "."), ".")
+	}
+
+	wildcard = -1
+	if s.MatchName == "" {
+		for i := len(labels) - 1; i >= 0; i-- {
+			if strings.Contains(labels[i], "*") {
+				wildcard = i
+				break
+			}
+		}
+	}
+	return labels, wildcard, true
+}
+
+// selectorKey identifies a selector including all its settings
+func selectorKey(s firewallv1.FQDNSelector) string {
+	key, _ := json.Marshal(s)
+	return string(key)
+}
+
+// glob matches strings against a pattern in which "*" matches 0 or more characters allowed in DNS names
+type glob struct {
+	parts []string
+}
+
+func compileGlob(pattern string) glob {
+	return glob{parts: strings.Split(pattern, "*")}
+}
+
+func (g glob) match(s string) bool {
+	if len(g.parts) == 1 {
+		return s == g.parts[0]
+	}
+	// the literal parts of a pattern only consist of allowed characters,
+	// so checking the whole string is the same as checking the parts matched by wildcards
+	if !isDNSName(s) {
+		return false
+	}
+
+	prefix, suffix := g.parts[0], g.parts[len(g.parts)-1]
+	if len(s) < len(prefix)+len(suffix) || !strings.HasPrefix(s, prefix) || !strings.HasSuffix(s, suffix) {
+		return false
+	}
+
+	s = s[len(prefix) : len(s)-len(suffix)]
+	for _, part := range g.parts[1 : len(g.parts)-1] {
+		i := strings.Index(s, part)
+		if i < 0 {
+			return false
+		}
+		s = s[i+len(part):]
+	}
+	return true
+}
+
+func isDNSName(s string) bool {
+	for _, ch := range s {
+		switch {
+		case ch >= 'a' && ch <= 'z', ch >= 'A' && ch <= 'Z', ch >= '0' && ch <= '9', ch == '-', ch == '_', ch == '.':
+		default:
+			return false
+		}
+	}
+	return true
+}
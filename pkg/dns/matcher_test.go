@@ -0,0 +1,207 @@
+package dns
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/nftables"
+
+	firewallv1 "github.com/metal-stack/firewall-controller/v2/api/v1"
+)
+
+func Test_fqdnMatcherMatchesLikeRegex(t *testing.T) {
+	patterns := []string{
+		"*",
+		"*.example.com",
+		"*.example.com.",
+		"example.com",
+		"*example.com",
+		"foo*.com",
+		"a*b.example.com",
+		"*.*.example",
+		"api.*.example.com",
+		"*.EXAMPLE.com",
+		"*-test.example.com",
+	}
+	names := []string{
+		".",
+		"com.",
+		"example.com.",
+		"www.example.com.",
+		"a.b.example.com.",
+		"myexample.com.",
+		"xexample.com.",
+		"foo.com.",
+		"foobar.baz.com.",
+		"ab.example.com.",
+		"axb.example.com.",
+		"ab.x.example.com.",
+		"a.b.example.",
+		"a.example.",
+		"api.v1.example.com.",
+		"api.example.com.",
+		"my-test.example.com.",
+		"my-test.example.org.",
+		"foo!.example.com.",
+	}
+
+	for _, p := range patterns {
+		s := firewallv1.FQDNSelector{MatchPattern: p}
+		re := regexp.MustCompile(s.GetRegex())
+		m := newFQDNMatcher([]firewallv1.FQDNSelector{s})
+
+		for _, n := range names {
+			if want, got := re.MatchString(n), m.matches(n); want != got {
+				t.Errorf("pattern %q, name %q: matcher = %v, regex = %v", p, n, got, want)
+			}
+		}
+	}
+}
+
+func Test_fqdnMatcherUpdate(t *testing.T) {
+	selectors := []firewallv1.FQDNSelector{
+		{MatchName: "example.com"},
+		{MatchPattern: "*.example.com"},
+		{MatchName: "test.org", MinTTL: duration(time.Minute)},
+	}
+	m := newFQDNMatcher(selectors)
+
+	matched := func(name string) (result []string) {
+		m.visit(name, func(_ string, s firewallv1.FQDNSelector) bool {
+			result = append(result, s.GetName())
+			return true
+		})
+		slices.Sort(result)
+		return
+	}
+
+	if diff := cmp.Diff([]string{"example.com"}, matched("example.com.")); diff != "" {
+		t.Errorf("visit() diff = %s", diff)
+	}
+	if diff := cmp.Diff([]string{"*.example.com"}, matched("www.example.com.")); diff != "" {
+		t.Errorf("visit() diff = %s", diff)
+	}
+
+	if m.update(slices.Clone(selectors)) {
+		t.Errorf("expected update() with the same selectors to report no change")
+	}
+
+	if !m.update([]firewallv1.FQDNSelector{
+		{MatchPattern: "*.example.com"},
+		{MatchName: "test.org", MinTTL: duration(time.Minute)},
+		{MatchName: "test.org", MinTTL: duration(time.Hour)},
+		{MatchPattern: "*"},
+	}) {
+		t.Errorf("expected update() to report a change")
+	}
+
+	if diff := cmp.Diff([]string{"*"}, matched("example.com.")); diff != "" {
+		t.Errorf("visit() after update diff = %s", diff)
+	}
+	if diff := cmp.Diff([]string{"*", "test.org", "test.org"}, matched("test.org.")); diff != "" {
+		t.Errorf("visit() after update diff = %s", diff)
+	}
+
+	m.update(nil)
+
+	if m.matches("www.example.com.") {
+		t.Errorf("expected no match after all selectors were removed")
+	}
+	if len(m.root.children) != 0 || len(m.root.globs) != 0 || len(m.selectors) != 0 {
+		t.Errorf("expected empty trie after all selectors were removed")
+	}
+}
+
+func benchmarkCache(b *testing.B, entries int) *DNSCache {
+	cache := newTestDNSCache(map[string]cacheEntry{})
+	for i := range entries {
+		fqdn := fmt.Sprintf("host%d.domain%d.example.com.", i, i%100)
+		if err := cache.updateIPEntry(fqdn, makeTestRRs(fqdn, "10.0.0.1"), time.Now(), nftables.TypeIPAddr); err != nil {
+			b.Fatal(err)
+		}
+	}
+	return cache
+}
+
+func benchmarkSelectors(count int) []firewallv1.FQDNSelector {
+	var selectors []firewallv1.FQDNSelector
+	for i := range count {
+		selectors = append(selectors,
+			firewallv1.FQDNSelector{MatchName: fmt.Sprintf("host%d.domain%d.example.com", i, i%100)},
+			firewallv1.FQDNSelector{MatchPattern: fmt.Sprintf("*.domain%d.example.com", i)},
+		)
+	}
+	return selectors
+}
+
+func BenchmarkGetSetsForRendering(b *testing.B) {
+	cache := benchmarkCache(b, 1000)
+	selectors := benchmarkSelectors(100)
+	cache.updateSelectors(selectors)
+
+	b.ResetTimer()
+	for b.Loop() {
+		cache.getSetsForRendering(selectors)
+	}
+}
+
+// BenchmarkGetSetsForRenderingUnknownSelectors renders selectors which were not passed to the cache before
+func BenchmarkGetSetsForRenderingUnknownSelectors(b *testing.B) {
+	cache := benchmarkCache(b, 1000)
+	selectors := benchmarkSelectors(100)
+
+	b.ResetTimer()
+	for b.Loop() {
+		cache.getSetsForRendering(selectors)
+	}
+}
+
+func BenchmarkGetSetNameForPattern(b *testing.B) {
+	cache := benchmarkCache(b, 1000)
+	selectors := benchmarkSelectors(100)
+	cache.updateSelectors(selectors)
+
+	b.ResetTimer()
+	for b.Loop() {
+		for _, s := range selectors {
+			if s.MatchPattern != "" {
+				cache.getSetNameForPattern(s)
+			}
+		}
+	}
+}
+
+// BenchmarkGetSetsForRenderingRegex matches like getSetsForRendering did before the fqdnMatcher was introduced
+func BenchmarkGetSetsForRenderingRegex(b *testing.B) {
+	cache := benchmarkCache(b, 1000)
+	selectors := benchmarkSelectors(100)
+
+	b.ResetTimer()
+	for b.Loop() {
+		for n := range cache.fqdnToEntry {
+			_ = slices.ContainsFunc(selectors, func(s firewallv1.FQDNSelector) bool {
+				if s.MatchName != "" {
+					return s.GetMatchName() == n
+				}
+				m, _ := regexp.MatchString(s.GetRegex(), n)
+				return m
+			})
+		}
+	}
+}
+
+func BenchmarkFQDNMatcherUpdate(b *testing.B) {
+	selectors := benchmarkSelectors(1000)
+	m := newFQDNMatcher(selectors)
+	changed := slices.Clone(selectors)
+
+	b.ResetTimer()
+	for i := 0; b.Loop(); i++ {
+		changed[0] = firewallv1.FQDNSelector{MatchPattern: fmt.Sprintf("*.changed%d.com", i)}
+		m.update(changed)
+	}
+}
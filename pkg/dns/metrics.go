@@ -0,0 +1,124 @@
+package dns
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+const (
+	metricsNamespace = "firewall_controller"
+	metricsSubsystem = "dns"
+)
+
+var (
+	requestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "requests_total",
+		Help:      "Number of DNS requests answered by the DNS proxy.",
+	}, []string{"rcode", "qtype", "transport"})
+
+	truncatedResponsesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "truncated_responses_total",
+		Help:      "Number of responses which had to be truncated to fit into the buffer size of the client.",
+	}, []string{"transport"})
+
+	upstreamRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "upstream_request_duration_seconds",
+		Help:      "Duration of requests forwarded to upstream DNS servers.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"server", "transport"})
+
+	upstreamErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "upstream_errors_total",
+		Help:      "Number of requests to upstream DNS servers which failed.",
+	}, []string{"server", "transport"})
+
+	rateLimitedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "rate_limited_total",
+		Help:      "Number of queries and responses which exceeded the rate limits of the clients.",
+	}, []string{"limit", "action"})
+
+	cacheUpdatesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "cache_updates_total",
+		Help:      "Number of DNS answers processed by the FQDN cache.",
+	}, []string{"result"})
+
+	dnssecValidationFailuresTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "dnssec_validation_failures_total",
+		Help:      "Number of DNS answers containing records which failed DNSSEC validation.",
+	})
+
+	trackedFQDNs = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "cache_tracked_fqdns",
+		Help:      "Number of FQDNs in the FQDN cache.",
+	})
+
+	setIPs = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "cache_set_ips",
+		Help:      "Number of IPs in a nftables set of the FQDN cache.",
+	}, []string{"set"})
+
+	expiredIPsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "cache_expired_ips_total",
+		Help:      "Number of IPs removed from nftables sets because they expired.",
+	})
+
+	nftSetUpdateErrorsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "nftables_set_update_errors_total",
+		Help:      "Number of failed updates of nftables sets.",
+	})
+
+	stateFlushDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "state_flush_duration_seconds",
+		Help:      "Duration of writing changed cache entries to FQDNCacheEntry resources.",
+		Buckets:   prometheus.DefBuckets,
+	})
+
+	stateFlushErrorsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "state_flush_errors_total",
+		Help:      "Number of cache entries which could not be written to FQDNCacheEntry resources.",
+	})
+)
+
+func init() {
+	metrics.Registry.MustRegister(
+		requestsTotal,
+		truncatedResponsesTotal,
+		upstreamRequestDuration,
+		upstreamErrorsTotal,
+		rateLimitedTotal,
+		cacheUpdatesTotal,
+		dnssecValidationFailuresTotal,
+		trackedFQDNs,
+		setIPs,
+		expiredIPsTotal,
+		nftSetUpdateErrorsTotal,
+		stateFlushDuration,
+		stateFlushErrorsTotal,
+	)
+}
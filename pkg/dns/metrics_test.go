@@ -0,0 +1,138 @@
+package dns
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/google/nftables"
+	dnsgo "github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	firewallv1 "github.com/metal-stack/firewall-controller/v2/api/v1"
+)
+
+type fakeResponseWriter struct {
+	dnsgo.ResponseWriter
+	msg *dnsgo.Msg
+}
+
+func (w *fakeResponseWriter) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}
+}
+
+func (w *fakeResponseWriter) RemoteAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 40000}
+}
+
+func (w *fakeResponseWriter) WriteMsg(m *dnsgo.Msg) error {
+	w.msg = m
+	return nil
+}
+
+func Test_ServeDNSMetrics(t *testing.T) {
+	zones := newTestSignedZones(t)
+
+	cache := newTestDNSCache(map[string]cacheEntry{})
+	cache.dnsServerAddr = zones.addr
+	cache.routes.update(firewallv1.DNSProxyConfigSpec{
+		Hosts: []firewallv1.DNSHost{{Hostname: "db.corp.example", IPs: []string{"10.0.0.10"}}},
+	})
+	handler := NewDNSProxyHandler(logr.Discard(), cache)
+
+	tests := []struct {
+		name      string
+		qname     string
+		qtype     uint16
+		wantRcode string
+	}{
+		{
+			name:      "static host",
+			qname:     "db.corp.example.",
+			qtype:     dnsgo.TypeA,
+			wantRcode: "NOERROR",
+		},
+		{
+			name:      "forwarded request",
+			qname:     "www.child.example.",
+			qtype:     dnsgo.TypeAAAA,
+			wantRcode: "NOERROR",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			counter := requestsTotal.WithLabelValues(tt.wantRcode, dnsgo.TypeToString[tt.qtype], "udp")
+			before := testutil.ToFloat64(counter)
+
+			request := new(dnsgo.Msg)
+			request.SetQuestion(tt.qname, tt.qtype)
+			w := &fakeResponseWriter{}
+			handler.ServeDNS(w, request)
+
+			if w.msg == nil {
+				t.Fatalf("expected a response to be written")
+			}
+			if got := testutil.ToFloat64(counter) - before; got != 1 {
+				t.Errorf("expected request counter to be incremented by 1, got %v", got)
+			}
+		})
+	}
+}
+
+func Test_cacheMetrics(t *testing.T) {
+	cache := newTestDNSCache(map[string]cacheEntry{})
+
+	for _, fqdn := range []string{"a.metrics.example.", "b.metrics.example."} {
+		if err := cache.updateIPEntry(fqdn, makeTestRRs(fqdn, "10.0.0.1"), time.Now(), nftables.TypeIPAddr); err != nil {
+			t.Fatalf("updateIPEntry() error = %v", err)
+		}
+	}
+
+	if got := testutil.ToFloat64(trackedFQDNs); got != 2 {
+		t.Errorf("expected 2 tracked fqdns, got %v", got)
+	}
+	setName := cache.fqdnToEntry["a.metrics.example."].IPv4.SetName
+	if got := testutil.ToFloat64(setIPs.WithLabelValues(setName)); got != 1 {
+		t.Errorf("expected 1 ip in set %s, got %v", setName, got)
+	}
+
+	cache.removeExpiredEntries(time.Now().Add(time.Hour))
+
+	if got := testutil.ToFloat64(trackedFQDNs); got != 0 {
+		t.Errorf("expected no tracked fqdns after expiration, got %v", got)
+	}
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(setIPs)
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("unable to gather metrics: %v", err)
+	}
+	for _, f := range families {
+		for _, m := range f.GetMetric() {
+			for _, l := range m.GetLabel() {
+				if l.GetValue() == setName {
+					t.Errorf("expected metric of set %s to be removed after expiration", setName)
+				}
+			}
+		}
+	}
+}
+
+func Test_cacheUpdateQueueMetrics(t *testing.T) {
+	// without workers the queue is not drained
+	handler := &DNSProxyHandler{log: logr.Discard(), cacheUpdates: make(chan cacheUpdate, 1)}
+
+	dropped := cacheUpdatesTotal.WithLabelValues("dropped")
+	before := testutil.ToFloat64(dropped)
+
+	response := new(dnsgo.Msg).SetQuestion("www.example.com.", dnsgo.TypeA)
+	for range 2 {
+		handler.enqueueCacheUpdate(time.Now(), response)
+	}
+
+	if got := testutil.ToFloat64(dropped) - before; got != 1 {
+		t.Errorf("expected one cache update to be dropped, got %v", got)
+	}
+}
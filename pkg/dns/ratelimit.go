@@ -0,0 +1,206 @@
+package dns
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	dnsgo "github.com/miekg/dns"
+	"golang.org/x/time/rate"
+
+	firewallv1 "github.com/metal-stack/firewall-controller/v2/api/v1"
+)
+
+const (
+	// limiterIdleTimeout is the time after which the state of a client which did not send any query is removed
+	limiterIdleTimeout = time.Minute
+	// limitReportInterval is the minimum time between two reports of the same limit of a client
+	limitReportInterval = time.Minute
+	// responseSlip is the ratio of limited responses which are answered truncated instead of being dropped
+	responseSlip = 2
+
+	queryLimit    = "query"
+	responseLimit = "response"
+)
+
+// rateLimitReporter is called the first time a limit of a client trips within limitReportInterval
+type rateLimitReporter func(limit string, client netip.Prefix, message string)
+
+// rateLimiter limits the queries per client IP and the identical responses per client subnet with token buckets
+type rateLimiter struct {
+	sync.Mutex
+
+	config firewallv1.DNSRateLimit
+	report rateLimitReporter
+
+	queriesPerSecond   rate.Limit
+	burst              int
+	responsesPerSecond rate.Limit
+
+	clients   map[netip.Addr]*limiterEntry
+	responses map[responseKey]*limiterEntry
+	lastSweep time.Time
+}
+
+type limiterEntry struct {
+	limiter      *rate.Limiter
+	lastSeen     time.Time
+	lastReported time.Time
+	limited      int
+}
+
+// responseKey identifies identical responses to a client subnet
+type responseKey struct {
+	subnet netip.Prefix
+	name   string
+	qtype  uint16
+	rcode  int
+}
+
+// newRateLimiter creates the limiter of the given configuration, without configuration nothing is limited and nil is returned
+func newRateLimiter(config *firewallv1.DNSRateLimit, report rateLimitReporter) *rateLimiter {
+	if config == nil || (config.QueriesPerSecond == nil && config.ResponsesPerSecond == nil) {
+		return nil
+	}
+
+	l := &rateLimiter{
+		config:    *config,
+		report:    report,
+		clients:   map[netip.Addr]*limiterEntry{},
+		responses: map[responseKey]*limiterEntry{},
+	}
+	if config.QueriesPerSecond != nil {
+		l.queriesPerSecond = rate.Limit(*config.QueriesPerSecond)
+		l.burst = 2 * int(*config.QueriesPerSecond)
+		if config.Burst != nil {
+			l.burst = int(*config.Burst)
+		}
+	}
+	if config.ResponsesPerSecond != nil {
+		l.responsesPerSecond = rate.Limit(*config.ResponsesPerSecond)
+	}
+	return l
+}
+
+// equals returns whether the limiter was created for the given configuration
+func (l *rateLimiter) equals(config *firewallv1.DNSRateLimit) bool {
+	other := newRateLimiter(config, nil)
+	if l == nil || other == nil {
+		return l == nil && other == nil
+	}
+	return l.queriesPerSecond == other.queriesPerSecond && l.burst == other.burst && l.responsesPerSecond == other.responsesPerSecond
+}
+
+// allowQuery returns whether the client may send another query
+func (l *rateLimiter) allowQuery(client netip.Addr, now time.Time) bool {
+	if l == nil || l.queriesPerSecond == 0 {
+		return true
+	}
+
+	l.Lock()
+	defer l.Unlock()
+	l.sweep(now)
+
+	e, ok := l.clients[client]
+	if !ok {
+		e = &limiterEntry{limiter: rate.NewLimiter(l.queriesPerSecond, l.burst)}
+		l.clients[client] = e
+	}
+	e.lastSeen = now
+	if e.limiter.AllowN(now, 1) {
+		return true
+	}
+
+	rateLimitedTotal.WithLabelValues(queryLimit, "refused").Inc()
+	l.reportLimited(e, queryLimit, netip.PrefixFrom(client, client.BitLen()), now,
+		fmt.Sprintf("client %s exceeds the limit of %d dns queries per second, queries are refused", client, *l.config.QueriesPerSecond))
+	return false
+}
+
+// allowResponse returns whether the response may be sent to the client.
+// If not, slip tells whether the response should be replaced with an empty truncated one.
+func (l *rateLimiter) allowResponse(client netip.Addr, request, response *dnsgo.Msg, now time.Time) (allow bool, slip bool) {
+	if l == nil || l.responsesPerSecond == 0 || len(request.Question) == 0 {
+		return true, false
+	}
+
+	key := responseKey{
+		subnet: responseSubnet(client),
+		name:   strings.ToLower(request.Question[0].Name),
+		qtype:  request.Question[0].Qtype,
+		rcode:  response.Rcode,
+	}
+
+	l.Lock()
+	defer l.Unlock()
+	l.sweep(now)
+
+	e, ok := l.responses[key]
+	if !ok {
+		e = &limiterEntry{limiter: rate.NewLimiter(l.responsesPerSecond, int(*l.config.ResponsesPerSecond))}
+		l.responses[key] = e
+	}
+	e.lastSeen = now
+	if e.limiter.AllowN(now, 1) {
+		return true, false
+	}
+
+	e.limited++
+	slip = e.limited%responseSlip == 0
+	if slip {
+		rateLimitedTotal.WithLabelValues(responseLimit, "truncated").Inc()
+	} else {
+		rateLimitedTotal.WithLabelValues(responseLimit, "dropped").Inc()
+	}
+	l.reportLimited(e, responseLimit, key.subnet, now,
+		fmt.Sprintf("clients in %s exceed the limit of %d identical dns responses per second for %s %s, responses are dropped", key.subnet, *l.config.ResponsesPerSecond, dnsgo.TypeToString[key.qtype], key.name))
+	return false, slip
+}
+
+// reportLimited reports a limit of a client at most once per limitReportInterval
+func (l *rateLimiter) reportLimited(e *limiterEntry, limit string, client netip.Prefix, now time.Time, message string) {
+	if l.report == nil || now.Sub(e.lastReported) < limitReportInterval {
+		return
+	}
+	e.lastReported = now
+	l.report(limit, client, message)
+}
+
+// sweep removes the state of idle clients, it is run at most once per limiterIdleTimeout
+func (l *rateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < limiterIdleTimeout {
+		return
+	}
+	l.lastSweep = now
+
+	for client, e := range l.clients {
+		if now.Sub(e.lastSeen) >= limiterIdleTimeout {
+			delete(l.clients, client)
+		}
+	}
+	for key, e := range l.responses {
+		if now.Sub(e.lastSeen) >= limiterIdleTimeout {
+			delete(l.responses, key)
+		}
+	}
+}
+
+// responseSubnet returns the subnet of the client identical responses are counted for
+func responseSubnet(client netip.Addr) netip.Prefix {
+	bits := 24
+	if client.Is6() {
+		bits = 56
+	}
+	prefix, _ := client.Prefix(bits)
+	return prefix
+}
+
+// truncatedMsg returns an empty response with the truncated flag, such that the client retries via TCP
+func truncatedMsg(request *dnsgo.Msg) *dnsgo.Msg {
+	m := new(dnsgo.Msg)
+	m.SetReply(request)
+	m.Truncated = true
+	return m
+}
@@ -0,0 +1,145 @@
+package dns
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/google/go-cmp/cmp"
+	dnsgo "github.com/miekg/dns"
+
+	firewallv1 "github.com/metal-stack/firewall-controller/v2/api/v1"
+)
+
+func Test_rateLimiterQueries(t *testing.T) {
+	var reports []string
+	l := newRateLimiter(&firewallv1.DNSRateLimit{QueriesPerSecond: new(uint32(2)), Burst: new(uint32(3))}, func(limit string, client netip.Prefix, _ string) {
+		reports = append(reports, limit+" "+client.String())
+	})
+
+	var (
+		now    = time.Date(2026, time.January, 1, 0, 0, 0, 0, time.UTC)
+		client = netip.MustParseAddr("10.0.0.1")
+		other  = netip.MustParseAddr("10.0.0.2")
+	)
+
+	var got []bool
+	for range 5 {
+		got = append(got, l.allowQuery(client, now))
+	}
+	if diff := cmp.Diff([]bool{true, true, true, false, false}, got); diff != "" {
+		t.Errorf("queries within the burst diff = %s", diff)
+	}
+	if !l.allowQuery(other, now) {
+		t.Errorf("expected other client not to be limited")
+	}
+	if !l.allowQuery(client, now.Add(500*time.Millisecond)) {
+		t.Errorf("expected a token to be refilled after half a second")
+	}
+	if l.allowQuery(client, now.Add(500*time.Millisecond)) {
+		t.Errorf("expected client to be limited again")
+	}
+	if diff := cmp.Diff([]string{"query 10.0.0.1/32"}, reports); diff != "" {
+		t.Errorf("expected limit to be reported once, diff = %s", diff)
+	}
+
+	l.allowQuery(other, now.Add(limiterIdleTimeout+time.Second))
+	if _, ok := l.clients[client]; ok {
+		t.Errorf("expected idle client to be removed")
+	}
+}
+
+func Test_rateLimiterResponses(t *testing.T) {
+	l := newRateLimiter(&firewallv1.DNSRateLimit{ResponsesPerSecond: new(uint32(1))}, nil)
+
+	var (
+		now      = time.Date(2026, time.January, 1, 0, 0, 0, 0, time.UTC)
+		request  = new(dnsgo.Msg).SetQuestion("www.example.com.", dnsgo.TypeA)
+		response = new(dnsgo.Msg).SetReply(request)
+	)
+
+	if !l.allowQuery(netip.MustParseAddr("10.0.0.1"), now) {
+		t.Errorf("expected queries not to be limited")
+	}
+
+	type result struct {
+		Allow bool
+		Slip  bool
+	}
+	var got []result
+	for _, client := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4"} {
+		allow, slip := l.allowResponse(netip.MustParseAddr(client), request, response, now)
+		got = append(got, result{Allow: allow, Slip: slip})
+	}
+	if diff := cmp.Diff([]result{{Allow: true}, {}, {Slip: true}, {}}, got); diff != "" {
+		t.Errorf("identical responses to a subnet diff = %s", diff)
+	}
+
+	if allow, _ := l.allowResponse(netip.MustParseAddr("10.0.1.1"), request, response, now); !allow {
+		t.Errorf("expected response to another subnet not to be limited")
+	}
+	other := new(dnsgo.Msg).SetQuestion("www.example.com.", dnsgo.TypeAAAA)
+	if allow, _ := l.allowResponse(netip.MustParseAddr("10.0.0.1"), other, new(dnsgo.Msg).SetReply(other), now); !allow {
+		t.Errorf("expected response of another type not to be limited")
+	}
+}
+
+func Test_rateLimiterEquals(t *testing.T) {
+	l := newRateLimiter(&firewallv1.DNSRateLimit{QueriesPerSecond: new(uint32(10))}, nil)
+
+	if !l.equals(&firewallv1.DNSRateLimit{QueriesPerSecond: new(uint32(10)), Burst: new(uint32(20))}) {
+		t.Errorf("expected limiter to equal the config with the default burst")
+	}
+	if l.equals(&firewallv1.DNSRateLimit{QueriesPerSecond: new(uint32(20))}) {
+		t.Errorf("expected limiter not to equal a config with other queries")
+	}
+	if l.equals(nil) {
+		t.Errorf("expected limiter not to equal a missing config")
+	}
+	if l := newRateLimiter(&firewallv1.DNSRateLimit{}, nil); l != nil || !l.equals(nil) {
+		t.Errorf("expected config without limits not to create a limiter")
+	}
+}
+
+func Test_ServeDNSRateLimit(t *testing.T) {
+	cache := newTestDNSCache(map[string]cacheEntry{})
+	cache.routes.update(firewallv1.DNSProxyConfigSpec{
+		Hosts: []firewallv1.DNSHost{{Hostname: "db.corp.example", IPs: []string{"10.0.0.10"}}},
+	})
+	handler := NewDNSProxyHandler(logr.Discard(), cache)
+
+	var reports int
+	handler.reportRateLimit = func(string, netip.Prefix, string) {
+		reports++
+	}
+	handler.UpdateRateLimit(&firewallv1.DNSRateLimit{QueriesPerSecond: new(uint32(1)), Burst: new(uint32(2))})
+
+	var rcodes []string
+	for range 3 {
+		request := new(dnsgo.Msg)
+		request.SetQuestion("db.corp.example.", dnsgo.TypeA)
+		w := &fakeResponseWriter{}
+		handler.ServeDNS(w, request)
+		if w.msg == nil {
+			t.Fatalf("expected a response to be written")
+		}
+		rcodes = append(rcodes, dnsgo.RcodeToString[w.msg.Rcode])
+	}
+	if diff := cmp.Diff([]string{"NOERROR", "NOERROR", "REFUSED"}, rcodes); diff != "" {
+		t.Errorf("rcodes diff = %s", diff)
+	}
+	if reports != 1 {
+		t.Errorf("expected limit to be reported once, got %d", reports)
+	}
+
+	limiter := handler.limiter
+	handler.UpdateRateLimit(&firewallv1.DNSRateLimit{QueriesPerSecond: new(uint32(1)), Burst: new(uint32(2))})
+	if handler.limiter != limiter {
+		t.Errorf("expected limiter to be kept if the limits did not change")
+	}
+	handler.UpdateRateLimit(nil)
+	if handler.limiter != nil {
+		t.Errorf("expected limiter to be removed")
+	}
+}
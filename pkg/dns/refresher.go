@@ -0,0 +1,108 @@
+package dns
+
+import (
+	"slices"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	// refreshInterval is the interval in which the cache checks for entries which need to be refreshed
+	refreshInterval = 10 * time.Second
+	// refreshAhead is the time before the expiration of an entry at which it gets resolved again.
+	// It is also the minimum time between two refreshes of the same name, so failing lookups are not retried on every check.
+	refreshAhead = 30 * time.Second
+	// refreshRate is the maximum number of refresh lookups per second sent to the upstream DNS server
+	refreshRate = 5
+	// refreshBurst is the number of refresh lookups which may be sent at once
+	refreshBurst = 10
+)
+
+// runRefresher resolves all names tracked by FQDN selectors shortly before their IPs expire.
+// This keeps the sets populated even if no client queries the names through the proxy,
+// e.g. after a reboot of the firewall or for workloads that cache DNS answers themselves.
+func (c *DNSCache) runRefresher() {
+	limiter := rate.NewLimiter(refreshRate, refreshBurst)
+	lastAttempt := map[string]time.Time{}
+
+	ticker := time.NewTicker(refreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			for _, name := range c.namesToRefresh(time.Now(), lastAttempt) {
+				if err := limiter.Wait(c.ctx); err != nil {
+					return
+				}
+
+				lastAttempt[name] = time.Now()
+				if err := c.loadDataFromDNSServer([]string{name}); err != nil {
+					c.log.Error(err, "failed to refresh dns cache entry", "fqdn", name)
+				}
+			}
+		case <-c.ctx.Done():
+			return
+		}
+	}
+}
+
+// namesToRefresh returns the names of all MatchName selectors whose cache entries are missing or expire soon.
+// Names which were attempted recently are skipped. Attempts of names which are not tracked anymore are forgotten.
+func (c *DNSCache) namesToRefresh(now time.Time, lastAttempt map[string]time.Time) []string {
+	c.RLock()
+	defer c.RUnlock()
+
+	tracked := map[string]struct{}{}
+	var names []string
+	for _, s := range c.selectors {
+		if s.MatchName == "" {
+			continue
+		}
+		name := s.GetMatchName()
+		if _, ok := tracked[name]; ok {
+			continue
+		}
+		tracked[name] = struct{}{}
+
+		if t, ok := lastAttempt[name]; ok && now.Sub(t) < refreshAhead {
+			continue
+		}
+
+		e, ok := c.fqdnToEntry[name]
+		if ok {
+			latest := e.latestExpiration()
+			if !latest.IsZero() && latest.After(now.Add(refreshAhead)) {
+				continue
+			}
+		}
+		names = append(names, name)
+	}
+
+	for name := range lastAttempt {
+		if _, ok := tracked[name]; !ok {
+			delete(lastAttempt, name)
+		}
+	}
+
+	slices.Sort(names)
+	return names
+}
+
+// latestExpiration returns the latest expiration time of all IPs of the entry, or the zero time if it has no IPs.
+// The IPs of the last answer expire latest, older IPs which are kept by a grace period or established connections
+// would otherwise cause the name to be queried again and again.
+func (e cacheEntry) latestExpiration() (latest time.Time) {
+	for _, ipe := range []*iPEntry{e.IPv4, e.IPv6} {
+		if ipe == nil {
+			continue
+		}
+		for _, expirationTime := range ipe.IPs {
+			if expirationTime.After(latest) {
+				latest = expirationTime
+			}
+		}
+	}
+	return
+}
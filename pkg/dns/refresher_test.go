@@ -0,0 +1,83 @@
+package dns
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+
+	firewallv1 "github.com/metal-stack/firewall-controller/v2/api/v1"
+)
+
+func Test_namesToRefresh(t *testing.T) {
+	now := time.Now()
+
+	tests := []struct {
+		name        string
+		selectors   []firewallv1.FQDNSelector
+		entries     map[string]cacheEntry
+		lastAttempt map[string]time.Time
+		want        []string
+		wantAttempt map[string]time.Time
+	}{
+		{
+			name:        "missing entries are refreshed",
+			selectors:   []firewallv1.FQDNSelector{{MatchName: "example.com"}, {MatchName: "example.com."}},
+			entries:     map[string]cacheEntry{},
+			lastAttempt: map[string]time.Time{},
+			want:        []string{"example.com."},
+			wantAttempt: map[string]time.Time{},
+		},
+		{
+			name:      "only entries which expire soon are refreshed",
+			selectors: []firewallv1.FQDNSelector{{MatchName: "expiring.com"}, {MatchName: "valid.com"}, {MatchName: "grace.com"}, {MatchPattern: "*.pattern.com"}},
+			entries: map[string]cacheEntry{
+				"expiring.com.": {
+					IPv4: &iPEntry{SetName: "a", IPs: map[string]time.Time{"1.1.1.1": now.Add(20 * time.Second), "2.2.2.2": now.Add(10 * time.Second)}},
+				},
+				// an expired IP which is kept by the grace period does not trigger a refresh while the last answer is valid
+				"grace.com.": {
+					IPv4: &iPEntry{SetName: "d", IPs: map[string]time.Time{"5.5.5.5": now.Add(-time.Minute), "6.6.6.6": now.Add(time.Hour)}},
+				},
+				"valid.com.": {
+					IPv4: &iPEntry{SetName: "b", IPs: map[string]time.Time{"3.3.3.3": now.Add(time.Hour)}},
+				},
+				"test.pattern.com.": {
+					IPv4: &iPEntry{SetName: "c", IPs: map[string]time.Time{"4.4.4.4": now.Add(-time.Hour)}},
+				},
+			},
+			lastAttempt: map[string]time.Time{},
+			want:        []string{"expiring.com."},
+			wantAttempt: map[string]time.Time{},
+		},
+		{
+			name:      "recent attempts are not retried and untracked names are forgotten",
+			selectors: []firewallv1.FQDNSelector{{MatchName: "recent.com"}, {MatchName: "old.com"}},
+			entries:   map[string]cacheEntry{},
+			lastAttempt: map[string]time.Time{
+				"recent.com.":  now.Add(-time.Second),
+				"old.com.":     now.Add(-time.Hour),
+				"removed.com.": now.Add(-time.Second),
+			},
+			want: []string{"old.com."},
+			wantAttempt: map[string]time.Time{
+				"recent.com.": now.Add(-time.Second),
+				"old.com.":    now.Add(-time.Hour),
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cache := newTestDNSCache(tt.entries)
+			cache.updateSelectors(tt.selectors)
+
+			got := cache.namesToRefresh(now, tt.lastAttempt)
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("namesToRefresh() diff = %s", diff)
+			}
+			if diff := cmp.Diff(tt.wantAttempt, tt.lastAttempt); diff != "" {
+				t.Errorf("namesToRefresh() last attempts diff = %s", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,132 @@
+package dns
+
+import (
+	"net"
+	"slices"
+	"sync"
+
+	dnsgo "github.com/miekg/dns"
+
+	firewallv1 "github.com/metal-stack/firewall-controller/v2/api/v1"
+)
+
+const (
+	// defaultStaticHostTTL is the TTL of answers for static hosts without a configured TTL
+	defaultStaticHostTTL = 300
+)
+
+// dnsRoutes decides which DNS servers are asked for a name and answers static hosts locally
+type dnsRoutes struct {
+	sync.RWMutex
+
+	// forwarders are sorted by the number of labels of their zones, the most specific zone comes first
+	forwarders []forwarder
+	hosts      map[string]firewallv1.DNSHost
+}
+
+type forwarder struct {
+	zone    string
+	servers []string
+}
+
+func newDNSRoutes() *dnsRoutes {
+	return &dnsRoutes{
+		hosts: map[string]firewallv1.DNSHost{},
+	}
+}
+
+// update replaces the forwarders and static hosts.
+// Later entries for the same zone or hostname take precedence.
+func (r *dnsRoutes) update(spec firewallv1.DNSProxyConfigSpec) {
+	zones := map[string]forwarder{}
+	for _, f := range spec.Forwarders {
+		zones[f.GetZone()] = forwarder{zone: f.GetZone(), servers: f.GetServers()}
+	}
+	forwarders := make([]forwarder, 0, len(zones))
+	for _, f := range zones {
+		forwarders = append(forwarders, f)
+	}
+	slices.SortFunc(forwarders, func(a, b forwarder) int {
+		if d := dnsgo.CountLabel(b.zone) - dnsgo.CountLabel(a.zone); d != 0 {
+			return d
+		}
+		if a.zone < b.zone {
+			return -1
+		}
+		return 1
+	})
+
+	hosts := map[string]firewallv1.DNSHost{}
+	for _, h := range spec.Hosts {
+		hosts[h.GetHostname()] = h
+	}
+
+	r.Lock()
+	r.forwarders = forwarders
+	r.hosts = hosts
+	r.Unlock()
+}
+
+// serversFor returns the servers which should be asked for the given name in order of preference
+func (r *dnsRoutes) serversFor(qname, defaultServer string) []string {
+	r.RLock()
+	defer r.RUnlock()
+
+	for _, f := range r.forwarders {
+		if dnsgo.IsSubDomain(f.zone, qname) {
+			return f.servers
+		}
+	}
+	return []string{defaultServer}
+}
+
+// isStatic returns whether the name is answered from the static hosts
+func (r *dnsRoutes) isStatic(qname string) bool {
+	r.RLock()
+	defer r.RUnlock()
+
+	_, ok := r.hosts[dnsgo.CanonicalName(qname)]
+	return ok
+}
+
+// staticAnswer returns the answer to the request if the name is a static host, otherwise nil.
+// Queries for other types than A and AAAA are answered without records.
+func (r *dnsRoutes) staticAnswer(request *dnsgo.Msg) *dnsgo.Msg {
+	if len(request.Question) == 0 {
+		return nil
+	}
+	q := request.Question[0]
+
+	r.RLock()
+	host, ok := r.hosts[dnsgo.CanonicalName(q.Name)]
+	r.RUnlock()
+	if !ok {
+		return nil
+	}
+
+	ttl := uint32(defaultStaticHostTTL)
+	if host.TTL != nil {
+		ttl = *host.TTL
+	}
+
+	m := new(dnsgo.Msg)
+	m.SetReply(request)
+	m.Authoritative = true
+	m.RecursionAvailable = true
+	for _, s := range host.IPs {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			continue
+		}
+		hdr := dnsgo.RR_Header{Name: q.Name, Class: dnsgo.ClassINET, Ttl: ttl}
+		switch {
+		case q.Qtype == dnsgo.TypeA && ip.To4() != nil:
+			hdr.Rrtype = dnsgo.TypeA
+			m.Answer = append(m.Answer, &dnsgo.A{Hdr: hdr, A: ip.To4()})
+		case q.Qtype == dnsgo.TypeAAAA && ip.To4() == nil:
+			hdr.Rrtype = dnsgo.TypeAAAA
+			m.Answer = append(m.Answer, &dnsgo.AAAA{Hdr: hdr, AAAA: ip})
+		}
+	}
+	return m
+}
@@ -0,0 +1,140 @@
+package dns
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	dnsgo "github.com/miekg/dns"
+
+	firewallv1 "github.com/metal-stack/firewall-controller/v2/api/v1"
+)
+
+func testRoutes() *dnsRoutes {
+	ttl := uint32(60)
+	r := newDNSRoutes()
+	r.update(firewallv1.DNSProxyConfigSpec{
+		Forwarders: []firewallv1.DNSForwarder{
+			{Zone: "corp.example", Servers: []string{"10.0.0.53"}},
+			{Zone: "dev.corp.example.", Servers: []string{"10.0.1.53:5353", "10.0.2.53"}},
+			{Zone: "Other.Example", Servers: []string{"10.0.3.53"}},
+			{Zone: "other.example", Servers: []string{"10.0.4.53"}},
+		},
+		Hosts: []firewallv1.DNSHost{
+			{Hostname: "db.corp.example", IPs: []string{"10.0.0.10", "2001:db8::10"}, TTL: &ttl},
+			{Hostname: "cache.corp.example", IPs: []string{"10.0.0.20"}},
+			{Hostname: "cache.corp.example", IPs: []string{"10.0.0.21"}},
+		},
+	})
+	return r
+}
+
+func Test_dnsRoutesServersFor(t *testing.T) {
+	tests := []struct {
+		name  string
+		qname string
+		want  []string
+	}{
+		{
+			name:  "name outside of forwarded zones",
+			qname: "example.com.",
+			want:  []string{"8.8.8.8:53"},
+		},
+		{
+			name:  "zone apex",
+			qname: "corp.example.",
+			want:  []string{"10.0.0.53:53"},
+		},
+		{
+			name:  "most specific zone wins",
+			qname: "host.dev.corp.example.",
+			want:  []string{"10.0.1.53:5353", "10.0.2.53:53"},
+		},
+		{
+			name:  "zones are case insensitive and later forwarders take precedence",
+			qname: "HOST.other.example.",
+			want:  []string{"10.0.4.53:53"},
+		},
+		{
+			name:  "no partial label match",
+			qname: "mycorp.example.",
+			want:  []string{"8.8.8.8:53"},
+		},
+	}
+	r := testRoutes()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if diff := cmp.Diff(tt.want, r.serversFor(tt.qname, "8.8.8.8:53")); diff != "" {
+				t.Errorf("serversFor() diff = %s", diff)
+			}
+		})
+	}
+}
+
+func Test_dnsRoutesStaticAnswer(t *testing.T) {
+	tests := []struct {
+		name   string
+		qname  string
+		qtype  uint16
+		want   []string
+		wantOK bool
+	}{
+		{
+			name:   "A record of static host",
+			qname:  "DB.corp.example.",
+			qtype:  dnsgo.TypeA,
+			want:   []string{"DB.corp.example.\t60\tIN\tA\t10.0.0.10"},
+			wantOK: true,
+		},
+		{
+			name:   "AAAA record of static host",
+			qname:  "db.corp.example.",
+			qtype:  dnsgo.TypeAAAA,
+			want:   []string{"db.corp.example.\t60\tIN\tAAAA\t2001:db8::10"},
+			wantOK: true,
+		},
+		{
+			name:   "other types are answered without records",
+			qname:  "db.corp.example.",
+			qtype:  dnsgo.TypeMX,
+			wantOK: true,
+		},
+		{
+			name:   "later hosts take precedence",
+			qname:  "cache.corp.example.",
+			qtype:  dnsgo.TypeA,
+			want:   []string{"cache.corp.example.\t300\tIN\tA\t10.0.0.21"},
+			wantOK: true,
+		},
+		{
+			name:  "names which are not static are not answered",
+			qname: "www.corp.example.",
+			qtype: dnsgo.TypeA,
+		},
+	}
+	r := testRoutes()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := new(dnsgo.Msg)
+			request.SetQuestion(tt.qname, tt.qtype)
+
+			response := r.staticAnswer(request)
+			if (response != nil) != tt.wantOK {
+				t.Fatalf("staticAnswer() = %v, want answer %v", response, tt.wantOK)
+			}
+			if response == nil {
+				return
+			}
+
+			var got []string
+			for _, rr := range response.Answer {
+				got = append(got, rr.String())
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("staticAnswer() diff = %s", diff)
+			}
+			if response.Id != request.Id || !response.Authoritative {
+				t.Errorf("expected authoritative reply to the request, got %v", response)
+			}
+		})
+	}
+}
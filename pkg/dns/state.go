@@ -0,0 +1,296 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/yaml"
+
+	firewallv1 "github.com/metal-stack/firewall-controller/v2/api/v1"
+)
+
+const (
+	// stateFlushInterval is the interval in which changed cache entries are written to FQDNCacheEntry resources
+	stateFlushInterval = 10 * time.Second
+	// stateGCInterval is the interval in which cache entries without valid IPs are removed
+	stateGCInterval = 5 * time.Minute
+	// stateTimeout is the maximum time a single load or flush of the cache state may take
+	stateTimeout = 30 * time.Second
+)
+
+// loadState restores the cache from the FQDNCacheEntry resources.
+// State which is still stored in the legacy fqdnstate configmap is migrated.
+func (c *DNSCache) loadState() error {
+	ctx, cancel := context.WithTimeout(c.ctx, stateTimeout)
+	defer cancel()
+
+	var entries firewallv1.FQDNCacheEntryList
+	if err := c.shootClient.List(ctx, &entries, client.InNamespace(fqdnStateNamespace)); err != nil {
+		return fmt.Errorf("unable to list fqdn cache entries: %w", err)
+	}
+
+	c.Lock()
+	for _, e := range entries.Items {
+		c.fqdnToEntry[e.Spec.FQDN] = cacheEntryFromSpec(e.Spec)
+		c.addMatches(e.Spec.FQDN)
+	}
+	c.Unlock()
+
+	if err := c.migrateConfigmapState(ctx); err != nil {
+		return fmt.Errorf("unable to migrate fqdnstate configmap: %w", err)
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	for _, e := range c.fqdnToEntry {
+		if e.IPv4 != nil {
+			c.setNames[e.IPv4.SetName] = struct{}{}
+			setIPs.WithLabelValues(e.IPv4.SetName).Set(float64(len(e.IPv4.IPs)))
+		}
+		if e.IPv6 != nil {
+			c.setNames[e.IPv6.SetName] = struct{}{}
+			setIPs.WithLabelValues(e.IPv6.SetName).Set(float64(len(e.IPv6.IPs)))
+		}
+	}
+	trackedFQDNs.Set(float64(len(c.fqdnToEntry)))
+
+	return nil
+}
+
+// migrateConfigmapState moves the entries of the legacy fqdnstate configmap to FQDNCacheEntry resources.
+// The configmap is deleted once all entries were written, it is kept if its content can't be parsed.
+func (c *DNSCache) migrateConfigmapState(ctx context.Context) error {
+	nn := types.NamespacedName{Name: fqdnStateConfigmapName, Namespace: fqdnStateNamespace}
+	scm := &v1.ConfigMap{}
+
+	err := c.shootClient.Get(ctx, nn, scm)
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if scm.Data[fqdnStateConfigmapKey] != "" {
+		// fields unknown to this version, e.g. written by another version, are ignored
+		legacy := map[string]cacheEntry{}
+		err = yaml.Unmarshal([]byte(scm.Data[fqdnStateConfigmapKey]), &legacy)
+		if err != nil {
+			// the configmap is kept, such that the legacy state is not lost
+			c.log.Error(err, "could not unmarshal state from fqdnstate configmap, keeping configmap", "configmap", fqdnStateConfigmapName, "namespace", fqdnStateNamespace)
+			return nil
+		}
+
+		c.Lock()
+		for fqdn, e := range legacy {
+			// entries which were already migrated are newer than the ones in the configmap
+			if _, ok := c.fqdnToEntry[fqdn]; ok {
+				continue
+			}
+			c.fqdnToEntry[fqdn] = e
+			c.addMatches(fqdn)
+			c.dirty[fqdn] = struct{}{}
+		}
+		c.Unlock()
+
+		if err := c.flushState(ctx); err != nil {
+			return err
+		}
+	}
+
+	c.log.Info("migrated fqdnstate configmap to fqdn cache entries, deleting configmap", "configmap", fqdnStateConfigmapName, "namespace", fqdnStateNamespace)
+
+	return client.IgnoreNotFound(c.shootClient.Delete(ctx, scm))
+}
+
+// runStateWriter periodically writes changed cache entries and removes entries without valid IPs.
+// Writes are debounced by the flush interval, so many updates of the same FQDN only result in a single write.
+func (c *DNSCache) runStateWriter() {
+	flushTicker := time.NewTicker(stateFlushInterval)
+	defer flushTicker.Stop()
+	gcTicker := time.NewTicker(stateGCInterval)
+	defer gcTicker.Stop()
+
+	for {
+		select {
+		case <-gcTicker.C:
+			c.removeExpiredEntries(time.Now())
+		case <-flushTicker.C:
+			ctx, cancel := context.WithTimeout(c.ctx, stateTimeout)
+			if err := c.flushState(ctx); err != nil {
+				c.log.Error(err, "failed to write dns cache state")
+			}
+			cancel()
+		case <-c.ctx.Done():
+			// the cache context is already cancelled, but pending changes should not get lost
+			ctx, cancel := context.WithTimeout(context.Background(), stateTimeout)
+			if err := c.flushState(ctx); err != nil {
+				c.log.Error(err, "failed to write dns cache state")
+			}
+			cancel()
+			return
+		}
+	}
+}
+
+// flushState writes all changed cache entries to their FQDNCacheEntry resources.
+// Resources of entries which were removed from the cache are deleted.
+func (c *DNSCache) flushState(ctx context.Context) error {
+	start := time.Now()
+	defer func() {
+		stateFlushDuration.Observe(time.Since(start).Seconds())
+	}()
+
+	c.Lock()
+	specs := make(map[string]*firewallv1.FQDNCacheEntrySpec, len(c.dirty))
+	for fqdn := range c.dirty {
+		e, ok := c.fqdnToEntry[fqdn]
+		if !ok {
+			specs[fqdn] = nil
+			continue
+		}
+		spec := cacheEntryToSpec(fqdn, e)
+		specs[fqdn] = &spec
+	}
+	c.dirty = map[string]struct{}{}
+	c.Unlock()
+
+	var errs []error
+	for fqdn, spec := range specs {
+		if err := c.writeCacheEntry(ctx, fqdn, spec); err != nil {
+			errs = append(errs, fmt.Errorf("unable to write cache entry for %s: %w", fqdn, err))
+			stateFlushErrorsTotal.Inc()
+
+			// retry with the next flush
+			c.Lock()
+			c.dirty[fqdn] = struct{}{}
+			c.Unlock()
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// writeCacheEntry creates, updates or deletes the FQDNCacheEntry of the given FQDN
+func (c *DNSCache) writeCacheEntry(ctx context.Context, fqdn string, spec *firewallv1.FQDNCacheEntrySpec) error {
+	entry := &firewallv1.FQDNCacheEntry{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      firewallv1.FQDNCacheEntryName(fqdn),
+			Namespace: fqdnStateNamespace,
+		},
+	}
+
+	if spec == nil {
+		return client.IgnoreNotFound(c.shootClient.Delete(ctx, entry))
+	}
+
+	err := c.shootClient.Get(ctx, client.ObjectKeyFromObject(entry), entry)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+
+	if apierrors.IsNotFound(err) {
+		entry.Spec = *spec
+		return c.shootClient.Create(ctx, entry)
+	}
+
+	if equality.Semantic.DeepEqual(entry.Spec, *spec) {
+		return nil
+	}
+
+	entry.Spec = *spec
+	return c.shootClient.Update(ctx, entry)
+}
+
+// removeExpiredEntries removes all entries from the cache which do not contain any valid IP anymore
+func (c *DNSCache) removeExpiredEntries(now time.Time) {
+	c.Lock()
+	defer c.Unlock()
+
+	for fqdn, e := range c.fqdnToEntry {
+		gracePeriod := c.ttlPolicyFor(fqdn).gracePeriod
+		if e.IPv4.hasValidIPs(now, gracePeriod, c.flows) || e.IPv6.hasValidIPs(now, gracePeriod, c.flows) {
+			continue
+		}
+
+		if e.IPv4 != nil {
+			delete(c.setNames, e.IPv4.SetName)
+			setIPs.DeleteLabelValues(e.IPv4.SetName)
+		}
+		if e.IPv6 != nil {
+			delete(c.setNames, e.IPv6.SetName)
+			setIPs.DeleteLabelValues(e.IPv6.SetName)
+		}
+		delete(c.fqdnToEntry, fqdn)
+		c.removeMatches(fqdn)
+		c.dirty[fqdn] = struct{}{}
+
+		c.log.V(4).Info("DEBUG removed expired entry from dns cache", "fqdn", fqdn)
+	}
+	trackedFQDNs.Set(float64(len(c.fqdnToEntry)))
+}
+
+// hasValidIPs returns whether the entry contains IPs which would not be removed by expireIPs
+func (e *iPEntry) hasValidIPs(now time.Time, gracePeriod time.Duration, flows flowTracker) bool {
+	if e == nil {
+		return false
+	}
+	for ip, expirationTime := range e.IPs {
+		if !expirationTime.Add(gracePeriod).Before(now) {
+			return true
+		}
+		if flows != nil && flows.HasEstablishedFlows(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func cacheEntryToSpec(fqdn string, e cacheEntry) firewallv1.FQDNCacheEntrySpec {
+	return firewallv1.FQDNCacheEntrySpec{
+		FQDN: fqdn,
+		IPv4: iPEntryToCachedIPs(e.IPv4),
+		IPv6: iPEntryToCachedIPs(e.IPv6),
+	}
+}
+
+func cacheEntryFromSpec(spec firewallv1.FQDNCacheEntrySpec) cacheEntry {
+	return cacheEntry{
+		IPv4: iPEntryFromCachedIPs(spec.IPv4),
+		IPv6: iPEntryFromCachedIPs(spec.IPv6),
+	}
+}
+
+func iPEntryToCachedIPs(e *iPEntry) *firewallv1.CachedIPs {
+	if e == nil {
+		return nil
+	}
+	ips := &firewallv1.CachedIPs{
+		SetName:           e.SetName,
+		IPExpirationTimes: make(map[string]metav1.Time, len(e.IPs)),
+	}
+	for ip, expirationTime := range e.IPs {
+		// resources only store seconds, truncating avoids updates which do not change anything
+		ips.IPExpirationTimes[ip] = metav1.NewTime(expirationTime.Truncate(time.Second))
+	}
+	return ips
+}
+
+func iPEntryFromCachedIPs(ips *firewallv1.CachedIPs) *iPEntry {
+	if ips == nil {
+		return nil
+	}
+	e := newIPEntry(ips.SetName)
+	for ip, expirationTime := range ips.IPExpirationTimes {
+		e.IPs[ip] = expirationTime.Time
+	}
+	return e
+}
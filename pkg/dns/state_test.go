@@ -0,0 +1,168 @@
+package dns
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/google/nftables"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	firewallv1 "github.com/metal-stack/firewall-controller/v2/api/v1"
+)
+
+func testScheme() *runtime.Scheme {
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	_ = firewallv1.AddToScheme(scheme)
+	return scheme
+}
+
+func Test_loadStateMigratesConfigmap(t *testing.T) {
+	expiration := time.Date(2100, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+	c := fake.NewClientBuilder().WithScheme(testScheme()).WithObjects(
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      fqdnStateConfigmapName,
+				Namespace: fqdnStateNamespace,
+			},
+			Data: map[string]string{
+				fqdnStateConfigmapKey: `
+example.com.:
+  ipv4:
+    ips:
+      1.2.3.4: "2100-01-01T00:00:00Z"
+    setName: legacyv4
+    unknownField: written by another version
+test.com.:
+  ipv4:
+    ips:
+      5.6.7.8: "2100-01-01T00:00:00Z"
+    setName: legacytestv4
+`,
+			},
+		},
+		&firewallv1.FQDNCacheEntry{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      firewallv1.FQDNCacheEntryName("test.com."),
+				Namespace: fqdnStateNamespace,
+			},
+			Spec: firewallv1.FQDNCacheEntrySpec{
+				FQDN: "test.com.",
+				IPv4: &firewallv1.CachedIPs{
+					SetName:           "testv4",
+					IPExpirationTimes: map[string]metav1.Time{"9.9.9.9": metav1.NewTime(expiration)},
+				},
+			},
+		},
+	).Build()
+
+	cache, err := newDNSCache(context.Background(), "127.0.0.1:53", true, false, c, logr.Discard(), nil, nil)
+	if err != nil {
+		t.Fatalf("newDNSCache() error = %v", err)
+	}
+
+	want := map[string]cacheEntry{
+		"example.com.": {
+			IPv4: &iPEntry{SetName: "legacyv4", IPs: map[string]time.Time{"1.2.3.4": expiration}},
+		},
+		"test.com.": {
+			IPv4: &iPEntry{SetName: "testv4", IPs: map[string]time.Time{"9.9.9.9": expiration}},
+		},
+	}
+	if diff := cmp.Diff(want, cache.fqdnToEntry, cmpopts.EquateApproxTime(0)); diff != "" {
+		t.Errorf("newDNSCache() cache diff = %s", diff)
+	}
+	if diff := cmp.Diff(map[string]struct{}{"legacyv4": {}, "testv4": {}}, cache.setNames); diff != "" {
+		t.Errorf("newDNSCache() set names diff = %s", diff)
+	}
+
+	err = c.Get(context.Background(), client.ObjectKey{Name: fqdnStateConfigmapName, Namespace: fqdnStateNamespace}, &corev1.ConfigMap{})
+	if !apierrors.IsNotFound(err) {
+		t.Errorf("expected fqdnstate configmap to be deleted, got err = %v", err)
+	}
+
+	var entries firewallv1.FQDNCacheEntryList
+	if err := c.List(context.Background(), &entries); err != nil {
+		t.Fatalf("unable to list cache entries: %v", err)
+	}
+	if len(entries.Items) != 2 {
+		t.Errorf("expected 2 cache entries, got %d", len(entries.Items))
+	}
+}
+
+func Test_loadStateKeepsUnparseableConfigmap(t *testing.T) {
+	c := fake.NewClientBuilder().WithScheme(testScheme()).WithObjects(
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      fqdnStateConfigmapName,
+				Namespace: fqdnStateNamespace,
+			},
+			Data: map[string]string{
+				fqdnStateConfigmapKey: "example.com.: [not, an, entry",
+			},
+		},
+	).Build()
+
+	cache, err := newDNSCache(context.Background(), "127.0.0.1:53", true, false, c, logr.Discard(), nil, nil)
+	if err != nil {
+		t.Fatalf("newDNSCache() error = %v", err)
+	}
+	if len(cache.fqdnToEntry) != 0 {
+		t.Errorf("expected empty cache, got %v", cache.fqdnToEntry)
+	}
+
+	err = c.Get(context.Background(), client.ObjectKey{Name: fqdnStateConfigmapName, Namespace: fqdnStateNamespace}, &corev1.ConfigMap{})
+	if err != nil {
+		t.Errorf("expected fqdnstate configmap to be kept, got err = %v", err)
+	}
+}
+
+func Test_flushState(t *testing.T) {
+	now := time.Now()
+	cache := newTestDNSCache(map[string]cacheEntry{})
+
+	rrs := makeTestRRs("example.com.", "1.2.3.4")
+	if err := cache.updateIPEntry("example.com.", rrs, now, nftables.TypeIPAddr); err != nil {
+		t.Fatalf("updateIPEntry() error = %v", err)
+	}
+	if err := cache.flushState(context.Background()); err != nil {
+		t.Fatalf("flushState() error = %v", err)
+	}
+
+	entry := &firewallv1.FQDNCacheEntry{}
+	key := client.ObjectKey{Name: firewallv1.FQDNCacheEntryName("example.com."), Namespace: fqdnStateNamespace}
+	if err := cache.shootClient.Get(context.Background(), key, entry); err != nil {
+		t.Fatalf("expected cache entry to be written: %v", err)
+	}
+	if entry.Spec.FQDN != "example.com." || entry.Spec.IPv4 == nil || len(entry.Spec.IPv4.IPExpirationTimes) != 1 {
+		t.Errorf("unexpected cache entry spec: %+v", entry.Spec)
+	}
+	if len(cache.dirty) != 0 {
+		t.Errorf("expected no dirty entries after flush, got %v", cache.dirty)
+	}
+
+	cache.removeExpiredEntries(now.Add(time.Hour))
+	if _, ok := cache.fqdnToEntry["example.com."]; ok {
+		t.Errorf("expected expired entry to be removed from cache")
+	}
+	if len(cache.setNames) != 0 {
+		t.Errorf("expected set names of expired entry to be released, got %v", cache.setNames)
+	}
+	if err := cache.flushState(context.Background()); err != nil {
+		t.Fatalf("flushState() error = %v", err)
+	}
+	if err := cache.shootClient.Get(context.Background(), key, entry); !apierrors.IsNotFound(err) {
+		t.Errorf("expected cache entry to be deleted, got err = %v", err)
+	}
+}
@@ -0,0 +1,51 @@
+package dns
+
+import (
+	"time"
+
+	firewallv1 "github.com/metal-stack/firewall-controller/v2/api/v1"
+)
+
+// ttlPolicy controls how long learned IPs are kept in the nftables sets
+type ttlPolicy struct {
+	minTTL      time.Duration
+	maxTTL      time.Duration
+	gracePeriod time.Duration
+	// unlimited is set if at least one selector does not restrict the maximum TTL
+	unlimited bool
+}
+
+// ttl clamps the TTL of a resource record to the policy
+func (p ttlPolicy) ttl(rrTTL uint32) time.Duration {
+	ttl := time.Duration(rrTTL) * time.Second
+	if !p.unlimited && p.maxTTL > 0 && ttl > p.maxTTL {
+		ttl = p.maxTTL
+	}
+	if ttl < p.minTTL {
+		ttl = p.minTTL
+	}
+	return ttl
+}
+
+// merge combines the policy with the settings of a selector.
+// The most permissive settings are kept, such that no selector loses IPs earlier than it asked for.
+func (p ttlPolicy) merge(s firewallv1.FQDNSelector) ttlPolicy {
+	if s.MinTTL != nil && s.MinTTL.Duration > p.minTTL {
+		p.minTTL = s.MinTTL.Duration
+	}
+	if s.MaxTTL == nil {
+		p.unlimited = true
+	} else if s.MaxTTL.Duration > p.maxTTL {
+		p.maxTTL = s.MaxTTL.Duration
+	}
+	if s.GracePeriod != nil && s.GracePeriod.Duration > p.gracePeriod {
+		p.gracePeriod = s.GracePeriod.Duration
+	}
+	return p
+}
+
+// flowTracker reports whether there are established connections to an IP address, it is implemented by conntrack.Tracker.
+// It is called while the cache is locked, so it must only read a snapshot of the flows.
+type flowTracker interface {
+	HasEstablishedFlows(ip string) bool
+}
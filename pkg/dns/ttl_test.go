@@ -0,0 +1,113 @@
+package dns
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	firewallv1 "github.com/metal-stack/firewall-controller/v2/api/v1"
+)
+
+type fakeFlowTracker map[string]bool
+
+func (f fakeFlowTracker) HasEstablishedFlows(ip string) bool {
+	return f[ip]
+}
+
+func duration(d time.Duration) *metav1.Duration {
+	return &metav1.Duration{Duration: d}
+}
+
+func Test_ttlPolicy(t *testing.T) {
+	tests := []struct {
+		name      string
+		selectors []firewallv1.FQDNSelector
+		rrTTL     uint32
+		wantTTL   time.Duration
+		wantGrace time.Duration
+	}{
+		{
+			name:    "no selector keeps the record ttl",
+			rrTTL:   20,
+			wantTTL: 20 * time.Second,
+		},
+		{
+			name:      "min ttl raises low ttls",
+			selectors: []firewallv1.FQDNSelector{{MatchName: "example.com", MinTTL: duration(5 * time.Minute)}},
+			rrTTL:     20,
+			wantTTL:   5 * time.Minute,
+		},
+		{
+			name:      "max ttl lowers high ttls",
+			selectors: []firewallv1.FQDNSelector{{MatchName: "example.com", MaxTTL: duration(time.Minute)}},
+			rrTTL:     3600,
+			wantTTL:   time.Minute,
+		},
+		{
+			name: "most permissive settings of all selectors win",
+			selectors: []firewallv1.FQDNSelector{
+				{MatchName: "example.com", MinTTL: duration(time.Minute), MaxTTL: duration(2 * time.Minute), GracePeriod: duration(time.Minute)},
+				{MatchPattern: "*.com", MinTTL: duration(2 * time.Minute), MaxTTL: duration(10 * time.Minute), GracePeriod: duration(5 * time.Minute)},
+			},
+			rrTTL:     3600,
+			wantTTL:   10 * time.Minute,
+			wantGrace: 5 * time.Minute,
+		},
+		{
+			name: "selector without max ttl lifts the limit",
+			selectors: []firewallv1.FQDNSelector{
+				{MatchName: "example.com", MaxTTL: duration(time.Minute)},
+				{MatchPattern: "*.com"},
+			},
+			rrTTL:   3600,
+			wantTTL: time.Hour,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cache := newTestDNSCache(map[string]cacheEntry{})
+			cache.updateSelectors(tt.selectors)
+
+			policy := cache.ttlPolicyFor("example.com.")
+			if got := policy.ttl(tt.rrTTL); got != tt.wantTTL {
+				t.Errorf("ttlPolicy.ttl() = %v, want %v", got, tt.wantTTL)
+			}
+			if policy.gracePeriod != tt.wantGrace {
+				t.Errorf("ttlPolicy.gracePeriod = %v, want %v", policy.gracePeriod, tt.wantGrace)
+			}
+		})
+	}
+}
+
+func Test_expireIPs(t *testing.T) {
+	now := time.Now()
+	entry := &iPEntry{
+		SetName: "test",
+		IPs: map[string]time.Time{
+			"1.1.1.1": now.Add(time.Minute),
+			"2.2.2.2": now.Add(-time.Minute),
+			"3.3.3.3": now.Add(-10 * time.Minute),
+			"4.4.4.4": now.Add(-10 * time.Minute),
+		},
+	}
+
+	deleted := entry.expireIPs(now, 5*time.Minute, fakeFlowTracker{"4.4.4.4": true})
+
+	var deletedIPs []string
+	for _, e := range deleted {
+		deletedIPs = append(deletedIPs, string(e.Key))
+	}
+	if diff := cmp.Diff([]string{"3.3.3.3"}, deletedIPs); diff != "" {
+		t.Errorf("expireIPs() deleted diff = %s", diff)
+	}
+
+	var keptIPs []string
+	for ip := range entry.IPs {
+		keptIPs = append(keptIPs, ip)
+	}
+	if len(keptIPs) != 3 {
+		t.Errorf("expected ips within grace period or with established flows to be kept, got %v", keptIPs)
+	}
+}
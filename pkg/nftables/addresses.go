@@ -0,0 +1,224 @@
+package nftables
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+
+	"github.com/vishvananda/netlink"
+
+	mn "github.com/metal-stack/metal-lib/pkg/net"
+
+	firewallv2 "github.com/metal-stack/firewall-controller-manager/api/v2"
+)
+
+// addrHandle are the netlink operations needed to reconcile the addresses of the interfaces, it is implemented by netlink.Handle
+type addrHandle interface {
+	LinkByName(name string) (netlink.Link, error)
+	AddrList(link netlink.Link, family int) ([]netlink.Addr, error)
+	AddrAdd(link netlink.Link, addr *netlink.Addr) error
+	AddrDel(link netlink.Link, addr *netlink.Addr) error
+}
+
+// EgressPrefixLengths are the prefix lengths the egress IPs of the firewall spec are added with to the interfaces of the external networks.
+// Zero is the host prefix length, i.e. /32 for IPv4 and /128 for IPv6.
+type EgressPrefixLengths struct {
+	IPv4 int
+	IPv6 int
+}
+
+// Validate checks that the prefix lengths are within the length of the addresses
+func (l EgressPrefixLengths) Validate() error {
+	var errs []error
+	if l.IPv4 < 0 || l.IPv4 > 32 {
+		errs = append(errs, fmt.Errorf("ipv4 egress prefix length %d must be between 0 and 32", l.IPv4))
+	}
+	if l.IPv6 < 0 || l.IPv6 > 128 {
+		errs = append(errs, fmt.Errorf("ipv6 egress prefix length %d must be between 0 and 128", l.IPv6))
+	}
+	return errors.Join(errs...)
+}
+
+// prefix returns the prefix of an egress IP
+func (l EgressPrefixLengths) prefix(addr netip.Addr) netip.Prefix {
+	bits := addr.BitLen()
+	switch {
+	case addr.Is4() && l.IPv4 > 0:
+		bits = l.IPv4
+	case addr.Is6() && l.IPv6 > 0:
+		bits = l.IPv6
+	}
+	return netip.PrefixFrom(addr, bits)
+}
+
+// reconcileIfaceAddresses adds the egress IPs to the interfaces of the external networks and removes the IPs which are not configured anymore.
+// The networks are reconciled independently, the errors are returned by network id.
+func (f *Firewall) reconcileIfaceAddresses() map[string]error {
+	errs := map[string]error{}
+
+	for _, n := range f.networkMap {
+		if n.NetworkType == nil || n.NetworkID == nil {
+			continue
+		}
+
+		if *n.NetworkType != mn.External {
+			continue
+		}
+
+		if err := f.reconcileNetworkAddresses(n, getConfiguredIPs(*n.NetworkID)); err != nil {
+			errs[*n.NetworkID] = err
+		}
+	}
+
+	return errs
+}
+
+// reconcileNetworkAddresses reconciles the addresses of the interface of an external network.
+// The configured IPs are added with the host prefix length, the egress IPs of the firewall spec with the egress prefix length.
+// Only addresses within the prefixes of the network are removed, other addresses of the interface are not managed by the firewall-controller.
+func (f *Firewall) reconcileNetworkAddresses(n firewallv2.FirewallNetwork, configuredIPs []string) error {
+	var errs []error
+
+	// configured IPs are kept with any prefix length, egress IPs must have the egress prefix length
+	configured := map[netip.Addr]bool{}
+	for _, ip := range configuredIPs {
+		addr, err := netip.ParseAddr(ip)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		configured[addr] = true
+	}
+	egress := map[netip.Addr]netip.Prefix{}
+	for _, r := range f.firewall.Spec.EgressRules {
+		if r.NetworkID != *n.NetworkID {
+			continue
+		}
+		for _, ip := range r.IPs {
+			addr, err := netip.ParseAddr(ip)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			if configured[addr] {
+				continue
+			}
+			egress[addr] = f.egressPrefixLengths.prefix(addr)
+		}
+		break
+	}
+
+	var networkPrefixes []netip.Prefix
+	for _, prefix := range n.Prefixes {
+		p, err := netip.ParsePrefix(prefix)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		networkPrefixes = append(networkPrefixes, p)
+	}
+
+	linkName := fmt.Sprintf("vlan%d", *n.Vrf)
+	link, err := f.nl.LinkByName(linkName)
+	if err != nil {
+		return errors.Join(append(errs, fmt.Errorf("unable to detect link %s: %w", linkName, err))...)
+	}
+	addrs, err := f.nl.AddrList(link, netlink.FAMILY_ALL)
+	if err != nil {
+		return errors.Join(append(errs, fmt.Errorf("unable to list addresses of link %s: %w", linkName, err))...)
+	}
+
+	actual := map[netip.Prefix]bool{}
+	actualAddrs := map[netip.Addr]bool{}
+	for _, a := range addrs {
+		if a.IPNet == nil {
+			continue
+		}
+		addr, ok := netip.AddrFromSlice(a.IP)
+		if !ok {
+			continue
+		}
+		addr = addr.Unmap()
+		// link local addresses are managed by the kernel
+		if addr.IsLinkLocalUnicast() {
+			continue
+		}
+		bits, _ := a.Mask.Size()
+		actual[netip.PrefixFrom(addr, bits)] = true
+		actualAddrs[addr] = true
+	}
+
+	// do not remove IPs that were initially used during machine allocation!
+	protected := map[netip.Addr]bool{}
+	for _, ip := range n.IPs {
+		if addr, err := netip.ParseAddr(ip); err == nil {
+			protected[addr] = true
+		}
+	}
+
+	var toAdd, toRemove []netip.Prefix
+	for addr := range configured {
+		if !actualAddrs[addr] {
+			toAdd = append(toAdd, netip.PrefixFrom(addr, addr.BitLen()))
+		}
+	}
+	for _, p := range egress {
+		if !actual[p] {
+			toAdd = append(toAdd, p)
+		}
+	}
+	for p := range actual {
+		addr := p.Addr()
+		if configured[addr] || protected[addr] {
+			continue
+		}
+		if want, ok := egress[addr]; ok {
+			// the egress prefix length changed
+			if want != p {
+				toRemove = append(toRemove, p)
+			}
+			continue
+		}
+		if slices.ContainsFunc(networkPrefixes, func(prefix netip.Prefix) bool { return prefix.Contains(addr) }) {
+			toRemove = append(toRemove, p)
+		}
+	}
+	slices.SortFunc(toAdd, comparePrefixes)
+	slices.SortFunc(toRemove, comparePrefixes)
+
+	if f.dryRun {
+		f.log.Info("skipping reconciling ips for", "network", n.NetworkID, "adding", toAdd, "removing", toRemove)
+		return errors.Join(errs...)
+	}
+	f.log.Info("reconciling ips for", "network", n.NetworkID, "adding", toAdd, "removing", toRemove)
+
+	// the addresses are removed first, such that an address can be added again with another prefix length
+	for _, p := range toRemove {
+		if err := f.nl.AddrDel(link, netlinkAddr(p)); err != nil {
+			errs = append(errs, fmt.Errorf("unable to remove %s from link %s: %w", p, linkName, err))
+		}
+	}
+	for _, p := range toAdd {
+		if err := f.nl.AddrAdd(link, netlinkAddr(p)); err != nil {
+			errs = append(errs, fmt.Errorf("unable to add %s to link %s: %w", p, linkName, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func netlinkAddr(p netip.Prefix) *netlink.Addr {
+	return &netlink.Addr{IPNet: &net.IPNet{
+		IP:   p.Addr().AsSlice(),
+		Mask: net.CIDRMask(p.Bits(), p.Addr().BitLen()),
+	}}
+}
+
+func comparePrefixes(a, b netip.Prefix) int {
+	if c := a.Addr().Compare(b.Addr()); c != 0 {
+		return c
+	}
+	return a.Bits() - b.Bits()
+}
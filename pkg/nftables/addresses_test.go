@@ -0,0 +1,190 @@
+package nftables
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/google/go-cmp/cmp"
+	mn "github.com/metal-stack/metal-lib/pkg/net"
+	"github.com/vishvananda/netlink"
+
+	firewallv2 "github.com/metal-stack/firewall-controller-manager/api/v2"
+	firewallv1 "github.com/metal-stack/firewall-controller/v2/api/v1"
+)
+
+// fakeAddrHandle records the address operations as strings
+type fakeAddrHandle struct {
+	addrs map[string][]string
+	ops   []string
+}
+
+func (h *fakeAddrHandle) LinkByName(name string) (netlink.Link, error) {
+	if _, ok := h.addrs[name]; !ok {
+		return nil, netlink.LinkNotFoundError{}
+	}
+	return &netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: name}}, nil
+}
+
+func (h *fakeAddrHandle) AddrList(link netlink.Link, family int) ([]netlink.Addr, error) {
+	if family != netlink.FAMILY_ALL {
+		return nil, fmt.Errorf("unexpected family %d", family)
+	}
+	var result []netlink.Addr
+	for _, a := range h.addrs[link.Attrs().Name] {
+		ip, ipnet, err := net.ParseCIDR(a)
+		if err != nil {
+			return nil, err
+		}
+		ipnet.IP = ip
+		result = append(result, netlink.Addr{IPNet: ipnet})
+	}
+	return result, nil
+}
+
+func (h *fakeAddrHandle) AddrAdd(link netlink.Link, addr *netlink.Addr) error {
+	h.ops = append(h.ops, fmt.Sprintf("add %s %s", link.Attrs().Name, addr.IPNet))
+	return nil
+}
+
+func (h *fakeAddrHandle) AddrDel(link netlink.Link, addr *netlink.Addr) error {
+	h.ops = append(h.ops, fmt.Sprintf("del %s %s", link.Attrs().Name, addr.IPNet))
+	return nil
+}
+
+func TestReconcileIfaceAddresses(t *testing.T) {
+	var (
+		private        = "private"
+		internet       = "internet"
+		internetV6     = "internet-v6"
+		mpls           = "mpls"
+		vrf1           = int64(1)
+		vrf2           = int64(2)
+		vrf3           = int64(3)
+		vrf4           = int64(4)
+		privatePrimary = mn.PrivatePrimaryShared
+		external       = mn.External
+	)
+	fw := firewallv2.Firewall{
+		Spec: firewallv2.FirewallSpec{
+			EgressRules: []firewallv2.EgressRuleSNAT{
+				{NetworkID: "internet", IPs: []string{"185.0.0.2", "185.0.0.3"}},
+				{NetworkID: "internet-v6", IPs: []string{"2001:db8::2"}},
+				{NetworkID: "mpls", IPs: []string{"100.0.0.2"}},
+			},
+		},
+		Status: firewallv2.FirewallStatus{
+			FirewallNetworks: []firewallv2.FirewallNetwork{
+				{NetworkID: &private, IPs: []string{"10.0.1.1"}, Vrf: &vrf1, NetworkType: &privatePrimary},
+				{NetworkID: &internet, IPs: []string{"185.0.0.1"}, Prefixes: []string{"185.0.0.0/24"}, Vrf: &vrf2, NetworkType: &external},
+				{NetworkID: &internetV6, IPs: []string{"2001:db8::1"}, Prefixes: []string{"2001:db8::/64"}, Vrf: &vrf3, NetworkType: &external},
+				{NetworkID: &mpls, IPs: []string{"100.0.0.1"}, Prefixes: []string{"100.0.0.0/24"}, Vrf: &vrf4, NetworkType: &external},
+			},
+		},
+	}
+
+	tests := []struct {
+		name           string
+		addrs          map[string][]string
+		prefixLengths  EgressPrefixLengths
+		dryRun         bool
+		wantOps        []string
+		wantErrNetwork []string
+	}{
+		{
+			name: "ipv4 and ipv6 egress ips are reconciled",
+			addrs: map[string][]string{
+				"vlan2": {"185.0.0.1/32", "185.0.0.2/32", "185.0.0.9/32", "fe80::1/64"},
+				"vlan3": {"2001:db8::1/128", "2001:db8::9/128", "fe80::2/64"},
+				"vlan4": {"100.0.0.1/32", "100.0.0.2/32"},
+			},
+			wantOps: []string{
+				"del vlan2 185.0.0.9/32",
+				"add vlan2 185.0.0.3/32",
+				"del vlan3 2001:db8::9/128",
+				"add vlan3 2001:db8::2/128",
+			},
+		},
+		{
+			name: "egress ips are added with the prefix length",
+			addrs: map[string][]string{
+				"vlan2": {"185.0.0.1/32", "185.0.0.2/32"},
+				"vlan3": {"2001:db8::1/128"},
+				"vlan4": {"100.0.0.1/32", "100.0.0.2/28"},
+			},
+			prefixLengths: EgressPrefixLengths{IPv4: 28, IPv6: 64},
+			wantOps: []string{
+				"del vlan2 185.0.0.2/32",
+				"add vlan2 185.0.0.2/28",
+				"add vlan2 185.0.0.3/28",
+				"add vlan3 2001:db8::2/64",
+			},
+		},
+		{
+			name: "addresses outside of the network prefixes are kept",
+			addrs: map[string][]string{
+				"vlan2": {"185.0.0.1/24", "185.0.0.2/32", "185.0.0.3/32", "185.0.1.9/32", "2001:db8:1::9/64"},
+				"vlan3": {"2001:db8::1/64", "2001:db8::2/128", "2001:db8:1::9/64"},
+				"vlan4": {"100.0.0.1/32", "100.0.0.2/32", "100.0.0.9/24"},
+			},
+			wantOps: []string{
+				"del vlan4 100.0.0.9/24",
+			},
+		},
+		{
+			name: "missing links do not abort the other networks",
+			addrs: map[string][]string{
+				"vlan2": {"185.0.0.1/32"},
+			},
+			wantOps: []string{
+				"add vlan2 185.0.0.2/32",
+				"add vlan2 185.0.0.3/32",
+			},
+			wantErrNetwork: []string{"internet-v6", "mpls"},
+		},
+		{
+			name: "dry run",
+			addrs: map[string][]string{
+				"vlan2": {"185.0.0.9/32"},
+				"vlan3": {},
+				"vlan4": {},
+			},
+			dryRun: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := NewFirewall(fw.DeepCopy(), &firewallv1.ClusterwideNetworkPolicyList{}, nil, nil, logr.Discard(), nil, FirewallOptions{EgressPrefixLengths: tt.prefixLengths})
+			h := &fakeAddrHandle{addrs: tt.addrs}
+			f.nl = h
+			f.dryRun = tt.dryRun
+
+			errs := f.reconcileIfaceAddresses()
+
+			// the networks are reconciled in random order
+			var ops []string
+			for _, link := range []string{"vlan2", "vlan3", "vlan4"} {
+				for _, op := range h.ops {
+					if strings.Fields(op)[1] == link {
+						ops = append(ops, op)
+					}
+				}
+			}
+			if diff := cmp.Diff(tt.wantOps, ops); diff != "" {
+				t.Errorf("reconcileIfaceAddresses() operations diff: %v", diff)
+			}
+
+			var errNetworks []string
+			for _, n := range []string{"internet", "internet-v6", "mpls"} {
+				if errs[n] != nil {
+					errNetworks = append(errNetworks, n)
+				}
+			}
+			if diff := cmp.Diff(tt.wantErrNetwork, errNetworks); diff != "" {
+				t.Errorf("reconcileIfaceAddresses() errors diff: %v, errors: %v", diff, errs)
+			}
+		})
+	}
+}
@@ -0,0 +1,158 @@
+package nftables
+
+import (
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	mn "github.com/metal-stack/metal-lib/pkg/net"
+	corev1 "k8s.io/api/core/v1"
+
+	firewallv1 "github.com/metal-stack/firewall-controller/v2/api/v1"
+	"github.com/metal-stack/firewall-controller/v2/pkg/updater"
+)
+
+// dnsInterception is a DNS interception with the IPv4 prefixes of its network
+type dnsInterception struct {
+	firewallv1.DNSInterception
+	prefixes []string
+}
+
+// dnsInterceptions resolves the networks of the configured DNS interceptions.
+// Only private networks with an IPv4 prefix can be intercepted, other interceptions are skipped and reported as events of the firewall.
+// The interceptions are only resolved once, as they are needed for the SNAT and the forwarding rules.
+func (f *Firewall) dnsInterceptions() []dnsInterception {
+	if f.interceptionsResolved {
+		return f.resolvedInterceptions
+	}
+
+	var result []dnsInterception
+	for _, i := range f.interceptions {
+		resolved, err := f.resolveDNSInterception(i)
+		if err != nil {
+			f.log.Error(err, "dns interception is ignored", "network", i.NetworkID)
+			if f.recorder != nil {
+				updater.ShootRecorderNamespaceRewriter(f.recorder)(f.firewall, corev1.EventTypeWarning, "Inapplicable", fmt.Sprintf("dns interception is ignored: %v", err))
+			}
+			continue
+		}
+		result = append(result, resolved)
+	}
+	f.resolvedInterceptions, f.interceptionsResolved = result, true
+	return result
+}
+
+func (f *Firewall) resolveDNSInterception(i firewallv1.DNSInterception) (dnsInterception, error) {
+	n, ok := f.networkMap[i.NetworkID]
+	if !ok {
+		return dnsInterception{}, fmt.Errorf("network %s of dns interception not found", i.NetworkID)
+	}
+
+	networkType := ""
+	if n.NetworkType != nil {
+		networkType = *n.NetworkType
+	}
+	switch networkType {
+	case mn.PrivatePrimaryShared, mn.PrivatePrimaryUnshared, mn.PrivateSecondaryShared, mn.PrivateSecondaryUnshared:
+	default:
+		return dnsInterception{}, fmt.Errorf("dns traffic can only be intercepted for private networks, but network %s is of type %q", i.NetworkID, networkType)
+	}
+
+	var prefixes []string
+	for _, p := range n.Prefixes {
+		prefix, err := netip.ParsePrefix(p)
+		if err != nil {
+			return dnsInterception{}, fmt.Errorf("could not parse cidr %s", p)
+		}
+		if prefix.Addr().Is4() {
+			prefixes = append(prefixes, p)
+		}
+	}
+	if len(prefixes) == 0 {
+		return dnsInterception{}, fmt.Errorf("network %s of dns interception does not have any ipv4 prefix", i.NetworkID)
+	}
+
+	return dnsInterception{DNSInterception: i, prefixes: prefixes}, nil
+}
+
+// dnsProxyPort returns the port the DNS proxy listens on
+func (f *Firewall) dnsProxyPort() string {
+	if f.firewall.Spec.DNSPort != nil {
+		return strconv.FormatUint(uint64(*f.firewall.Spec.DNSPort), 10)
+	}
+	return "53"
+}
+
+// sourceMatch matches the sources of the interception which are not excluded
+func (i dnsInterception) sourceMatch() []string {
+	var match []string
+	if len(i.ExcludedPrefixes) > 0 {
+		match = append(match, fmt.Sprintf("ip saddr != { %s }", strings.Join(i.ExcludedPrefixes, ", ")))
+	}
+	return append(match, fmt.Sprintf("ip saddr { %s }", strings.Join(i.prefixes, ", ")))
+}
+
+// listenAddress returns the address the DNS proxy listens on for the interception
+func (i dnsInterception) listenAddress(cache FQDNCache) (string, error) {
+	if i.ListenAddress != "" {
+		return i.ListenAddress, nil
+	}
+	return cache.CacheAddr()
+}
+
+// dnsProxyDNATRules redirects the DNS traffic of the intercepted networks to the DNS proxy
+func dnsProxyDNATRules(f *Firewall, interceptions []dnsInterception) (nftablesRules, error) {
+	rules := nftablesRules{}
+	for _, i := range interceptions {
+		addr, err := i.listenAddress(f.cache)
+		if err != nil {
+			return nil, err
+		}
+		for _, proto := range []string{"tcp", "udp"} {
+			parts := i.sourceMatch()
+			parts = append(parts,
+				fmt.Sprintf("ip daddr != { %s }", addr),
+				fmt.Sprintf("%s dport { 53 }", proto),
+				fmt.Sprintf("counter dnat ip to %s:%s", addr, f.dnsProxyPort()),
+				fmt.Sprintf(`comment "dnat dns traffic of network %s to dns proxy %s"`, i.NetworkID, proto),
+			)
+			rules = append(rules, strings.Join(parts, " "))
+		}
+	}
+	return rules, nil
+}
+
+// dnsProxyForwardRules accepts the redirected DNS traffic of the intercepted networks to the DNS proxy
+func dnsProxyForwardRules(f *Firewall, interceptions []dnsInterception) (nftablesRules, error) {
+	rules := nftablesRules{}
+	for _, i := range interceptions {
+		addr, err := i.listenAddress(f.cache)
+		if err != nil {
+			return nil, err
+		}
+		base := append(i.sourceMatch(), fmt.Sprintf("ip daddr { %s }", addr))
+		comment := fmt.Sprintf("accept intercepted traffic of network %s for dns cache", i.NetworkID)
+		rules = append(rules,
+			assembleDestinationPortRule(base, "tcp", []string{f.dnsProxyPort()}, f.logAcceptedConnections, comment+" tcp"),
+			assembleDestinationPortRule(base, "udp", []string{f.dnsProxyPort()}, f.logAcceptedConnections, comment+" udp"),
+		)
+	}
+	return rules, nil
+}
+
+// dnsProxyEscapeSNATRules prevents the redirected DNS traffic of the intercepted networks from being masqueraded
+func dnsProxyEscapeSNATRules(f *Firewall, interceptions []dnsInterception) nftablesRules {
+	rules := nftablesRules{}
+	for _, i := range interceptions {
+		for _, proto := range []string{"tcp", "udp"} {
+			parts := i.sourceMatch()
+			parts = append(parts,
+				fmt.Sprintf("%s dport { %s }", proto, f.dnsProxyPort()),
+				fmt.Sprintf(`accept comment "escape snat for dns proxy of network %s %s"`, i.NetworkID, proto),
+			)
+			rules = append(rules, strings.Join(parts, " "))
+		}
+	}
+	return rules
+}
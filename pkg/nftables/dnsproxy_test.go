@@ -0,0 +1,106 @@
+package nftables
+
+import (
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/google/go-cmp/cmp"
+	mn "github.com/metal-stack/metal-lib/pkg/net"
+
+	firewallv2 "github.com/metal-stack/firewall-controller-manager/api/v2"
+	firewallv1 "github.com/metal-stack/firewall-controller/v2/api/v1"
+	mocks "github.com/metal-stack/firewall-controller/v2/pkg/nftables/mocks/pkg/nftables"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestDNSProxyRules(t *testing.T) {
+	private := "private"
+	secondary := "secondary"
+	internet := "internet"
+	ipv6 := "ipv6"
+	external := mn.External
+	privatePrimary := mn.PrivatePrimaryShared
+	privateSecondary := mn.PrivateSecondaryUnshared
+	port := uint(5353)
+
+	fw := &firewallv2.Firewall{
+		Spec: firewallv2.FirewallSpec{
+			DNSPort: &port,
+		},
+		Status: firewallv2.FirewallStatus{
+			FirewallNetworks: []firewallv2.FirewallNetwork{
+				{
+					NetworkID:   &private,
+					Prefixes:    []string{"10.0.1.0/24"},
+					NetworkType: &privatePrimary,
+				},
+				{
+					NetworkID:   &secondary,
+					Prefixes:    []string{"10.0.2.0/24"},
+					NetworkType: &privateSecondary,
+				},
+				{
+					NetworkID:   &internet,
+					Prefixes:    []string{"185.0.0.0/24"},
+					NetworkType: &external,
+				},
+				{
+					NetworkID:   &ipv6,
+					Prefixes:    []string{"2001:db8::/64"},
+					NetworkType: &privateSecondary,
+				},
+			},
+		},
+	}
+	interceptions := []firewallv1.DNSInterception{
+		{NetworkID: "private", ExcludedPrefixes: []string{"10.0.1.128/25"}},
+		{NetworkID: "secondary", ListenAddress: "10.0.2.1"},
+		// invalid interceptions are skipped
+		{NetworkID: "unknown"},
+		{NetworkID: "internet"},
+		{NetworkID: "ipv6"},
+	}
+
+	cache := mocks.NewFQDNCache(t)
+	cache.On("CacheAddr").Return("185.0.0.1", nil)
+
+	recorder := record.NewFakeRecorder(10)
+	f := NewFirewall(fw, &firewallv1.ClusterwideNetworkPolicyList{}, nil, cache, logr.Discard(), recorder, FirewallOptions{DNSInterceptions: interceptions})
+	resolved := f.dnsInterceptions()
+	if len(resolved) != 2 {
+		t.Fatalf("expected 2 valid interceptions, got %d", len(resolved))
+	}
+	// the interceptions are only resolved once, such that the skipped ones are reported once
+	f.dnsInterceptions()
+	if len(recorder.Events) != 3 {
+		t.Errorf("expected 3 events for the skipped interceptions, got %d", len(recorder.Events))
+	}
+
+	dnat, err := dnsProxyDNATRules(f, resolved)
+	if err != nil {
+		t.Fatalf("dnsProxyDNATRules() error = %v", err)
+	}
+	wantDNAT := nftablesRules{
+		`ip saddr != { 10.0.1.128/25 } ip saddr { 10.0.1.0/24 } ip daddr != { 185.0.0.1 } tcp dport { 53 } counter dnat ip to 185.0.0.1:5353 comment "dnat dns traffic of network private to dns proxy tcp"`,
+		`ip saddr != { 10.0.1.128/25 } ip saddr { 10.0.1.0/24 } ip daddr != { 185.0.0.1 } udp dport { 53 } counter dnat ip to 185.0.0.1:5353 comment "dnat dns traffic of network private to dns proxy udp"`,
+		`ip saddr { 10.0.2.0/24 } ip daddr != { 10.0.2.1 } tcp dport { 53 } counter dnat ip to 10.0.2.1:5353 comment "dnat dns traffic of network secondary to dns proxy tcp"`,
+		`ip saddr { 10.0.2.0/24 } ip daddr != { 10.0.2.1 } udp dport { 53 } counter dnat ip to 10.0.2.1:5353 comment "dnat dns traffic of network secondary to dns proxy udp"`,
+	}
+	if diff := cmp.Diff(wantDNAT, dnat); diff != "" {
+		t.Errorf("dnsProxyDNATRules() diff: %v", diff)
+	}
+
+	forward, err := dnsProxyForwardRules(f, resolved)
+	if err != nil {
+		t.Fatalf("dnsProxyForwardRules() error = %v", err)
+	}
+	wantForward := nftablesRules{
+		`ip saddr != { 10.0.1.128/25 } ip saddr { 10.0.1.0/24 } ip daddr { 185.0.0.1 } tcp dport { 5353 } counter accept comment "accept intercepted traffic of network private for dns cache tcp"`,
+		`ip saddr != { 10.0.1.128/25 } ip saddr { 10.0.1.0/24 } ip daddr { 185.0.0.1 } udp dport { 5353 } counter accept comment "accept intercepted traffic of network private for dns cache udp"`,
+		`ip saddr { 10.0.2.0/24 } ip daddr { 10.0.2.1 } tcp dport { 5353 } counter accept comment "accept intercepted traffic of network secondary for dns cache tcp"`,
+		`ip saddr { 10.0.2.0/24 } ip daddr { 10.0.2.1 } udp dport { 5353 } counter accept comment "accept intercepted traffic of network secondary for dns cache udp"`,
+	}
+	if diff := cmp.Diff(wantForward, forward); diff != "" {
+		t.Errorf("dnsProxyForwardRules() diff: %v", diff)
+	}
+}
@@ -2,9 +2,7 @@ package nftables
 
 import (
 	"embed"
-	"errors"
 	"fmt"
-	"net/netip"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -16,7 +14,7 @@ import (
 	"github.com/go-logr/logr"
 	"github.com/vishvananda/netlink"
 	corev1 "k8s.io/api/core/v1"
-	"k8s.io/apimachinery/pkg/util/sets"
+	discoveryv1 "k8s.io/api/discovery/v1"
 	"k8s.io/client-go/tools/record"
 
 	mn "github.com/metal-stack/metal-lib/pkg/net"
@@ -52,10 +50,27 @@ type Firewall struct {
 	firewall                   *firewallv2.Firewall
 	clusterwideNetworkPolicies *firewallv1.ClusterwideNetworkPolicyList
 	services                   *corev1.ServiceList
+	nodes                      []corev1.Node
+	endpointSlices             []discoveryv1.EndpointSlice
+	snatPolicies               []SNATPolicy
+	portForwards               []firewallv1.PortForward
+	networkRateLimits          []firewallv1.NetworkRateLimit
 
 	primaryPrivateNet *firewallv2.FirewallNetwork
 	networkMap        networkMap
 	cache             FQDNCache
+	interceptions     []firewallv1.DNSInterception
+	snatHashMode      SNATHashMode
+	rateLimitMode     RateLimitMode
+
+	nl                  addrHandle
+	egressPrefixLengths EgressPrefixLengths
+	// addressErrors are the errors of reconciling the addresses of the interfaces by network id
+	addressErrors map[string]error
+
+	// resolvedInterceptions are the valid dns interceptions, they are resolved on first use
+	resolvedInterceptions []dnsInterception
+	interceptionsResolved bool
 
 	enableDNS              bool
 	dryRun                 bool
@@ -71,6 +86,20 @@ type forwardingRules struct {
 	Egress  nftablesRules
 }
 
+// FirewallOptions are the resources and settings which are rendered in addition to the policies and services
+type FirewallOptions struct {
+	Nodes             []corev1.Node
+	EndpointSlices    []discoveryv1.EndpointSlice
+	SNATPolicies      []SNATPolicy
+	PortForwards      []firewallv1.PortForward
+	NetworkRateLimits []firewallv1.NetworkRateLimit
+	// DNSInterceptions are the networks whose DNS traffic is redirected to the DNS proxy
+	DNSInterceptions    []firewallv1.DNSInterception
+	SNATHashMode        SNATHashMode
+	RateLimitMode       RateLimitMode
+	EgressPrefixLengths EgressPrefixLengths
+}
+
 // NewFirewall creates a new nftables firewall object based on k8s entities
 func NewFirewall(
 	firewall *firewallv2.Firewall,
@@ -79,6 +108,7 @@ func NewFirewall(
 	cache FQDNCache,
 	log logr.Logger,
 	recorder record.EventRecorder,
+	opts FirewallOptions,
 ) *Firewall {
 	networkMap := networkMap{}
 	var primaryPrivateNet *firewallv2.FirewallNetwork
@@ -96,11 +126,21 @@ func NewFirewall(
 		firewall:                   firewall,
 		clusterwideNetworkPolicies: cwnps,
 		services:                   svcs,
+		nodes:                      opts.Nodes,
+		endpointSlices:             opts.EndpointSlices,
+		snatPolicies:               opts.SNATPolicies,
+		portForwards:               opts.PortForwards,
+		networkRateLimits:          opts.NetworkRateLimits,
 		primaryPrivateNet:          primaryPrivateNet,
 		networkMap:                 networkMap,
 		dryRun:                     firewall.Spec.DryRun,
 		logAcceptedConnections:     firewall.Spec.LogAcceptedConnections,
 		cache:                      cache,
+		interceptions:              opts.DNSInterceptions,
+		snatHashMode:               opts.SNATHashMode,
+		rateLimitMode:              opts.RateLimitMode,
+		nl:                         &netlink.Handle{},
+		egressPrefixLengths:        opts.EgressPrefixLengths,
 		enableDNS:                  len(cwnps.GetFQDNs()) > 0,
 		log:                        log,
 		recorder:                   recorder,
@@ -139,10 +179,8 @@ func (f *Firewall) Reconcile() (updated bool, err error) {
 		_ = os.Remove(tmpFile.Name())
 	}()
 
-	err = f.reconcileIfaceAddresses()
-	if err != nil {
-		return
-	}
+	// the rules are rendered even if the addresses of some networks could not be reconciled, the errors are reported separately
+	f.addressErrors = f.reconcileIfaceAddresses()
 
 	desired := tmpFile.Name()
 	err = f.renderFile(desired)
@@ -172,6 +210,11 @@ func (f *Firewall) Reconcile() (updated bool, err error) {
 	return true, nil
 }
 
+// AddressErrors returns the errors of reconciling the egress IPs of the last reconciliation by network id
+func (f *Firewall) AddressErrors() map[string]error {
+	return f.addressErrors
+}
+
 func (f *Firewall) ReconcileNetconfTables() error {
 	c, err := netconf.New(network.GetLogger(), network.MetalNetworkerConfig)
 	if err != nil || c == nil {
@@ -180,7 +223,8 @@ func (f *Firewall) ReconcileNetconfTables() error {
 
 	c.Networks = network.GetNewNetworks(f.firewall, c.Networks)
 
-	configurator, err := netconf.NewConfigurator(netconf.Firewall, *c, f.enableDNS)
+	// with custom interceptions the DNAT to the DNS proxy is rendered by the firewall-controller itself
+	configurator, err := netconf.NewConfigurator(netconf.Firewall, *c, f.enableDNS && len(f.interceptions) == 0)
 	if err != nil {
 		return fmt.Errorf("failed to init networker configurator: %w", err)
 	}
@@ -233,90 +277,6 @@ func (f *Firewall) validate(file string) error {
 	return nil
 }
 
-func (f *Firewall) reconcileIfaceAddresses() error {
-	var errs []error
-
-	for _, n := range f.networkMap {
-		if n.NetworkType == nil || n.NetworkID == nil {
-			continue
-		}
-
-		if *n.NetworkType != mn.External {
-			continue
-		}
-
-		configureIPs := getConfiguredIPs(*n.NetworkID)
-
-		wantedIPs := sets.NewString(configureIPs...)
-		for _, i := range f.firewall.Spec.EgressRules {
-			if i.NetworkID == *n.NetworkID {
-				wantedIPs.Insert(i.IPs...)
-				break
-			}
-		}
-
-		linkName := fmt.Sprintf("vlan%d", *n.Vrf)
-		link, err := netlink.LinkByName(linkName)
-		if err != nil {
-			var notFound netlink.LinkNotFoundError
-			if errors.As(err, &notFound) {
-				f.log.Info("skipping link because not found", "name", linkName)
-			}
-			return fmt.Errorf("unable to detect link by name: %w", err)
-		}
-		addrs, err := netlink.AddrList(link, netlink.FAMILY_V4)
-		if err != nil {
-			errs = append(errs, err)
-			continue
-		}
-
-		actualIPs := sets.NewString()
-		for _, addr := range addrs {
-			actualIPs.Insert(addr.IP.String())
-		}
-
-		toAdd := wantedIPs.Difference(actualIPs)
-		toRemove := actualIPs.Difference(wantedIPs)
-
-		// do not remove IPs that were initially used during machine allocation!
-		toRemove.Delete(n.IPs...)
-
-		if f.dryRun {
-			f.log.Info("skipping reconciling ips for", "network", n.NetworkID, "adding", toAdd, "removing", toRemove)
-			continue
-		}
-		f.log.Info("reconciling ips for", "network", n.NetworkID, "adding", toAdd, "removing", toRemove)
-
-		for add := range toAdd {
-			parsedAddr, err := netip.ParseAddr(add)
-			if err != nil {
-				errs = append(errs, err)
-				continue
-			}
-			addr, _ := netlink.ParseAddr(fmt.Sprintf("%s/%d", parsedAddr.String(), parsedAddr.BitLen()))
-			err = netlink.AddrAdd(link, addr)
-			if err != nil {
-				errs = append(errs, err)
-			}
-		}
-
-		for delete := range toRemove {
-			parsedAddr, err := netip.ParseAddr(delete)
-			if err != nil {
-				errs = append(errs, err)
-				continue
-			}
-			addr, _ := netlink.ParseAddr(fmt.Sprintf("%s/%d", parsedAddr.String(), parsedAddr.BitLen()))
-			err = netlink.AddrDel(link, addr)
-			if err != nil {
-				errs = append(errs, err)
-			}
-		}
-	}
-
-	return errors.Join(errs...)
-}
-
 func (f *Firewall) reload() error {
 	c := exec.Command(systemctlBin, "reload", nftablesService)
 	err := c.Run()
@@ -2,6 +2,7 @@ package nftables
 
 import (
 	"fmt"
+	"maps"
 	"strconv"
 	"strings"
 
@@ -25,38 +26,86 @@ func clusterwideNetworkPolicyRules(
 		egress, updated = clusterwideNetworkPolicyEgressRules(cache, np, logAcceptedConnections)
 	}
 	if len(np.Spec.Ingress) > 0 {
-		ingress = append(ingress, clusterwideNetworkPolicyIngressRules(np, logAcceptedConnections)...)
+		var fqdnState firewallv1.FQDNState
+		ingress, fqdnState = clusterwideNetworkPolicyIngressRules(cache, np, logAcceptedConnections)
+		if len(fqdnState) > 0 {
+			merged := firewallv1.FQDNState{}
+			maps.Copy(merged, updated.Status.FQDNState)
+			maps.Copy(merged, fqdnState)
+			updated.Status.FQDNState = merged
+		}
 	}
 
 	return
 }
 
-func clusterwideNetworkPolicyIngressRules(np firewallv1.ClusterwideNetworkPolicy, logAcceptedConnections bool) (rules nftablesRules) {
+func clusterwideNetworkPolicyIngressRules(
+	cache FQDNCache,
+	np firewallv1.ClusterwideNetworkPolicy,
+	logAcceptedConnections bool,
+) (rules nftablesRules, fqdnState firewallv1.FQDNState) {
 	for _, i := range np.Spec.Ingress {
-		allow := []string{}
-		except := []string{}
-		for _, ipBlock := range i.From {
-			allow = append(allow, ipBlock.CIDR)
-			except = append(except, ipBlock.Except...)
-		}
-		common := []string{}
-		if len(except) > 0 {
-			common = append(common, fmt.Sprintf("ip saddr != { %s }", strings.Join(except, ", ")))
-		}
-		if len(allow) > 0 {
-			common = append(common, fmt.Sprintf("ip saddr { %s }", strings.Join(allow, ", ")))
+		ruleBases := []ruleBase{}
+		if len(i.FromFQDNs) > 0 {
+			var rbs []ruleBase
+			rbs, fqdnState = clusterwideNetworkPolicyIngressFromFQDNRules(cache, fqdnState, i)
+			ruleBases = append(ruleBases, rbs...)
+		} else {
+			allow := []string{}
+			except := []string{}
+			for _, ipBlock := range i.From {
+				allow = append(allow, ipBlock.CIDR)
+				except = append(except, ipBlock.Except...)
+			}
+			common := []string{}
+			if len(except) > 0 {
+				common = append(common, fmt.Sprintf("ip saddr != { %s }", strings.Join(except, ", ")))
+			}
+			if len(allow) > 0 {
+				common = append(common, fmt.Sprintf("ip saddr { %s }", strings.Join(allow, ", ")))
+			}
+			ruleBases = append(ruleBases, ruleBase{base: common})
 		}
+
 		tcpPorts, udpPorts := calculatePorts(i.Ports)
 		comment := fmt.Sprintf("accept traffic for k8s network policy %s", np.Name)
-		if len(tcpPorts) > 0 {
-			rules = append(rules, assembleDestinationPortRule(common, "tcp", tcpPorts, logAcceptedConnections, comment+" tcp"))
+		for _, rb := range ruleBases {
+			if len(tcpPorts) > 0 {
+				rules = append(rules, assembleDestinationPortRule(rb.base, "tcp", tcpPorts, logAcceptedConnections, comment+" tcp"+rb.comment))
+			}
+			if len(udpPorts) > 0 {
+				rules = append(rules, assembleDestinationPortRule(rb.base, "udp", udpPorts, logAcceptedConnections, comment+" udp"+rb.comment))
+			}
+		}
+	}
+
+	return uniqueSorted(rules), fqdnState
+}
+
+// clusterwideNetworkPolicyIngressFromFQDNRules allows traffic from the IPs which the DNS cache resolved for the FQDNs of the rule
+// and from their pinned IPs
+func clusterwideNetworkPolicyIngressFromFQDNRules(
+	cache FQDNCache,
+	fqdnState firewallv1.FQDNState,
+	i firewallv1.IngressRule,
+) (rules []ruleBase, updatedState firewallv1.FQDNState) {
+	if fqdnState == nil {
+		fqdnState = firewallv1.FQDNState{}
+	}
+
+	for _, fqdn := range i.FromFQDNs {
+		sets := fqdnSets(cache, fqdn)
+		if len(sets) == 0 && !cache.IsInitialized() {
+			continue
 		}
-		if len(udpPorts) > 0 {
-			rules = append(rules, assembleDestinationPortRule(common, "udp", udpPorts, logAcceptedConnections, comment+" udp"))
+		fqdnState[fqdn.GetName()] = sets
+		for _, set := range sets {
+			rb := []string{setMatch(set, "saddr")}
+			rules = append(rules, ruleBase{comment: fmt.Sprintf(", fqdn: %s", fqdn.GetName()), base: rb})
 		}
 	}
 
-	return uniqueSorted(rules)
+	return rules, fqdnState
 }
 
 func clusterwideNetworkPolicyEgressDNSCacheRules(cache FQDNCache, logAcceptedConnections bool) (nftablesRules, error) {
@@ -93,7 +142,7 @@ func clusterwideNetworkPolicyEgressRules(
 				}
 			}
 			ruleBases = append(ruleBases, ruleBase{base: rb})
-		} else if len(e.ToFQDNs) > 0 && cache.IsInitialized() {
+		} else if len(e.ToFQDNs) > 0 {
 			rbs, u := clusterwideNetworkPolicyEgressToFQDNRules(cache, fqdnState, e)
 			ruleBases = append(ruleBases, rbs...)
 			fqdnState = u
@@ -138,10 +187,14 @@ func clusterwideNetworkPolicyEgressToFQDNRules(
 			fqdnName = fqdn.MatchPattern
 		}
 
-		fqdnState[fqdnName] = cache.GetSetsForFQDN(fqdn)
-		for _, set := range fqdnState[fqdnName] {
+		sets := fqdnSets(cache, fqdn)
+		if len(sets) == 0 && !cache.IsInitialized() {
+			continue
+		}
+		fqdnState[fqdnName] = sets
+		for _, set := range sets {
 			rb := []string{"ip saddr == @cluster_prefixes"}
-			rb = append(rb, fmt.Sprintf(string(set.Version)+" daddr @%s", set.SetName))
+			rb = append(rb, setMatch(set, "daddr"))
 			rules = append(rules, ruleBase{comment: fmt.Sprintf(", fqdn: %s", fqdn.GetName()), base: rb})
 		}
 	}
@@ -149,6 +202,30 @@ func clusterwideNetworkPolicyEgressToFQDNRules(
 	return rules, fqdnState
 }
 
+// fqdnSets returns the sets of the IPs learned by the DNS cache for the FQDN selector, if the cache is initialized,
+// followed by a set per IP version with the pinned IPs of the selector
+func fqdnSets(cache FQDNCache, fqdn firewallv1.FQDNSelector) []firewallv1.IPSet {
+	var sets []firewallv1.IPSet
+	if cache.IsInitialized() {
+		sets = cache.GetSetsForFQDN(fqdn)
+	}
+	for _, version := range []firewallv1.IPVersion{firewallv1.IPv4, firewallv1.IPv6} {
+		if pins := fqdn.GetPinnedIPs(version); len(pins) > 0 {
+			sets = append(sets, firewallv1.IPSet{FQDN: fqdn.GetName(), Version: version, PinnedIPs: pins})
+		}
+	}
+	return sets
+}
+
+// setMatch matches the source or destination address against the set,
+// pinned IPs are matched directly as they are not part of a nftables set of the DNS cache
+func setMatch(set firewallv1.IPSet, direction string) string {
+	if len(set.PinnedIPs) > 0 {
+		return fmt.Sprintf("%s %s { %s }", set.Version, direction, strings.Join(set.PinnedIPs, ", "))
+	}
+	return fmt.Sprintf("%s %s @%s", set.Version, direction, set.SetName)
+}
+
 func calculatePorts(ports []firewallv1.NetworkPolicyPort) (tcpPorts, udpPorts []string) {
 	for _, p := range ports {
 		var (
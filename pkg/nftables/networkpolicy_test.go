@@ -225,6 +225,40 @@ func TestClusterwideNetworkPolicyEgressRules(t *testing.T) {
 				},
 			},
 		},
+		{
+			name: "pinned IPs of DNS based egress policies are rendered before the cache is initialized",
+			input: firewallv1.ClusterwideNetworkPolicy{
+				Spec: firewallv1.PolicySpec{
+					Egress: []firewallv1.EgressRule{
+						{
+							ToFQDNs: []firewallv1.FQDNSelector{
+								{
+									MatchName: "api.internal.example",
+									PinnedIPs: []string{"10.1.0.0/16", "10.2.0.5", "2001:db8::/64"},
+								},
+							},
+							Ports: []firewallv1.NetworkPolicyPort{
+								{
+									Protocol: &tcp,
+									Port:     int32(443),
+								},
+							},
+						},
+					},
+				},
+			},
+			record: func(cache *mocks.FQDNCache) {
+				cache.
+					On("IsInitialized").
+					Return(false)
+			},
+			want: want{
+				egress: nftablesRules{
+					`ip saddr == @cluster_prefixes ip daddr { 10.1.0.0/16, 10.2.0.5 } tcp dport { 443 } counter accept comment "accept traffic for np  tcp, fqdn: api.internal.example"`,
+					`ip saddr == @cluster_prefixes ip6 daddr { 2001:db8::/64 } tcp dport { 443 } counter accept comment "accept traffic for np  tcp, fqdn: api.internal.example"`,
+				},
+			},
+		},
 	}
 
 	for _, tt := range tests {
@@ -247,3 +281,137 @@ func TestClusterwideNetworkPolicyEgressRules(t *testing.T) {
 		})
 	}
 }
+
+func TestClusterwideNetworkPolicyIngressRules(t *testing.T) {
+	tcp := corev1.ProtocolTCP
+
+	tests := []struct {
+		name          string
+		input         firewallv1.ClusterwideNetworkPolicy
+		record        func(*mocks.FQDNCache)
+		wantIngress   nftablesRules
+		wantFQDNState firewallv1.FQDNState
+	}{
+		{
+			name: "DNS based ingress policies",
+			input: firewallv1.ClusterwideNetworkPolicy{
+				Spec: firewallv1.PolicySpec{
+					Ingress: []firewallv1.IngressRule{
+						{
+							FromFQDNs: []firewallv1.FQDNSelector{
+								{
+									MatchName: "partner.example.com",
+								},
+							},
+							Ports: []firewallv1.NetworkPolicyPort{
+								{
+									Protocol: &tcp,
+									Port:     int32(443),
+								},
+							},
+						},
+					},
+				},
+			},
+			record: func(cache *mocks.FQDNCache) {
+				cache.
+					On("IsInitialized").
+					Return(true)
+				cache.
+					On("GetSetsForFQDN", firewallv1.FQDNSelector{MatchName: "partner.example.com"}).
+					Return([]firewallv1.IPSet{{SetName: "test", Version: firewallv1.IPv4}, {SetName: "test2", Version: firewallv1.IPv6}})
+			},
+			wantIngress: nftablesRules{
+				`ip saddr @test tcp dport { 443 } counter accept comment "accept traffic for k8s network policy  tcp, fqdn: partner.example.com"`,
+				`ip6 saddr @test2 tcp dport { 443 } counter accept comment "accept traffic for k8s network policy  tcp, fqdn: partner.example.com"`,
+			},
+			wantFQDNState: firewallv1.FQDNState{
+				"partner.example.com": {{SetName: "test", Version: firewallv1.IPv4}, {SetName: "test2", Version: firewallv1.IPv6}},
+			},
+		},
+		{
+			name: "DNS based ingress policies are not rendered before the cache is initialized",
+			input: firewallv1.ClusterwideNetworkPolicy{
+				Spec: firewallv1.PolicySpec{
+					Ingress: []firewallv1.IngressRule{
+						{
+							FromFQDNs: []firewallv1.FQDNSelector{
+								{
+									MatchName: "partner.example.com",
+								},
+							},
+							Ports: []firewallv1.NetworkPolicyPort{
+								{
+									Protocol: &tcp,
+									Port:     int32(443),
+								},
+							},
+						},
+					},
+				},
+			},
+			record: func(cache *mocks.FQDNCache) {
+				cache.
+					On("IsInitialized").
+					Return(false)
+			},
+			wantIngress: nftablesRules{},
+		},
+		{
+			name: "DNS based ingress policies with pinned IPs",
+			input: firewallv1.ClusterwideNetworkPolicy{
+				Spec: firewallv1.PolicySpec{
+					Ingress: []firewallv1.IngressRule{
+						{
+							FromFQDNs: []firewallv1.FQDNSelector{
+								{
+									MatchName: "partner.example.com",
+									PinnedIPs: []string{"185.0.0.1"},
+								},
+							},
+							Ports: []firewallv1.NetworkPolicyPort{
+								{
+									Protocol: &tcp,
+									Port:     int32(443),
+								},
+							},
+						},
+					},
+				},
+			},
+			record: func(cache *mocks.FQDNCache) {
+				cache.
+					On("IsInitialized").
+					Return(true)
+				cache.
+					On("GetSetsForFQDN", firewallv1.FQDNSelector{MatchName: "partner.example.com", PinnedIPs: []string{"185.0.0.1"}}).
+					Return([]firewallv1.IPSet{{SetName: "test", Version: firewallv1.IPv4}})
+			},
+			wantIngress: nftablesRules{
+				`ip saddr @test tcp dport { 443 } counter accept comment "accept traffic for k8s network policy  tcp, fqdn: partner.example.com"`,
+				`ip saddr { 185.0.0.1 } tcp dport { 443 } counter accept comment "accept traffic for k8s network policy  tcp, fqdn: partner.example.com"`,
+			},
+			wantFQDNState: firewallv1.FQDNState{
+				"partner.example.com": {
+					{SetName: "test", Version: firewallv1.IPv4},
+					{FQDN: "partner.example.com", Version: firewallv1.IPv4, PinnedIPs: []string{"185.0.0.1"}},
+				},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fqdnCache := mocks.NewFQDNCache(t)
+			tt.record(fqdnCache)
+
+			ingress, _, updated := clusterwideNetworkPolicyRules(fqdnCache, tt.input, false)
+			if diff := cmp.Diff(tt.wantIngress, ingress); diff != "" {
+				t.Errorf("clusterwideNetworkPolicyRules() ingress diff: %v", diff)
+			}
+			if diff := cmp.Diff(tt.wantFQDNState, updated.Status.FQDNState); diff != "" {
+				t.Errorf("clusterwideNetworkPolicyRules() fqdn state diff: %v", diff)
+			}
+		})
+	}
+}
@@ -34,6 +34,9 @@ table inet firewall {
 	counter external_out { }
 	counter drop_total { }
 	counter drop_ratelimit { }
+	{{- range .RateLimitCounters }}
+	counter {{ . }} { }
+	{{- end }}
 
 	chain forward {
 		type filter hook forward priority 1; policy drop;
@@ -81,6 +84,24 @@ table inet firewall {
         {{- end }}
 	}
 {{- end }}
+{{- if gt (len .PortForwardDNATRules) 0 }}
+
+	chain prerouting {
+		type nat hook prerouting priority -100; policy accept;
+		{{- range .PortForwardDNATRules }}
+		{{ . }}
+		{{- end }}
+	}
+{{- end }}
+{{- if gt (len .DNSProxyDNATRules) 0 }}
+
+	chain prerouting_dns_proxy {
+		type nat hook prerouting priority -100; policy accept;
+		{{- range .DNSProxyDNATRules }}
+		{{ . }}
+		{{- end }}
+	}
+{{- end }}
 }
 {{- if .AdditionalDNSAddrs }}
 
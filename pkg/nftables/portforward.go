@@ -0,0 +1,78 @@
+package nftables
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"go4.org/netipx"
+	corev1 "k8s.io/api/core/v1"
+
+	firewallv1 "github.com/metal-stack/firewall-controller/v2/api/v1"
+	"github.com/metal-stack/firewall-controller/v2/pkg/helper"
+)
+
+// portForwardRules generates the DNAT rules of the port forwards and the rules accepting the forwarded traffic.
+// Port forwards which are invalid or not within the allowed ingress networks are ignored, which is reflected in their status.
+func portForwardRules(f *Firewall, allowed *netipx.IPSet) (dnat nftablesRules, forward nftablesRules) {
+	dnat, forward = nftablesRules{}, nftablesRules{}
+	for i := range f.portForwards {
+		pf := &f.portForwards[i]
+		if err := f.validatePortForward(pf, allowed); err != nil {
+			pf.Status = firewallv1.PortForwardStatus{State: firewallv1.PolicyDeploymentStateIgnored, Message: err.Error()}
+			if f.recorder != nil {
+				f.recorder.Event(pf, corev1.EventTypeWarning, "Inapplicable", fmt.Sprintf("port forward is ignored: %v", err))
+			}
+			continue
+		}
+		pf.Status = firewallv1.PortForwardStatus{State: firewallv1.PolicyDeploymentStateDeployed}
+
+		var (
+			spec     = pf.Spec
+			protocol = proto(spec.Protocol)
+			comment  = fmt.Sprintf("port forward %s/%s", pf.Namespace, pf.Name)
+			from     []string
+		)
+		if len(spec.From) > 0 {
+			from = append(from, fmt.Sprintf("ip saddr { %s }", strings.Join(spec.From, ", ")))
+		}
+
+		dnatParts := append(slices.Clone(from),
+			fmt.Sprintf("ip daddr %s", spec.ExternalIP),
+			fmt.Sprintf("%s dport %d", protocol, spec.Port),
+			fmt.Sprintf("counter dnat ip to %s:%d", spec.TargetIP, spec.GetTargetPort()),
+			fmt.Sprintf(`comment "%s"`, comment),
+		)
+		dnat = append(dnat, strings.Join(dnatParts, " "))
+
+		// only connections which were forwarded are accepted, the target is not exposed directly
+		forwardBase := append(slices.Clone(from), fmt.Sprintf("ip daddr %s", spec.TargetIP), "ct status dnat")
+		forward = append(forward, assembleDestinationPortRule(forwardBase, protocol, []string{fmt.Sprint(spec.GetTargetPort())}, f.logAcceptedConnections, "accept "+comment))
+	}
+	return dnat, forward
+}
+
+// validatePortForward checks the port forward and that its addresses are within the allowed ingress networks of the firewall, if restricted
+func (f *Firewall) validatePortForward(pf *firewallv1.PortForward, allowed *netipx.IPSet) error {
+	if err := pf.Spec.Validate(); err != nil {
+		return err
+	}
+	if allowed == nil {
+		return nil
+	}
+
+	if len(pf.Spec.From) == 0 {
+		return fmt.Errorf("sources must be restricted to the allowed networks %s", helper.NetworkSetAsString(allowed))
+	}
+	for _, cidr := range append([]string{pf.Spec.ExternalIP + "/32"}, pf.Spec.From...) {
+		// the event is recorded by the caller together with the status
+		ok, err := helper.ValidateCIDR(pf, cidr, allowed, nil)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("%s is outside of the allowed networks %s", cidr, helper.NetworkSetAsString(allowed))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+package nftables
+
+import (
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/google/go-cmp/cmp"
+	"go4.org/netipx"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	firewallv2 "github.com/metal-stack/firewall-controller-manager/api/v2"
+	firewallv1 "github.com/metal-stack/firewall-controller/v2/api/v1"
+	"github.com/metal-stack/firewall-controller/v2/pkg/helper"
+)
+
+func TestPortForwardRules(t *testing.T) {
+	udp := corev1.ProtocolUDP
+	portForward := func(name string, spec firewallv1.PortForwardSpec) firewallv1.PortForward {
+		return firewallv1.PortForward{
+			ObjectMeta: metav1.ObjectMeta{Namespace: firewallv1.ClusterwideNetworkPolicyNamespace, Name: name},
+			Spec:       spec,
+		}
+	}
+
+	tests := []struct {
+		name                   string
+		portForwards           []firewallv1.PortForward
+		allowedNetworks        []string
+		logAcceptedConnections bool
+		wantDNAT               nftablesRules
+		wantForward            nftablesRules
+		wantStatuses           []firewallv1.PortForwardStatus
+	}{
+		{
+			name: "port forward to another port",
+			portForwards: []firewallv1.PortForward{
+				portForward("bastion", firewallv1.PortForwardSpec{ExternalIP: "185.0.0.10", Port: 2222, TargetIP: "10.0.1.5", TargetPort: 22, From: []string{"203.0.113.0/24"}}),
+			},
+			wantDNAT: nftablesRules{
+				`ip saddr { 203.0.113.0/24 } ip daddr 185.0.0.10 tcp dport 2222 counter dnat ip to 10.0.1.5:22 comment "port forward firewall/bastion"`,
+			},
+			wantForward: nftablesRules{
+				`ip saddr { 203.0.113.0/24 } ip daddr 10.0.1.5 ct status dnat tcp dport { 22 } counter accept comment "accept port forward firewall/bastion"`,
+			},
+			wantStatuses: []firewallv1.PortForwardStatus{{State: firewallv1.PolicyDeploymentStateDeployed}},
+		},
+		{
+			name: "udp port forward from everywhere with logging",
+			portForwards: []firewallv1.PortForward{
+				portForward("vpn", firewallv1.PortForwardSpec{ExternalIP: "185.0.0.10", Protocol: &udp, Port: 51820, TargetIP: "10.0.1.6"}),
+			},
+			logAcceptedConnections: true,
+			wantDNAT: nftablesRules{
+				`ip daddr 185.0.0.10 udp dport 51820 counter dnat ip to 10.0.1.6:51820 comment "port forward firewall/vpn"`,
+			},
+			wantForward: nftablesRules{
+				"ip daddr 10.0.1.6 ct status dnat udp dport { 51820 } log prefix \"nftables-firewall-accepted: \" limit rate 10/second\nip daddr 10.0.1.6 ct status dnat udp dport { 51820 } counter accept comment \"accept port forward firewall/vpn\"",
+			},
+			wantStatuses: []firewallv1.PortForwardStatus{{State: firewallv1.PolicyDeploymentStateDeployed}},
+		},
+		{
+			name: "invalid port forward",
+			portForwards: []firewallv1.PortForward{
+				portForward("invalid", firewallv1.PortForwardSpec{ExternalIP: "185.0.0.10", Port: 70000, TargetIP: "10.0.1.5"}),
+			},
+			wantDNAT:     nftablesRules{},
+			wantForward:  nftablesRules{},
+			wantStatuses: []firewallv1.PortForwardStatus{{State: firewallv1.PolicyDeploymentStateIgnored, Message: "port 70000 is out of range"}},
+		},
+		{
+			name: "allowed networks",
+			portForwards: []firewallv1.PortForward{
+				portForward("allowed", firewallv1.PortForwardSpec{ExternalIP: "185.0.0.10", Port: 2222, TargetIP: "10.0.1.5", TargetPort: 22, From: []string{"203.0.113.0/24"}}),
+				portForward("external-ip-not-allowed", firewallv1.PortForwardSpec{ExternalIP: "185.0.1.10", Port: 2222, TargetIP: "10.0.1.5", From: []string{"203.0.113.0/24"}}),
+				portForward("source-not-allowed", firewallv1.PortForwardSpec{ExternalIP: "185.0.0.10", Port: 2223, TargetIP: "10.0.1.5", From: []string{"198.51.100.0/24"}}),
+				portForward("unrestricted-source", firewallv1.PortForwardSpec{ExternalIP: "185.0.0.10", Port: 2224, TargetIP: "10.0.1.5"}),
+			},
+			allowedNetworks: []string{"185.0.0.0/24", "203.0.113.0/24"},
+			wantDNAT: nftablesRules{
+				`ip saddr { 203.0.113.0/24 } ip daddr 185.0.0.10 tcp dport 2222 counter dnat ip to 10.0.1.5:22 comment "port forward firewall/allowed"`,
+			},
+			wantForward: nftablesRules{
+				`ip saddr { 203.0.113.0/24 } ip daddr 10.0.1.5 ct status dnat tcp dport { 22 } counter accept comment "accept port forward firewall/allowed"`,
+			},
+			wantStatuses: []firewallv1.PortForwardStatus{
+				{State: firewallv1.PolicyDeploymentStateDeployed},
+				{State: firewallv1.PolicyDeploymentStateIgnored, Message: "185.0.1.10/32 is outside of the allowed networks 185.0.0.0/24,203.0.113.0/24"},
+				{State: firewallv1.PolicyDeploymentStateIgnored, Message: "198.51.100.0/24 is outside of the allowed networks 185.0.0.0/24,203.0.113.0/24"},
+				{State: firewallv1.PolicyDeploymentStateIgnored, Message: "sources must be restricted to the allowed networks 185.0.0.0/24,203.0.113.0/24"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fw := &firewallv2.Firewall{Spec: firewallv2.FirewallSpec{LogAcceptedConnections: tt.logAcceptedConnections}}
+			f := NewFirewall(fw, &firewallv1.ClusterwideNetworkPolicyList{}, nil, nil, logr.Discard(), nil, FirewallOptions{PortForwards: tt.portForwards})
+
+			var allowed *netipx.IPSet
+			if len(tt.allowedNetworks) > 0 {
+				var err error
+				allowed, err = helper.BuildNetworksIPSet(tt.allowedNetworks)
+				if err != nil {
+					t.Fatalf("unable to build allowed networks: %v", err)
+				}
+			}
+
+			dnat, forward := portForwardRules(f, allowed)
+			if diff := cmp.Diff(tt.wantDNAT, dnat); diff != "" {
+				t.Errorf("portForwardRules() dnat diff: %v", diff)
+			}
+			if diff := cmp.Diff(tt.wantForward, forward); diff != "" {
+				t.Errorf("portForwardRules() forward diff: %v", diff)
+			}
+
+			var statuses []firewallv1.PortForwardStatus
+			for _, pf := range tt.portForwards {
+				statuses = append(statuses, pf.Status)
+			}
+			if diff := cmp.Diff(tt.wantStatuses, statuses); diff != "" {
+				t.Errorf("status diff: %v", diff)
+			}
+		})
+	}
+}
@@ -2,22 +2,149 @@ package nftables
 
 import (
 	"fmt"
+	"strings"
 
 	mn "github.com/metal-stack/metal-lib/pkg/net"
+	corev1 "k8s.io/api/core/v1"
+
+	firewallv1 "github.com/metal-stack/firewall-controller/v2/api/v1"
+	"github.com/metal-stack/firewall-controller/v2/pkg/trafficcontrol"
+	"github.com/metal-stack/firewall-controller/v2/pkg/updater"
 )
 
-// rateLimitRules generates the nftables rules for rate limiting networks based on the firewall spec
-func rateLimitRules(f *Firewall) nftablesRules {
+// RateLimitMode determines how the traffic of a network over its rate limit is treated
+type RateLimitMode string
+
+const (
+	// RateLimitModeDrop drops the packets received from a network over its rate limit
+	RateLimitModeDrop RateLimitMode = "drop"
+	// RateLimitModeShape shapes the traffic of a network to its rate limit with tc, the packets are delayed instead of dropped
+	RateLimitModeShape RateLimitMode = "shape"
+)
+
+// Validate checks that the rate limit mode is known, the empty rate limit mode defaults to RateLimitModeDrop
+func (m RateLimitMode) Validate() error {
+	switch m {
+	case "", RateLimitModeDrop, RateLimitModeShape:
+		return nil
+	default:
+		return fmt.Errorf("unknown rate limit mode %q, supported are %q and %q", m, RateLimitModeDrop, RateLimitModeShape)
+	}
+}
+
+// rateLimitRules generates the nftables rules for rate limiting networks based on the firewall spec and the network rate limits,
+// together with the named counters of the network rate limits.
+// Rate limits of the firewall spec for networks which can not be limited are reported as events of the firewall,
+// network rate limits which are invalid are ignored, which is reflected in their status.
+func rateLimitRules(f *Firewall) (nftablesRules, []string) {
 	rules := nftablesRules{}
 	for _, l := range f.firewall.Spec.RateLimits {
-		n, ok := f.networkMap[l.NetworkID]
-		if !ok {
+		vrf, err := f.rateLimitVrf(l.NetworkID)
+		if err != nil {
+			if f.recorder != nil {
+				updater.ShootRecorderNamespaceRewriter(f.recorder)(f.firewall, corev1.EventTypeWarning, "Inapplicable", fmt.Sprintf("rate limit is ignored: %v", err))
+			}
+			continue
+		}
+		if f.rateLimitMode == RateLimitModeShape {
 			continue
 		}
-		if n.NetworkType == nil || *n.NetworkType == mn.Underlay {
+		rules = append(rules, fmt.Sprintf(`meta iifname "vrf%d" limit rate over %d mbytes/second counter name drop_ratelimit drop`, vrf, l.Rate))
+	}
+	rules = uniqueSorted(rules)
+	if f.rateLimitMode == RateLimitModeShape {
+		// the traffic is shaped by tc, the traffic class of the connection is restored for the packets which are accepted as established
+		rules = nftablesRules{`ct mark != 0 meta mark set ct mark comment "restore traffic class"`}
+	}
+
+	counters := []string{}
+	for i := range f.networkRateLimits {
+		rl := &f.networkRateLimits[i]
+		vrf, err := f.validateNetworkRateLimit(rl)
+		if err != nil {
+			rl.Status = firewallv1.NetworkRateLimitStatus{State: firewallv1.PolicyDeploymentStateIgnored, Message: err.Error()}
+			if f.recorder != nil {
+				f.recorder.Event(rl, corev1.EventTypeWarning, "Inapplicable", fmt.Sprintf("network rate limit is ignored: %v", err))
+			}
 			continue
 		}
-		rules = append(rules, fmt.Sprintf(`meta iifname "%s" limit rate over %d mbytes/second counter name drop_ratelimit drop`, fmt.Sprintf("vrf%d", *n.Vrf), l.Rate))
+		rl.Status = firewallv1.NetworkRateLimitStatus{State: firewallv1.PolicyDeploymentStateDeployed}
+
+		counter := networkRateLimitCounter(rl.Name)
+		counters = append(counters, counter)
+		rules = append(rules, networkRateLimitRule(rl, vrf, counter))
+	}
+	return rules, counters
+}
+
+// rateLimitVrf returns the vrf of a network which can be rate limited
+func (f *Firewall) rateLimitVrf(networkID string) (int64, error) {
+	n, ok := f.networkMap[networkID]
+	if !ok {
+		return 0, fmt.Errorf("network %q is not a network of the firewall", networkID)
+	}
+	if n.NetworkType == nil || *n.NetworkType == mn.Underlay || n.Vrf == nil {
+		return 0, fmt.Errorf("network %q can not be rate limited", networkID)
+	}
+	return *n.Vrf, nil
+}
+
+// validateNetworkRateLimit checks the network rate limit and returns the vrf of its network
+func (f *Firewall) validateNetworkRateLimit(rl *firewallv1.NetworkRateLimit) (int64, error) {
+	if err := rl.Spec.Validate(); err != nil {
+		return 0, err
+	}
+	return f.rateLimitVrf(rl.Spec.NetworkID)
+}
+
+// networkRateLimitRule drops the traffic of the network rate limit over its rate
+func networkRateLimitRule(rl *firewallv1.NetworkRateLimit, vrf int64, counter string) string {
+	spec := rl.Spec
+
+	var parts []string
+	switch spec.GetDirection() {
+	case firewallv1.RateLimitDirectionEgress:
+		parts = append(parts, fmt.Sprintf(`meta oifname { "vlan%d", "vrf%d" }`, vrf, vrf))
+	default:
+		parts = append(parts, fmt.Sprintf(`meta iifname "vrf%d"`, vrf))
+	}
+	if len(spec.Destinations) > 0 {
+		parts = append(parts, fmt.Sprintf("ip daddr { %s }", strings.Join(spec.Destinations, ", ")))
+	}
+
+	switch spec.GetUnit() {
+	case firewallv1.RateLimitUnitPackets:
+		parts = append(parts, fmt.Sprintf("limit rate over %d/second", spec.Rate))
+		if spec.Burst != nil {
+			parts = append(parts, fmt.Sprintf("burst %d packets", *spec.Burst))
+		}
+	default:
+		parts = append(parts, fmt.Sprintf("limit rate over %d %s", spec.Rate, spec.GetUnit()))
+		if spec.Burst != nil {
+			parts = append(parts, fmt.Sprintf("burst %d kbytes", *spec.Burst))
+		}
+	}
+
+	parts = append(parts,
+		fmt.Sprintf("counter name %s drop", counter),
+		fmt.Sprintf(`comment "network rate limit %s/%s"`, rl.Namespace, rl.Name),
+	)
+	return strings.Join(parts, " ")
+}
+
+// networkRateLimitCounter returns the name of the counter of the packets dropped by a network rate limit
+func networkRateLimitCounter(name string) string {
+	return "ratelimit_" + name
+}
+
+// trafficClassRules marks the connections accepted by the rules with the traffic class, such that tc shapes them accordingly
+func trafficClassRules(rules nftablesRules, trafficClass string) nftablesRules {
+	mark := trafficcontrol.TrafficClassMark(trafficClass)
+	statement := fmt.Sprintf(" meta mark set %#x ct mark set %#x counter accept", mark, mark)
+
+	marked := make(nftablesRules, 0, len(rules))
+	for _, r := range rules {
+		marked = append(marked, strings.ReplaceAll(r, " counter accept", statement))
 	}
-	return uniqueSorted(rules)
+	return marked
 }
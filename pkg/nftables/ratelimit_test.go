@@ -1,6 +1,7 @@
 package nftables
 
 import (
+	"fmt"
 	"testing"
 
 	"github.com/go-logr/logr"
@@ -9,6 +10,9 @@ import (
 
 	firewallv2 "github.com/metal-stack/firewall-controller-manager/api/v2"
 	firewallv1 "github.com/metal-stack/firewall-controller/v2/api/v1"
+	"github.com/metal-stack/firewall-controller/v2/pkg/trafficcontrol"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
 )
 
 func TestRateLimitRules(t *testing.T) {
@@ -20,10 +24,38 @@ func TestRateLimitRules(t *testing.T) {
 	vrf3 := int64(3)
 	privatePrimary := mn.PrivatePrimaryShared
 	external := mn.External
+	hundred := uint32(100)
+	rateLimit := func(name string, spec firewallv1.NetworkRateLimitSpec) firewallv1.NetworkRateLimit {
+		return firewallv1.NetworkRateLimit{
+			ObjectMeta: metav1.ObjectMeta{Namespace: firewallv1.ClusterwideNetworkPolicyNamespace, Name: name},
+			Spec:       spec,
+		}
+	}
+	networks := []firewallv2.FirewallNetwork{
+		{
+			NetworkID:   &private,
+			Prefixes:    []string{"10.0.1.0/24"},
+			IPs:         []string{"10.0.1.1"},
+			Vrf:         &vrf1,
+			NetworkType: &privatePrimary,
+		},
+		{
+			NetworkID:   &internet,
+			Prefixes:    []string{"185.0.0.0/24"},
+			IPs:         []string{"185.0.0.1"},
+			Vrf:         &vrf2,
+			NetworkType: &external,
+		},
+	}
 	tests := []struct {
-		name  string
-		input firewallv2.Firewall
-		want  nftablesRules
+		name              string
+		input             firewallv2.Firewall
+		networkRateLimits []firewallv1.NetworkRateLimit
+		mode              RateLimitMode
+		want              nftablesRules
+		wantCounters      []string
+		wantStatuses      []firewallv1.NetworkRateLimitStatus
+		wantEvents        int
 	}{
 		{
 			name: "rate limit for multiple networks",
@@ -76,15 +108,122 @@ func TestRateLimitRules(t *testing.T) {
 				`meta iifname "vrf2" limit rate over 10 mbytes/second counter name drop_ratelimit drop`,
 				`meta iifname "vrf3" limit rate over 20 mbytes/second counter name drop_ratelimit drop`,
 			},
+			wantCounters: []string{},
+			wantEvents:   1,
+		},
+		{
+			name: "rate limits are shaped",
+			input: firewallv2.Firewall{
+				Spec: firewallv2.FirewallSpec{
+					RateLimits: []firewallv2.RateLimit{{NetworkID: "internet", Rate: uint32(10)}},
+				},
+				Status: firewallv2.FirewallStatus{
+					FirewallNetworks: []firewallv2.FirewallNetwork{
+						{
+							NetworkID:   &internet,
+							Prefixes:    []string{"185.0.0.0/24"},
+							IPs:         []string{"185.0.0.1"},
+							Vrf:         &vrf2,
+							NetworkType: &external,
+						},
+					},
+				},
+			},
+			mode: RateLimitModeShape,
+			want: nftablesRules{
+				`ct mark != 0 meta mark set ct mark comment "restore traffic class"`,
+			},
+			wantCounters: []string{},
+		},
+		{
+			name: "network rate limits",
+			input: firewallv2.Firewall{
+				Spec: firewallv2.FirewallSpec{
+					RateLimits: []firewallv2.RateLimit{{NetworkID: "internet", Rate: uint32(10)}},
+				},
+				Status: firewallv2.FirewallStatus{FirewallNetworks: networks},
+			},
+			networkRateLimits: []firewallv1.NetworkRateLimit{
+				rateLimit("internet-egress", firewallv1.NetworkRateLimitSpec{NetworkID: "internet", Direction: firewallv1.RateLimitDirectionEgress, Rate: 5}),
+				rateLimit("internet-packets", firewallv1.NetworkRateLimitSpec{NetworkID: "internet", Rate: 1000, Unit: firewallv1.RateLimitUnitPackets, Burst: &hundred}),
+				rateLimit("private-storage", firewallv1.NetworkRateLimitSpec{NetworkID: "private", Rate: 500, Unit: firewallv1.RateLimitUnitKBytes, Burst: &hundred, Destinations: []string{"10.0.1.128/25", "10.0.1.64/26"}}),
+				rateLimit("unknown", firewallv1.NetworkRateLimitSpec{NetworkID: "mpls", Rate: 10}),
+				rateLimit("invalid", firewallv1.NetworkRateLimitSpec{NetworkID: "internet", Destinations: []string{"internet"}}),
+			},
+			want: nftablesRules{
+				`meta iifname "vrf2" limit rate over 10 mbytes/second counter name drop_ratelimit drop`,
+				`meta oifname { "vlan2", "vrf2" } limit rate over 5 mbytes/second counter name ratelimit_internet-egress drop comment "network rate limit firewall/internet-egress"`,
+				`meta iifname "vrf2" limit rate over 1000/second burst 100 packets counter name ratelimit_internet-packets drop comment "network rate limit firewall/internet-packets"`,
+				`meta iifname "vrf1" ip daddr { 10.0.1.128/25, 10.0.1.64/26 } limit rate over 500 kbytes/second burst 100 kbytes counter name ratelimit_private-storage drop comment "network rate limit firewall/private-storage"`,
+			},
+			wantCounters: []string{"ratelimit_internet-egress", "ratelimit_internet-packets", "ratelimit_private-storage"},
+			wantStatuses: []firewallv1.NetworkRateLimitStatus{
+				{State: firewallv1.PolicyDeploymentStateDeployed},
+				{State: firewallv1.PolicyDeploymentStateDeployed},
+				{State: firewallv1.PolicyDeploymentStateDeployed},
+				{State: firewallv1.PolicyDeploymentStateIgnored, Message: `network "mpls" is not a network of the firewall`},
+				{State: firewallv1.PolicyDeploymentStateIgnored, Message: "rate must be greater than 0\ndestination internet is not a valid ipv4 CIDR"},
+			},
+			wantEvents: 2,
+		},
+		{
+			name: "network rate limits are dropped when shaping",
+			input: firewallv2.Firewall{
+				Spec: firewallv2.FirewallSpec{
+					RateLimits: []firewallv2.RateLimit{{NetworkID: "internet", Rate: uint32(10)}, {NetworkID: "unknown", Rate: uint32(10)}},
+				},
+				Status: firewallv2.FirewallStatus{FirewallNetworks: networks},
+			},
+			networkRateLimits: []firewallv1.NetworkRateLimit{
+				rateLimit("internet", firewallv1.NetworkRateLimitSpec{NetworkID: "internet", Rate: 1000, Unit: firewallv1.RateLimitUnitPackets}),
+			},
+			mode: RateLimitModeShape,
+			want: nftablesRules{
+				`ct mark != 0 meta mark set ct mark comment "restore traffic class"`,
+				`meta iifname "vrf2" limit rate over 1000/second counter name ratelimit_internet drop comment "network rate limit firewall/internet"`,
+			},
+			wantCounters: []string{"ratelimit_internet"},
+			wantStatuses: []firewallv1.NetworkRateLimitStatus{{State: firewallv1.PolicyDeploymentStateDeployed}},
+			wantEvents:   1,
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			f := NewFirewall(&firewallv2.Firewall{Spec: tt.input.Spec, Status: tt.input.Status}, &firewallv1.ClusterwideNetworkPolicyList{}, nil, nil, logr.Discard(), nil)
-			got := rateLimitRules(f)
+			recorder := record.NewFakeRecorder(10)
+			f := NewFirewall(&firewallv2.Firewall{Spec: tt.input.Spec, Status: tt.input.Status}, &firewallv1.ClusterwideNetworkPolicyList{}, nil, nil, logr.Discard(), recorder, FirewallOptions{NetworkRateLimits: tt.networkRateLimits, RateLimitMode: tt.mode})
+			got, counters := rateLimitRules(f)
 			if !cmp.Equal(got, tt.want) {
 				t.Errorf("rateLimitRules() diff: %v", cmp.Diff(got, tt.want))
 			}
+			if diff := cmp.Diff(tt.wantCounters, counters); diff != "" {
+				t.Errorf("rateLimitRules() counters diff: %v", diff)
+			}
+
+			var statuses []firewallv1.NetworkRateLimitStatus
+			for _, rl := range f.networkRateLimits {
+				statuses = append(statuses, rl.Status)
+			}
+			if diff := cmp.Diff(tt.wantStatuses, statuses); diff != "" {
+				t.Errorf("status diff: %v", diff)
+			}
+			if len(recorder.Events) != tt.wantEvents {
+				t.Errorf("expected %d events, got %d", tt.wantEvents, len(recorder.Events))
+			}
 		})
 	}
 }
+
+func TestTrafficClassRules(t *testing.T) {
+	rules := nftablesRules{
+		`ip saddr == @cluster_prefixes ip daddr { 0.0.0.0/0 } tcp dport { 443 } counter accept comment "accept traffic for k8s network policy backup tcp"`,
+		"ip saddr == @cluster_prefixes tcp dport { 22 } log prefix \"nftables-firewall-accepted: \" limit rate 10/second\nip saddr == @cluster_prefixes tcp dport { 22 } counter accept comment \"accept traffic for k8s network policy backup tcp\"",
+	}
+	mark := trafficcontrol.TrafficClassMark("backup")
+	want := nftablesRules{
+		fmt.Sprintf(`ip saddr == @cluster_prefixes ip daddr { 0.0.0.0/0 } tcp dport { 443 } meta mark set %#x ct mark set %#x counter accept comment "accept traffic for k8s network policy backup tcp"`, mark, mark),
+		fmt.Sprintf("ip saddr == @cluster_prefixes tcp dport { 22 } log prefix \"nftables-firewall-accepted: \" limit rate 10/second\nip saddr == @cluster_prefixes tcp dport { 22 } meta mark set %#x ct mark set %#x counter accept comment \"accept traffic for k8s network policy backup tcp\"", mark, mark),
+	}
+	if diff := cmp.Diff(want, trafficClassRules(rules, "backup")); diff != "" {
+		t.Errorf("trafficClassRules() diff: %v", diff)
+	}
+}
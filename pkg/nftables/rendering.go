@@ -16,13 +16,16 @@ import (
 
 // firewallRenderingData holds the data available in the nftables template
 type firewallRenderingData struct {
-	ForwardingRules    forwardingRules
-	RateLimitRules     nftablesRules
-	SnatRules          nftablesRules
-	Sets               []dns.RenderIPSet
-	InternalPrefixes   string
-	PrivateVrfID       uint
-	AdditionalDNSAddrs []string
+	ForwardingRules      forwardingRules
+	RateLimitRules       nftablesRules
+	RateLimitCounters    []string
+	SnatRules            nftablesRules
+	DNSProxyDNATRules    nftablesRules
+	PortForwardDNATRules nftablesRules
+	Sets                 []dns.RenderIPSet
+	InternalPrefixes     string
+	PrivateVrfID         uint
+	AdditionalDNSAddrs   []string
 }
 
 func newFirewallRenderingData(f *Firewall) (*firewallRenderingData, error) {
@@ -34,6 +37,9 @@ func newFirewallRenderingData(f *Firewall) (*firewallRenderingData, error) {
 		}
 
 		i, e, u := clusterwideNetworkPolicyRules(f.cache, np, f.logAcceptedConnections)
+		if f.rateLimitMode == RateLimitModeShape && np.Spec.TrafficClass != "" {
+			i, e = trafficClassRules(i, np.Spec.TrafficClass), trafficClassRules(e, np.Spec.TrafficClass)
+		}
 		ingress = append(ingress, i...)
 		egress = append(egress, e...)
 		f.clusterwideNetworkPolicies.Items[ind] = u
@@ -52,20 +58,50 @@ func newFirewallRenderingData(f *Firewall) (*firewallRenderingData, error) {
 	}
 
 	for _, svc := range f.services.Items {
-		ingress = append(ingress, serviceRules(svc, serviceAllowedSet, f.logAcceptedConnections, f.recorder)...)
+		// a service without ready endpoints would not answer, so its ports are not opened until it is ready
+		if !serviceHasReadyEndpoints(svc, f.endpointSlices) {
+			continue
+		}
+		nodeIPs := serviceNodeIPs(svc, f.nodes, f.endpointSlices)
+		ingress = append(ingress, serviceRules(svc, nodeIPs, f.cache, serviceAllowedSet, f.logAcceptedConnections, f.recorder)...)
 	}
 
+	portForwardDNATRules, portForwardRules := portForwardRules(f, serviceAllowedSet)
+	ingress = append(ingress, portForwardRules...)
+
 	snatRules, err := snatRules(f)
 	if err != nil {
 		return &firewallRenderingData{}, err
 	}
+	hairpinRules := nftablesRules{}
+	for _, svc := range f.services.Items {
+		if !serviceHasReadyEndpoints(svc, f.endpointSlices) {
+			continue
+		}
+		hairpinRules = append(hairpinRules, serviceHairpinSNATRules(svc, serviceAllowedSet, *f.primaryPrivateNet.Vrf)...)
+	}
+	snatRules = append(hairpinRules, snatRules...)
 
 	var (
-		sets     []dns.RenderIPSet
-		dnsAddrs = []string{}
+		sets      []dns.RenderIPSet
+		fqdns     = append(f.clusterwideNetworkPolicies.GetFQDNs(), ServiceHostnameSelectors(f.services.Items)...)
+		dnatRules = nftablesRules{}
+		dnsAddrs  = []string{}
 	)
-	if f.cache.IsInitialized() {
-		sets = f.cache.GetSetsForRendering(f.clusterwideNetworkPolicies.GetFQDNs())
+	if f.cache.IsInitialized() && len(f.interceptions) > 0 {
+		sets = f.cache.GetSetsForRendering(fqdns)
+		interceptions := f.dnsInterceptions()
+		dnatRules, err = dnsProxyDNATRules(f, interceptions)
+		if err != nil {
+			return &firewallRenderingData{}, err
+		}
+		rules, err := dnsProxyForwardRules(f, interceptions)
+		if err != nil {
+			return &firewallRenderingData{}, err
+		}
+		egress = append(egress, rules...)
+	} else if f.cache.IsInitialized() {
+		sets = f.cache.GetSetsForRendering(fqdns)
 		rules, err := clusterwideNetworkPolicyEgressDNSCacheRules(f.cache, f.logAcceptedConnections)
 		if err != nil {
 			return &firewallRenderingData{}, err
@@ -76,6 +112,10 @@ func newFirewallRenderingData(f *Firewall) (*firewallRenderingData, error) {
 		egress = append(egress, rules...)
 	}
 
+	sets = append(sets, snatPolicySets(f)...)
+
+	rateLimitRules, rateLimitCounters := rateLimitRules(f)
+
 	ingress = splitRules(ingress)
 	egress = splitRules(egress)
 
@@ -87,9 +127,12 @@ func newFirewallRenderingData(f *Firewall) (*firewallRenderingData, error) {
 			Ingress: ingress,
 			Egress:  egress,
 		},
-		RateLimitRules: rateLimitRules(f),
-		SnatRules:      snatRules,
-		Sets:           sets,
+		RateLimitRules:       rateLimitRules,
+		RateLimitCounters:    rateLimitCounters,
+		SnatRules:            snatRules,
+		DNSProxyDNATRules:    dnatRules,
+		PortForwardDNATRules: portForwardDNATRules,
+		Sets:                 sets,
 	}, nil
 }
 
@@ -85,6 +85,58 @@ func TestFirewallRenderingData_renderString(t *testing.T) {
 			},
 			wantErr: false,
 		},
+		{
+			name: "dns-interception",
+			data: &firewallRenderingData{
+				ForwardingRules: forwardingRules{
+					Egress:  []string{"egress rule"},
+					Ingress: []string{"ingress rule"},
+				},
+				InternalPrefixes: "1.2.3.4",
+				RateLimitRules:   []string{},
+				SnatRules:        []string{"ip saddr { 10.0.1.0/24 } udp dport { 53 } accept comment \"escape snat for dns proxy of network private udp\""},
+				DNSProxyDNATRules: []string{
+					"ip saddr != { 10.0.1.128/25 } ip saddr { 10.0.1.0/24 } ip daddr != { 10.0.1.1 } udp dport { 53 } counter dnat ip to 10.0.1.1:53 comment \"dnat dns traffic of network private to dns proxy udp\"",
+				},
+				PrivateVrfID: uint(42),
+			},
+			wantErr: false,
+		},
+		{
+			name: "rate-limits",
+			data: &firewallRenderingData{
+				ForwardingRules: forwardingRules{
+					Egress:  []string{"egress rule"},
+					Ingress: []string{"ingress rule"},
+				},
+				InternalPrefixes: "1.2.3.4",
+				RateLimitRules: []string{
+					"meta iifname \"vrf104009\" limit rate over 10 mbytes/second counter name drop_ratelimit drop",
+					"meta oifname { \"vlan104009\", \"vrf104009\" } ip daddr { 185.0.0.0/24 } limit rate over 1000/second burst 100 packets counter name ratelimit_internet-egress drop comment \"network rate limit firewall/internet-egress\"",
+				},
+				RateLimitCounters: []string{"ratelimit_internet-egress"},
+				SnatRules:         []string{},
+				PrivateVrfID:      uint(42),
+			},
+			wantErr: false,
+		},
+		{
+			name: "port-forward",
+			data: &firewallRenderingData{
+				ForwardingRules: forwardingRules{
+					Egress:  []string{"egress rule"},
+					Ingress: []string{"ip saddr { 203.0.113.0/24 } ip daddr 10.0.1.5 ct status dnat tcp dport { 22 } counter accept comment \"accept port forward firewall/bastion\""},
+				},
+				InternalPrefixes: "1.2.3.4",
+				RateLimitRules:   []string{},
+				SnatRules:        []string{},
+				PortForwardDNATRules: []string{
+					"ip saddr { 203.0.113.0/24 } ip daddr 185.0.0.10 tcp dport 2222 counter dnat ip to 10.0.1.5:22 comment \"port forward firewall/bastion\"",
+				},
+				PrivateVrfID: uint(42),
+			},
+			wantErr: false,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -1,66 +1,359 @@
 package nftables
 
 import (
+	"errors"
 	"fmt"
 	"net/netip"
+	"regexp"
+	"slices"
+	"strconv"
 	"strings"
 
+	firewallv1 "github.com/metal-stack/firewall-controller/v2/api/v1"
 	"github.com/metal-stack/firewall-controller/v2/pkg/helper"
 	"go4.org/netipx"
 	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
 	"k8s.io/client-go/tools/record"
 )
 
-// serviceRules generates nftables rules base on a k8s service definition
-func serviceRules(svc corev1.Service, allowed *netipx.IPSet, logAcceptedConnections bool, recorder record.EventRecorder) nftablesRules {
-	if svc.Spec.Type != corev1.ServiceTypeLoadBalancer && svc.Spec.Type != corev1.ServiceTypeNodePort {
-		return nil
+const (
+	// ServiceHairpinAnnotation enables access to the load balancer IPs of a service from within the cluster through the firewall if set to true
+	ServiceHairpinAnnotation = "firewall.metal-stack.io/hairpin"
+	// ServiceIgnoreAnnotation opts a service out of the firewall, no traffic is accepted for it if set to "true"
+	ServiceIgnoreAnnotation = "firewall.metal-stack.io/ignore"
+	// ServicePortsAnnotation restricts the accepted traffic to a comma separated list of ports of the service, optionally with protocol, e.g. "443,53/udp"
+	ServicePortsAnnotation = "firewall.metal-stack.io/ports"
+	// ServiceSourceRangesAnnotation adds a comma separated list of CIDRs to the sources allowed by the load balancer source ranges,
+	// it has no effect on services without source ranges, which are open to any source
+	ServiceSourceRangesAnnotation = "firewall.metal-stack.io/source-ranges"
+	// ServiceLogAcceptedConnectionsAnnotation overrides whether accepted connections to the service are logged
+	ServiceLogAcceptedConnectionsAnnotation = "firewall.metal-stack.io/log-accepted-connections"
+	// ServiceRateLimitAnnotation limits the packets accepted for new connections to the service per protocol, e.g. "100/second"
+	ServiceRateLimitAnnotation = "firewall.metal-stack.io/rate-limit"
+
+	invalidServiceAnnotation = "InvalidAnnotation"
+)
+
+var serviceRateLimitRE = regexp.MustCompile(`^[1-9][0-9]*/(second|minute|hour)$`)
+
+// serviceOptions are the options of a service set by annotations
+type serviceOptions struct {
+	ignore                 bool
+	hairpin                bool
+	ports                  map[string]bool
+	sourceRanges           []string
+	logAcceptedConnections *bool
+	rateLimit              string
+	// unexposed is set if the ports or sources can't be determined, such that no traffic is accepted instead of too much
+	unexposed bool
+}
+
+// serviceOptionsFromAnnotations parses the annotations of a service, the options of invalid annotations are not set
+func serviceOptionsFromAnnotations(svc corev1.Service) (serviceOptions, error) {
+	var (
+		opts serviceOptions
+		errs []error
+	)
+
+	parseBool := func(annotation string) *bool {
+		v, ok := svc.Annotations[annotation]
+		if !ok {
+			return nil
+		}
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("annotation %s: %q is not a boolean", annotation, v))
+			return nil
+		}
+		return &b
+	}
+	if ignore := parseBool(ServiceIgnoreAnnotation); ignore != nil {
+		opts.ignore = *ignore
+	}
+	if hairpin := parseBool(ServiceHairpinAnnotation); hairpin != nil {
+		opts.hairpin = *hairpin
 	}
+	opts.logAcceptedConnections = parseBool(ServiceLogAcceptedConnectionsAnnotation)
 
-	from := []string{}
-	from = append(from, svc.Spec.LoadBalancerSourceRanges...)
-	to := []string{}
-	if svc.Spec.Type == corev1.ServiceTypeLoadBalancer {
-		to = appendServiceIP(to, svc, allowed, svc.Spec.LoadBalancerIP, recorder)
-		for _, e := range svc.Status.LoadBalancer.Ingress {
-			to = appendServiceIP(to, svc, allowed, e.IP, recorder)
+	if v, ok := svc.Annotations[ServicePortsAnnotation]; ok {
+		opts.ports = map[string]bool{}
+		for entry := range strings.SplitSeq(v, ",") {
+			entry = strings.TrimSpace(entry)
+			port, protocol, withProtocol := strings.Cut(entry, "/")
+			protocols := []corev1.Protocol{corev1.ProtocolTCP, corev1.ProtocolUDP}
+			if withProtocol {
+				protocols = []corev1.Protocol{corev1.Protocol(strings.ToUpper(protocol))}
+			}
+
+			matched := false
+			for _, p := range svc.Spec.Ports {
+				if fmt.Sprint(p.Port) == port && slices.Contains(protocols, p.Protocol) {
+					opts.ports[servicePortKey(p)] = true
+					matched = true
+				}
+			}
+			if !matched {
+				errs = append(errs, fmt.Errorf("annotation %s: %q is not a port of the service", ServicePortsAnnotation, entry))
+				opts.unexposed = true
+			}
 		}
 	}
 
-	// avoid empty rules
-	if len(from) == 0 && len(to) == 0 {
+	if v, ok := svc.Annotations[ServiceSourceRangesAnnotation]; ok {
+		for cidr := range strings.SplitSeq(v, ",") {
+			cidr = strings.TrimSpace(cidr)
+			prefix, err := netip.ParsePrefix(cidr)
+			if err != nil || !prefix.Addr().Is4() {
+				errs = append(errs, fmt.Errorf("annotation %s: %q is not a valid ipv4 CIDR", ServiceSourceRangesAnnotation, cidr))
+				opts.unexposed = true
+				continue
+			}
+			opts.sourceRanges = append(opts.sourceRanges, prefix.String())
+		}
+	}
+
+	if v, ok := svc.Annotations[ServiceRateLimitAnnotation]; ok {
+		if serviceRateLimitRE.MatchString(v) {
+			opts.rateLimit = v
+		} else {
+			errs = append(errs, fmt.Errorf("annotation %s: %q is not a rate like 100/second", ServiceRateLimitAnnotation, v))
+		}
+	}
+
+	return opts, errors.Join(errs...)
+}
+
+func servicePortKey(p corev1.ServicePort) string {
+	return fmt.Sprintf("%d/%s", p.Port, proto(&p.Protocol))
+}
+
+// serviceRules generates nftables rules base on a k8s service definition.
+// Traffic is accepted to the ports of the load balancer IPs, external IPs and load balancer hostnames of a service,
+// and to the node ports of the given node IPs for services of type node port.
+func serviceRules(svc corev1.Service, nodeIPs []string, cache FQDNCache, allowed *netipx.IPSet, logAcceptedConnections bool, recorder record.EventRecorder) nftablesRules {
+	if !IsExposedService(svc) {
+		return nil
+	}
+
+	opts, err := serviceOptionsFromAnnotations(svc)
+	if err != nil && recorder != nil {
+		recorder.Eventf(&svc, corev1.EventTypeWarning, invalidServiceAnnotation, "invalid firewall annotations, ignoring them: %v", err)
+	}
+	if opts.ignore || opts.unexposed {
 		return nil
 	}
+	if opts.logAcceptedConnections != nil {
+		logAcceptedConnections = *opts.logAcceptedConnections
+	}
 
-	ruleBase := []string{}
+	from := []string{}
+	from = append(from, svc.Spec.LoadBalancerSourceRanges...)
+	// additional source ranges must not restrict a service which is open to any source
 	if len(from) > 0 {
-		ruleBase = append(ruleBase, fmt.Sprintf("ip saddr { %s }", strings.Join(from, ", ")))
+		from = append(from, opts.sourceRanges...)
 	}
 
+	var (
+		to                 = serviceIPs(svc, allowed, recorder)
+		tcpPorts, udpPorts = servicePorts(svc, opts, false)
+		destinations       []serviceDestination
+	)
 	if len(to) > 0 {
-		ruleBase = append(ruleBase, fmt.Sprintf("ip daddr { %s }", strings.Join(to, ", ")))
+		destinations = append(destinations, serviceDestination{match: fmt.Sprintf("ip daddr { %s }", strings.Join(to, ", ")), tcpPorts: tcpPorts, udpPorts: udpPorts})
+	}
+	for _, set := range serviceHostnameSets(svc, cache, allowed) {
+		destinations = append(destinations, serviceDestination{match: setMatch(set, "daddr"), tcpPorts: tcpPorts, udpPorts: udpPorts})
+	}
+	if svc.Spec.Type == corev1.ServiceTypeNodePort {
+		var nodes []string
+		for _, ip := range nodeIPs {
+			nodes = appendServiceIP(nodes, svc, allowed, ip, recorder)
+		}
+		// without a destination, the node ports would be opened on every address
+		if len(nodes) > 0 {
+			nodeTCPPorts, nodeUDPPorts := servicePorts(svc, opts, true)
+			destinations = append(destinations, serviceDestination{match: fmt.Sprintf("ip daddr { %s }", strings.Join(nodes, ", ")), tcpPorts: nodeTCPPorts, udpPorts: nodeUDPPorts})
+		}
+	}
+	if len(destinations) == 0 && len(from) > 0 && svc.Spec.Type == corev1.ServiceTypeLoadBalancer {
+		// the ports are opened for the source ranges even if no load balancer IP is allowed
+		destinations = append(destinations, serviceDestination{tcpPorts: tcpPorts, udpPorts: udpPorts})
 	}
 
-	tcpPorts := []string{}
-	udpPorts := []string{}
+	comment := fmt.Sprintf("accept traffic for k8s service %s/%s", svc.Namespace, svc.Name)
+	rules := nftablesRules{}
+	for _, d := range destinations {
+		ruleBase := []string{}
+		if len(from) > 0 {
+			ruleBase = append(ruleBase, fmt.Sprintf("ip saddr { %s }", strings.Join(from, ", ")))
+		}
+		if d.match != "" {
+			ruleBase = append(ruleBase, d.match)
+		}
+		rules = append(rules, d.rules(ruleBase, opts.rateLimit, logAcceptedConnections, comment)...)
+	}
+
+	if opts.hairpin && len(to) > 0 {
+		hairpin := serviceDestination{match: fmt.Sprintf("ip daddr { %s }", strings.Join(to, ", ")), tcpPorts: tcpPorts, udpPorts: udpPorts}
+		hairpinComment := fmt.Sprintf("accept hairpin traffic for k8s service %s/%s", svc.Namespace, svc.Name)
+		rules = append(rules, hairpin.rules([]string{"ip saddr @cluster_prefixes", hairpin.match}, opts.rateLimit, logAcceptedConnections, hairpinComment)...)
+	}
+	if len(rules) == 0 {
+		return nil
+	}
+	return uniqueSorted(rules)
+}
+
+// serviceDestination is a destination of a service with the ports opened on it
+type serviceDestination struct {
+	match    string
+	tcpPorts []string
+	udpPorts []string
+}
+
+func (d serviceDestination) rules(ruleBase []string, rateLimit string, logAcceptedConnections bool, comment string) nftablesRules {
+	rules := nftablesRules{}
+	if len(d.tcpPorts) > 0 {
+		rules = append(rules, assembleLimitedDestinationPortRule(slices.Clone(ruleBase), "tcp", d.tcpPorts, rateLimit, logAcceptedConnections, comment))
+	}
+	if len(d.udpPorts) > 0 {
+		rules = append(rules, assembleLimitedDestinationPortRule(slices.Clone(ruleBase), "udp", d.udpPorts, rateLimit, logAcceptedConnections, comment))
+	}
+	return rules
+}
+
+// servicePorts returns the ports or node ports of the service which are opened
+func servicePorts(svc corev1.Service, opts serviceOptions, nodePorts bool) (tcpPorts, udpPorts []string) {
 	for _, p := range svc.Spec.Ports {
-		proto := proto(&p.Protocol)
-		switch proto {
+		if opts.ports != nil && !opts.ports[servicePortKey(p)] {
+			continue
+		}
+		port := p.Port
+		if nodePorts {
+			port = p.NodePort
+		}
+		if port == 0 {
+			continue
+		}
+		switch proto(&p.Protocol) {
 		case "tcp":
-			tcpPorts = append(tcpPorts, fmt.Sprint(p.Port))
+			tcpPorts = append(tcpPorts, fmt.Sprint(port))
 		case "udp":
-			udpPorts = append(udpPorts, fmt.Sprint(p.Port))
+			udpPorts = append(udpPorts, fmt.Sprint(port))
 		}
 	}
-	comment := fmt.Sprintf("accept traffic for k8s service %s/%s", svc.Namespace, svc.Name)
-	rules := nftablesRules{}
-	if len(tcpPorts) > 0 {
-		rules = append(rules, assembleDestinationPortRule(ruleBase, "tcp", tcpPorts, logAcceptedConnections, comment))
+	return tcpPorts, udpPorts
+}
+
+// serviceHostnameSets returns the IPv4 sets of the DNS cache with the addresses of the load balancer hostnames of a service.
+// As their addresses change dynamically, hostnames are not used if the ingress is restricted to allowed networks.
+func serviceHostnameSets(svc corev1.Service, cache FQDNCache, allowed *netipx.IPSet) []firewallv1.IPSet {
+	if cache == nil || allowed != nil {
+		return nil
+	}
+	var sets []firewallv1.IPSet
+	for _, hostname := range serviceHostnames(svc) {
+		for _, set := range fqdnSets(cache, firewallv1.FQDNSelector{MatchName: hostname}) {
+			if set.Version == firewallv1.IPv4 {
+				sets = append(sets, set)
+			}
+		}
+	}
+	return sets
+}
+
+// serviceHostnames returns the hostnames of the load balancer of a service
+func serviceHostnames(svc corev1.Service) []string {
+	if svc.Spec.Type != corev1.ServiceTypeLoadBalancer {
+		return nil
 	}
-	if len(udpPorts) > 0 {
-		rules = append(rules, assembleDestinationPortRule(ruleBase, "udp", udpPorts, logAcceptedConnections, comment))
+	var hostnames []string
+	for _, e := range svc.Status.LoadBalancer.Ingress {
+		if e.Hostname != "" {
+			hostnames = append(hostnames, e.Hostname)
+		}
 	}
-	return uniqueSorted(rules)
+	return hostnames
+}
+
+// ServiceHostnameSelectors returns selectors for the load balancer hostnames of the services, such that the DNS cache resolves them
+func ServiceHostnameSelectors(svcs []corev1.Service) []firewallv1.FQDNSelector {
+	var selectors []firewallv1.FQDNSelector
+	for _, svc := range svcs {
+		for _, hostname := range serviceHostnames(svc) {
+			selectors = append(selectors, firewallv1.FQDNSelector{MatchName: hostname})
+		}
+	}
+	return selectors
+}
+
+// IsExposedService returns whether the ports of the service can be opened by the firewall,
+// i.e. it is of type load balancer or node port or has external IPs
+func IsExposedService(svc corev1.Service) bool {
+	return svc.Spec.Type == corev1.ServiceTypeLoadBalancer || svc.Spec.Type == corev1.ServiceTypeNodePort || len(svc.Spec.ExternalIPs) > 0
+}
+
+// serviceHasReadyEndpoints returns whether any endpoint of the service is ready to serve traffic
+func serviceHasReadyEndpoints(svc corev1.Service, endpointSlices []discoveryv1.EndpointSlice) bool {
+	for _, slice := range serviceEndpointSlices(svc, endpointSlices) {
+		for _, e := range slice.Endpoints {
+			if endpointReady(e) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func serviceEndpointSlices(svc corev1.Service, endpointSlices []discoveryv1.EndpointSlice) []discoveryv1.EndpointSlice {
+	var result []discoveryv1.EndpointSlice
+	for _, slice := range endpointSlices {
+		if slice.Namespace == svc.Namespace && slice.Labels[discoveryv1.LabelServiceName] == svc.Name {
+			result = append(result, slice)
+		}
+	}
+	return result
+}
+
+// endpointReady returns whether the endpoint is ready, an unknown readiness is interpreted as ready
+func endpointReady(e discoveryv1.Endpoint) bool {
+	return e.Conditions.Ready == nil || *e.Conditions.Ready
+}
+
+// serviceHairpinSNATRules masquerades the traffic from within the cluster to the load balancer IPs of a service with hairpin enabled.
+// Otherwise the answers of the service would be sent to the client directly, bypassing the connection tracking of the firewall.
+func serviceHairpinSNATRules(svc corev1.Service, allowed *netipx.IPSet, privateVrfID int64) nftablesRules {
+	if svc.Spec.Type != corev1.ServiceTypeLoadBalancer {
+		return nil
+	}
+	// invalid annotations are already reported by serviceRules
+	if opts, _ := serviceOptionsFromAnnotations(svc); !opts.hairpin || opts.ignore || opts.unexposed {
+		return nil
+	}
+	// events for IPs outside of the allowed networks are already recorded by serviceRules
+	to := serviceIPs(svc, allowed, nil)
+	if len(to) == 0 {
+		return nil
+	}
+	return nftablesRules{
+		fmt.Sprintf(`ip saddr @cluster_prefixes ip daddr { %s } oifname "vlan%d" counter masquerade comment "hairpin nat for k8s service %s/%s"`, strings.Join(to, ", "), privateVrfID, svc.Namespace, svc.Name),
+	}
+}
+
+// serviceIPs returns the load balancer IPs and external IPs of a service which are within the allowed networks
+func serviceIPs(svc corev1.Service, allowed *netipx.IPSet, recorder record.EventRecorder) []string {
+	to := []string{}
+	if svc.Spec.Type == corev1.ServiceTypeLoadBalancer {
+		to = appendServiceIP(to, svc, allowed, svc.Spec.LoadBalancerIP, recorder)
+		for _, e := range svc.Status.LoadBalancer.Ingress {
+			to = appendServiceIP(to, svc, allowed, e.IP, recorder)
+		}
+	}
+	for _, ip := range svc.Spec.ExternalIPs {
+		to = appendServiceIP(to, svc, allowed, ip, recorder)
+	}
+	return to
 }
 
 func appendServiceIP(to []string, svc corev1.Service, allowed *netipx.IPSet, ip string, recorder record.EventRecorder) []string {
@@ -80,3 +373,37 @@ func appendServiceIP(to []string, svc corev1.Service, allowed *netipx.IPSet, ip
 	}
 	return to
 }
+
+// serviceNodeIPs returns the internal IPv4 addresses of the nodes which expose the node ports of a service.
+// With the local external traffic policy, only the nodes running ready endpoints of the service answer on the node ports.
+func serviceNodeIPs(svc corev1.Service, nodes []corev1.Node, endpointSlices []discoveryv1.EndpointSlice) []string {
+	if svc.Spec.Type != corev1.ServiceTypeNodePort {
+		return nil
+	}
+
+	var endpointNodes map[string]bool
+	if svc.Spec.ExternalTrafficPolicy == corev1.ServiceExternalTrafficPolicyLocal {
+		endpointNodes = map[string]bool{}
+		for _, slice := range serviceEndpointSlices(svc, endpointSlices) {
+			for _, e := range slice.Endpoints {
+				if e.NodeName != nil && endpointReady(e) {
+					endpointNodes[*e.NodeName] = true
+				}
+			}
+		}
+	}
+
+	var ips []string
+	for _, n := range nodes {
+		if endpointNodes != nil && !endpointNodes[n.Name] {
+			continue
+		}
+		for _, a := range n.Status.Addresses {
+			if ip, err := netip.ParseAddr(a.Address); a.Type == corev1.NodeInternalIP && err == nil && ip.Is4() {
+				ips = append(ips, ip.String())
+			}
+		}
+	}
+	slices.Sort(ips)
+	return slices.Compact(ips)
+}
@@ -4,11 +4,16 @@ import (
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	firewallv1 "github.com/metal-stack/firewall-controller/v2/api/v1"
 	"github.com/metal-stack/firewall-controller/v2/pkg/helper"
+	mocks "github.com/metal-stack/firewall-controller/v2/pkg/nftables/mocks/pkg/nftables"
 	"go4.org/netipx"
 	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/tools/record"
 )
 
 func helpMustParseIPSet(ips []string) *netipx.IPSet {
@@ -70,6 +75,52 @@ func TestServiceRules(t *testing.T) {
 				},
 			},
 		},
+		{
+			name: "service type loadbalancer with hairpin",
+			input: corev1.Service{
+				ObjectMeta: v1.ObjectMeta{
+					Namespace:   "test",
+					Name:        "svc",
+					Annotations: map[string]string{ServiceHairpinAnnotation: "true"},
+				},
+				Spec: corev1.ServiceSpec{
+					Type: corev1.ServiceTypeLoadBalancer,
+					Ports: []corev1.ServicePort{
+						{
+							Port:     443,
+							Protocol: corev1.ProtocolTCP,
+						},
+						{
+							Port:     53,
+							Protocol: corev1.ProtocolUDP,
+						},
+					},
+				},
+				Status: corev1.ServiceStatus{
+					LoadBalancer: corev1.LoadBalancerStatus{
+						Ingress: []corev1.LoadBalancerIngress{
+							{
+								IP: "185.0.0.1",
+							},
+						},
+					},
+				},
+			},
+			want: want{
+				ingress: nftablesRules{
+					`ip daddr { 185.0.0.1 } tcp dport { 443 } counter accept comment "accept traffic for k8s service test/svc"`,
+					`ip daddr { 185.0.0.1 } udp dport { 53 } counter accept comment "accept traffic for k8s service test/svc"`,
+					`ip saddr @cluster_prefixes ip daddr { 185.0.0.1 } tcp dport { 443 } counter accept comment "accept hairpin traffic for k8s service test/svc"`,
+					`ip saddr @cluster_prefixes ip daddr { 185.0.0.1 } udp dport { 53 } counter accept comment "accept hairpin traffic for k8s service test/svc"`,
+				},
+				ingressAL: nftablesRules{
+					`ip daddr { 185.0.0.1 } tcp dport { 443 } log prefix "nftables-firewall-accepted: " limit rate 10/second` + "\n" + `ip daddr { 185.0.0.1 } tcp dport { 443 } counter accept comment "accept traffic for k8s service test/svc"`,
+					`ip daddr { 185.0.0.1 } udp dport { 53 } log prefix "nftables-firewall-accepted: " limit rate 10/second` + "\n" + `ip daddr { 185.0.0.1 } udp dport { 53 } counter accept comment "accept traffic for k8s service test/svc"`,
+					`ip saddr @cluster_prefixes ip daddr { 185.0.0.1 } tcp dport { 443 } log prefix "nftables-firewall-accepted: " limit rate 10/second` + "\n" + `ip saddr @cluster_prefixes ip daddr { 185.0.0.1 } tcp dport { 443 } counter accept comment "accept hairpin traffic for k8s service test/svc"`,
+					`ip saddr @cluster_prefixes ip daddr { 185.0.0.1 } udp dport { 53 } log prefix "nftables-firewall-accepted: " limit rate 10/second` + "\n" + `ip saddr @cluster_prefixes ip daddr { 185.0.0.1 } udp dport { 53 } counter accept comment "accept hairpin traffic for k8s service test/svc"`,
+				},
+			},
+		},
 		{
 			name: "service type nodeport is a noop",
 			input: corev1.Service{
@@ -219,14 +270,416 @@ func TestServiceRules(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			ingress := serviceRules(tt.input, tt.allowed, false, nil)
+			ingress := serviceRules(tt.input, nil, nil, tt.allowed, false, nil)
 			if !cmp.Equal(ingress, tt.want.ingress) {
 				t.Errorf("serviceRules() diff: %v", cmp.Diff(ingress, tt.want.ingress))
 			}
-			ingressAL := serviceRules(tt.input, tt.allowed, true, nil)
+			ingressAL := serviceRules(tt.input, nil, nil, tt.allowed, true, nil)
 			if !cmp.Equal(ingressAL, tt.want.ingressAL) {
 				t.Errorf("serviceRules() diff: %v", cmp.Diff(ingressAL, tt.want.ingressAL))
 			}
 		})
 	}
 }
+
+func TestServiceHairpinSNATRules(t *testing.T) {
+	svc := func(annotations map[string]string, ip string) corev1.Service {
+		return corev1.Service{
+			ObjectMeta: v1.ObjectMeta{Namespace: "test", Name: "svc", Annotations: annotations},
+			Spec: corev1.ServiceSpec{
+				Type:  corev1.ServiceTypeLoadBalancer,
+				Ports: []corev1.ServicePort{{Port: 443, Protocol: corev1.ProtocolTCP}},
+			},
+			Status: corev1.ServiceStatus{
+				LoadBalancer: corev1.LoadBalancerStatus{Ingress: []corev1.LoadBalancerIngress{{IP: ip}}},
+			},
+		}
+	}
+
+	tests := []struct {
+		name    string
+		input   corev1.Service
+		allowed *netipx.IPSet
+		want    nftablesRules
+	}{
+		{
+			name:  "hairpin enabled",
+			input: svc(map[string]string{ServiceHairpinAnnotation: "true"}, "185.0.0.1"),
+			want: nftablesRules{
+				`ip saddr @cluster_prefixes ip daddr { 185.0.0.1 } oifname "vlan42" counter masquerade comment "hairpin nat for k8s service test/svc"`,
+			},
+		},
+		{
+			name:  "hairpin enabled with another boolean notation",
+			input: svc(map[string]string{ServiceHairpinAnnotation: "1"}, "185.0.0.1"),
+			want: nftablesRules{
+				`ip saddr @cluster_prefixes ip daddr { 185.0.0.1 } oifname "vlan42" counter masquerade comment "hairpin nat for k8s service test/svc"`,
+			},
+		},
+		{
+			name:  "hairpin not enabled",
+			input: svc(nil, "185.0.0.1"),
+		},
+		{
+			name:  "invalid hairpin annotation",
+			input: svc(map[string]string{ServiceHairpinAnnotation: "yes"}, "185.0.0.1"),
+		},
+		{
+			name:    "ip outside of allowed networks",
+			input:   svc(map[string]string{ServiceHairpinAnnotation: "true"}, "185.0.0.1"),
+			allowed: helpMustParseIPSet([]string{"182.0.0.0/8"}),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := serviceHairpinSNATRules(tt.input, tt.allowed, 42)
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("serviceHairpinSNATRules() diff: %v", diff)
+			}
+		})
+	}
+}
+
+func TestServiceRulesAnnotations(t *testing.T) {
+	svc := func(annotations map[string]string) corev1.Service {
+		return corev1.Service{
+			ObjectMeta: v1.ObjectMeta{Namespace: "test", Name: "svc", Annotations: annotations},
+			Spec: corev1.ServiceSpec{
+				Type: corev1.ServiceTypeLoadBalancer,
+				Ports: []corev1.ServicePort{
+					{Port: 443, Protocol: corev1.ProtocolTCP},
+					{Port: 8443, Protocol: corev1.ProtocolTCP},
+					{Port: 53, Protocol: corev1.ProtocolUDP},
+				},
+				LoadBalancerSourceRanges: []string{"185.0.0.0/16"},
+			},
+			Status: corev1.ServiceStatus{
+				LoadBalancer: corev1.LoadBalancerStatus{Ingress: []corev1.LoadBalancerIngress{{IP: "185.0.0.1"}}},
+			},
+		}
+	}
+
+	tests := []struct {
+		name       string
+		input      corev1.Service
+		want       nftablesRules
+		wantEvents int
+	}{
+		{
+			name:  "opt out",
+			input: svc(map[string]string{ServiceIgnoreAnnotation: "true"}),
+		},
+		{
+			name:  "subset of ports",
+			input: svc(map[string]string{ServicePortsAnnotation: "443, 53/udp"}),
+			want: nftablesRules{
+				`ip saddr { 185.0.0.0/16 } ip daddr { 185.0.0.1 } tcp dport { 443 } counter accept comment "accept traffic for k8s service test/svc"`,
+				`ip saddr { 185.0.0.0/16 } ip daddr { 185.0.0.1 } udp dport { 53 } counter accept comment "accept traffic for k8s service test/svc"`,
+			},
+		},
+		{
+			name:       "unknown port is not exposed",
+			input:      svc(map[string]string{ServicePortsAnnotation: "443,53/tcp"}),
+			wantEvents: 1,
+		},
+		{
+			name:  "additional source ranges with rate limit",
+			input: svc(map[string]string{ServiceSourceRangesAnnotation: "203.0.113.0/24", ServiceRateLimitAnnotation: "100/second", ServicePortsAnnotation: "443"}),
+			want: nftablesRules{
+				`ip saddr { 185.0.0.0/16, 203.0.113.0/24 } ip daddr { 185.0.0.1 } tcp dport { 443 } limit rate 100/second counter accept comment "accept traffic for k8s service test/svc"`,
+			},
+		},
+		{
+			name: "additional source ranges do not restrict an open service",
+			input: func() corev1.Service {
+				s := svc(map[string]string{ServiceSourceRangesAnnotation: "203.0.113.0/24", ServicePortsAnnotation: "443"})
+				s.Spec.LoadBalancerSourceRanges = nil
+				return s
+			}(),
+			want: nftablesRules{
+				`ip daddr { 185.0.0.1 } tcp dport { 443 } counter accept comment "accept traffic for k8s service test/svc"`,
+			},
+		},
+		{
+			name:       "invalid source range is not exposed",
+			input:      svc(map[string]string{ServiceSourceRangesAnnotation: "203.0.113.0"}),
+			wantEvents: 1,
+		},
+		{
+			name:  "log accepted connections",
+			input: svc(map[string]string{ServiceLogAcceptedConnectionsAnnotation: "true", ServicePortsAnnotation: "443"}),
+			want: nftablesRules{
+				`ip saddr { 185.0.0.0/16 } ip daddr { 185.0.0.1 } tcp dport { 443 } log prefix "nftables-firewall-accepted: " limit rate 10/second` + "\n" + `ip saddr { 185.0.0.0/16 } ip daddr { 185.0.0.1 } tcp dport { 443 } counter accept comment "accept traffic for k8s service test/svc"`,
+			},
+		},
+		{
+			name:  "invalid rate limit and boolean are ignored",
+			input: svc(map[string]string{ServiceRateLimitAnnotation: "fast", ServiceIgnoreAnnotation: "maybe", ServicePortsAnnotation: "8443"}),
+			want: nftablesRules{
+				`ip saddr { 185.0.0.0/16 } ip daddr { 185.0.0.1 } tcp dport { 8443 } counter accept comment "accept traffic for k8s service test/svc"`,
+			},
+			wantEvents: 1,
+		},
+		{
+			name:  "invalid hairpin annotation is ignored",
+			input: svc(map[string]string{ServiceHairpinAnnotation: "yes", ServicePortsAnnotation: "8443"}),
+			want: nftablesRules{
+				`ip saddr { 185.0.0.0/16 } ip daddr { 185.0.0.1 } tcp dport { 8443 } counter accept comment "accept traffic for k8s service test/svc"`,
+			},
+			wantEvents: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := record.NewFakeRecorder(10)
+			got := serviceRules(tt.input, nil, nil, nil, false, recorder)
+			if diff := cmp.Diff(tt.want, got, cmpopts.EquateEmpty()); diff != "" {
+				t.Errorf("serviceRules() diff: %v", diff)
+			}
+			if len(recorder.Events) != tt.wantEvents {
+				t.Errorf("expected %d events, got %d", tt.wantEvents, len(recorder.Events))
+			}
+		})
+	}
+}
+
+func TestServiceRulesNodePort(t *testing.T) {
+	nodePort := func(policy corev1.ServiceExternalTrafficPolicy) corev1.Service {
+		return corev1.Service{
+			ObjectMeta: v1.ObjectMeta{Namespace: "test", Name: "svc"},
+			Spec: corev1.ServiceSpec{
+				Type: corev1.ServiceTypeNodePort,
+				Ports: []corev1.ServicePort{
+					{Port: 443, NodePort: 30443, Protocol: corev1.ProtocolTCP},
+					{Port: 53, NodePort: 30053, Protocol: corev1.ProtocolUDP},
+				},
+				ExternalTrafficPolicy:    policy,
+				LoadBalancerSourceRanges: []string{"185.0.0.0/16"},
+			},
+		}
+	}
+	node := func(name string, ips ...string) corev1.Node {
+		n := corev1.Node{ObjectMeta: v1.ObjectMeta{Name: name}}
+		for _, ip := range ips {
+			n.Status.Addresses = append(n.Status.Addresses, corev1.NodeAddress{Type: corev1.NodeInternalIP, Address: ip})
+		}
+		n.Status.Addresses = append(n.Status.Addresses, corev1.NodeAddress{Type: corev1.NodeHostName, Address: name})
+		return n
+	}
+	nodeName, notReadyNodeName, notReady := "node-2", "node-1", false
+	nodes := []corev1.Node{node("node-1", "10.0.1.11", "2001:db8::11"), node("node-2", "10.0.1.12"), node("node-3")}
+	endpointSlices := []discoveryv1.EndpointSlice{
+		{
+			ObjectMeta: v1.ObjectMeta{Namespace: "test", Name: "svc-abc", Labels: map[string]string{discoveryv1.LabelServiceName: "svc"}},
+			Endpoints: []discoveryv1.Endpoint{
+				{Addresses: []string{"10.244.1.5"}, NodeName: &nodeName},
+				{Addresses: []string{"10.244.0.7"}, NodeName: &notReadyNodeName, Conditions: discoveryv1.EndpointConditions{Ready: &notReady}},
+			},
+		},
+	}
+
+	tests := []struct {
+		name        string
+		input       corev1.Service
+		nodes       []corev1.Node
+		wantNodeIPs []string
+		want        nftablesRules
+	}{
+		{
+			name:        "node ports on all nodes",
+			input:       nodePort(corev1.ServiceExternalTrafficPolicyCluster),
+			nodes:       nodes,
+			wantNodeIPs: []string{"10.0.1.11", "10.0.1.12"},
+			want: nftablesRules{
+				`ip saddr { 185.0.0.0/16 } ip daddr { 10.0.1.11, 10.0.1.12 } tcp dport { 30443 } counter accept comment "accept traffic for k8s service test/svc"`,
+				`ip saddr { 185.0.0.0/16 } ip daddr { 10.0.1.11, 10.0.1.12 } udp dport { 30053 } counter accept comment "accept traffic for k8s service test/svc"`,
+			},
+		},
+		{
+			name:        "node ports on nodes with ready endpoints only",
+			input:       nodePort(corev1.ServiceExternalTrafficPolicyLocal),
+			nodes:       nodes,
+			wantNodeIPs: []string{"10.0.1.12"},
+			want: nftablesRules{
+				`ip saddr { 185.0.0.0/16 } ip daddr { 10.0.1.12 } tcp dport { 30443 } counter accept comment "accept traffic for k8s service test/svc"`,
+				`ip saddr { 185.0.0.0/16 } ip daddr { 10.0.1.12 } udp dport { 30053 } counter accept comment "accept traffic for k8s service test/svc"`,
+			},
+		},
+		{
+			name:  "no nodes",
+			input: nodePort(corev1.ServiceExternalTrafficPolicyCluster),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nodeIPs := serviceNodeIPs(tt.input, tt.nodes, endpointSlices)
+			if diff := cmp.Diff(tt.wantNodeIPs, nodeIPs); diff != "" {
+				t.Errorf("serviceNodeIPs() diff: %v", diff)
+			}
+			got := serviceRules(tt.input, nodeIPs, nil, nil, false, nil)
+			if diff := cmp.Diff(tt.want, got, cmpopts.EquateEmpty()); diff != "" {
+				t.Errorf("serviceRules() diff: %v", diff)
+			}
+		})
+	}
+}
+
+func TestServiceRulesExternalIPsAndHostnames(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   corev1.Service
+		allowed *netipx.IPSet
+		record  func(*mocks.FQDNCache)
+		want    nftablesRules
+	}{
+		{
+			name: "external ips of a cluster ip service",
+			input: corev1.Service{
+				ObjectMeta: v1.ObjectMeta{Namespace: "test", Name: "svc"},
+				Spec: corev1.ServiceSpec{
+					Type:        corev1.ServiceTypeClusterIP,
+					ExternalIPs: []string{"185.0.0.2", "185.0.0.1"},
+					Ports:       []corev1.ServicePort{{Port: 443, Protocol: corev1.ProtocolTCP}},
+				},
+			},
+			record: func(cache *mocks.FQDNCache) {},
+			want: nftablesRules{
+				`ip daddr { 185.0.0.2, 185.0.0.1 } tcp dport { 443 } counter accept comment "accept traffic for k8s service test/svc"`,
+			},
+		},
+		{
+			name: "external ips outside of the allowed networks",
+			input: corev1.Service{
+				ObjectMeta: v1.ObjectMeta{Namespace: "test", Name: "svc"},
+				Spec: corev1.ServiceSpec{
+					Type:        corev1.ServiceTypeClusterIP,
+					ExternalIPs: []string{"185.0.0.1", "192.168.0.1"},
+					Ports:       []corev1.ServicePort{{Port: 443, Protocol: corev1.ProtocolTCP}},
+				},
+			},
+			allowed: helpMustParseIPSet([]string{"185.0.0.0/16"}),
+			record:  func(cache *mocks.FQDNCache) {},
+			want: nftablesRules{
+				`ip daddr { 185.0.0.1 } tcp dport { 443 } counter accept comment "accept traffic for k8s service test/svc"`,
+			},
+		},
+		{
+			name: "load balancer hostname",
+			input: corev1.Service{
+				ObjectMeta: v1.ObjectMeta{Namespace: "test", Name: "svc"},
+				Spec: corev1.ServiceSpec{
+					Type:                     corev1.ServiceTypeLoadBalancer,
+					LoadBalancerSourceRanges: []string{"203.0.113.0/24"},
+					Ports:                    []corev1.ServicePort{{Port: 443, Protocol: corev1.ProtocolTCP}},
+				},
+				Status: corev1.ServiceStatus{
+					LoadBalancer: corev1.LoadBalancerStatus{Ingress: []corev1.LoadBalancerIngress{{IP: "185.0.0.1"}, {Hostname: "lb.example.com"}}},
+				},
+			},
+			record: func(cache *mocks.FQDNCache) {
+				cache.
+					On("IsInitialized").
+					Return(true)
+				cache.
+					On("GetSetsForFQDN", firewallv1.FQDNSelector{MatchName: "lb.example.com"}).
+					Return([]firewallv1.IPSet{{SetName: "lb", Version: firewallv1.IPv4}, {SetName: "lb6", Version: firewallv1.IPv6}})
+			},
+			want: nftablesRules{
+				`ip saddr { 203.0.113.0/24 } ip daddr @lb tcp dport { 443 } counter accept comment "accept traffic for k8s service test/svc"`,
+				`ip saddr { 203.0.113.0/24 } ip daddr { 185.0.0.1 } tcp dport { 443 } counter accept comment "accept traffic for k8s service test/svc"`,
+			},
+		},
+		{
+			name: "load balancer hostname which is not resolved yet",
+			input: corev1.Service{
+				ObjectMeta: v1.ObjectMeta{Namespace: "test", Name: "svc"},
+				Spec: corev1.ServiceSpec{
+					Type:  corev1.ServiceTypeLoadBalancer,
+					Ports: []corev1.ServicePort{{Port: 443, Protocol: corev1.ProtocolTCP}},
+				},
+				Status: corev1.ServiceStatus{
+					LoadBalancer: corev1.LoadBalancerStatus{Ingress: []corev1.LoadBalancerIngress{{Hostname: "lb.example.com"}}},
+				},
+			},
+			record: func(cache *mocks.FQDNCache) {
+				cache.
+					On("IsInitialized").
+					Return(false)
+			},
+		},
+		{
+			name: "load balancer hostname with allowed networks",
+			input: corev1.Service{
+				ObjectMeta: v1.ObjectMeta{Namespace: "test", Name: "svc"},
+				Spec: corev1.ServiceSpec{
+					Type:  corev1.ServiceTypeLoadBalancer,
+					Ports: []corev1.ServicePort{{Port: 443, Protocol: corev1.ProtocolTCP}},
+				},
+				Status: corev1.ServiceStatus{
+					LoadBalancer: corev1.LoadBalancerStatus{Ingress: []corev1.LoadBalancerIngress{{Hostname: "lb.example.com"}}},
+				},
+			},
+			allowed: helpMustParseIPSet([]string{"185.0.0.0/16"}),
+			record:  func(cache *mocks.FQDNCache) {},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cache := mocks.NewFQDNCache(t)
+			tt.record(cache)
+			got := serviceRules(tt.input, nil, cache, tt.allowed, false, nil)
+			if diff := cmp.Diff(tt.want, got, cmpopts.EquateEmpty()); diff != "" {
+				t.Errorf("serviceRules() diff: %v", diff)
+			}
+		})
+	}
+}
+
+func TestServiceHasReadyEndpoints(t *testing.T) {
+	ready, notReady := true, false
+	svc := corev1.Service{ObjectMeta: v1.ObjectMeta{Namespace: "test", Name: "svc"}}
+	slice := func(namespace, service string, endpoints ...discoveryv1.Endpoint) discoveryv1.EndpointSlice {
+		return discoveryv1.EndpointSlice{
+			ObjectMeta: v1.ObjectMeta{Namespace: namespace, Name: service + "-abc", Labels: map[string]string{discoveryv1.LabelServiceName: service}},
+			Endpoints:  endpoints,
+		}
+	}
+
+	tests := []struct {
+		name           string
+		endpointSlices []discoveryv1.EndpointSlice
+		want           bool
+	}{
+		{
+			name: "no endpoint slices",
+		},
+		{
+			name:           "ready endpoint",
+			endpointSlices: []discoveryv1.EndpointSlice{slice("test", "svc", discoveryv1.Endpoint{Conditions: discoveryv1.EndpointConditions{Ready: &ready}})},
+			want:           true,
+		},
+		{
+			name:           "unknown readiness",
+			endpointSlices: []discoveryv1.EndpointSlice{slice("test", "svc", discoveryv1.Endpoint{})},
+			want:           true,
+		},
+		{
+			name:           "endpoints not ready",
+			endpointSlices: []discoveryv1.EndpointSlice{slice("test", "svc", discoveryv1.Endpoint{Conditions: discoveryv1.EndpointConditions{Ready: &notReady}})},
+		},
+		{
+			name: "ready endpoints of other services",
+			endpointSlices: []discoveryv1.EndpointSlice{
+				slice("other", "svc", discoveryv1.Endpoint{}),
+				slice("test", "other", discoveryv1.Endpoint{}),
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := serviceHasReadyEndpoints(svc, tt.endpointSlices); got != tt.want {
+				t.Errorf("serviceHasReadyEndpoints() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -3,20 +3,101 @@ package nftables
 import (
 	"fmt"
 	"net"
+	"slices"
 	"strings"
 
 	mn "github.com/metal-stack/metal-lib/pkg/net"
+	corev1 "k8s.io/api/core/v1"
+
+	firewallv2 "github.com/metal-stack/firewall-controller-manager/api/v2"
+	firewallv1 "github.com/metal-stack/firewall-controller/v2/api/v1"
+	"github.com/metal-stack/firewall-controller/v2/pkg/dns"
+)
+
+// SNATPolicy is a SNAT policy with the IPs of the pods selected by its sources
+type SNATPolicy struct {
+	firewallv1.SNATPolicy
+	// PodIPs are the IPv4 addresses of the pods selected by the sources of the policy
+	PodIPs []string
+}
+
+// SNATHashMode determines how connections are distributed among multiple egress IPs of a network
+type SNATHashMode string
+
+const (
+	// SNATHashModeProtocol hashes tcp and udp connections by destination and source port, other traffic by destination only
+	SNATHashModeProtocol SNATHashMode = "protocol"
+	// SNATHashModeSource hashes by source address, such that all connections of a source use the same egress IP
+	SNATHashModeSource SNATHashMode = "source"
+	// SNATHashModeDestination hashes by destination address, such that all connections to a destination use the same egress IP
+	SNATHashModeDestination SNATHashMode = "destination"
+	// SNATHashModeRoundRobin assigns the egress IPs to new connections in turn
+	SNATHashModeRoundRobin SNATHashMode = "round-robin"
 )
 
+// Validate checks that the hash mode is known, the empty hash mode defaults to SNATHashModeProtocol
+func (m SNATHashMode) Validate() error {
+	switch m {
+	case "", SNATHashModeProtocol, SNATHashModeSource, SNATHashModeDestination, SNATHashModeRoundRobin:
+		return nil
+	default:
+		return fmt.Errorf("unknown snat hash mode %q, supported are %q, %q, %q and %q", m, SNATHashModeProtocol, SNATHashModeSource, SNATHashModeDestination, SNATHashModeRoundRobin)
+	}
+}
+
 type snatRule struct {
 	sourceNetworks string
+	protocol       string
 	oifname        string
 	to             string
 	comment        string
 }
 
 func (s *snatRule) String() string {
-	return fmt.Sprintf(`ip saddr { %s } oifname "%s" counter snat %s random comment "%s"`, s.sourceNetworks, s.oifname, s.to, s.comment)
+	protocol := ""
+	if s.protocol != "" {
+		protocol = " " + s.protocol
+	}
+	return fmt.Sprintf(`ip saddr { %s }%s oifname "%s" counter snat %s random comment "%s"`, s.sourceNetworks, protocol, s.oifname, s.to, s.comment)
+}
+
+// snatTarget is the egress IP selection of a SNAT rule for the traffic matching protocol
+type snatTarget struct {
+	protocol string
+	to       string
+}
+
+// snatTargets returns the protocol matches and targets of the SNAT rules for the given egress IPs.
+// Multiple egress IPs are selected according to the hash mode, the port based hashes require one rule per protocol.
+func snatTargets(mode SNATHashMode, ips []string) ([]snatTarget, error) {
+	if len(ips) == 1 {
+		return []snatTarget{{to: ips[0]}}, nil
+	}
+
+	hmap := []string{}
+	for k, ip := range ips {
+		hmap = append(hmap, fmt.Sprintf("%d : %s", k, ip))
+	}
+	to := func(hash string) string {
+		return fmt.Sprintf("to %s mod %d map { %s }", hash, len(ips), strings.Join(hmap, ", "))
+	}
+
+	switch mode {
+	case "", SNATHashModeProtocol:
+		return []snatTarget{
+			{protocol: "meta l4proto tcp", to: to("jhash ip daddr . tcp sport")},
+			{protocol: "meta l4proto udp", to: to("jhash ip daddr . udp sport")},
+			{protocol: "meta l4proto != { tcp, udp }", to: to("jhash ip daddr")},
+		}, nil
+	case SNATHashModeSource:
+		return []snatTarget{{to: to("jhash ip saddr")}}, nil
+	case SNATHashModeDestination:
+		return []snatTarget{{to: to("jhash ip daddr")}}, nil
+	case SNATHashModeRoundRobin:
+		return []snatTarget{{to: to("numgen inc")}}, nil
+	default:
+		return nil, mode.Validate()
+	}
 }
 
 // snatRules generates the nftables rules for SNAT based on the firewall spec
@@ -37,12 +118,16 @@ func snatRules(f *Firewall) (nftablesRules, error) {
 			continue
 		}
 
-		hmap := []string{}
-		for k, i := range s.IPs {
+		ips := []string{}
+		for _, i := range s.IPs {
 			ip := net.ParseIP(i)
 			if ip == nil {
 				return nil, fmt.Errorf("could not parse ip %s", i)
 			}
+			// the rules are rendered for ipv4 only, ipv6 egress ips are just configured on the interface
+			if ip.To4() == nil {
+				continue
+			}
 
 			innets := false
 			for _, prefix := range n.Prefixes {
@@ -60,35 +145,133 @@ func snatRules(f *Firewall) (nftablesRules, error) {
 			if !innets {
 				return nil, fmt.Errorf("ip %s is not in any prefix of network %s", i, s.NetworkID)
 			}
-			hmap = append(hmap, fmt.Sprintf("%d : %s", k, ip.String()))
+			ips = append(ips, ip.String())
 		}
 
-		var to string
-		if len(s.IPs) == 0 {
+		if len(ips) == 0 && len(s.IPs) > 0 {
+			continue
+		}
+		if len(ips) == 0 {
 			return nil, fmt.Errorf("need to specify at least one address for SNAT")
-		} else if len(s.IPs) == 1 {
-			to = s.IPs[0]
-		} else {
-			to = fmt.Sprintf("to jhash ip daddr . tcp sport mod %d map { %s }", len(s.IPs), strings.Join(hmap, ", "))
+		}
+		targets, err := snatTargets(f.snatHashMode, ips)
+		if err != nil {
+			return nil, err
 		}
 
-		snatRule := snatRule{
-			comment:        fmt.Sprintf("snat for %s", s.NetworkID),
-			sourceNetworks: sourceNetworks,
-			oifname:        fmt.Sprintf("vlan%d", *n.Vrf),
-			to:             to,
+		for _, target := range targets {
+			snatRule := snatRule{
+				comment:        fmt.Sprintf("snat for %s", s.NetworkID),
+				sourceNetworks: sourceNetworks,
+				protocol:       target.protocol,
+				oifname:        fmt.Sprintf("vlan%d", *n.Vrf),
+				to:             target.to,
+			}
+			rules = append(rules, snatRule.String())
 		}
-		rules = append(rules, snatRule.String())
 	}
+	rules = append(snatPolicyRules(f), uniqueSorted(rules)...)
 
 	enableDNS := len(f.clusterwideNetworkPolicies.GetFQDNs()) > 0
+	if enableDNS && len(f.interceptions) > 0 {
+		return append(dnsProxyEscapeSNATRules(f, f.dnsInterceptions()), rules...), nil
+	}
 	if enableDNS {
 		escapeDNSRules := []string{
 			fmt.Sprintf(`ip saddr { %s } tcp dport { 53 } accept comment "escape snat for dns proxy tcp"`, sourceNetworks),
 			fmt.Sprintf(`ip saddr { %s } udp dport { 53 } accept comment "escape snat for dns proxy udp"`, sourceNetworks),
 		}
-		return append(escapeDNSRules, uniqueSorted(rules)...), nil
+		return append(escapeDNSRules, rules...), nil
 	}
 
-	return uniqueSorted(rules), nil
+	return rules, nil
+}
+
+// snatPolicyRules generates the SNAT rules of the SNAT policies, which are applied before the SNAT rules of the firewall spec.
+// Policies which can't be applied to this firewall are ignored, which is reflected in their status.
+func snatPolicyRules(f *Firewall) nftablesRules {
+	rules := nftablesRules{}
+	for i := range f.snatPolicies {
+		p := &f.snatPolicies[i]
+		n, err := f.snatPolicyNetwork(p)
+		if err != nil {
+			p.Status = firewallv1.SNATPolicyStatus{State: firewallv1.PolicyDeploymentStateIgnored, Message: err.Error()}
+			if f.recorder != nil {
+				f.recorder.Event(&p.SNATPolicy, corev1.EventTypeWarning, "Inapplicable", fmt.Sprintf("snat policy is ignored: %v", err))
+			}
+			continue
+		}
+		p.Status = firewallv1.SNATPolicyStatus{State: firewallv1.PolicyDeploymentStateDeployed}
+
+		var sources []string
+		if len(p.Spec.Sources) == 0 {
+			sources = append(sources, fmt.Sprintf("ip saddr { %s }", strings.Join(f.primaryPrivateNet.Prefixes, ", ")))
+		}
+		var cidrs []string
+		selectsPods := false
+		for _, src := range p.Spec.Sources {
+			cidrs = append(cidrs, src.CIDRs...)
+			selectsPods = selectsPods || src.SelectsPods()
+		}
+		if len(cidrs) > 0 {
+			sources = append(sources, fmt.Sprintf("ip saddr { %s }", strings.Join(cidrs, ", ")))
+		}
+		if selectsPods {
+			sources = append(sources, fmt.Sprintf("ip saddr @%s", p.sourceSetName()))
+		}
+
+		for _, source := range sources {
+			parts := []string{source}
+			if len(p.Spec.Destinations) > 0 {
+				parts = append(parts, fmt.Sprintf("ip daddr { %s }", strings.Join(p.Spec.Destinations, ", ")))
+			}
+			parts = append(parts,
+				fmt.Sprintf(`oifname "vlan%d"`, *n.Vrf),
+				fmt.Sprintf("counter snat to %s", p.Spec.EgressIP),
+				fmt.Sprintf(`comment "snat policy %s"`, p.Name),
+			)
+			rules = append(rules, strings.Join(parts, " "))
+		}
+	}
+	return rules
+}
+
+// snatPolicySets returns the sets with the pod IPs of the SNAT policies which select pods
+func snatPolicySets(f *Firewall) []dns.RenderIPSet {
+	var sets []dns.RenderIPSet
+	for _, p := range f.snatPolicies {
+		if p.Status.State != firewallv1.PolicyDeploymentStateDeployed {
+			continue
+		}
+		if !slices.ContainsFunc(p.Spec.Sources, func(s firewallv1.SNATSource) bool { return s.SelectsPods() }) {
+			continue
+		}
+		sets = append(sets, dns.RenderIPSet{SetName: p.sourceSetName(), IPs: p.PodIPs, Version: dns.IPv4})
+	}
+	return sets
+}
+
+// snatPolicyNetwork returns the external network of the policy and checks that the egress IP is configured for it
+func (f *Firewall) snatPolicyNetwork(p *SNATPolicy) (*firewallv2.FirewallNetwork, error) {
+	if err := p.Spec.Validate(); err != nil {
+		return nil, err
+	}
+	n, ok := f.networkMap[p.Spec.NetworkID]
+	if !ok {
+		return nil, fmt.Errorf("network %s not found", p.Spec.NetworkID)
+	}
+	if n.NetworkType == nil || *n.NetworkType != mn.External || n.Vrf == nil {
+		return nil, fmt.Errorf("network %s is not an external network", p.Spec.NetworkID)
+	}
+	for _, r := range f.firewall.Spec.EgressRules {
+		if r.NetworkID == p.Spec.NetworkID && slices.Contains(r.IPs, p.Spec.EgressIP) {
+			return &n, nil
+		}
+	}
+	return nil, fmt.Errorf("egress ip %s is not configured for network %s", p.Spec.EgressIP, p.Spec.NetworkID)
+}
+
+// sourceSetName returns the name of the set with the pod IPs of the policy
+func (p *SNATPolicy) sourceSetName() string {
+	return "snat_" + strings.ReplaceAll(p.Name, "-", "_")
 }
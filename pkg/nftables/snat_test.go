@@ -2,15 +2,19 @@ package nftables
 
 import (
 	"errors"
+	"os"
+	"path"
 	"testing"
 
 	"github.com/go-logr/logr"
 	"github.com/google/go-cmp/cmp"
 	mn "github.com/metal-stack/metal-lib/pkg/net"
 	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
 	firewallv2 "github.com/metal-stack/firewall-controller-manager/api/v2"
 	firewallv1 "github.com/metal-stack/firewall-controller/v2/api/v1"
+	"github.com/metal-stack/firewall-controller/v2/pkg/dns"
 )
 
 func TestSnatRules(t *testing.T) {
@@ -20,18 +24,62 @@ func TestSnatRules(t *testing.T) {
 	internet := "internet"
 	mpls := "mpls"
 	underlay := "underlay"
+	secondary := "secondary"
 	vrf1 := int64(1)
 	vrf2 := int64(2)
 	privatePrimary := mn.PrivatePrimaryShared
+	privateSecondary := mn.PrivateSecondaryShared
 	external := mn.External
 	underlayNet := mn.Underlay
+	dnsCWNPs := firewallv1.ClusterwideNetworkPolicyList{
+		Items: []firewallv1.ClusterwideNetworkPolicy{
+			{
+				Spec: firewallv1.PolicySpec{
+					Egress: []firewallv1.EgressRule{
+						{
+							ToFQDNs: []firewallv1.FQDNSelector{
+								{
+									MatchName: "test.com",
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+	interceptionNetworks := firewallv2.FirewallStatus{
+		FirewallNetworks: []firewallv2.FirewallNetwork{
+			{
+				NetworkID:   &private,
+				Prefixes:    []string{"10.0.1.0/24"},
+				IPs:         []string{"10.0.1.1"},
+				NetworkType: &privatePrimary,
+			},
+			{
+				NetworkID:   &secondary,
+				Prefixes:    []string{"10.0.2.0/24", "2001:db8::/64"},
+				IPs:         []string{"10.0.2.1"},
+				NetworkType: &privateSecondary,
+			},
+			{
+				NetworkID:   &internet,
+				Prefixes:    []string{"185.0.0.0/24"},
+				IPs:         []string{"185.0.0.1"},
+				Vrf:         &vrf1,
+				NetworkType: &external,
+			},
+		},
+	}
+
 	tests := []struct {
-		name    string
-		input   firewallv2.Firewall
-		cwnps   firewallv1.ClusterwideNetworkPolicyList
-		want    nftablesRules
-		wantErr bool
-		err     error
+		name          string
+		input         firewallv2.Firewall
+		cwnps         firewallv1.ClusterwideNetworkPolicyList
+		interceptions []firewallv1.DNSInterception
+		want          nftablesRules
+		wantErr       bool
+		err           error
 	}{
 		{
 			name: "snat for multiple networks",
@@ -74,10 +122,56 @@ func TestSnatRules(t *testing.T) {
 			},
 			cwnps: firewallv1.ClusterwideNetworkPolicyList{},
 			want: nftablesRules{
-				`ip saddr { 10.0.1.0/24 } oifname "vlan1" counter snat to jhash ip daddr . tcp sport mod 2 map { 0 : 185.0.0.2, 1 : 185.0.0.3 } random comment "snat for internet"`,
+				`ip saddr { 10.0.1.0/24 } meta l4proto != { tcp, udp } oifname "vlan1" counter snat to jhash ip daddr mod 2 map { 0 : 185.0.0.2, 1 : 185.0.0.3 } random comment "snat for internet"`,
+				`ip saddr { 10.0.1.0/24 } meta l4proto tcp oifname "vlan1" counter snat to jhash ip daddr . tcp sport mod 2 map { 0 : 185.0.0.2, 1 : 185.0.0.3 } random comment "snat for internet"`,
+				`ip saddr { 10.0.1.0/24 } meta l4proto udp oifname "vlan1" counter snat to jhash ip daddr . udp sport mod 2 map { 0 : 185.0.0.2, 1 : 185.0.0.3 } random comment "snat for internet"`,
 				`ip saddr { 10.0.1.0/24 } oifname "vlan2" counter snat 100.0.0.2 random comment "snat for mpls"`,
 			},
 		},
+		{
+			name: "ipv6 egress ips are not used for snat",
+			input: firewallv2.Firewall{
+				Spec: firewallv2.FirewallSpec{
+					EgressRules: []firewallv2.EgressRuleSNAT{
+						{
+							NetworkID: "internet",
+							IPs:       []string{"185.0.0.2", "2001:db8::2"},
+						}, {
+							NetworkID: "mpls",
+							IPs:       []string{"2001:db8:1::2"},
+						},
+					},
+				},
+				Status: firewallv2.FirewallStatus{
+					FirewallNetworks: []firewallv2.FirewallNetwork{
+						{
+							NetworkID:   &private,
+							Prefixes:    []string{"10.0.1.0/24"},
+							IPs:         []string{"10.0.1.1"},
+							NetworkType: &privatePrimary,
+						},
+						{
+							NetworkID:   &internet,
+							Prefixes:    []string{"185.0.0.0/24", "2001:db8::/64"},
+							IPs:         []string{"185.0.0.1"},
+							Vrf:         &vrf1,
+							NetworkType: &external,
+						},
+						{
+							NetworkID:   &mpls,
+							Prefixes:    []string{"2001:db8:1::/64"},
+							IPs:         []string{"2001:db8:1::1"},
+							Vrf:         &vrf2,
+							NetworkType: &external,
+						},
+					},
+				},
+			},
+			cwnps: firewallv1.ClusterwideNetworkPolicyList{},
+			want: nftablesRules{
+				`ip saddr { 10.0.1.0/24 } oifname "vlan1" counter snat 185.0.0.2 random comment "snat for internet"`,
+			},
+		},
 		{
 			name: "escape DNS for dns-based CWNPs",
 			input: firewallv2.Firewall{
@@ -150,10 +244,53 @@ func TestSnatRules(t *testing.T) {
 			want: nftablesRules{
 				`ip saddr { 10.0.1.0/24 } tcp dport { 53 } accept comment "escape snat for dns proxy tcp"`,
 				`ip saddr { 10.0.1.0/24 } udp dport { 53 } accept comment "escape snat for dns proxy udp"`,
-				`ip saddr { 10.0.1.0/24 } oifname "vlan1" counter snat to jhash ip daddr . tcp sport mod 2 map { 0 : 185.0.0.2, 1 : 185.0.0.3 } random comment "snat for internet"`,
+				`ip saddr { 10.0.1.0/24 } meta l4proto != { tcp, udp } oifname "vlan1" counter snat to jhash ip daddr mod 2 map { 0 : 185.0.0.2, 1 : 185.0.0.3 } random comment "snat for internet"`,
+				`ip saddr { 10.0.1.0/24 } meta l4proto tcp oifname "vlan1" counter snat to jhash ip daddr . tcp sport mod 2 map { 0 : 185.0.0.2, 1 : 185.0.0.3 } random comment "snat for internet"`,
+				`ip saddr { 10.0.1.0/24 } meta l4proto udp oifname "vlan1" counter snat to jhash ip daddr . udp sport mod 2 map { 0 : 185.0.0.2, 1 : 185.0.0.3 } random comment "snat for internet"`,
 				`ip saddr { 10.0.1.0/24 } oifname "vlan2" counter snat 100.0.0.2 random comment "snat for mpls"`,
 			},
 		},
+		{
+			name: "escape DNS for intercepted networks",
+			input: firewallv2.Firewall{
+				Spec: firewallv2.FirewallSpec{
+					EgressRules: []firewallv2.EgressRuleSNAT{
+						{
+							NetworkID: "internet",
+							IPs:       []string{"185.0.0.2"},
+						},
+					},
+				},
+				Status: interceptionNetworks,
+			},
+			cwnps: dnsCWNPs,
+			interceptions: []firewallv1.DNSInterception{
+				{NetworkID: "private", ExcludedPrefixes: []string{"10.0.1.128/25"}},
+				{NetworkID: "secondary", ListenAddress: "10.0.2.1"},
+			},
+			want: nftablesRules{
+				`ip saddr != { 10.0.1.128/25 } ip saddr { 10.0.1.0/24 } tcp dport { 53 } accept comment "escape snat for dns proxy of network private tcp"`,
+				`ip saddr != { 10.0.1.128/25 } ip saddr { 10.0.1.0/24 } udp dport { 53 } accept comment "escape snat for dns proxy of network private udp"`,
+				`ip saddr { 10.0.2.0/24 } tcp dport { 53 } accept comment "escape snat for dns proxy of network secondary tcp"`,
+				`ip saddr { 10.0.2.0/24 } udp dport { 53 } accept comment "escape snat for dns proxy of network secondary udp"`,
+				`ip saddr { 10.0.1.0/24 } oifname "vlan1" counter snat 185.0.0.2 random comment "snat for internet"`,
+			},
+		},
+		{
+			name: "interception of external network is skipped",
+			input: firewallv2.Firewall{
+				Status: interceptionNetworks,
+			},
+			cwnps: dnsCWNPs,
+			interceptions: []firewallv1.DNSInterception{
+				{NetworkID: "internet"},
+				{NetworkID: "secondary"},
+			},
+			want: nftablesRules{
+				`ip saddr { 10.0.2.0/24 } tcp dport { 53 } accept comment "escape snat for dns proxy of network secondary tcp"`,
+				`ip saddr { 10.0.2.0/24 } udp dport { 53 } accept comment "escape snat for dns proxy of network secondary udp"`,
+			},
+		},
 		{
 			name: "empty snat rules",
 			input: firewallv2.Firewall{
@@ -196,7 +333,7 @@ func TestSnatRules(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			f := NewFirewall(&firewallv2.Firewall{Spec: tt.input.Spec, Status: tt.input.Status}, &tt.cwnps, nil, nil, logr.Discard(), nil)
+			f := NewFirewall(&firewallv2.Firewall{Spec: tt.input.Spec, Status: tt.input.Status}, &tt.cwnps, nil, nil, logr.Discard(), nil, FirewallOptions{DNSInterceptions: tt.interceptions})
 			got, err := snatRules(f)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("snatRules() error = %v, wantErr %v", err, tt.err)
@@ -214,3 +351,221 @@ func TestSnatRules(t *testing.T) {
 		})
 	}
 }
+
+func TestSnatPolicyRules(t *testing.T) {
+	private := "private"
+	internet := "internet"
+	privateNet := "private-secondary"
+	vrf1 := int64(1)
+	vrf3 := int64(3)
+	privatePrimary := mn.PrivatePrimaryShared
+	privateSecondary := mn.PrivateSecondaryShared
+	external := mn.External
+
+	fw := firewallv2.Firewall{
+		Spec: firewallv2.FirewallSpec{
+			EgressRules: []firewallv2.EgressRuleSNAT{
+				{
+					NetworkID: "internet",
+					IPs:       []string{"185.0.0.2", "185.0.0.3"},
+				},
+			},
+		},
+		Status: firewallv2.FirewallStatus{
+			FirewallNetworks: []firewallv2.FirewallNetwork{
+				{
+					NetworkID:   &private,
+					Prefixes:    []string{"10.0.1.0/24"},
+					IPs:         []string{"10.0.1.1"},
+					NetworkType: &privatePrimary,
+				},
+				{
+					NetworkID:   &privateNet,
+					Prefixes:    []string{"10.0.3.0/24"},
+					IPs:         []string{"10.0.3.1"},
+					Vrf:         &vrf3,
+					NetworkType: &privateSecondary,
+				},
+				{
+					NetworkID:   &internet,
+					Prefixes:    []string{"185.0.0.0/24"},
+					IPs:         []string{"185.0.0.1"},
+					Vrf:         &vrf1,
+					NetworkType: &external,
+				},
+			},
+		},
+	}
+
+	policy := func(name string, spec firewallv1.SNATPolicySpec, podIPs ...string) SNATPolicy {
+		return SNATPolicy{
+			SNATPolicy: firewallv1.SNATPolicy{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: firewallv1.ClusterwideNetworkPolicyNamespace}, Spec: spec},
+			PodIPs:     podIPs,
+		}
+	}
+
+	tests := []struct {
+		name         string
+		policies     []SNATPolicy
+		want         nftablesRules
+		wantSets     []dns.RenderIPSet
+		wantStatuses []firewallv1.SNATPolicyStatus
+	}{
+		{
+			name: "policies are applied before the snat rules of the firewall",
+			policies: []SNATPolicy{
+				policy("tenant-a", firewallv1.SNATPolicySpec{
+					Sources: []firewallv1.SNATSource{
+						{NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"tenant": "a"}}},
+						{CIDRs: []string{"10.0.1.128/25"}},
+					},
+					Destinations: []string{"203.0.113.0/24"},
+					NetworkID:    "internet",
+					EgressIP:     "185.0.0.3",
+				}, "10.0.1.10", "10.0.1.11"),
+				policy("partner", firewallv1.SNATPolicySpec{
+					NetworkID: "internet",
+					EgressIP:  "185.0.0.2",
+				}),
+			},
+			want: nftablesRules{
+				`ip saddr { 10.0.1.128/25 } ip daddr { 203.0.113.0/24 } oifname "vlan1" counter snat to 185.0.0.3 comment "snat policy tenant-a"`,
+				`ip saddr @snat_tenant_a ip daddr { 203.0.113.0/24 } oifname "vlan1" counter snat to 185.0.0.3 comment "snat policy tenant-a"`,
+				`ip saddr { 10.0.1.0/24 } oifname "vlan1" counter snat to 185.0.0.2 comment "snat policy partner"`,
+				`ip saddr { 10.0.1.0/24 } meta l4proto != { tcp, udp } oifname "vlan1" counter snat to jhash ip daddr mod 2 map { 0 : 185.0.0.2, 1 : 185.0.0.3 } random comment "snat for internet"`,
+				`ip saddr { 10.0.1.0/24 } meta l4proto tcp oifname "vlan1" counter snat to jhash ip daddr . tcp sport mod 2 map { 0 : 185.0.0.2, 1 : 185.0.0.3 } random comment "snat for internet"`,
+				`ip saddr { 10.0.1.0/24 } meta l4proto udp oifname "vlan1" counter snat to jhash ip daddr . udp sport mod 2 map { 0 : 185.0.0.2, 1 : 185.0.0.3 } random comment "snat for internet"`,
+			},
+			wantSets: []dns.RenderIPSet{
+				{SetName: "snat_tenant_a", IPs: []string{"10.0.1.10", "10.0.1.11"}, Version: dns.IPv4},
+			},
+			wantStatuses: []firewallv1.SNATPolicyStatus{
+				{State: firewallv1.PolicyDeploymentStateDeployed},
+				{State: firewallv1.PolicyDeploymentStateDeployed},
+			},
+		},
+		{
+			name: "policies which can't be applied are ignored",
+			policies: []SNATPolicy{
+				policy("unknown-ip", firewallv1.SNATPolicySpec{NetworkID: "internet", EgressIP: "185.0.0.4"}),
+				policy("private-network", firewallv1.SNATPolicySpec{NetworkID: "private-secondary", EgressIP: "10.0.3.1"}),
+				policy("invalid", firewallv1.SNATPolicySpec{NetworkID: "internet", EgressIP: "185.0.0.2", Destinations: []string{"2001:db8::/64"}}),
+			},
+			want: nftablesRules{
+				`ip saddr { 10.0.1.0/24 } meta l4proto != { tcp, udp } oifname "vlan1" counter snat to jhash ip daddr mod 2 map { 0 : 185.0.0.2, 1 : 185.0.0.3 } random comment "snat for internet"`,
+				`ip saddr { 10.0.1.0/24 } meta l4proto tcp oifname "vlan1" counter snat to jhash ip daddr . tcp sport mod 2 map { 0 : 185.0.0.2, 1 : 185.0.0.3 } random comment "snat for internet"`,
+				`ip saddr { 10.0.1.0/24 } meta l4proto udp oifname "vlan1" counter snat to jhash ip daddr . udp sport mod 2 map { 0 : 185.0.0.2, 1 : 185.0.0.3 } random comment "snat for internet"`,
+			},
+			wantStatuses: []firewallv1.SNATPolicyStatus{
+				{State: firewallv1.PolicyDeploymentStateIgnored, Message: "egress ip 185.0.0.4 is not configured for network internet"},
+				{State: firewallv1.PolicyDeploymentStateIgnored, Message: "network private-secondary is not an external network"},
+				{State: firewallv1.PolicyDeploymentStateIgnored, Message: "destination 2001:db8::/64 is not a valid ipv4 CIDR"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := NewFirewall(&fw, &firewallv1.ClusterwideNetworkPolicyList{}, nil, nil, logr.Discard(), nil, FirewallOptions{SNATPolicies: tt.policies})
+			got, err := snatRules(f)
+			if err != nil {
+				t.Fatalf("snatRules() error = %v", err)
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("snatRules() diff: %v", diff)
+			}
+			if diff := cmp.Diff(tt.wantSets, snatPolicySets(f)); diff != "" {
+				t.Errorf("snatPolicySets() diff: %v", diff)
+			}
+
+			var statuses []firewallv1.SNATPolicyStatus
+			for _, p := range tt.policies {
+				statuses = append(statuses, p.Status)
+			}
+			if diff := cmp.Diff(tt.wantStatuses, statuses); diff != "" {
+				t.Errorf("status diff: %v", diff)
+			}
+		})
+	}
+}
+
+func TestSnatRulesHashModes(t *testing.T) {
+	private := "private"
+	internet := "internet"
+	vrf := int64(104009)
+	privatePrimary := mn.PrivatePrimaryShared
+	external := mn.External
+	fw := firewallv2.Firewall{
+		Spec: firewallv2.FirewallSpec{
+			EgressRules: []firewallv2.EgressRuleSNAT{
+				{
+					NetworkID: "internet",
+					IPs:       []string{"185.0.0.2", "185.0.0.3", "185.0.0.4"},
+				},
+			},
+		},
+		Status: firewallv2.FirewallStatus{
+			FirewallNetworks: []firewallv2.FirewallNetwork{
+				{
+					NetworkID:   &private,
+					Prefixes:    []string{"10.0.1.0/24"},
+					IPs:         []string{"10.0.1.1"},
+					NetworkType: &privatePrimary,
+				},
+				{
+					NetworkID:   &internet,
+					Prefixes:    []string{"185.0.0.0/24"},
+					IPs:         []string{"185.0.0.1"},
+					Vrf:         &vrf,
+					NetworkType: &external,
+				},
+			},
+		},
+	}
+
+	tests := []struct {
+		mode    SNATHashMode
+		golden  string
+		wantErr error
+	}{
+		{mode: "", golden: "snat-hash-protocol"},
+		{mode: SNATHashModeProtocol, golden: "snat-hash-protocol"},
+		{mode: SNATHashModeSource, golden: "snat-hash-source"},
+		{mode: SNATHashModeDestination, golden: "snat-hash-destination"},
+		{mode: SNATHashModeRoundRobin, golden: "snat-hash-round-robin"},
+		{mode: "random", wantErr: errors.New(`unknown snat hash mode "random", supported are "protocol", "source", "destination" and "round-robin"`)},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.mode), func(t *testing.T) {
+			f := NewFirewall(&fw, &firewallv1.ClusterwideNetworkPolicyList{}, nil, nil, logr.Discard(), nil, FirewallOptions{SNATHashMode: tt.mode})
+			rules, err := snatRules(f)
+			if tt.wantErr != nil {
+				if err == nil || err.Error() != tt.wantErr.Error() {
+					t.Errorf("snatRules() error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("snatRules() error = %v", err)
+			}
+
+			data := &firewallRenderingData{
+				ForwardingRules: forwardingRules{
+					Egress:  []string{"egress rule"},
+					Ingress: []string{"ingress rule"},
+				},
+				InternalPrefixes: "10.0.1.0/24",
+				RateLimitRules:   []string{},
+				SnatRules:        rules,
+				PrivateVrfID:     uint(42),
+			}
+			got, err := data.renderString()
+			if err != nil {
+				t.Fatalf("renderString() error = %v", err)
+			}
+			rendered, _ := os.ReadFile(path.Join("test_data", tt.golden+".nftable.v4"))
+			if diff := cmp.Diff(string(rendered), got); diff != "" {
+				t.Errorf("renderString() diff: %v", diff)
+			}
+		})
+	}
+}
@@ -64,6 +64,11 @@ func checksum(file string) (string, error) {
 }
 
 func assembleDestinationPortRule(common []string, protocol string, ports []string, logAcceptedConnections bool, comment string) string {
+	return assembleLimitedDestinationPortRule(common, protocol, ports, "", logAcceptedConnections, comment)
+}
+
+// assembleLimitedDestinationPortRule only accepts the packets within the given rate, if set
+func assembleLimitedDestinationPortRule(common []string, protocol string, ports []string, rate string, logAcceptedConnections bool, comment string) string {
 	logRule := ""
 	rule := ""
 	parts := common
@@ -72,6 +77,9 @@ func assembleDestinationPortRule(common []string, protocol string, ports []strin
 		logParts := append(parts, "log prefix \"nftables-firewall-accepted: \" limit rate 10/second")
 		logRule = strings.Join(logParts, " ")
 	}
+	if rate != "" {
+		parts = append(parts, "limit rate "+rate)
+	}
 	parts = append(parts, "counter", "accept")
 	if comment != "" {
 		parts = append(parts, "comment", fmt.Sprintf(`"%s"`, comment))
@@ -0,0 +1,270 @@
+package trafficcontrol
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+
+	"github.com/go-logr/logr"
+	"github.com/vishvananda/netlink"
+
+	firewallv2 "github.com/metal-stack/firewall-controller-manager/api/v2"
+)
+
+const (
+	// ethPAll matches the packets of all protocols in filters
+	ethPAll = 0x0003
+
+	// handles of the htb qdisc 1: with the parent class 1:1, the class 1:2 of the unclassified traffic and the traffic classes from 1:10 on
+	rootMajor         = 1
+	parentClassMinor  = 1
+	defaultClassMinor = 2
+	firstClassMinor   = 0x10
+	ingressMajor      = 0xffff
+
+	// unclassifiedShare is the share of the rate which is at least guaranteed to the unclassified traffic, 1/100
+	unclassifiedShare = 100
+)
+
+// netlinkHandle are the netlink operations needed to shape the traffic, it is implemented by netlink.Handle
+type netlinkHandle interface {
+	LinkByName(name string) (netlink.Link, error)
+	LinkAdd(link netlink.Link) error
+	LinkSetUp(link netlink.Link) error
+	LinkDel(link netlink.Link) error
+	QdiscList(link netlink.Link) ([]netlink.Qdisc, error)
+	QdiscAdd(qdisc netlink.Qdisc) error
+	QdiscDel(qdisc netlink.Qdisc) error
+	ClassAdd(class netlink.Class) error
+	FilterAdd(filter netlink.Filter) error
+}
+
+// Shaper shapes the traffic of the networks of the firewall with tc.
+// The traffic sent to a network is shaped by a HTB qdisc on its VLAN interface, the traffic received from the network is
+// redirected to an IFB device and shaped on its egress. The leaves of the HTB qdiscs are fq_codel qdiscs.
+// Traffic classes are assigned by the packet mark, which nftables sets for the connections accepted by a ClusterwideNetworkPolicy.
+type Shaper struct {
+	log logr.Logger
+	nl  netlinkHandle
+
+	// applied are the shapings which were applied by their link, nil if the shaping of a link was removed
+	applied map[string]*Shaping
+}
+
+// NewShaper creates a new traffic shaper
+func NewShaper(log logr.Logger) *Shaper {
+	return &Shaper{
+		log:     log,
+		nl:      &netlink.Handle{},
+		applied: map[string]*Shaping{},
+	}
+}
+
+// Reconcile applies the shapings to the networks of the firewall, the shaping of all other networks is removed.
+// Shapings are only reapplied if they changed.
+func (s *Shaper) Reconcile(fw *firewallv2.Firewall, shapings []Shaping) error {
+	desired := map[string]Shaping{}
+	for _, sh := range shapings {
+		desired[sh.Link] = sh
+	}
+	all := networks(fw)
+	links := make([]Shaping, 0, len(all))
+	for _, n := range all {
+		links = append(links, n)
+	}
+	slices.SortFunc(links, func(a, b Shaping) int {
+		return strings.Compare(a.Link, b.Link)
+	})
+
+	var errs []error
+	for _, n := range links {
+		sh, ok := desired[n.Link]
+		applied, known := s.applied[n.Link]
+		if !ok {
+			if known && applied == nil {
+				continue
+			}
+			if err := s.remove(n); err != nil {
+				errs = append(errs, fmt.Errorf("unable to remove traffic shaping of network %s: %w", n.NetworkID, err))
+				continue
+			}
+			s.applied[n.Link] = nil
+			continue
+		}
+
+		if applied != nil && reflect.DeepEqual(*applied, sh) {
+			continue
+		}
+		s.log.Info("shaping traffic", "network", sh.NetworkID, "link", sh.Link, "rate", sh.Rate, "classes", len(sh.Classes))
+		if err := s.apply(sh); err != nil {
+			// the shaping is applied again on the next reconciliation
+			delete(s.applied, sh.Link)
+			errs = append(errs, fmt.Errorf("unable to shape traffic of network %s: %w", sh.NetworkID, err))
+			continue
+		}
+		s.applied[sh.Link] = &sh
+	}
+	return errors.Join(errs...)
+}
+
+// apply replaces the shaping of a network
+func (s *Shaper) apply(sh Shaping) error {
+	if err := s.remove(sh); err != nil {
+		return err
+	}
+
+	link, err := s.nl.LinkByName(sh.Link)
+	if err != nil {
+		return fmt.Errorf("unable to find link %s: %w", sh.Link, err)
+	}
+	if err := s.nl.LinkAdd(&netlink.Ifb{LinkAttrs: netlink.LinkAttrs{Name: sh.IFB}}); err != nil {
+		return fmt.Errorf("unable to add ifb device %s: %w", sh.IFB, err)
+	}
+	ifb, err := s.nl.LinkByName(sh.IFB)
+	if err != nil {
+		return fmt.Errorf("unable to find ifb device %s: %w", sh.IFB, err)
+	}
+	if err := s.nl.LinkSetUp(ifb); err != nil {
+		return fmt.Errorf("unable to set ifb device %s up: %w", sh.IFB, err)
+	}
+
+	for _, l := range []netlink.Link{link, ifb} {
+		if err := s.addHTB(l, sh); err != nil {
+			return err
+		}
+	}
+
+	// the received traffic is redirected to the ifb device only after it is able to shape it,
+	// the mark of the connection is restored before, as nftables only sees the packets afterwards
+	ingress := &netlink.Ingress{QdiscAttrs: netlink.QdiscAttrs{
+		LinkIndex: link.Attrs().Index,
+		Parent:    netlink.HANDLE_INGRESS,
+		Handle:    netlink.MakeHandle(ingressMajor, 0),
+	}}
+	if err := s.nl.QdiscAdd(ingress); err != nil {
+		return fmt.Errorf("unable to add ingress qdisc to %s: %w", sh.Link, err)
+	}
+	redirect := &netlink.MatchAll{
+		FilterAttrs: netlink.FilterAttrs{
+			LinkIndex: link.Attrs().Index,
+			Parent:    netlink.MakeHandle(ingressMajor, 0),
+			Priority:  1,
+			Protocol:  ethPAll,
+		},
+		Actions: []netlink.Action{netlink.NewConnmarkAction(), netlink.NewMirredAction(ifb.Attrs().Index)},
+	}
+	if err := s.nl.FilterAdd(redirect); err != nil {
+		return fmt.Errorf("unable to redirect the traffic of %s to %s: %w", sh.Link, sh.IFB, err)
+	}
+	return nil
+}
+
+// addHTB adds the HTB qdisc with a class for the unclassified traffic and the traffic classes to the link
+func (s *Shaper) addHTB(link netlink.Link, sh Shaping) error {
+	var (
+		index  = link.Attrs().Index
+		name   = link.Attrs().Name
+		root   = netlink.MakeHandle(rootMajor, 0)
+		parent = netlink.MakeHandle(rootMajor, parentClassMinor)
+	)
+
+	htb := netlink.NewHtb(netlink.QdiscAttrs{LinkIndex: index, Parent: netlink.HANDLE_ROOT, Handle: root})
+	htb.Defcls = defaultClassMinor
+	if err := s.nl.QdiscAdd(htb); err != nil {
+		return fmt.Errorf("unable to add htb qdisc to %s: %w", name, err)
+	}
+	if err := s.nl.ClassAdd(netlink.NewHtbClass(
+		netlink.ClassAttrs{LinkIndex: index, Parent: root, Handle: parent},
+		netlink.HtbClassAttrs{Rate: bits(sh.Rate), Ceil: bits(sh.Rate), Buffer: sh.Burst, Cbuffer: sh.Burst},
+	)); err != nil {
+		return fmt.Errorf("unable to add htb class to %s: %w", name, err)
+	}
+
+	// the unclassified traffic is guaranteed the bandwidth which is not guaranteed to the classes
+	unclassified := sh.Rate
+	for _, c := range sh.Classes {
+		unclassified -= c.Rate
+	}
+	unclassified = max(unclassified, sh.Rate/unclassifiedShare, 1)
+	leaves := []Class{{Name: "unclassified", Rate: unclassified, Ceil: sh.Rate}}
+	leaves = append(leaves, sh.Classes...)
+
+	for i, c := range leaves {
+		minor := uint16(defaultClassMinor)
+		if i > 0 {
+			minor = uint16(firstClassMinor + i - 1) // nolint:gosec
+		}
+		handle := netlink.MakeHandle(rootMajor, minor)
+
+		if err := s.nl.ClassAdd(netlink.NewHtbClass(
+			netlink.ClassAttrs{LinkIndex: index, Parent: parent, Handle: handle},
+			netlink.HtbClassAttrs{Rate: bits(c.Rate), Ceil: bits(c.Ceil), Prio: c.Priority},
+		)); err != nil {
+			return fmt.Errorf("unable to add htb class for %s to %s: %w", c.Name, name, err)
+		}
+		if err := s.nl.QdiscAdd(netlink.NewFqCodel(netlink.QdiscAttrs{LinkIndex: index, Parent: handle, Handle: netlink.MakeHandle(minor, 0)})); err != nil {
+			return fmt.Errorf("unable to add fq_codel qdisc for %s to %s: %w", c.Name, name, err)
+		}
+		if c.Mark == 0 {
+			continue
+		}
+		if err := s.nl.FilterAdd(&netlink.FwFilter{
+			FilterAttrs: netlink.FilterAttrs{LinkIndex: index, Parent: root, Handle: c.Mark, Priority: 1, Protocol: ethPAll},
+			ClassId:     handle,
+		}); err != nil {
+			return fmt.Errorf("unable to add filter for %s to %s: %w", c.Name, name, err)
+		}
+	}
+	return nil
+}
+
+// remove removes the qdiscs and the ifb device of the shaping of a network, if present
+func (s *Shaper) remove(n Shaping) error {
+	ifb, err := s.nl.LinkByName(n.IFB)
+	if err != nil {
+		var notFound netlink.LinkNotFoundError
+		if !errors.As(err, &notFound) {
+			return fmt.Errorf("unable to find ifb device %s: %w", n.IFB, err)
+		}
+		ifb = nil
+	}
+
+	link, err := s.nl.LinkByName(n.Link)
+	if err != nil {
+		var notFound netlink.LinkNotFoundError
+		if !errors.As(err, &notFound) {
+			return fmt.Errorf("unable to find link %s: %w", n.Link, err)
+		}
+		s.log.Info("skipping link because not found", "name", n.Link)
+	} else {
+		qdiscs, err := s.nl.QdiscList(link)
+		if err != nil {
+			return fmt.Errorf("unable to list qdiscs of %s: %w", n.Link, err)
+		}
+		for _, q := range qdiscs {
+			// the ingress qdisc is only removed if it was added together with the ifb device
+			ours := q.Attrs().Parent == netlink.HANDLE_ROOT && q.Attrs().Handle == netlink.MakeHandle(rootMajor, 0) && q.Type() == "htb"
+			ours = ours || (ifb != nil && q.Type() == "ingress")
+			if !ours {
+				continue
+			}
+			if err := s.nl.QdiscDel(q); err != nil {
+				return fmt.Errorf("unable to remove %s qdisc of %s: %w", q.Type(), n.Link, err)
+			}
+		}
+	}
+
+	if ifb != nil {
+		if err := s.nl.LinkDel(ifb); err != nil {
+			return fmt.Errorf("unable to remove ifb device %s: %w", n.IFB, err)
+		}
+	}
+	return nil
+}
+
+// bits converts bytes/second to bits/second, which netlink expects for htb classes
+func bits(rate uint64) uint64 {
+	return rate * 8
+}
@@ -0,0 +1,187 @@
+package trafficcontrol
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/google/go-cmp/cmp"
+	"github.com/vishvananda/netlink"
+
+	firewallv2 "github.com/metal-stack/firewall-controller-manager/api/v2"
+)
+
+// fakeNetlink records the netlink operations as strings
+type fakeNetlink struct {
+	links  map[string]netlink.Link
+	qdiscs map[int][]netlink.Qdisc
+	ops    []string
+}
+
+func newFakeNetlink(links ...string) *fakeNetlink {
+	f := &fakeNetlink{links: map[string]netlink.Link{}, qdiscs: map[int][]netlink.Qdisc{}}
+	for _, l := range links {
+		f.links[l] = &netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: l, Index: len(f.links) + 1}}
+	}
+	return f
+}
+
+func (f *fakeNetlink) LinkByName(name string) (netlink.Link, error) {
+	l, ok := f.links[name]
+	if !ok {
+		return nil, netlink.LinkNotFoundError{}
+	}
+	return l, nil
+}
+
+func (f *fakeNetlink) LinkAdd(link netlink.Link) error {
+	link.Attrs().Index = len(f.links) + 1
+	f.links[link.Attrs().Name] = link
+	f.ops = append(f.ops, fmt.Sprintf("link add %s %s", link.Type(), link.Attrs().Name))
+	return nil
+}
+
+func (f *fakeNetlink) LinkSetUp(link netlink.Link) error {
+	f.ops = append(f.ops, fmt.Sprintf("link set up %s", link.Attrs().Name))
+	return nil
+}
+
+func (f *fakeNetlink) LinkDel(link netlink.Link) error {
+	delete(f.links, link.Attrs().Name)
+	delete(f.qdiscs, link.Attrs().Index)
+	f.ops = append(f.ops, fmt.Sprintf("link del %s", link.Attrs().Name))
+	return nil
+}
+
+func (f *fakeNetlink) QdiscList(link netlink.Link) ([]netlink.Qdisc, error) {
+	return f.qdiscs[link.Attrs().Index], nil
+}
+
+func (f *fakeNetlink) QdiscAdd(qdisc netlink.Qdisc) error {
+	a := qdisc.Attrs()
+	f.qdiscs[a.LinkIndex] = append(f.qdiscs[a.LinkIndex], qdisc)
+	f.ops = append(f.ops, fmt.Sprintf("qdisc add %s %s parent %s handle %s", f.name(a.LinkIndex), qdisc.Type(), netlink.HandleStr(a.Parent), netlink.HandleStr(a.Handle)))
+	return nil
+}
+
+func (f *fakeNetlink) QdiscDel(qdisc netlink.Qdisc) error {
+	a := qdisc.Attrs()
+	var remaining []netlink.Qdisc
+	for _, q := range f.qdiscs[a.LinkIndex] {
+		if q != qdisc {
+			remaining = append(remaining, q)
+		}
+	}
+	f.qdiscs[a.LinkIndex] = remaining
+	f.ops = append(f.ops, fmt.Sprintf("qdisc del %s %s", f.name(a.LinkIndex), qdisc.Type()))
+	return nil
+}
+
+func (f *fakeNetlink) ClassAdd(class netlink.Class) error {
+	a := class.Attrs()
+	htb := class.(*netlink.HtbClass)
+	f.ops = append(f.ops, fmt.Sprintf("class add %s htb parent %s classid %s rate %d ceil %d prio %d", f.name(a.LinkIndex), netlink.HandleStr(a.Parent), netlink.HandleStr(a.Handle), htb.Rate, htb.Ceil, htb.Prio))
+	return nil
+}
+
+func (f *fakeNetlink) FilterAdd(filter netlink.Filter) error {
+	a := filter.Attrs()
+	switch fi := filter.(type) {
+	case *netlink.FwFilter:
+		f.ops = append(f.ops, fmt.Sprintf("filter add %s parent %s fw handle %#x classid %s", f.name(a.LinkIndex), netlink.HandleStr(a.Parent), a.Handle, netlink.HandleStr(fi.ClassId)))
+	case *netlink.MatchAll:
+		actions := ""
+		for _, action := range fi.Actions {
+			actions += " " + action.Type()
+			if m, ok := action.(*netlink.MirredAction); ok {
+				actions += " " + f.name(m.Ifindex)
+			}
+		}
+		f.ops = append(f.ops, fmt.Sprintf("filter add %s parent %s matchall action%s", f.name(a.LinkIndex), netlink.HandleStr(a.Parent), actions))
+	}
+	return nil
+}
+
+func (f *fakeNetlink) name(index int) string {
+	for name, l := range f.links {
+		if l.Attrs().Index == index {
+			return name
+		}
+	}
+	return fmt.Sprint(index)
+}
+
+func TestShaperReconcile(t *testing.T) {
+	fw := testFirewall()
+	web := TrafficClassMark("web")
+	shaping := Shaping{
+		NetworkID: "internet", Link: "vlan2", IFB: "ifb2", Rate: 100 * mbyte,
+		Classes: []Class{{Name: "web", Mark: web, Rate: 60 * mbyte, Ceil: 100 * mbyte, Priority: 1}},
+	}
+	htb := func(link string) []string {
+		return []string{
+			fmt.Sprintf("qdisc add %s htb parent root handle 1:0", link),
+			fmt.Sprintf("class add %s htb parent 1:0 classid 1:1 rate 104857600 ceil 104857600 prio 0", link),
+			fmt.Sprintf("class add %s htb parent 1:1 classid 1:2 rate 41943040 ceil 104857600 prio 0", link),
+			fmt.Sprintf("qdisc add %s fq_codel parent 1:2 handle 2:0", link),
+			fmt.Sprintf("class add %s htb parent 1:1 classid 1:10 rate 62914560 ceil 104857600 prio 1", link),
+			fmt.Sprintf("qdisc add %s fq_codel parent 1:10 handle 10:0", link),
+			fmt.Sprintf("filter add %s parent 1:0 fw handle %#x classid 1:10", link, web),
+		}
+	}
+
+	nl := newFakeNetlink("vlan1", "vlan2", "vlan3")
+	s := &Shaper{log: logr.Discard(), nl: nl, applied: map[string]*Shaping{}}
+
+	// the shaping is applied and the other links are checked for a shaping to remove
+	if err := s.Reconcile(fw, []Shaping{shaping}); err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+	want := []string{"link add ifb ifb2", "link set up ifb2"}
+	want = append(want, htb("vlan2")...)
+	want = append(want, htb("ifb2")...)
+	want = append(want,
+		"qdisc add vlan2 ingress parent ingress handle ffff:0",
+		"filter add vlan2 parent ffff:0 matchall action connmark mirred ifb2",
+	)
+	if diff := cmp.Diff(want, nl.ops); diff != "" {
+		t.Errorf("Reconcile() operations diff: %v", diff)
+	}
+
+	// unchanged shapings are not applied again
+	nl.ops = nil
+	if err := s.Reconcile(fw, []Shaping{shaping}); err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+	if len(nl.ops) > 0 {
+		t.Errorf("Reconcile() applied unchanged shaping: %v", nl.ops)
+	}
+
+	// removed shapings are cleaned up
+	if err := s.Reconcile(fw, nil); err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+	want = []string{"qdisc del vlan2 htb", "qdisc del vlan2 ingress", "link del ifb2"}
+	if diff := cmp.Diff(want, nl.ops); diff != "" {
+		t.Errorf("Reconcile() operations diff: %v", diff)
+	}
+}
+
+func TestShaperReconcileMissingLink(t *testing.T) {
+	nl := newFakeNetlink("vlan1", "vlan3")
+	s := &Shaper{log: logr.Discard(), nl: nl, applied: map[string]*Shaping{}}
+
+	err := s.Reconcile(&firewallv2.Firewall{Status: testFirewall().Status}, []Shaping{
+		{NetworkID: "internet", Link: "vlan2", IFB: "ifb2", Rate: 100 * mbyte},
+		{NetworkID: "mpls", Link: "vlan3", IFB: "ifb3", Rate: 10 * mbyte},
+	})
+	if err == nil {
+		t.Fatalf("Reconcile() expected error for missing link")
+	}
+	if _, ok := s.applied["vlan2"]; ok {
+		t.Errorf("shaping of the missing link must be applied again")
+	}
+	if s.applied["vlan3"] == nil {
+		t.Errorf("shaping of the other network must be applied despite the error")
+	}
+}
@@ -0,0 +1,187 @@
+package trafficcontrol
+
+import (
+	"fmt"
+	"hash/fnv"
+	"slices"
+	"strings"
+
+	mn "github.com/metal-stack/metal-lib/pkg/net"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/record"
+
+	firewallv2 "github.com/metal-stack/firewall-controller-manager/api/v2"
+	firewallv1 "github.com/metal-stack/firewall-controller/v2/api/v1"
+)
+
+const (
+	// the rates of the firewall spec and the traffic shapings are given in mbytes/second, like the rate limits rendered by nftables
+	mbyte = 1024 * 1024
+	kbyte = 1024
+)
+
+// Shaping is the traffic shaping of a network of the firewall
+type Shaping struct {
+	NetworkID string
+	// Link is the VLAN interface of the network, the traffic sent to the network is shaped on its egress
+	Link string
+	// IFB is the device the traffic received from the network is redirected to, it is shaped on the egress of this device
+	IFB string
+	// Rate is the bandwidth of the network in bytes/second
+	Rate uint64
+	// Burst is the amount of bytes which may be sent at once, zero lets the kernel choose the minimum burst
+	Burst uint32
+	// Classes divide the bandwidth of the network
+	Classes []Class
+}
+
+// Class is a traffic class of a network, the traffic of the class is identified by its mark
+type Class struct {
+	Name string
+	Mark uint32
+	// Rate is the bandwidth guaranteed to the class in bytes/second
+	Rate uint64
+	// Ceil is the bandwidth the class may use in bytes/second
+	Ceil     uint64
+	Priority uint32
+}
+
+// TrafficClassMark returns the packet mark of the traffic assigned to a traffic class
+func TrafficClassMark(name string) uint32 {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(name))
+	// the mark must not be zero, as zero is the mark of unclassified traffic
+	return h.Sum32() | 1
+}
+
+// Shapings returns the traffic shaping of the networks of the firewall.
+// All networks with a rate limit are shaped at this rate, the traffic shapings are applied in the given order and may lower the rate and divide it into classes.
+// Traffic shapings which are invalid or conflict with an earlier one are ignored, which is reflected in their status.
+func Shapings(fw *firewallv2.Firewall, trafficShapings []firewallv1.TrafficShaping, recorder record.EventRecorder) []Shaping {
+	var (
+		networks = networks(fw)
+		limits   = map[string]uint32{}
+		shapings = map[string]*Shaping{}
+		sources  = map[string]string{}
+	)
+	for _, l := range fw.Spec.RateLimits {
+		n, ok := networks[l.NetworkID]
+		if !ok {
+			continue
+		}
+		limits[l.NetworkID] = l.Rate
+		n.Rate = uint64(l.Rate) * mbyte
+		shapings[l.NetworkID] = &n
+	}
+
+	for i := range trafficShapings {
+		ts := &trafficShapings[i]
+		err := func() error {
+			if err := ts.Spec.Validate(); err != nil {
+				return err
+			}
+			n, ok := networks[ts.Spec.NetworkID]
+			if !ok {
+				return fmt.Errorf("network %q is not a network of the firewall which can be shaped", ts.Spec.NetworkID)
+			}
+			if source, ok := sources[ts.Spec.NetworkID]; ok {
+				return fmt.Errorf("network %q is already shaped by %s", ts.Spec.NetworkID, source)
+			}
+			shaping, err := shapingOf(n, ts.Spec, limits)
+			if err != nil {
+				return err
+			}
+			shapings[ts.Spec.NetworkID] = shaping
+			sources[ts.Spec.NetworkID] = ts.Name
+			return nil
+		}()
+		if err != nil {
+			ts.Status = firewallv1.TrafficShapingStatus{State: firewallv1.PolicyDeploymentStateIgnored, Message: err.Error()}
+			if recorder != nil {
+				recorder.Event(ts, corev1.EventTypeWarning, "Inapplicable", fmt.Sprintf("traffic shaping is ignored: %v", err))
+			}
+			continue
+		}
+		ts.Status = firewallv1.TrafficShapingStatus{State: firewallv1.PolicyDeploymentStateDeployed}
+	}
+
+	result := []Shaping{}
+	for _, s := range shapings {
+		result = append(result, *s)
+	}
+	slices.SortFunc(result, func(a, b Shaping) int {
+		return strings.Compare(a.Link, b.Link)
+	})
+	return result
+}
+
+// Ignore sets the status of the traffic shapings if the traffic of the firewall is not shaped
+func Ignore(trafficShapings []firewallv1.TrafficShaping) {
+	for i := range trafficShapings {
+		trafficShapings[i].Status = firewallv1.TrafficShapingStatus{
+			State:   firewallv1.PolicyDeploymentStateIgnored,
+			Message: "traffic shaping is not enabled on the firewall, the rate limits drop the traffic",
+		}
+	}
+}
+
+func shapingOf(n Shaping, spec firewallv1.TrafficShapingSpec, limits map[string]uint32) (*Shaping, error) {
+	limit, limited := limits[spec.NetworkID]
+	rate := limit
+	switch {
+	case spec.Rate != nil && limited && *spec.Rate > limit:
+		return nil, fmt.Errorf("rate %d exceeds the rate limit %d of network %q", *spec.Rate, limit, spec.NetworkID)
+	case spec.Rate != nil:
+		rate = *spec.Rate
+	case !limited:
+		return nil, fmt.Errorf("rate must be given as network %q has no rate limit", spec.NetworkID)
+	}
+
+	n.Rate = uint64(rate) * mbyte
+	if spec.Burst != nil {
+		n.Burst = *spec.Burst * kbyte
+	}
+
+	var sum uint32
+	for _, c := range spec.Classes {
+		ceil := rate
+		if c.Ceil != nil {
+			ceil = *c.Ceil
+		}
+		if ceil > rate {
+			return nil, fmt.Errorf("ceil of class %q exceeds the rate %d of network %q", c.Name, rate, spec.NetworkID)
+		}
+		var prio uint32
+		if c.Priority != nil {
+			prio = *c.Priority
+		}
+		n.Classes = append(n.Classes, Class{
+			Name:     c.Name,
+			Mark:     TrafficClassMark(c.Name),
+			Rate:     uint64(c.Rate) * mbyte,
+			Ceil:     uint64(ceil) * mbyte,
+			Priority: prio,
+		})
+		sum += c.Rate
+	}
+	if sum > rate {
+		return nil, fmt.Errorf("the rates of the classes exceed the rate %d of network %q", rate, spec.NetworkID)
+	}
+	return &n, nil
+}
+
+// networks returns the networks of the firewall which can be shaped by their ids, these are the networks which can be rate limited
+func networks(fw *firewallv2.Firewall) map[string]Shaping {
+	result := map[string]Shaping{}
+	for _, n := range fw.Status.FirewallNetworks {
+		if n.NetworkID == nil || n.Vrf == nil || n.NetworkType == nil || *n.NetworkType == mn.Underlay {
+			continue
+		}
+		result[*n.NetworkID] = Shaping{
+			NetworkID: *n.NetworkID,
+			Link:      fmt.Sprintf("vlan%d", *n.Vrf),
+			IFB:       fmt.Sprintf("ifb%d", *n.Vrf),
+		}
+	}
+	return result
+}
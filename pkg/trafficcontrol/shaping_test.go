@@ -0,0 +1,189 @@
+package trafficcontrol
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	mn "github.com/metal-stack/metal-lib/pkg/net"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	firewallv2 "github.com/metal-stack/firewall-controller-manager/api/v2"
+	firewallv1 "github.com/metal-stack/firewall-controller/v2/api/v1"
+)
+
+func testFirewall(rateLimits ...firewallv2.RateLimit) *firewallv2.Firewall {
+	var (
+		private        = "private"
+		internet       = "internet"
+		mpls           = "mpls"
+		underlay       = "underlay"
+		vrf1           = int64(1)
+		vrf2           = int64(2)
+		vrf3           = int64(3)
+		vrf4           = int64(4)
+		privatePrimary = mn.PrivatePrimaryShared
+		external       = mn.External
+		underlayType   = mn.Underlay
+	)
+	return &firewallv2.Firewall{
+		Spec: firewallv2.FirewallSpec{RateLimits: rateLimits},
+		Status: firewallv2.FirewallStatus{
+			FirewallNetworks: []firewallv2.FirewallNetwork{
+				{NetworkID: &private, Vrf: &vrf1, NetworkType: &privatePrimary},
+				{NetworkID: &internet, Vrf: &vrf2, NetworkType: &external},
+				{NetworkID: &mpls, Vrf: &vrf3, NetworkType: &external},
+				{NetworkID: &underlay, Vrf: &vrf4, NetworkType: &underlayType},
+			},
+		},
+	}
+}
+
+func TestShapings(t *testing.T) {
+	var (
+		fifty   = uint32(50)
+		hundred = uint32(100)
+		tooHigh = uint32(300)
+		burst   = uint32(64)
+		prio    = uint32(7)
+	)
+	trafficShaping := func(name string, spec firewallv1.TrafficShapingSpec) firewallv1.TrafficShaping {
+		return firewallv1.TrafficShaping{
+			ObjectMeta: metav1.ObjectMeta{Namespace: firewallv1.ClusterwideNetworkPolicyNamespace, Name: name},
+			Spec:       spec,
+		}
+	}
+
+	tests := []struct {
+		name            string
+		firewall        *firewallv2.Firewall
+		trafficShapings []firewallv1.TrafficShaping
+		want            []Shaping
+		wantStatuses    []firewallv1.TrafficShapingStatus
+	}{
+		{
+			name:     "rate limits are shaped",
+			firewall: testFirewall(firewallv2.RateLimit{NetworkID: "internet", Rate: 200}, firewallv2.RateLimit{NetworkID: "underlay", Rate: 10}, firewallv2.RateLimit{NetworkID: "unknown", Rate: 10}),
+			want: []Shaping{
+				{NetworkID: "internet", Link: "vlan2", IFB: "ifb2", Rate: 200 * mbyte},
+			},
+		},
+		{
+			name:     "traffic shaping with classes",
+			firewall: testFirewall(firewallv2.RateLimit{NetworkID: "internet", Rate: 200}),
+			trafficShapings: []firewallv1.TrafficShaping{
+				trafficShaping("internet", firewallv1.TrafficShapingSpec{
+					NetworkID: "internet",
+					Rate:      &hundred,
+					Burst:     &burst,
+					Classes: []firewallv1.TrafficClass{
+						{Name: "web", Rate: 60},
+						{Name: "backup", Rate: 20, Ceil: &fifty, Priority: &prio},
+					},
+				}),
+			},
+			want: []Shaping{
+				{
+					NetworkID: "internet", Link: "vlan2", IFB: "ifb2", Rate: 100 * mbyte, Burst: 64 * kbyte,
+					Classes: []Class{
+						{Name: "web", Mark: TrafficClassMark("web"), Rate: 60 * mbyte, Ceil: 100 * mbyte},
+						{Name: "backup", Mark: TrafficClassMark("backup"), Rate: 20 * mbyte, Ceil: 50 * mbyte, Priority: 7},
+					},
+				},
+			},
+			wantStatuses: []firewallv1.TrafficShapingStatus{{State: firewallv1.PolicyDeploymentStateDeployed}},
+		},
+		{
+			name:     "traffic shaping of networks without rate limit",
+			firewall: testFirewall(),
+			trafficShapings: []firewallv1.TrafficShaping{
+				trafficShaping("a-mpls", firewallv1.TrafficShapingSpec{NetworkID: "mpls", Rate: &fifty}),
+				trafficShaping("b-internet", firewallv1.TrafficShapingSpec{NetworkID: "internet"}),
+			},
+			want: []Shaping{
+				{NetworkID: "mpls", Link: "vlan3", IFB: "ifb3", Rate: 50 * mbyte},
+			},
+			wantStatuses: []firewallv1.TrafficShapingStatus{
+				{State: firewallv1.PolicyDeploymentStateDeployed},
+				{State: firewallv1.PolicyDeploymentStateIgnored, Message: `rate must be given as network "internet" has no rate limit`},
+			},
+		},
+		{
+			name:     "ignored traffic shapings",
+			firewall: testFirewall(firewallv2.RateLimit{NetworkID: "internet", Rate: 200}),
+			trafficShapings: []firewallv1.TrafficShaping{
+				trafficShaping("a", firewallv1.TrafficShapingSpec{NetworkID: "internet", Rate: &hundred}),
+				trafficShaping("b", firewallv1.TrafficShapingSpec{NetworkID: "internet", Rate: &fifty}),
+				trafficShaping("c", firewallv1.TrafficShapingSpec{NetworkID: "underlay", Rate: &fifty}),
+				trafficShaping("d", firewallv1.TrafficShapingSpec{NetworkID: "mpls"}),
+				trafficShaping("e", firewallv1.TrafficShapingSpec{NetworkID: "private", Rate: &hundred, Classes: []firewallv1.TrafficClass{{Name: "web", Rate: 10, Ceil: &tooHigh}}}),
+				trafficShaping("f", firewallv1.TrafficShapingSpec{NetworkID: "private", Rate: &hundred}),
+			},
+			want: []Shaping{
+				{NetworkID: "private", Link: "vlan1", IFB: "ifb1", Rate: 100 * mbyte},
+				{NetworkID: "internet", Link: "vlan2", IFB: "ifb2", Rate: 100 * mbyte},
+			},
+			wantStatuses: []firewallv1.TrafficShapingStatus{
+				{State: firewallv1.PolicyDeploymentStateDeployed},
+				{State: firewallv1.PolicyDeploymentStateIgnored, Message: `network "internet" is already shaped by a`},
+				{State: firewallv1.PolicyDeploymentStateIgnored, Message: `network "underlay" is not a network of the firewall which can be shaped`},
+				{State: firewallv1.PolicyDeploymentStateIgnored, Message: `rate must be given as network "mpls" has no rate limit`},
+				{State: firewallv1.PolicyDeploymentStateIgnored, Message: `ceil of class "web" must not exceed the rate of the network`},
+				{State: firewallv1.PolicyDeploymentStateDeployed},
+			},
+		},
+		{
+			name:     "rate exceeds the rate limit",
+			firewall: testFirewall(firewallv2.RateLimit{NetworkID: "internet", Rate: 200}),
+			trafficShapings: []firewallv1.TrafficShaping{
+				trafficShaping("internet", firewallv1.TrafficShapingSpec{NetworkID: "internet", Rate: &tooHigh}),
+			},
+			want: []Shaping{
+				{NetworkID: "internet", Link: "vlan2", IFB: "ifb2", Rate: 200 * mbyte},
+			},
+			wantStatuses: []firewallv1.TrafficShapingStatus{
+				{State: firewallv1.PolicyDeploymentStateIgnored, Message: `rate 300 exceeds the rate limit 200 of network "internet"`},
+			},
+		},
+		{
+			name:     "classes exceed the rate limit",
+			firewall: testFirewall(firewallv2.RateLimit{NetworkID: "internet", Rate: 50}),
+			trafficShapings: []firewallv1.TrafficShaping{
+				trafficShaping("internet", firewallv1.TrafficShapingSpec{NetworkID: "internet", Classes: []firewallv1.TrafficClass{{Name: "web", Rate: 40}, {Name: "backup", Rate: 20}}}),
+			},
+			want: []Shaping{
+				{NetworkID: "internet", Link: "vlan2", IFB: "ifb2", Rate: 50 * mbyte},
+			},
+			wantStatuses: []firewallv1.TrafficShapingStatus{
+				{State: firewallv1.PolicyDeploymentStateIgnored, Message: `the rates of the classes exceed the rate 50 of network "internet"`},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Shapings(tt.firewall, tt.trafficShapings, nil)
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("Shapings() diff: %v", diff)
+			}
+
+			var statuses []firewallv1.TrafficShapingStatus
+			for _, ts := range tt.trafficShapings {
+				statuses = append(statuses, ts.Status)
+			}
+			if diff := cmp.Diff(tt.wantStatuses, statuses); diff != "" {
+				t.Errorf("status diff: %v", diff)
+			}
+		})
+	}
+}
+
+func TestTrafficClassMark(t *testing.T) {
+	if TrafficClassMark("web") != TrafficClassMark("web") {
+		t.Errorf("TrafficClassMark() is not stable")
+	}
+	if TrafficClassMark("web") == TrafficClassMark("backup") {
+		t.Errorf("TrafficClassMark() is equal for different classes")
+	}
+	if TrafficClassMark("") == 0 {
+		t.Errorf("TrafficClassMark() must not be zero")
+	}
+}
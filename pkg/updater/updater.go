@@ -26,12 +26,16 @@ type Updater struct {
 	log logr.Logger
 
 	recorderCallback func(f *firewallv2.Firewall, eventtype, reason, message string)
+
+	// nftablesExporter is false if the nftables metrics are only served by the firewall-controller, the nftables-exporter is not updated then
+	nftablesExporter bool
 }
 
-func New(log logr.Logger, shootRecorder record.EventRecorder) *Updater {
+func New(log logr.Logger, shootRecorder record.EventRecorder, nftablesExporter bool) *Updater {
 	return &Updater{
 		log:              log,
 		recorderCallback: ShootRecorderNamespaceRewriter(shootRecorder),
+		nftablesExporter: nftablesExporter,
 	}
 }
 
@@ -42,6 +46,10 @@ func (u *Updater) Run(ctx context.Context, f *firewallv2.Firewall) error {
 		return err
 	}
 
+	if !u.nftablesExporter {
+		return nil
+	}
+
 	err = u.updateNFTablesExporter(ctx, f)
 	if err != nil {
 		u.recorderCallback(f, corev1.EventTypeWarning, "Self-Reconciliation", fmt.Sprintf("updating nftables-exporter failed with error: %v", err))